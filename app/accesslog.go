@@ -0,0 +1,239 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	accessLogJSON     = "json"
+	accessLogCombined = "combined"
+)
+
+// accessLog writes one entry per request, apart from the application log,
+// in JSON lines or the Apache combined format. With a sample rate below 1
+// only that fraction of requests is logged, though server errors always
+// are.
+type accessLog struct {
+	format     string
+	sampleRate float64
+
+	mu  sync.Mutex
+	w   io.Writer
+	rng *rand.Rand
+}
+
+// accessLogEntry is an entry in the JSON format.
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteIP   string    `json:"remote_ip"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs float64   `json:"duration_ms"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+func newAccessLog(w io.Writer, format string, sampleRate float64) *accessLog {
+	return &accessLog{
+		format:     format,
+		sampleRate: sampleRate,
+		w:          w,
+		rng:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// sampled decides whether to log a request that got status.
+func (l *accessLog) sampled(status int) bool {
+	if l.sampleRate >= 1 || status >= 500 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rng.Float64() < l.sampleRate
+}
+
+// Middleware logs requests to h, attributed to the real client address.
+func (l *accessLog) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: 200}
+		h.ServeHTTP(rec, r)
+		if !l.sampled(rec.status) {
+			return
+		}
+		remoteIP := "-" // e.g. a peer on a unix socket
+		if ip := clientIPFromContext(r.Context()); ip != nil {
+			remoteIP = ip.String()
+		}
+		l.write(accessLogEntry{
+			Time:       start,
+			RemoteIP:   remoteIP,
+			Method:     r.Method,
+			URI:        redactedURI(r),
+			Proto:      r.Proto,
+			Status:     rec.status,
+			Bytes:      rec.bytes,
+			DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+			RequestID:  requestIDFromContext(r.Context()),
+		})
+	})
+}
+
+func (l *accessLog) write(e accessLogEntry) {
+	var line []byte
+	if l.format == accessLogCombined {
+		line = []byte(combinedLogLine(e))
+	} else {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		line = append(b, '\n')
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// a failed write has nowhere better to be reported
+	l.w.Write(line)
+}
+
+// Close closes the log's file, if it has one.
+func (l *accessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f, ok := l.w.(*rotatingFile); ok {
+		return f.Close()
+	}
+	return nil
+}
+
+// combinedLogLine formats e in the Apache combined log format. We don't
+// know the client's user name, so that's always "-".
+func combinedLogLine(e accessLogEntry) string {
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+	return fmt.Sprintf("%s - - [%s] %s %d %s %s %s\n",
+		e.RemoteIP, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		quoteLogField(e.Method+" "+e.URI+" "+e.Proto), e.Status, bytes,
+		quoteLogField(e.Referer), quoteLogField(e.UserAgent))
+}
+
+// quoteLogField quotes a field of a combined log line, escaping quotes and
+// control characters the way Apache does, so that a client can't forge
+// lines.
+func quoteLogField(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// redactedURI returns the request URI with any API key in the query
+// replaced, so that keys don't end up in logs.
+func redactedURI(r *http.Request) string {
+	if r.URL.RawQuery == "" || !strings.Contains(r.URL.RawQuery, "api_key=") {
+		return r.URL.RequestURI()
+	}
+	u := *r.URL
+	q := u.Query()
+	q.Set("api_key", "REDACTED")
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
+
+// rotatingFile is a log file that's rotated once it grows past maxSize:
+// path is renamed to path.1, path.1 to path.2 and so on, keeping at most
+// maxBackups of them. A maxSize of 0 never rotates.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, info.Size()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would take it past
+// maxSize. If rotation fails the file just keeps growing. Callers
+// serialize writes.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file aside and opens a new one. It only fails if no
+// file could be opened at all.
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+	if rf.maxBackups > 0 {
+		for i := rf.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		}
+		os.Rename(rf.path, rf.path+".1")
+	} else {
+		os.Remove(rf.path)
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) Close() error {
+	return rf.f.Close()
+}
@@ -0,0 +1,131 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// accountExportVersion is the version of the account export format. The
+// API description only accepts imports of this version.
+const accountExportVersion = 1
+
+// AccountExport is everything a client has set up under its API key, in a
+// form that can be imported under another key or in another deployment.
+// Saved locations, with their digest schedules, are all there is: alert
+// subscriptions belong to Telegram chats, not API keys.
+type AccountExport struct {
+	Version    int                `json:"version"`
+	ExportedAt time.Time          `json:"exported_at"`
+	Locations  []exportedLocation `json:"locations"`
+}
+
+// exportedLocation is a saved location without what's specific to where it
+// was saved: its ID, owner and creation time.
+type exportedLocation struct {
+	Name   string  `json:"name"`
+	Lat    float64 `json:"lat"`
+	Lon    float64 `json:"lon"`
+	Digest string  `json:"digest,omitempty"`
+}
+
+// AccountImport is the result of an import.
+type AccountImport struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"` // already saved
+}
+
+// Import saves locations for a client, skipping any it already has with the
+// same name and coordinates, so that importing twice is harmless. Either
+// all the new locations are saved or, if they'd take the client over its
+// limit, none are.
+func (ls *locationStore) Import(clientID string, locs []savedLocation) (imported, skipped int, err error) {
+	now := time.Now().UTC()
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	n := 0
+	have := make(map[string]bool)
+	for _, rec := range ls.records {
+		if rec.ClientID == clientID && rec.DeletedAt == nil {
+			n++
+			have[rec.Name+" "+rec.location().Key()] = true
+		}
+	}
+	var added []string
+	for i := range locs {
+		loc := locs[i]
+		key := loc.Name + " " + loc.location().Key()
+		if have[key] {
+			skipped++
+			continue
+		}
+		have[key] = true
+		loc.ID = randomHex(8)
+		loc.ClientID = clientID
+		// keep the order they were saved in
+		loc.CreatedAt = now.Add(time.Duration(len(added)) * time.Microsecond)
+		ls.records[loc.ID] = &loc
+		added = append(added, loc.ID)
+	}
+	undo := func() {
+		for _, id := range added {
+			delete(ls.records, id)
+		}
+	}
+	if n+len(added) > maxSavedLocations {
+		undo()
+		return 0, 0, errTooManyLocations
+	}
+	if err := ls.save(); err != nil {
+		undo()
+		return 0, 0, err
+	}
+	return len(added), skipped, nil
+}
+
+// accountHandler moves a client's setup between keys or deployments:
+//
+//	GET  /account/export  download everything as one JSON document
+//	POST /account/import  add the contents of an export
+func (s *server) accountHandler(w http.ResponseWriter, r *http.Request) {
+	clientID := clientFromContext(r.Context()).ID
+	switch {
+	case r.URL.Path == "/account/export" && r.Method == "GET":
+		export := AccountExport{Version: accountExportVersion, ExportedAt: time.Now().UTC(), Locations: []exportedLocation{}}
+		for _, saved := range s.locations.List(clientID) {
+			export.Locations = append(export.Locations, exportedLocation{
+				Name:   saved.Name,
+				Lat:    saved.Lat,
+				Lon:    saved.Lon,
+				Digest: saved.Digest,
+			})
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="weather-account.json"`)
+		writeJSON(w, &export)
+
+	case r.URL.Path == "/account/import" && r.Method == "POST":
+		var doc AccountExport
+		if !decodeBody(w, r, "POST /account/import", 1<<20, &doc) {
+			return
+		}
+		locs := make([]savedLocation, len(doc.Locations))
+		for i, loc := range doc.Locations {
+			locs[i] = savedLocation{Name: strings.TrimSpace(loc.Name), Lat: loc.Lat, Lon: loc.Lon, Digest: loc.Digest}
+		}
+		imported, skipped, err := s.locations.Import(clientID, locs)
+		if err == errTooManyLocations {
+			w.WriteHeader(409)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			s.storageError(w, err)
+			return
+		}
+		writeJSON(w, &AccountImport{Imported: imported, Skipped: skipped})
+
+	default:
+		w.WriteHeader(404)
+	}
+}
@@ -0,0 +1,275 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// frostHorizon is how far ahead frost risk looks.
+const frostHorizon = 48 * time.Hour
+
+// defaultFrostProfiles are the crop sensitivity profiles available unless
+// FROST_PROFILES overrides them: the temperature at which each class of crop
+// starts to be damaged.
+var defaultFrostProfiles = map[string]models.Temperature{
+	"tender":     models.DegreesF(32), // tomatoes, peppers, beans, squash
+	"blossom":    models.DegreesF(28), // fruit trees in bloom
+	"semi-hardy": models.DegreesF(28), // potatoes, lettuce, carrots
+	"hardy":      models.DegreesF(24), // cabbage, broccoli, kale
+}
+
+// frostRisks are the risk levels, least to most severe.
+var frostRisks = []string{"none", "low", "moderate", "high", "severe"}
+
+// parseFrostProfiles parses a FROST_PROFILES style spec
+// ("tender=32,hardy=-4C"), which replaces the default profiles. Temperatures
+// are in °F unless they say otherwise.
+func parseFrostProfiles(spec string) (map[string]models.Temperature, error) {
+	entries := splitList(spec)
+	if len(entries) == 0 {
+		return defaultFrostProfiles, nil
+	}
+	profiles := make(map[string]models.Temperature)
+	for _, entry := range entries {
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid frost profile %q: want name=temperature", entry)
+		}
+		t, err := models.ParseTemperature(entry[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid frost profile %q: %s", entry, err)
+		}
+		profiles[entry[:i]] = t
+	}
+	return profiles, nil
+}
+
+// FrostRisk is the response of the frost risk endpoint.
+type FrostRisk struct {
+	Crop               string             `json:"crop"`
+	CriticalTemp       models.Temperature `json:"critical_temp"`
+	Risk               string             `json:"risk"` // the worst hour's
+	HoursBelowCritical int                `json:"hours_below_critical"`
+	Coldest            *FrostHour         `json:"coldest,omitempty"`
+	Hours              []FrostHour        `json:"hours"`
+}
+
+// FrostHour is the frost risk for one forecast hour.
+type FrostHour struct {
+	Time        time.Time          `json:"time"`
+	Temperature models.Temperature `json:"temperature"`
+	DewPoint    models.Temperature `json:"dew_point"`
+	WindSpeed   float64            `json:"wind_speed"`
+	// SurfaceTemp estimates the temperature of plant surfaces, which on
+	// calm nights radiate heat away and fall below the air temperature.
+	SurfaceTemp models.Temperature `json:"surface_temp"`
+	Frost       bool               `json:"frost"` // cold and dry enough for ice to form
+	Risk        string             `json:"risk"`
+}
+
+// newFrostHour assesses one forecast hour against a critical temperature.
+func newFrostHour(hour models.ForecastHour, critical models.Temperature) FrostHour {
+	// the adjustments and margins are in °F
+	surface, dewPoint, crit := hour.Temperature.F(), hour.DewPoint.F(), critical.F()
+	switch {
+	case hour.WindSpeed < 5:
+		surface -= 4
+	case hour.WindSpeed < 10:
+		surface -= 2
+	}
+	// moist air slows radiative cooling; dew forming releases heat
+	if dewPoint > surface {
+		surface = (surface + dewPoint) / 2
+	}
+
+	risk := 0
+	switch {
+	case surface <= crit-4:
+		risk = 4
+	case surface <= crit:
+		risk = 3
+	case surface <= crit+3:
+		risk = 2
+	case surface <= crit+6:
+		risk = 1
+	}
+	return FrostHour{
+		Time:        hour.Time,
+		Temperature: hour.Temperature,
+		DewPoint:    hour.DewPoint,
+		WindSpeed:   hour.WindSpeed,
+		SurfaceTemp: models.DegreesF(surface),
+		Frost:       surface <= models.Freezing.F() && dewPoint <= models.Freezing.F(),
+		Risk:        frostRisks[risk],
+	}
+}
+
+// frostRiskHandler classifies the risk of frost damage over the next 48
+// hours for a crop sensitivity profile, given as ?crop= (tender by default).
+func (s *server) frostRiskHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	crop := q.Get("crop")
+	if crop == "" {
+		crop = "tender"
+	}
+	critical, ok := s.frostProfiles[crop]
+	if !ok {
+		available := make([]string, 0, len(s.frostProfiles))
+		for name := range s.frostProfiles {
+			available = append(available, name)
+		}
+		sort.Strings(available)
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Unknown crop profile %q (available: %s)", crop, strings.Join(available, ", "))
+		return
+	}
+
+	lat, lon, _ := s.requestLocation(r, q)
+	data, err := s.forecast(lat, lon, []string{"hourly"})
+	if err != nil {
+		s.upstreamFailed(err)
+		s.upstreamError(w, r, err)
+		return
+	}
+
+	result := FrostRisk{
+		Crop:         crop,
+		CriticalTemp: critical,
+		Hours:        []FrostHour{},
+	}
+	end := time.Now().Add(frostHorizon)
+	worst, coldest := 0, -1
+	for _, hour := range newOWMForecast(data).Hourly {
+		if hour.Time.After(end) {
+			break
+		}
+		fh := newFrostHour(hour, critical)
+		if !critical.Less(fh.SurfaceTemp) {
+			result.HoursBelowCritical++
+		}
+		if coldest < 0 || fh.SurfaceTemp.Less(result.Hours[coldest].SurfaceTemp) {
+			coldest = len(result.Hours)
+		}
+		for i, risk := range frostRisks {
+			if risk == fh.Risk && i > worst {
+				worst = i
+			}
+		}
+		result.Hours = append(result.Hours, fh)
+	}
+	if coldest >= 0 {
+		result.Coldest = &result.Hours[coldest]
+	}
+	result.Risk = frostRisks[worst]
+	writeJSON(w, &result)
+}
+
+// GrowingSeason is the response of the growing season endpoint.
+type GrowingSeason struct {
+	Base              models.Temperature `json:"base"`
+	Cap               models.Temperature `json:"cap"`
+	From              string             `json:"from"`
+	To                string             `json:"to"`
+	GrowingDegreeDays float64            `json:"gdd"`
+	Precip            float64            `json:"precip"` // inches
+	Days              []GrowingDay       `json:"days"`
+	// MissingDays counts days in the range we have no observations for,
+	// which leave the totals short.
+	MissingDays int `json:"missing_days"`
+}
+
+// GrowingDay is one day of a growing season, with running totals.
+type GrowingDay struct {
+	Date              string             `json:"date"`
+	MinTemp           models.Temperature `json:"min_temp"`
+	MaxTemp           models.Temperature `json:"max_temp"`
+	GrowingDegreeDays float64            `json:"gdd"`
+	AccumulatedGDD    float64            `json:"accumulated_gdd"`
+	Precip            float64            `json:"precip"`
+	AccumulatedPrecip float64            `json:"accumulated_precip"`
+	Samples           int                `json:"samples"`
+}
+
+// growingDegreeDays computes a day's growing degree days, in °F days, by the
+// modified method: temperatures are clamped to [base, ceiling] before
+// averaging, since crop development stalls below the base and stops speeding
+// up above the ceiling.
+func growingDegreeDays(min, max, base, ceiling models.Temperature) float64 {
+	clamp := func(t models.Temperature) float64 { return math.Min(math.Max(t.F(), base.F()), ceiling.F()) }
+	return (clamp(min)+clamp(max))/2 - base.F()
+}
+
+// growingSeasonHandler accumulates growing degree days and precipitation at
+// a location over a season, from the observations in the history store.
+// ?base= and ?cap= default to 50°F and 86°F, the usual thresholds for corn,
+// and may be given in other units, e.g. 10C; the season defaults to the year
+// to yesterday.
+func (s *server) growingSeasonHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lat, lon, _ := s.requestLocation(r, q)
+	loc, err := models.ParseLocation(lat, lon)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	base, ceiling := models.DegreesF(50), models.DegreesF(86)
+	for _, param := range []struct {
+		name string
+		t    *models.Temperature
+	}{{"base", &base}, {"cap", &ceiling}} {
+		if raw := q.Get(param.name); raw != "" {
+			if *param.t, err = models.ParseTemperature(raw); err != nil {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "Invalid %s: %q", param.name, raw)
+				return
+			}
+		}
+	}
+	if !base.Less(ceiling) {
+		w.WriteHeader(400)
+		w.Write([]byte("cap must be above base"))
+		return
+	}
+
+	yesterday := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	newYear := time.Date(yesterday.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	from, to, span, err := parseDateRange(q, newYear, yesterday)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	season := GrowingSeason{
+		Base: base,
+		Cap:  ceiling,
+		From: from.Format("2006-01-02"),
+		To:   to.Format("2006-01-02"),
+		Days: []GrowingDay{},
+	}
+	for _, day := range s.history.DailySummaries(loc, season.From, season.To) {
+		gdd := growingDegreeDays(day.MinTemp, day.MaxTemp, base, ceiling)
+		season.GrowingDegreeDays += gdd
+		season.Precip += day.Precip
+		season.Days = append(season.Days, GrowingDay{
+			Date:              day.Date,
+			MinTemp:           day.MinTemp,
+			MaxTemp:           day.MaxTemp,
+			GrowingDegreeDays: gdd,
+			AccumulatedGDD:    season.GrowingDegreeDays,
+			Precip:            day.Precip,
+			AccumulatedPrecip: season.Precip,
+			Samples:           day.Samples,
+		})
+	}
+	season.MissingDays = span - len(season.Days)
+	writeJSON(w, &season)
+}
@@ -0,0 +1,110 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+var alertsOutsideArea = newCounter("alerts_outside_area_total",
+	"Provider alerts dropped because their area doesn't contain the requested point.")
+
+// AlertList is the response of the alerts endpoint.
+type AlertList struct {
+	Alerts   []models.Alert    `json:"alerts"`
+	Location *ResolvedLocation `json:"location,omitempty"`
+}
+
+// locationAlerts returns the alerts in effect at a location. When NWS is
+// configured its alerts, which include geometry, are preferred; the
+// openweathermap alerts it duplicates (those for the same events) are
+// dropped. NWS alerts whose area doesn't contain the location are left
+// out, and the rest are recorded in the alert history. If NWS fails we
+// fall back to openweathermap's alerts alone.
+func (s *server) locationAlerts(ctx context.Context, lat, lon string) ([]models.Alert, error) {
+	data, err := s.fetchWeather(ctx, lat, lon)
+	if err != nil {
+		return nil, err
+	}
+
+	alerts := []models.Alert{}
+	events := map[string]bool{}
+	if s.nws != nil {
+		nwsAlerts, err := s.nwsAlerts(lat, lon)
+		if err != nil {
+			upstreamErrors.Inc(errorClass(err))
+			s.logger.Printf("Failed to fetch NWS alerts: %s", err)
+		}
+		loc, locErr := models.ParseLocation(lat, lon)
+		for _, a := range nwsAlerts {
+			alert := newNWSAlert(a)
+			// this also hides openweathermap's copy if we filter it out
+			events[alert.Event] = true
+			// NWS matches alerts to the point by forecast zone or county,
+			// which can be far bigger than the alert's own area
+			if alert.Geometry != nil && locErr == nil {
+				inside, err := geometryContains(alert.Geometry, loc.Lon, loc.Lat)
+				if err != nil {
+					s.logger.Printf("Bad geometry on NWS alert %q: %s", alert.Event, err)
+				} else if !inside {
+					alertsOutsideArea.Inc()
+					continue
+				}
+			}
+			alerts = append(alerts, alert)
+		}
+		if locErr == nil {
+			s.history.RecordAlerts(loc, alerts)
+		}
+	}
+	// alerts pushed to us over CAP may be too new for the providers to
+	// know about yet
+	if loc, err := models.ParseLocation(lat, lon); err == nil {
+		keys := map[string]bool{}
+		for _, alert := range alerts {
+			keys[alertKey(alert)] = true
+		}
+		for _, alert := range s.cap.At(loc, time.Now()) {
+			if !keys[alertKey(alert)] {
+				events[alert.Event] = true
+				alerts = append(alerts, alert)
+			}
+		}
+	}
+	for _, alert := range data.Alerts {
+		if !events[alert.Event] {
+			alerts = append(alerts, alert)
+		}
+	}
+	return alerts, nil
+}
+
+// alertsHandler lists the alerts in effect at a location, in full.
+func (s *server) alertsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lat, lon, resolved := s.requestLocation(r, q)
+
+	alerts, err := s.locationAlerts(r.Context(), lat, lon)
+	if err != nil {
+		s.upstreamError(w, r, err)
+		return
+	}
+
+	if wantsGeoJSON(w, r, q) {
+		features := make([]GeoJSONFeature, len(alerts))
+		for i, alert := range alerts {
+			// zone-based alerts have no geometry; GeoJSON allows null
+			features[i] = GeoJSONFeature{Type: "Feature"}
+			if alert.Geometry != nil {
+				features[i].Geometry = alert.Geometry
+			}
+			alert.Geometry = nil
+			features[i].Properties = alert
+		}
+		writeGeoJSON(w, featureCollection(features))
+		return
+	}
+	writeJSON(w, &AlertList{Alerts: alerts, Location: resolved})
+}
@@ -0,0 +1,1011 @@
+// Package app is the weather service: its providers, stores, HTTP API and
+// background jobs, wired together from a Config.
+package app
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// App is the whole service, built but not yet running.
+type App struct {
+	config  Config
+	logger  *log.Logger
+	server  *server
+	handler http.Handler
+	workers []func(ctx context.Context) // run until ctx is done, or they're finished
+
+	accessLog *accessLog // optional
+	redactor  *redactor  // nil if no secrets are configured
+
+	addr            string
+	socketMode      os.FileMode
+	tlsConfig       *tls.Config // optional
+	shutdownTimeout time.Duration
+}
+
+// New builds the service from config, checking the configuration and
+// opening the stores, but starts nothing: see Run.
+func New(config Config) (a *App, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			cerr, ok := r.(configError)
+			if !ok {
+				panic(r)
+			}
+			a, err = nil, cerr
+		}
+	}()
+
+	a = &App{
+		config:          config,
+		logger:          config.Logger,
+		addr:            config.get("ADDR"),
+		socketMode:      config.fileMode("SOCKET_MODE", 0),
+		shutdownTimeout: config.duration("SHUTDOWN_TIMEOUT", 30*time.Second),
+	}
+	if a.addr == "" {
+		a.addr = ":8080"
+	}
+	if a.logger == nil {
+		a.logger = log.Default()
+	}
+	secrets := splitList(config.get("REDACT_SECRETS"))
+	for _, name := range secretVars {
+		secrets = append(secrets, config.get(name))
+	}
+	if keys, _, err := parseAPIKeys(config.get("API_KEYS")); err == nil {
+		secrets = append(secrets, keys...)
+	}
+	if a.redactor = newRedactor(secrets); a.redactor != nil {
+		a.logger = log.New(a.redactor.Writer(a.logger.Writer()), a.logger.Prefix(), a.logger.Flags())
+	}
+	if a.server, err = a.newServer(); err != nil {
+		return nil, err
+	}
+	if err := a.addWorkers(); err != nil {
+		return nil, err
+	}
+	if err := a.openAccessLog(); err != nil {
+		return nil, err
+	}
+	a.handler = a.newRouter()
+	if err := a.configureTLS(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Handler returns the service's HTTP handler, with all of its middleware.
+func (a *App) Handler() http.Handler {
+	return a.handler
+}
+
+// newClient builds the HTTP client used to call providers, going through
+// proxies as routed. In offline mode nothing leaves the process: upstream
+// requests are answered from fixtures and cached data never expires.
+func (a *App) newClient(offline bool, proxies *proxyRoutes) *http.Client {
+	c := a.config
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxies.Proxy
+	client := &http.Client{Transport: transport}
+	if offline {
+		client.Transport = &offlineTransport{dir: c.get("FIXTURES_DIR")}
+		a.logger.Println("Running in offline mode; no outbound requests will be made")
+	}
+	faults := newFaultTransport(client.Transport)
+	faults.latency = c.duration("FAULT_LATENCY", 2*time.Second)
+	faults.latencyRate = c.float("FAULT_LATENCY_RATE", 0)
+	faults.errorRate = c.float("FAULT_ERROR_RATE", 0)
+	faults.malformedRate = c.float("FAULT_MALFORMED_RATE", 0)
+	if faults.Enabled() {
+		client.Transport = faults
+		a.logger.Println("Fault injection is enabled for upstream requests")
+	}
+	return client
+}
+
+// newServer builds the providers, stores and settings the handlers use.
+func (a *App) newServer() (*server, error) {
+	c := a.config
+	offline := c.boolean("OFFLINE", false)
+	proxies := newProxyRoutes()
+	client := a.newClient(offline, proxies)
+
+	appid := c.get("API_KEY")
+	if appid == "" && c.get("API_KEYS") == "" && !offline {
+		return nil, fmt.Errorf("missing (or empty) API_KEY or API_KEYS environment variable")
+	}
+	newGate := func() *rateGate {
+		return newRateGate(
+			c.duration("UPSTREAM_RATELIMIT_MAX_WAIT", 5*time.Second),
+			float64(c.integer("UPSTREAM_RATELIMIT_LOW_WATER_PERCENT", 10))/100,
+		)
+	}
+
+	service := &OWMService{
+		client:  client,
+		baseURL: c.get("OWM_URL"),
+		appid:   appid,
+		logger:  a.logger,
+		gate:    newGate(),
+		pool: newLimiter(
+			c.integer("UPSTREAM_MAX_CONCURRENCY", 16),
+			c.integer("UPSTREAM_QUEUE_DEPTH", 64),
+		),
+	}
+	if service.baseURL == "" {
+		service.baseURL = "https://api.openweathermap.org"
+	}
+	if spec := c.get("API_KEYS"); spec != "" {
+		keys, weights, err := parseAPIKeys(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid API_KEYS: %s", err)
+		}
+		service.keys = newKeyPool(keys, weights, c.duration("API_KEY_AUTH_BACKOFF", time.Hour), newGate)
+		service.gate = nil
+		a.logger.Printf("Spreading provider requests over %d API keys", len(keys))
+	}
+	oneCall, err := newOneCallVersion(strings.ToLower(c.get("ONECALL_VERSION")), c.duration("ONECALL_RECHECK", time.Hour))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ONECALL_VERSION: %s", err)
+	}
+	service.oneCall = oneCall
+	if ttl := c.duration("NEGATIVE_CACHE_TTL", time.Minute); ttl > 0 {
+		service.negative = newNegativeCache(ttl, c.integer("NEGATIVE_CACHE_MAX_ENTRIES", 10000))
+	}
+	if delay := c.duration("UPSTREAM_HEDGE_DELAY", 0); delay > 0 {
+		hedge, err := newHedger(delay, c.get("UPSTREAM_HEDGE_URL"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid UPSTREAM_HEDGE_URL: %s", err)
+		}
+		service.hedge = hedge
+	}
+	switch mode := strings.ToLower(c.get("STRICT_MODE")); mode {
+	case "", "off":
+	case strictFlag, strictReject:
+		service.strict = mode
+	default:
+		return nil, fmt.Errorf("invalid STRICT_MODE: %q (want off, flag or reject)", mode)
+	}
+
+	if c.boolean("STARTUP_CHECK", true) && !offline {
+		if err := checkProvider(service); err != nil {
+			return nil, fmt.Errorf("startup check failed: %s (set STARTUP_CHECK=0 to skip)", err)
+		}
+	}
+
+	history := newHistoryStore()
+	if path := c.get("HISTORY_PATH"); path != "" {
+		var err error
+		history, err = openHistoryStore(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open history store: %s", err)
+		}
+	}
+	history.logger = a.logger
+
+	tiers := map[string]*tier{
+		"free":    {Name: "free", MaxAge: c.duration("TIER_FREE_MAX_AGE", 10*time.Minute)},
+		"premium": {Name: "premium", MaxAge: c.duration("TIER_PREMIUM_MAX_AGE", time.Minute)},
+	}
+	anonymousTier := c.get("ANONYMOUS_TIER")
+	if anonymousTier == "" {
+		anonymousTier = "free"
+	}
+	var keys *keyStore
+	if path := c.get("KEYS_PATH"); path != "" {
+		var err error
+		keys, err = openKeyStore(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open key store: %s", err)
+		}
+	}
+	clients, err := newClientRegistry(c.get("CLIENT_KEYS"), tiers, anonymousTier, c.integer("ANONYMOUS_DAILY_QUOTA", 0), keys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CLIENT_KEYS: %s", err)
+	}
+
+	var geoIP *geoIPDB
+	if paths := splitList(c.get("GEOIP_DB")); len(paths) > 0 {
+		geoIP, err = loadGeoIPDB(paths...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load GeoIP database: %s", err)
+		}
+		a.logger.Printf("Loaded %d GeoIP blocks", len(geoIP.blocks))
+	}
+
+	// NWS alerts only cover the US, but come with the affected area
+	var nws *NWSService
+	if c.boolean("NWS_ALERTS", false) {
+		nws = &NWSService{
+			client:     client,
+			baseURL:    "https://api.weather.gov",
+			userAgent:  c.get("NWS_USER_AGENT"),
+			validators: newValidatorCache(nwsProvider),
+		}
+		if nws.userAgent == "" {
+			nws.userAgent = "banno-project weather service"
+		}
+	}
+
+	// Open-Meteo fills in the snow data openweathermap lacks
+	var openMeteo *OpenMeteoService
+	if c.boolean("OPEN_METEO", false) {
+		openMeteo = &OpenMeteoService{
+			client:  client,
+			baseURL: c.get("OPEN_METEO_URL"),
+		}
+		if openMeteo.baseURL == "" {
+			openMeteo.baseURL = "https://api.open-meteo.com"
+		}
+	}
+
+	var lightning *LightningService
+	if id := c.get("LIGHTNING_CLIENT_ID"); id != "" {
+		lightning = &LightningService{
+			client:       client,
+			baseURL:      c.get("LIGHTNING_URL"),
+			clientID:     id,
+			clientSecret: c.get("LIGHTNING_CLIENT_SECRET"),
+		}
+		if lightning.baseURL == "" {
+			lightning.baseURL = "https://data.api.xweather.com"
+		}
+	}
+
+	nhc := &NHCService{client: client, baseURL: c.get("NHC_URL"), logger: a.logger, validators: newValidatorCache(nhcProvider)}
+	if nhc.baseURL == "" {
+		nhc.baseURL = "https://www.nhc.noaa.gov"
+	}
+
+	usgs := &USGSService{client: client, baseURL: c.get("USGS_URL")}
+	if usgs.baseURL == "" {
+		usgs.baseURL = "https://earthquake.usgs.gov"
+	}
+
+	// mirrors and the environment's proxy won't always suit every provider
+	routes := map[string]string{
+		"OWM_PROXY":  service.baseURL,
+		"NHC_PROXY":  nhc.baseURL,
+		"USGS_PROXY": usgs.baseURL,
+	}
+	if nws != nil {
+		routes["NWS_PROXY"] = nws.baseURL
+	}
+	if openMeteo != nil {
+		routes["OPEN_METEO_PROXY"] = openMeteo.baseURL
+	}
+	if lightning != nil {
+		routes["LIGHTNING_PROXY"] = lightning.baseURL
+	}
+	for setting, baseURL := range routes {
+		if err := proxies.Route(baseURL, c.get(setting)); err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", setting, err)
+		}
+	}
+
+	deletedRetention := c.duration("DELETED_RETENTION", 30*24*time.Hour)
+	locations, err := openLocationStore(c.get("LOCATIONS_PATH"), deletedRetention)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open location store: %s", err)
+	}
+	// notifications don't go through the upstream client, which may be
+	// serving fixtures or injecting faults
+	notifyClient := &http.Client{Timeout: c.duration("NOTIFY_TIMEOUT", 10*time.Second)}
+	webhooks := splitList(c.get("NOTIFY_WEBHOOKS"))
+	secrets, err := parseWebhookSecrets(c.get("NOTIFY_WEBHOOK_SECRETS"), webhooks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NOTIFY_WEBHOOK_SECRETS: %s", err)
+	}
+	var notifiers []notifier
+	for _, url := range webhooks {
+		notifiers = append(notifiers, &webhookNotifier{client: notifyClient, url: url, secret: secrets[url]})
+	}
+
+	subscriptions, err := openSubscriptionStore(c.get("SUBSCRIPTIONS_PATH"), deletedRetention)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open subscription store: %s", err)
+	}
+	deliveries, err := openDeliveryQueue(
+		c.get("DELIVERIES_PATH"),
+		c.integer("DELIVERY_MAX_ATTEMPTS", 5),
+		c.duration("DELIVERY_RETRY_BACKOFF", time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open delivery queue: %s", err)
+	}
+	audit, err := openAuditLog(c.get("AUDIT_LOG_PATH"), c.duration("AUDIT_RETENTION", 90*24*time.Hour))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %s", err)
+	}
+	audit.logger = a.logger
+	var telegram *telegramBot
+	if token := c.get("TELEGRAM_BOT_TOKEN"); token != "" {
+		telegram = &telegramBot{
+			// long polls outlast notifyClient's timeout; calls set their own
+			client: &http.Client{},
+			apiURL: c.get("TELEGRAM_API_URL"),
+			token:  token,
+			shared: make(map[int64]models.Location),
+		}
+		if telegram.apiURL == "" {
+			telegram.apiURL = "https://api.telegram.org"
+		}
+	}
+
+	frostProfiles, err := parseFrostProfiles(c.get("FROST_PROFILES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid FROST_PROFILES: %s", err)
+	}
+	outdoorWeights, err := parseOutdoorWeights(c.get("OUTDOOR_WEIGHTS"), defaultOutdoorWeights)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OUTDOOR_WEIGHTS: %s", err)
+	}
+	// the defaults are the usual red flag warning criteria
+	fire := fireThresholds{
+		Humidity: c.float("FIRE_MAX_HUMIDITY", 15),
+		Wind:     c.float("FIRE_MIN_WIND", 20),
+		Gust:     c.float("FIRE_MIN_GUST", 35),
+		Temp:     c.temperature("FIRE_MIN_TEMP", models.DegreesF(75)),
+	}
+
+	s := &server{
+		owm:           service,
+		nws:           nws,
+		openMeteo:     openMeteo,
+		lightning:     lightning,
+		nhc:           nhc,
+		usgs:          usgs,
+		history:       history,
+		locations:     locations,
+		notifiers:     notifiers,
+		deliveries:    deliveries,
+		audit:         audit,
+		cap:           newCAPStore(),
+		capClient:     client,
+		capValidators: newValidatorCache("cap"),
+		cache:         newWeatherCache(),
+		deltas:        newDeltaSnapshots(),
+		clients:       clients,
+		ready:         newReadiness(),
+		authRejected:  make(chan struct{}, 1),
+		geoIP:         geoIP,
+		logger:        a.logger,
+		redactor:      a.redactor,
+		offline:       offline,
+		adminToken:    c.get("ADMIN_TOKEN"),
+
+		keyRotationGrace: c.duration("KEY_ROTATION_GRACE", 24*time.Hour),
+		tokenKey:         []byte(c.get("TOKEN_SIGNING_KEY")),
+		tokenTTL:         c.duration("TOKEN_TTL", 15*time.Minute),
+		slackSecret:      []byte(c.get("SLACK_SIGNING_SECRET")),
+		capIngestToken:   c.get("CAP_INGEST_TOKEN"),
+		frostProfiles:    frostProfiles,
+		fireThresholds:   fire,
+		outdoorWeights:   outdoorWeights,
+		subscriptions:    subscriptions,
+		telegram:         telegram,
+
+		lightningAlertRadius: c.float("LIGHTNING_ALERT_RADIUS", 15),
+		alertCheckInterval:   c.duration("ALERT_CHECK_INTERVAL", 5*time.Minute),
+		pollTimeout:          c.duration("POLL_TIMEOUT", 30*time.Second),
+		maxAgeFloor:          c.duration("MAX_AGE_FLOOR", 10*time.Second),
+	}
+	s.cache.maxEntries = c.integer("CACHE_MAX_ENTRIES", 100000)
+	s.cache.maxBytes = int64(c.integer("CACHE_MAX_SIZE_MB", 256)) << 20
+	ttls, err := parseCacheTTLs(c.get("CACHE_TTLS"))
+	if err != nil {
+		invalid("CACHE_TTLS", err)
+	}
+	s.responses = newResponseCache(ttls, s.cache.maxEntries)
+	if s.compat, err = parseCompat(c.get("RESPONSE_COMPAT")); err != nil {
+		return nil, fmt.Errorf("invalid RESPONSE_COMPAT: %s", err)
+	}
+	if s.shape.Naming, err = parseNaming(c.get("RESPONSE_NAMING")); err != nil {
+		return nil, fmt.Errorf("invalid RESPONSE_NAMING: %s", err)
+	}
+	s.shape.Envelope = c.boolean("RESPONSE_ENVELOPE", false)
+	if s.providers, err = s.parseProviderSelection(c.get("PROVIDER_SELECTION")); err != nil {
+		return nil, fmt.Errorf("invalid PROVIDER_SELECTION: %s", err)
+	}
+	if percent := c.integer("CACHE_PREFETCH_PERCENT", 10); percent > 0 {
+		if percent >= 100 {
+			return nil, fmt.Errorf("invalid CACHE_PREFETCH_PERCENT: %d (want 0 to 99)", percent)
+		}
+		s.prefetch = newPrefetcher(float64(percent) / 100)
+	}
+	if topK := c.integer("POPULAR_TOP_K", 0); topK > 0 {
+		s.popular = newPopularity(topK, c.integer("POPULAR_MIN_REQUESTS", 10), c.duration("POPULAR_WINDOW", time.Hour))
+	}
+	switch policy := strings.ToLower(c.get("CACHE_EVICTION")); policy {
+	case "", "lru":
+	case "lfu":
+		s.cache.policy = newLFUPolicy()
+	default:
+		return nil, fmt.Errorf("invalid CACHE_EVICTION: %q (want lru or lfu)", policy)
+	}
+	if dsn := c.get("SENTRY_DSN"); dsn != "" {
+		sentry, err := newSentryReporter(dsn)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SENTRY_DSN: %s", err)
+		}
+		sentry.environment = c.get("SENTRY_ENVIRONMENT")
+		sentry.failureThreshold = c.integer("SENTRY_UPSTREAM_FAILURE_THRESHOLD", 5)
+		sentry.failureWindow = c.duration("SENTRY_UPSTREAM_FAILURE_WINDOW", 5*time.Minute)
+		sentry.logger, sentry.redactor = a.logger, a.redactor
+		s.sentry = sentry
+	}
+	if raw := c.get("DISCORD_PUBLIC_KEY"); raw != "" {
+		key, err := hex.DecodeString(raw)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid DISCORD_PUBLIC_KEY: want a hex-encoded Ed25519 public key")
+		}
+		s.discordKey = key
+	}
+
+	// with several replicas, only the elected leader runs background jobs
+	var elector elector
+	leaseDuration := c.duration("LEADER_LEASE_DURATION", 15*time.Second)
+	switch mode := c.get("LEADER_ELECTION"); mode {
+	case "":
+	case "file":
+		if path := c.get("LEADER_LOCK_PATH"); path != "" {
+			elector, err = newFileLock(path)
+		} else {
+			err = fmt.Errorf("file mode requires LEADER_LOCK_PATH")
+		}
+	case "kubernetes":
+		name := c.get("LEADER_LEASE_NAME")
+		if name == "" {
+			name = "banno-project"
+		}
+		elector, err = newKubeLease(name, leaderIdentity(), leaseDuration)
+	default:
+		err = fmt.Errorf("unknown mode %q", mode)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid LEADER_ELECTION: %s", err)
+	}
+	if elector != nil {
+		s.leader = &leadership{elector: elector, renew: leaseDuration / 3, logger: a.logger}
+	}
+
+	// the scheduler keeps monitored locations fresh in the cache and history,
+	// and drives subscription notifications
+	s.scheduler = newScheduler(
+		s.pollLocation,
+		c.float("SCHEDULER_JITTER", 0.1),
+		c.duration("SCHEDULER_MAX_BACKOFF", time.Hour),
+		c.integer("SCHEDULER_CONCURRENCY", 4),
+	)
+	s.scheduler.active = s.leader.IsLeader
+	s.scheduler.logger = a.logger
+	if path := c.get("MONITORS_PATH"); path != "" {
+		if err := s.scheduler.Load(path); err != nil {
+			return nil, fmt.Errorf("failed to load monitors: %s", err)
+		}
+	}
+	monitors, err := parseMonitorList(c.get("MONITOR_LOCATIONS"), c.duration("MONITOR_INTERVAL", 10*time.Minute))
+	if err != nil {
+		return nil, fmt.Errorf("invalid MONITOR_LOCATIONS: %s", err)
+	}
+	s.scheduler.Sync("config", monitors)
+	s.syncMonitors()
+	return s, nil
+}
+
+// addWorkers sets up the background jobs. Most of them only do anything on
+// the leader.
+func (a *App) addWorkers() error {
+	c, s := a.config, a.server
+	if s.leader != nil {
+		a.addWorker(s.leader.run)
+	}
+	if s.sentry != nil {
+		a.addWorker(s.sentry.Run)
+	}
+	recheckInterval := c.duration("PROVIDER_RECHECK_INTERVAL", time.Minute)
+	a.addWorker(func(ctx context.Context) {
+		s.recheckProviderAuth(ctx, recheckInterval)
+	})
+	if c.get("HISTORY_PATH") != "" {
+		a.addWorker(func(ctx context.Context) {
+			s.history.saveEvery(ctx, time.Minute)
+		})
+	}
+	interval, retention := c.duration("HISTORY_COMPACT_INTERVAL", time.Hour), c.duration("HISTORY_RAW_RETENTION", 90*24*time.Hour)
+	a.addWorker(func(ctx context.Context) {
+		s.history.compactEvery(ctx, interval, retention)
+	})
+	if !s.offline {
+		var maxAge time.Duration
+		for _, t := range s.clients.tiers {
+			if t.MaxAge > maxAge {
+				maxAge = t.MaxAge
+			}
+		}
+		if ttl := s.responses.TTL(cacheCurrent); ttl < maxAge {
+			maxAge = ttl
+		}
+		a.addWorker(func(ctx context.Context) {
+			s.cache.expireEvery(ctx, time.Minute, maxAge)
+		})
+	}
+	a.addWorker(func(ctx context.Context) {
+		s.responses.expireEvery(ctx, time.Minute)
+	})
+	a.addWorker(func(ctx context.Context) {
+		s.audit.expireEvery(ctx, time.Hour)
+	})
+	a.addWorker(func(ctx context.Context) {
+		for range ticks(ctx, time.Hour) {
+			if err := s.locations.Purge(); err != nil {
+				s.logger.Printf("Failed to purge deleted locations: %s", err)
+			}
+			if err := s.subscriptions.Purge(); err != nil {
+				s.logger.Printf("Failed to purge deleted subscriptions: %s", err)
+			}
+		}
+	})
+
+	a.addWorker(s.scheduler.Run)
+	if s.popular != nil {
+		interval := c.duration("POPULAR_MONITOR_INTERVAL", c.duration("MONITOR_INTERVAL", 10*time.Minute))
+		a.addWorker(func(ctx context.Context) {
+			s.promoteEvery(ctx, interval)
+		})
+	}
+	if c.get("MONITORS_PATH") != "" {
+		a.addWorker(func(ctx context.Context) {
+			s.scheduler.saveEvery(ctx, time.Minute)
+		})
+	}
+	retryInterval := c.duration("DELIVERY_RETRY_INTERVAL", 15*time.Second)
+	a.addWorker(func(ctx context.Context) {
+		s.retryDeliveriesEvery(ctx, retryInterval)
+	})
+
+	// off by default: each check costs a request per snapshot
+	if interval := c.duration("SCHEMA_CHECK_INTERVAL", 0); interval > 0 && !s.offline {
+		a.addWorker(func(ctx context.Context) {
+			s.checkSchemasEvery(ctx, interval)
+		})
+	}
+
+	capFeeds, err := parseCAPFeeds(c.get("CAP_FEEDS"))
+	if err != nil {
+		return fmt.Errorf("invalid CAP_FEEDS: %s", err)
+	}
+	if len(capFeeds) > 0 {
+		pollInterval := c.duration("CAP_POLL_INTERVAL", time.Minute)
+		a.addWorker(func(ctx context.Context) {
+			s.pollCAPFeedsEvery(ctx, capFeeds, pollInterval)
+		})
+	}
+
+	warm, err := parseLocationList(c.get("WARM_LOCATIONS"))
+	if err != nil {
+		return fmt.Errorf("invalid WARM_LOCATIONS: %s", err)
+	}
+	if len(warm) > 0 {
+		s.ready.SetNotReady("cache", "warming")
+		concurrency := c.integer("WARM_CONCURRENCY", 4)
+		a.addWorker(func(ctx context.Context) {
+			s.warmCache(ctx, warm, concurrency)
+		})
+	}
+
+	// digests are always available at /digest; they're only pushed when
+	// there's somewhere to push them
+	if len(s.notifiers) > 0 {
+		digestAt := c.get("DIGEST_TIME")
+		if digestAt == "" {
+			digestAt = "07:00"
+		}
+		weeklyOn := c.get("DIGEST_WEEKDAY")
+		if weeklyOn == "" {
+			weeklyOn = "monday"
+		}
+		offset, weekday, err := parseDigestSchedule(digestAt, weeklyOn)
+		if err != nil {
+			return fmt.Errorf("invalid digest schedule: %s", err)
+		}
+		a.addWorker(func(ctx context.Context) {
+			s.sendDigestsEvery(ctx, offset, weekday)
+		})
+	}
+
+	if s.telegram != nil {
+		if url := c.get("TELEGRAM_WEBHOOK_URL"); url != "" {
+			s.telegram.webhookSecret = c.get("TELEGRAM_WEBHOOK_SECRET")
+			if s.telegram.webhookSecret == "" {
+				return fmt.Errorf("TELEGRAM_WEBHOOK_URL requires TELEGRAM_WEBHOOK_SECRET")
+			}
+			a.addWorker(func(ctx context.Context) {
+				if err := s.telegram.setWebhook(url); err != nil {
+					a.logger.Printf("Failed to set Telegram webhook: %s", err)
+				}
+			})
+		} else {
+			a.addWorker(s.pollTelegram)
+		}
+	}
+	return nil
+}
+
+// addWorker adds a background job for Run to start.
+func (a *App) addWorker(run func(ctx context.Context)) {
+	a.workers = append(a.workers, run)
+}
+
+// newRouter builds the HTTP handler: the routes, behind the middleware that
+// applies to all of them.
+func (a *App) newRouter() http.Handler {
+	c, server := a.config, a.server
+
+	var filter ipFilter
+	var realIP realIP
+	for _, list := range []struct {
+		env  string
+		nets *[]*net.IPNet
+	}{
+		{"IP_ALLOWLIST", &filter.allow},
+		{"IP_DENYLIST", &filter.deny},
+		{"TRUSTED_PROXIES", &realIP.trustedProxies},
+	} {
+		nets, err := parseCIDRs(splitList(c.get(list.env)))
+		if err != nil {
+			invalid(list.env, err)
+		}
+		*list.nets = nets
+	}
+
+	shedder := newLoadShedder(
+		c.duration("SHED_P99_THRESHOLD", 0),
+		c.integer("SHED_MAX_IN_FLIGHT", 0),
+		c.float("SHED_MAX_FRACTION", 0.9),
+	)
+
+	mux := http.NewServeMux()
+	queueDepth := c.integer("ROUTE_QUEUE_DEPTH", 0)
+	routeLimits, err := parseRouteLimits(c.get("ROUTE_CONCURRENCY"), queueDepth)
+	if err != nil {
+		invalid("ROUTE_CONCURRENCY", err)
+	}
+	limits := concurrencyLimits{mux: mux, routes: routeLimits}
+	if n := c.integer("MAX_IN_FLIGHT", 0); n > 0 {
+		limits.global = newLimiter(n, queueDepth)
+	}
+	mux.HandleFunc("/weather/", server.authenticate(server.weatherHandler))
+	mux.HandleFunc("/widget", server.authenticate(server.widgetHandler))
+	mux.HandleFunc("/badge", server.authenticate(server.badgeHandler))
+	mux.HandleFunc("/forecast", server.authenticate(server.forecastHandler))
+	mux.HandleFunc("/geocode", server.authenticate(server.geocodeHandler))
+	mux.HandleFunc("/compare", server.authenticate(server.compareHandler))
+	mux.HandleFunc("/route-weather", server.authenticate(server.routeWeatherHandler))
+	mux.HandleFunc("/weather/area", server.authenticate(server.areaWeatherHandler))
+	mux.HandleFunc("/weather/observed", server.authenticate(server.observedHandler))
+	mux.HandleFunc("/weather/poll", server.authenticate(server.pollHandler))
+	mux.HandleFunc("/agri/frost-risk", server.authenticate(server.frostRiskHandler))
+	mux.HandleFunc("/agri/season", server.authenticate(server.growingSeasonHandler))
+	mux.HandleFunc("/fire-risk", server.authenticate(server.fireRiskHandler))
+	mux.HandleFunc("/outdoor-score", server.authenticate(server.outdoorScoreHandler))
+	mux.HandleFunc("/snow", server.authenticate(server.snowHandler))
+	mux.HandleFunc("/lightning", server.authenticate(server.lightningHandler))
+	mux.HandleFunc("/tropical", server.authenticate(server.tropicalHandler))
+	mux.HandleFunc("/earthquakes", server.authenticate(server.earthquakesHandler))
+	mux.HandleFunc("/hazards", server.authenticate(server.hazardsHandler))
+	mux.HandleFunc("/degree-days", server.authenticate(server.degreeDaysHandler))
+	mux.HandleFunc("/alerts", server.authenticate(server.alertsHandler))
+	mux.HandleFunc("/alerts/history", server.authenticate(server.alertHistoryHandler))
+	mux.HandleFunc("/alerts/recent", server.authenticate(server.recentAlertsHandler))
+	mux.HandleFunc("/locations", server.authenticate(server.locationsHandler))
+	mux.HandleFunc("/locations/", server.authenticate(server.locationsHandler))
+	mux.HandleFunc("/account/", server.authenticate(server.accountHandler))
+	mux.HandleFunc("/digest", server.authenticate(server.digestHandler))
+	mux.HandleFunc("/summary", server.authenticate(server.summaryHandler))
+	mux.HandleFunc("/conditions/check", server.authenticate(server.conditionsCheckHandler))
+	mux.HandleFunc("/calendar.ics", server.authenticate(server.calendarHandler))
+	mux.HandleFunc("/assistant", server.authenticate(server.assistantHandler))
+	mux.HandleFunc("/slash", server.slashHandler)
+	mux.HandleFunc("/telegram", server.telegramWebhookHandler)
+	mux.HandleFunc("/ingest/cap", server.capIngestHandler)
+	mux.HandleFunc("/token", server.tokenHandler)
+	mux.Handle("/", uiHandler())
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/readyz", server.ready.readyHandler)
+	mux.HandleFunc("/admin/history/import", server.requireAdmin(server.importHandler))
+	mux.HandleFunc("/admin/keys", server.requireAdmin(server.keysHandler))
+	mux.HandleFunc("/admin/keys/", server.requireAdmin(server.keysHandler))
+	mux.HandleFunc("/admin/monitors", server.requireAdmin(server.monitorsHandler))
+	mux.HandleFunc("/admin/monitors/", server.requireAdmin(server.monitorsHandler))
+	mux.HandleFunc("/admin/deliveries", server.requireAdmin(server.deliveriesHandler))
+	mux.HandleFunc("/admin/deliveries/", server.requireAdmin(server.deliveriesHandler))
+	mux.HandleFunc("/admin/audit", server.requireAdmin(server.auditHandler))
+	mux.HandleFunc("/admin/cache", server.requireAdmin(server.cacheHandler))
+	mux.HandleFunc("/admin/popular", server.requireAdmin(server.popularHandler))
+
+	timing := &serverTiming{
+		header:      c.boolean("SERVER_TIMING", true),
+		allowOrigin: c.get("SERVER_TIMING_ALLOW_ORIGIN"),
+	}
+	slo := newSLOTracker(
+		c.fraction("SLO_AVAILABILITY_OBJECTIVE", 0.999),
+		c.fraction("SLO_LATENCY_OBJECTIVE", 0.99),
+		c.duration("SLO_LATENCY_THRESHOLD", 500*time.Millisecond),
+	)
+
+	handler := slo.Middleware(filter.Middleware(shedder.Middleware(limits.Middleware(a.redactor.Middleware(cacheHeaders(timing.Middleware(a.server.requestFreshness(a.server.selectProvider(mux)))))))))
+	if a.accessLog != nil {
+		handler = a.accessLog.Middleware(handler)
+	} else {
+		handler = logRequests(a.logger, handler)
+	}
+	return requestIDs(realIP.Middleware(a.server.sentry.Middleware(handler)))
+}
+
+// openAccessLog opens the access log, if ACCESS_LOG is set: "stdout",
+// "stderr" or the path of a file, which is rotated by size. Without one,
+// requests are logged to the application log.
+func (a *App) openAccessLog() error {
+	c := a.config
+	dest := c.get("ACCESS_LOG")
+	if dest == "" {
+		return nil
+	}
+	format := strings.ToLower(c.get("ACCESS_LOG_FORMAT"))
+	switch format {
+	case "":
+		format = accessLogJSON
+	case accessLogJSON, accessLogCombined:
+	default:
+		return fmt.Errorf("invalid ACCESS_LOG_FORMAT: %q (want json or combined)", format)
+	}
+	sampleRate := c.float("ACCESS_LOG_SAMPLE_RATE", 1)
+	if sampleRate <= 0 || sampleRate > 1 {
+		invalid("ACCESS_LOG_SAMPLE_RATE", "must be more than 0 and at most 1")
+	}
+
+	var w io.Writer
+	switch dest {
+	case "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		f, err := openRotatingFile(dest,
+			int64(c.integer("ACCESS_LOG_MAX_SIZE_MB", 100))<<20,
+			c.integer("ACCESS_LOG_MAX_BACKUPS", 5),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to open access log: %s", err)
+		}
+		w = f
+	}
+	a.accessLog = newAccessLog(w, format, sampleRate)
+	return nil
+}
+
+// configureTLS loads the TLS settings, if any. The key pair is loaded now,
+// so a bad one fails a restart rather than taking over from a working
+// process.
+func (a *App) configureTLS() error {
+	c := a.config
+	certFile, keyFile := c.get("TLS_CERT_FILE"), c.get("TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return nil
+	}
+	tlsConfig, err := newTLSConfig(c.get("TLS_CLIENT_CA_FILE"), splitList(c.get("TLS_CLIENT_ALLOWED_NAMES")))
+	if err != nil {
+		return fmt.Errorf("invalid TLS configuration: %s", err)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("invalid TLS configuration: %s", err)
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	a.tlsConfig = tlsConfig
+	return nil
+}
+
+// listen returns the listener to serve on: one inherited from the process
+// we're replacing, one from systemd socket activation, or a new one on
+// ADDR.
+func (a *App) listen() (net.Listener, error) {
+	ln, err := inheritedListener()
+	if err != nil {
+		return nil, fmt.Errorf("invalid inherited listener: %s", err)
+	}
+	if ln != nil {
+		return ln, nil
+	}
+	if ln, err = systemdListener(); err != nil {
+		return nil, fmt.Errorf("invalid socket activation: %s", err)
+	}
+	if ln != nil {
+		return ln, nil
+	}
+	return listen(a.addr, a.socketMode)
+}
+
+// Run serves the API and runs the background jobs until ctx is done, or
+// until a restart hands over to a replacement process, then shuts down
+// cleanly.
+func (a *App) Run(ctx context.Context) error {
+	ln, err := a.listen()
+	if err != nil {
+		return err
+	}
+	return a.Serve(ctx, ln)
+}
+
+// restartHooks are what a restart does around starting the replacement
+// process.
+type restartHooks struct {
+	handOff func() // stop what the replacement takes over, before it starts
+	resume  func() // take it back, if the replacement didn't come up
+	logger  *log.Logger
+}
+
+// Serve is Run on a listener of the caller's choosing.
+func (a *App) Serve(ctx context.Context, ln net.Listener) error {
+	s := &http.Server{Handler: a.handler, TLSConfig: a.tlsConfig}
+	ctx, cancel := context.WithCancel(ctx)
+
+	// the background jobs and the stores are handed over to a replacement
+	// before it starts: with both of us running the jobs, notifications
+	// would go out twice, and our saves would overwrite its
+	var mu sync.Mutex
+	stopWorkers := a.startWorkers(ctx)
+	handedOff := false
+	drained := handleRestarts(ctx, s, ln, a.shutdownTimeout, restartHooks{
+		handOff: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			stopWorkers()
+			a.server.leader.StepDown()
+			a.flush()
+			handedOff = true
+		},
+		resume: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			stopWorkers = a.startWorkers(ctx)
+			handedOff = false
+		},
+		logger: a.logger,
+	})
+	defer func() {
+		cancel()
+		mu.Lock()
+		if !handedOff {
+			stopWorkers()
+			a.server.leader.Release()
+			a.flush()
+		}
+		mu.Unlock()
+		a.closeAccessLog()
+	}()
+
+	// stopped is closed once s has shut down, however that came about
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			a.logger.Println("Shutting down; draining connections")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), a.shutdownTimeout)
+			defer cancel()
+			if err := s.Shutdown(shutdownCtx); err != nil {
+				a.logger.Printf("Failed to drain connections: %s", err)
+			}
+		}
+	}()
+
+	notifyParent()
+	sdNotify("READY=1")
+	go sdWatchdog(ctx)
+	var err error
+	if s.TLSConfig != nil {
+		a.logger.Printf("Listening on %s (TLS)\n", ln.Addr())
+		err = s.ServeTLS(ln, "", "")
+	} else {
+		a.logger.Printf("Listening on %s\n", ln.Addr())
+		err = s.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-stopped
+	return nil
+}
+
+// startWorkers starts the background jobs, returning a function that
+// stops them and waits for them to finish.
+func (a *App) startWorkers(ctx context.Context) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	var workers sync.WaitGroup
+	for _, w := range a.workers {
+		workers.Add(1)
+		go func(run func(context.Context)) {
+			defer workers.Done()
+			run(ctx)
+		}(w)
+	}
+	return func() {
+		cancel()
+		workers.Wait()
+	}
+}
+
+// flush saves the stores, once the workers are done.
+func (a *App) flush() {
+	s := a.server
+	if err := s.history.Save(); err != nil {
+		a.logger.Printf("Failed to save history: %s", err)
+	}
+	if err := s.scheduler.Save(); err != nil {
+		a.logger.Printf("Failed to save monitors: %s", err)
+	}
+}
+
+// closeAccessLog closes the access log, once the last request is done.
+func (a *App) closeAccessLog() {
+	if a.accessLog != nil {
+		if err := a.accessLog.Close(); err != nil {
+			a.logger.Printf("Failed to close access log: %s", err)
+		}
+	}
+}
+
+// ticks delivers the time every interval until ctx is done, when the
+// channel is closed. Background jobs range over it.
+func ticks(ctx context.Context, interval time.Duration) <-chan time.Time {
+	c := make(chan time.Time)
+	go func() {
+		defer close(c)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				select {
+				case c <- now:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return c
+}
+
+// sleep waits for d, reporting false if ctx was done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,156 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+const (
+	// maxAreaPoints bounds how many grid points an area query samples;
+	// each one may be an upstream call.
+	maxAreaPoints = 100
+	// areaConcurrency is how many of an area's points are fetched at once.
+	areaConcurrency = 8
+)
+
+// AreaWeather is the response of the area endpoint: a matrix of the
+// weather at each grid point. Rows run south to north, one per entry in
+// Lats, and columns west to east, one per entry in Lons. A cell is null if
+// its weather couldn't be fetched.
+type AreaWeather struct {
+	BBox   [4]float64        `json:"bbox"`
+	Grid   float64           `json:"grid"`
+	Lats   []float64         `json:"lats"`
+	Lons   []float64         `json:"lons"`
+	Cells  [][]*PointWeather `json:"cells"`
+	Errors int               `json:"errors"`
+}
+
+// parseBBox parses a "minLon,minLat,maxLon,maxLat" bounding box, the order
+// GeoJSON and most map libraries use.
+func parseBBox(raw string) ([4]float64, error) {
+	var bbox [4]float64
+	parts := strings.Split(raw, ",")
+	if len(parts) != 4 {
+		return bbox, errors.New("Invalid bbox: want minLon,minLat,maxLon,maxLat")
+	}
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(v) {
+			return bbox, fmt.Errorf("Invalid bbox: %q is not a number", part)
+		}
+		bbox[i] = v
+	}
+	minLon, minLat, maxLon, maxLat := bbox[0], bbox[1], bbox[2], bbox[3]
+	if minLat < -90 || maxLat > 90 || minLon < -180 || maxLon > 180 {
+		return bbox, errors.New("Invalid bbox: out of range")
+	}
+	if minLat > maxLat || minLon > maxLon {
+		return bbox, errors.New("Invalid bbox: min must not exceed max")
+	}
+	return bbox, nil
+}
+
+// gridCount is how many grid lines there are from min to max, inclusive,
+// every step.
+func gridCount(min, max, step float64) float64 {
+	return math.Floor((max-min)/step+1e-9) + 1
+}
+
+// gridSteps returns the coordinates from min to max, inclusive, every step.
+func gridSteps(min, max, step float64) []float64 {
+	steps := make([]float64, int(gridCount(min, max, step)))
+	for i := range steps {
+		// keep float error out of the output, and out of cache keys
+		steps[i] = math.Round((min+float64(i)*step)*1e6) / 1e6
+	}
+	return steps
+}
+
+// areaWeatherHandler samples the weather on a grid of points covering a
+// bounding box, for heat-map overlays.
+func (s *server) areaWeatherHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	bbox, err := parseBBox(q.Get("bbox"))
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	grid := 0.5
+	if raw := q.Get("grid"); raw != "" {
+		if grid, err = strconv.ParseFloat(raw, 64); err != nil || !(grid > 0) {
+			w.WriteHeader(400)
+			w.Write([]byte("Invalid grid: must be a positive number of degrees"))
+			return
+		}
+	}
+
+	// check the size before building the grid, which could be enormous
+	if n := gridCount(bbox[1], bbox[3], grid) * gridCount(bbox[0], bbox[2], grid); n > maxAreaPoints {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Grid has %.0f points; at most %d are allowed, so use a larger grid or a smaller bbox", n, maxAreaPoints)
+		return
+	}
+	area := AreaWeather{
+		BBox: bbox,
+		Grid: grid,
+		Lats: gridSteps(bbox[1], bbox[3], grid),
+		Lons: gridSteps(bbox[0], bbox[2], grid),
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		lastErr error
+		sem     = make(chan struct{}, areaConcurrency)
+	)
+	area.Cells = make([][]*PointWeather, len(area.Lats))
+	for i, lat := range area.Lats {
+		area.Cells[i] = make([]*PointWeather, len(area.Lons))
+		for j, lon := range area.Lons {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(cell **PointWeather, loc models.Location) {
+				defer func() { <-sem; wg.Done() }()
+				lat, lon := loc.Strings()
+				data, err := s.fetchWeather(r.Context(), lat, lon)
+				if err != nil {
+					mu.Lock()
+					area.Errors++
+					lastErr = err
+					mu.Unlock()
+					return
+				}
+				pw := newPointWeather(loc, data)
+				*cell = &pw
+			}(&area.Cells[i][j], models.Location{Lat: lat, Lon: lon})
+		}
+	}
+	wg.Wait()
+
+	if area.Errors == len(area.Lats)*len(area.Lons) {
+		s.upstreamError(w, r, lastErr)
+		return
+	}
+	if wantsGeoJSON(w, r, q) {
+		var features []GeoJSONFeature
+		for _, row := range area.Cells {
+			for _, cell := range row {
+				if cell != nil {
+					features = append(features, pointFeature(cell.Lat, cell.Lon, cell))
+				}
+			}
+		}
+		writeGeoJSON(w, featureCollection(features))
+		return
+	}
+	writeJSON(w, &area)
+}
@@ -0,0 +1,175 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// alexaMaxSkew is how old (or new) an Alexa request may be; Alexa rejects
+// skills that accept requests older than this, to limit replays.
+const alexaMaxSkew = 150 * time.Second
+
+// assistantRequest is the union of the Alexa skill and Actions on Google
+// webhook requests, enough of each to tell them apart and answer.
+type assistantRequest struct {
+	// Alexa
+	Version string `json:"version"`
+	Context struct {
+		System struct {
+			User struct {
+				AccessToken string `json:"accessToken"` // set by account linking
+			} `json:"user"`
+		} `json:"System"`
+	} `json:"context"`
+	Request *struct {
+		Type      string    `json:"type"` // LaunchRequest, IntentRequest, SessionEndedRequest
+		Timestamp time.Time `json:"timestamp"`
+		Intent    struct {
+			Name  string `json:"name"`
+			Slots map[string]struct {
+				Value string `json:"value"`
+			} `json:"slots"`
+		} `json:"intent"`
+	} `json:"request"`
+
+	// Actions on Google
+	Handler *struct {
+		Name string `json:"name"`
+	} `json:"handler"`
+	Intent struct {
+		Name   string `json:"name"`
+		Params map[string]struct {
+			Resolved interface{} `json:"resolved"`
+		} `json:"params"`
+	} `json:"intent"`
+	Session struct {
+		ID string `json:"id"`
+	} `json:"session"`
+}
+
+// assistantHandler is the fulfillment endpoint for Alexa skills and Actions
+// on Google. It answers "what's the weather at home" with the digest summary
+// for the caller's home location (see locationStore.Home), for the week if
+// the request asks about the week.
+//
+// The caller is whoever authenticated the request, typically with an
+// api_key in the endpoint URL, unless an Alexa request carries an account
+// linking token, which must be a token from /token.
+func (s *server) assistantHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(405)
+		return
+	}
+	var req assistantRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid request body: %s", err)
+		return
+	}
+
+	client := clientFromContext(r.Context())
+	switch {
+	case req.Request != nil:
+		if skew := time.Since(req.Request.Timestamp); skew > alexaMaxSkew || skew < -alexaMaxSkew {
+			w.WriteHeader(400)
+			w.Write([]byte("Request timestamp is too far from the current time"))
+			return
+		}
+		if token := req.Context.System.User.AccessToken; token != "" {
+			if client = s.tokenClient(token); client == nil {
+				writeJSON(w, alexaResponse("Please link your account again in the Alexa app.", true))
+				return
+			}
+		}
+		switch {
+		case req.Request.Type == "SessionEndedRequest":
+			writeJSON(w, alexaResponse("", true))
+		case req.Request.Intent.Name == "AMAZON.HelpIntent":
+			writeJSON(w, alexaResponse(assistantHelp, false))
+		case req.Request.Intent.Name == "AMAZON.StopIntent" || req.Request.Intent.Name == "AMAZON.CancelIntent":
+			writeJSON(w, alexaResponse("Goodbye.", true))
+		default:
+			weekly := false
+			for _, slot := range req.Request.Intent.Slots {
+				weekly = weekly || strings.Contains(strings.ToLower(slot.Value), "week")
+			}
+			writeJSON(w, alexaResponse(spoken(s.assistantAnswer(r, client.ID, weekly)), true))
+		}
+
+	case req.Handler != nil:
+		weekly := strings.Contains(strings.ToLower(req.Intent.Name), "week")
+		for _, param := range req.Intent.Params {
+			weekly = weekly || strings.Contains(strings.ToLower(fmt.Sprint(param.Resolved)), "week")
+		}
+		writeJSON(w, googleResponse(req.Session.ID, s.assistantAnswer(r, client.ID, weekly)))
+
+	default:
+		w.WriteHeader(400)
+		w.Write([]byte("Unrecognized assistant request"))
+	}
+}
+
+const assistantHelp = "Ask me what the weather is like at home, today or this week."
+
+// assistantAnswer answers what the weather is like at the client's home.
+func (s *server) assistantAnswer(r *http.Request, clientID string, weekly bool) string {
+	home, ok := s.locations.Home(clientID)
+	if !ok {
+		return "You haven't saved a home location yet."
+	}
+	period := "daily"
+	if weekly {
+		period = "weekly"
+	}
+	d, err := s.composeDigest(r.Context(), home.Name, home.location(), period)
+	if err != nil {
+		s.logger.Printf("Failed to compose assistant answer: %s", err)
+		return "Sorry, I couldn't get the weather right now. Please try again later."
+	}
+	return d.Summary
+}
+
+// spoken adapts text for speech.
+func spoken(text string) string {
+	return strings.ReplaceAll(text, "°F", " degrees")
+}
+
+// alexaResponse is an Alexa skill response.
+func alexaResponse(speech string, end bool) interface{} {
+	type outputSpeech struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	type response struct {
+		OutputSpeech     *outputSpeech `json:"outputSpeech,omitempty"`
+		ShouldEndSession bool          `json:"shouldEndSession"`
+	}
+	resp := response{ShouldEndSession: end}
+	if speech != "" {
+		resp.OutputSpeech = &outputSpeech{Type: "PlainText", Text: speech}
+	}
+	return struct {
+		Version  string   `json:"version"`
+		Response response `json:"response"`
+	}{"1.0", resp}
+}
+
+// googleResponse is an Actions on Google webhook response, which shows the
+// text as well as speaking it.
+func googleResponse(sessionID, text string) interface{} {
+	type simple struct {
+		Speech string `json:"speech"`
+		Text   string `json:"text"`
+	}
+	return map[string]interface{}{
+		"session": map[string]interface{}{"id": sessionID, "params": map[string]interface{}{}},
+		"prompt": map[string]interface{}{
+			"override":    false,
+			"firstSimple": simple{Speech: spoken(text), Text: text},
+		},
+	}
+}
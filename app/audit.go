@@ -0,0 +1,269 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// auditEntry records one attempt to deliver a notification.
+type auditEntry struct {
+	Seq          int64     `json:"seq"`
+	Time         time.Time `json:"time"`
+	Channel      string    `json:"channel"`
+	Recipient    string    `json:"recipient"` // webhook URL or chat ID
+	Subscription string    `json:"subscription,omitempty"`
+	Type         string    `json:"type"` // e.g. "alert" or "digest"
+	// PayloadHash is the SHA-256 of what was sent, so a delivery can be
+	// matched to a payload without keeping the payload.
+	PayloadHash string  `json:"payload_hash"`
+	Status      string  `json:"status"` // "ok" or "error"
+	Error       string  `json:"error,omitempty"`
+	LatencyMs   float64 `json:"latency_ms"`
+}
+
+// auditLog records every notification delivery attempt. When path is set
+// entries are appended to it as JSON lines, and survive restarts; otherwise
+// they only live in memory. Entries older than retention are dropped.
+type auditLog struct {
+	path      string
+	retention time.Duration
+	logger    *log.Logger
+
+	mu      sync.Mutex
+	entries []auditEntry // oldest first
+	seq     int64
+	file    *os.File
+}
+
+// openAuditLog loads the audit log at path, dropping expired entries, and
+// opens it for appending. An empty path gives an in-memory log.
+func openAuditLog(path string, retention time.Duration) (*auditLog, error) {
+	a := &auditLog{path: path, retention: retention, logger: log.Default()}
+	if path == "" {
+		return a, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		cutoff := time.Now().Add(-retention)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e auditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				// a torn final line from a crash; skip it
+				continue
+			}
+			if e.Seq > a.seq {
+				a.seq = e.Seq
+			}
+			if e.Time.After(cutoff) {
+				a.entries = append(a.entries, e)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	// rewrite the file without the expired entries
+	if err := a.rewrite(); err != nil {
+		return nil, err
+	}
+	a.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// rewrite atomically replaces the file with the entries in memory.
+func (a *auditLog) rewrite() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(a.path), filepath.Base(a.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range a.entries {
+		if err := enc.Encode(e); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), a.path)
+}
+
+// Record adds an entry to the log.
+func (a *auditLog) Record(e auditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.seq++
+	e.Seq = a.seq
+	a.entries = append(a.entries, e)
+	if a.file == nil {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	if _, err := a.file.Write(append(b, '\n')); err != nil {
+		a.logger.Printf("Failed to write audit log: %s", err)
+	}
+}
+
+// expireEvery drops expired entries from memory every interval. The file
+// is trimmed when it's next opened.
+func (a *auditLog) expireEvery(ctx context.Context, interval time.Duration) {
+	for range ticks(ctx, interval) {
+		cutoff := time.Now().Add(-a.retention)
+		a.mu.Lock()
+		i := 0
+		for i < len(a.entries) && !a.entries[i].Time.After(cutoff) {
+			i++
+		}
+		a.entries = append([]auditEntry(nil), a.entries[i:]...)
+		a.mu.Unlock()
+	}
+}
+
+// auditQuery narrows a search of the audit log. Empty fields match
+// anything.
+type auditQuery struct {
+	Channel   string
+	Recipient string
+	Status    string
+	Type      string
+	From, To  time.Time
+}
+
+func (q auditQuery) matches(e auditEntry) bool {
+	return (q.Channel == "" || e.Channel == q.Channel) &&
+		(q.Recipient == "" || e.Recipient == q.Recipient || e.Subscription == q.Recipient) &&
+		(q.Status == "" || e.Status == q.Status) &&
+		(q.Type == "" || e.Type == q.Type) &&
+		(q.From.IsZero() || !e.Time.Before(q.From)) &&
+		(q.To.IsZero() || e.Time.Before(q.To))
+}
+
+// Query returns up to limit entries matching q with a sequence number
+// below before (if set), newest first.
+func (a *auditLog) Query(q auditQuery, before int64, limit int) []auditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var out []auditEntry
+	for i := len(a.entries) - 1; i >= 0 && len(out) < limit; i-- {
+		e := a.entries[i]
+		if (before == 0 || e.Seq < before) && q.matches(e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// payloadHash hashes a payload for the audit log. Strings and byte slices
+// are hashed as they are, anything else as JSON.
+func payloadHash(payload interface{}) string {
+	var b []byte
+	switch p := payload.(type) {
+	case string:
+		b = []byte(p)
+	case []byte:
+		b = p
+	default:
+		b, _ = json.Marshal(p)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// audited makes a delivery attempt with send, recording it in the audit
+// log.
+func (s *server) audited(entry auditEntry, payload interface{}, send func() error) error {
+	start := time.Now()
+	err := send()
+	entry.Time = start.UTC()
+	entry.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	entry.PayloadHash = payloadHash(payload)
+	entry.Status = "ok"
+	if err != nil {
+		entry.Status = "error"
+		entry.Error = s.redactor.String(err.Error())
+	}
+	s.audit.Record(entry)
+	return err
+}
+
+// auditHandler searches the notification audit log, newest first. It can
+// be narrowed by ?channel=, ?recipient= (a webhook URL, chat ID or
+// subscription ID), ?status=, ?type=, ?from= and ?to=.
+func (s *server) auditHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := auditQuery{
+		Channel:   q.Get("channel"),
+		Recipient: q.Get("recipient"),
+		Status:    q.Get("status"),
+		Type:      q.Get("type"),
+	}
+	if query.Status != "" && query.Status != "ok" && query.Status != "error" {
+		w.WriteHeader(400)
+		w.Write([]byte("status must be ok or error"))
+		return
+	}
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &query.From}, {"to", &query.To}} {
+		if raw := q.Get(bound.name); raw != "" {
+			var err error
+			if *bound.t, err = parseTimeParam(raw); err != nil {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "Invalid %s: want a date (2006-01-02) or RFC 3339 time", bound.name)
+				return
+			}
+		}
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// fetch one extra entry to learn whether there is a next page
+	items := s.audit.Query(query, page.Before, page.Limit+1)
+	var next int64
+	if len(items) > page.Limit {
+		items = items[:page.Limit]
+		next = items[len(items)-1].Seq
+	}
+	if items == nil {
+		items = []auditEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newPageResponse(r, items, next))
+}
@@ -0,0 +1,101 @@
+package app
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// badgeColors maps a temperature label to a shields.io-style message color.
+var badgeColors = map[string]string{
+	"cold":     "#007ec6",
+	"moderate": "#44cc11",
+	"hot":      "#fe7d37",
+	"":         "#9f9f9f", // no label: the temperature is unknown
+}
+
+// badgeData is the view model for the badge template.
+type badgeData struct {
+	Label        string
+	Message      string
+	Color        string
+	LabelWidth   int
+	MessageWidth int
+}
+
+// Width is the total width of the badge.
+func (b badgeData) Width() int { return b.LabelWidth + b.MessageWidth }
+
+// LabelX is the horizontal center of the label text.
+func (b badgeData) LabelX() int { return b.LabelWidth / 2 }
+
+// MessageX is the horizontal center of the message text.
+func (b badgeData) MessageX() int { return b.LabelWidth + b.MessageWidth/2 }
+
+var badgeSVG = template.Must(template.New("badge.svg").Parse(`<svg xmlns="http://www.w3.org/2000/svg" width="{{.Width}}" height="20" role="img" aria-label="{{.Label}}: {{.Message}}">
+<title>{{.Label}}: {{.Message}}</title>
+<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="{{.Width}}" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)">
+<rect width="{{.LabelWidth}}" height="20" fill="#555"/>
+<rect x="{{.LabelWidth}}" width="{{.MessageWidth}}" height="20" fill="{{.Color}}"/>
+<rect width="{{.Width}}" height="20" fill="url(#s)"/>
+</g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="{{.LabelX}}" y="15" fill="#010101" fill-opacity=".3">{{.Label}}</text>
+<text x="{{.LabelX}}" y="14">{{.Label}}</text>
+<text x="{{.MessageX}}" y="15" fill="#010101" fill-opacity=".3">{{.Message}}</text>
+<text x="{{.MessageX}}" y="14">{{.Message}}</text>
+</g>
+</svg>
+`))
+
+// badgeTextWidth approximates the rendered width of s in 11px Verdana, plus
+// horizontal padding.
+func badgeTextWidth(s string) int {
+	return utf8.RuneCountInString(s)*7 + 10
+}
+
+// badgeHandler serves a shields.io-style SVG badge with the current
+// temperature, e.g. "Austin: 93°F hot".
+func (s *server) badgeHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lat, lon, _ := s.requestLocation(r, q)
+
+	label := q.Get("label")
+	if label == "" {
+		label = "weather"
+	}
+
+	data, err := s.fetchWeather(r.Context(), lat, lon)
+	if err != nil {
+		s.upstreamError(w, r, err)
+		return
+	}
+
+	weather := newWeather(data)
+	message := strings.TrimSpace(formatDegrees(data.Temp) + " " + weather.Temperature)
+	view := badgeData{
+		Label:        label,
+		Message:      message,
+		Color:        badgeColors[weather.Temperature],
+		LabelWidth:   badgeTextWidth(label),
+		MessageWidth: badgeTextWidth(message),
+	}
+
+	var buf bytes.Buffer
+	stop := timePhase(r.Context(), phaseRender)
+	err = badgeSVG.Execute(&buf, view)
+	stop()
+	if err != nil {
+		w.WriteHeader(500)
+		s.logger.Printf("Failed to render badge: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(buf.Bytes())
+}
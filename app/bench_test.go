@@ -0,0 +1,106 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// benchOneCall is a representative onecall response, alerts included.
+const benchOneCall = `{"lat":30.49,"lon":-99.77,"timezone":"America/Chicago","timezone_offset":-18000,
+"current":{"dt":1600000000,"sunrise":1599999000,"sunset":1600040000,"temp":93.2,"feels_like":95.1,
+"pressure":1012,"humidity":40,"dew_point":65.3,"uvi":9.1,"clouds":20,"visibility":10000,"wind_speed":8.05,
+"wind_deg":180,"weather":[{"id":801,"main":"Clouds","description":"few clouds","icon":"02d"}]},
+"alerts":[{"sender_name":"NWS Austin/San Antonio","event":"Heat Advisory","start":1600000000,"end":1600050000,
+"description":"...HEAT ADVISORY REMAINS IN EFFECT UNTIL 8 PM CDT THIS EVENING..."}]}`
+
+// staticTransport answers every request with the same body.
+type staticTransport struct {
+	body []byte
+}
+
+func (t *staticTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(t.body)),
+		Request:    req,
+	}, nil
+}
+
+func newBenchServer(b *testing.B, maxAge time.Duration) *server {
+	tiers := map[string]*tier{"free": {Name: "free", MaxAge: maxAge}}
+	clients, err := newClientRegistry("", tiers, "free", 0, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return &server{
+		owm: &OWMService{
+			client:  &http.Client{Transport: &staticTransport{body: []byte(benchOneCall)}},
+			baseURL: "https://api.openweathermap.org",
+			appid:   "bench",
+		},
+		history: newHistoryStore(),
+		cache:   newWeatherCache(),
+		deltas:  newDeltaSnapshots(),
+		clients: clients,
+		ready:   newReadiness(),
+		logger:  log.New(ioutil.Discard, "", 0),
+	}
+}
+
+func benchmarkWeatherHandler(b *testing.B, maxAge time.Duration) {
+	s := newBenchServer(b, maxAge)
+	h := s.authenticate(s.weatherHandler)
+	req := httptest.NewRequest("GET", "/weather/?lat=30.489772&lon=-99.771335", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if rec.Code != 200 {
+			b.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+	}
+}
+
+func BenchmarkWeatherHandlerCached(b *testing.B) {
+	benchmarkWeatherHandler(b, time.Hour)
+}
+
+func BenchmarkWeatherHandlerUncached(b *testing.B) {
+	benchmarkWeatherHandler(b, 0)
+}
+
+func BenchmarkDecodeOneCall(b *testing.B) {
+	body := []byte(benchOneCall)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	for i := 0; i < b.N; i++ {
+		var data OWMApiResponse
+		if err := json.NewDecoder(bytes.NewReader(body)).Decode(&data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeWeather(b *testing.B) {
+	var data OWMApiResponse
+	if err := json.Unmarshal([]byte(benchOneCall), &data); err != nil {
+		b.Fatal(err)
+	}
+	current := newOWMConditions(&data)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		weather := newWeather(current)
+		if err := writeJSON(ioutil.Discard, &weather); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request bodies are checked against the schemas in the API description
+// (ui/openapi.json), so that what's documented is what's enforced and a
+// client learns which fields are wrong, not just that decoding failed. The
+// subset of JSON Schema used there is supported: type, properties,
+// required, additionalProperties, items, enum, minimum, maximum,
+// exclusiveMinimum, minItems, maxItems, minLength, maxLength, the
+// date-time format and local $refs.
+
+// FieldError is a problem with one field of a request body. Field is a
+// path such as "waypoints[2][0]"; it's empty for the body as a whole.
+type FieldError struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// InvalidBody is the response to a request body that fails validation.
+type InvalidBody struct {
+	Message string       `json:"message"`
+	Errors  []FieldError `json:"errors"`
+}
+
+var apiDescription struct {
+	once sync.Once
+	doc  map[string]interface{}
+	err  error
+}
+
+// requestSchema returns the schema of the JSON body of an operation in the
+// API description, such as "POST /route-weather".
+func requestSchema(operation string) (map[string]interface{}, error) {
+	apiDescription.once.Do(func() {
+		raw, err := uiFiles.ReadFile("ui/openapi.json")
+		if err == nil {
+			err = json.Unmarshal(raw, &apiDescription.doc)
+		}
+		apiDescription.err = err
+	})
+	if apiDescription.err != nil {
+		return nil, apiDescription.err
+	}
+	parts := strings.SplitN(operation, " ", 2)
+	schema, ok := lookup(apiDescription.doc, "paths", parts[1], strings.ToLower(parts[0]),
+		"requestBody", "content", "application/json", "schema").(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("no JSON request body is described for %s", operation)
+	}
+	return schema, nil
+}
+
+// lookup follows keys down through nested objects, returning nil if any is
+// missing.
+func lookup(v interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = obj[key]
+	}
+	return v
+}
+
+// resolve follows a local $ref, such as "#/components/schemas/Weather".
+func resolve(schema map[string]interface{}) map[string]interface{} {
+	ref, ok := schema["$ref"].(string)
+	if !ok || !strings.HasPrefix(ref, "#/") {
+		return schema
+	}
+	target, _ := lookup(apiDescription.doc, strings.Split(ref[2:], "/")...).(map[string]interface{})
+	return target
+}
+
+// validateBody checks a decoded JSON document against a schema.
+func validateBody(schema map[string]interface{}, v interface{}) []FieldError {
+	var errs []FieldError
+	checkValue(schema, v, "", &errs)
+	return errs
+}
+
+func checkValue(schema map[string]interface{}, v interface{}, path string, errs *[]FieldError) {
+	schema = resolve(schema)
+	if schema == nil {
+		return
+	}
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, FieldError{Field: path, Message: fmt.Sprintf(format, args...)})
+	}
+	if v == nil {
+		if nullable, _ := schema["nullable"].(bool); !nullable && schema["type"] != nil {
+			fail("must not be null")
+		}
+		return
+	}
+	if typ, ok := schema["type"].(string); ok && !hasType(v, typ) {
+		fail("must be %s %s, not %s", article(typ), typ, jsonType(v))
+		return
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok && !inEnum(enum, v) {
+		var names []string
+		for _, e := range enum {
+			names = append(names, fmt.Sprint(e))
+		}
+		fail("must be one of %s", strings.Join(names, ", "))
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := v[name.(string)]; !ok {
+					*errs = append(*errs, FieldError{Field: joinField(path, name.(string)), Message: "is required"})
+				}
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if prop, ok := properties[name].(map[string]interface{}); ok {
+				checkValue(prop, v[name], joinField(path, name), errs)
+			} else if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+				*errs = append(*errs, FieldError{Field: joinField(path, name), Message: "is not a known field"})
+			}
+		}
+
+	case []interface{}:
+		if min, ok := schema["minItems"].(float64); ok && float64(len(v)) < min {
+			fail("must have at least %v items", min)
+		}
+		if max, ok := schema["maxItems"].(float64); ok && float64(len(v)) > max {
+			fail("must have at most %v items", max)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, elem := range v {
+				checkValue(items, elem, fmt.Sprintf("%s[%d]", path, i), errs)
+			}
+		}
+
+	case json.Number:
+		n, _ := v.Float64()
+		if min, ok := schema["minimum"].(float64); ok {
+			if exclusive, _ := schema["exclusiveMinimum"].(bool); exclusive && n <= min {
+				fail("must be greater than %v", min)
+			} else if n < min {
+				fail("must be at least %v", min)
+			}
+		}
+		if max, ok := schema["maximum"].(float64); ok && n > max {
+			fail("must be at most %v", max)
+		}
+
+	case string:
+		if min, ok := schema["minLength"].(float64); ok && float64(len(v)) < min {
+			fail("must be at least %v characters", min)
+		}
+		if max, ok := schema["maxLength"].(float64); ok && float64(len(v)) > max {
+			fail("must be at most %v characters", max)
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, v); err != nil {
+				fail("must be an RFC 3339 date-time")
+			}
+		}
+	}
+}
+
+func hasType(v interface{}, typ string) bool {
+	if typ == "integer" {
+		n, ok := v.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Int64()
+		return err == nil
+	}
+	return jsonType(v) == typ
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "null"
+}
+
+func article(typ string) string {
+	if strings.IndexAny(typ[:1], "aeiou") == 0 {
+		return "an"
+	}
+	return "a"
+}
+
+func inEnum(enum []interface{}, v interface{}) bool {
+	for _, e := range enum {
+		if n, ok := v.(json.Number); ok {
+			if f, err := n.Float64(); err == nil && e == f {
+				return true
+			}
+		} else if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func joinField(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// decodeBody reads a JSON request body of at most limit bytes into v,
+// validating it against the operation's schema in the API description
+// first. If the body is invalid it writes a 400 response listing the
+// problems and returns false.
+func decodeBody(w http.ResponseWriter, r *http.Request, operation string, limit int64, v interface{}) bool {
+	raw, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		invalidBody(w, FieldError{Message: err.Error()})
+		return false
+	}
+	schema, err := requestSchema(operation)
+	if err != nil {
+		panic(err) // the API description is embedded; this is a bug
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		invalidBody(w, FieldError{Message: err.Error()})
+		return false
+	}
+	if errs := validateBody(schema, doc); len(errs) > 0 {
+		invalidBody(w, errs...)
+		return false
+	}
+	// what's left, such as values out of range for their Go types
+	if err := json.Unmarshal(raw, v); err != nil {
+		invalidBody(w, FieldError{Message: err.Error()})
+		return false
+	}
+	return true
+}
+
+func invalidBody(w http.ResponseWriter, errs ...FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(400)
+	writeJSON(w, &InvalidBody{Message: "Invalid request body", Errors: errs})
+}
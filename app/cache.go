@@ -0,0 +1,731 @@
+package app
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+var (
+	cacheRequests = newCounter("cache_requests_total",
+		"Weather cache lookups, by result.", "result")
+	cacheEvictions = newCounter("cache_evictions_total",
+		"Entries dropped from the weather cache, by reason.", "reason")
+	cacheEntries = newGauge("cache_entries",
+		"Entries in the weather cache.")
+	cacheBytes = newGauge("cache_bytes",
+		"Estimated memory used by the weather cache's entries.")
+)
+
+// cacheResult is how a cache lookup went, as reported in metrics and the
+// X-Cache header.
+type cacheResult string
+
+const (
+	cacheHit  cacheResult = "hit"
+	cacheMiss cacheResult = "miss"
+	// cacheStale is a hit on an entry older than the caller would normally
+	// accept, as served when we can't refresh it (in offline mode)
+	cacheStale cacheResult = "stale"
+)
+
+// cacheEntry is the cached current conditions at a location.
+type cacheEntry struct {
+	key       string
+	data      *models.CurrentConditions
+	fetchedAt time.Time
+	size      int64
+	hits      int64
+	lastHit   time.Time
+
+	elem  *list.Element // in lruPolicy's list
+	index int           // in lfuPolicy's heap
+}
+
+// lastUsed is when the entry was last read, or written if it never was.
+func (e *cacheEntry) lastUsed() time.Time {
+	if e.lastHit.After(e.fetchedAt) {
+		return e.lastHit
+	}
+	return e.fetchedAt
+}
+
+// weatherCache holds recently fetched conditions by location. Entries carry
+// the time they were fetched rather than a fixed expiry, so that each caller
+// can decide how old is too old (see tier).
+//
+// With maxEntries or maxBytes set, adding an entry past either bound evicts
+// others as the policy chooses, so that a scan of many unique locations
+// can't grow the cache without limit.
+type weatherCache struct {
+	maxEntries int   // 0 for no limit
+	maxBytes   int64 // likewise
+	policy     evictionPolicy
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	bytes   int64
+	watches map[string]*cacheWatch // by key, while anyone's waiting
+}
+
+// cacheWatch is a channel closed on the next Put of a key, with how many
+// are waiting on it.
+type cacheWatch struct {
+	next    chan struct{}
+	waiters int
+}
+
+// newWeatherCache returns an unbounded cache that, once bounded, evicts the
+// least recently used entries.
+func newWeatherCache() *weatherCache {
+	return &weatherCache{
+		entries: make(map[string]*cacheEntry),
+		watches: make(map[string]*cacheWatch),
+		policy:  newLRUPolicy(),
+	}
+}
+
+// evictionPolicy orders a cache's entries for eviction. The cache calls it
+// with c.mu held.
+type evictionPolicy interface {
+	added(e *cacheEntry)
+	used(e *cacheEntry)
+	removed(e *cacheEntry)
+	victim() *cacheEntry // nil if there are no entries
+}
+
+// lruPolicy evicts the least recently used entry.
+type lruPolicy struct {
+	order *list.List // most recently used first
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{order: list.New()}
+}
+
+func (p *lruPolicy) added(e *cacheEntry)   { e.elem = p.order.PushFront(e) }
+func (p *lruPolicy) used(e *cacheEntry)    { p.order.MoveToFront(e.elem) }
+func (p *lruPolicy) removed(e *cacheEntry) { p.order.Remove(e.elem) }
+
+func (p *lruPolicy) victim() *cacheEntry {
+	if back := p.order.Back(); back != nil {
+		return back.Value.(*cacheEntry)
+	}
+	return nil
+}
+
+// lfuPolicy evicts the least frequently used entry, the least recently
+// used of those if there's a tie. It suits a few hot locations amid a long
+// tail better than LRU does, at the cost of keeping entries that were
+// popular once.
+type lfuPolicy struct {
+	entries lfuHeap
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{}
+}
+
+func (p *lfuPolicy) added(e *cacheEntry)   { heap.Push(&p.entries, e) }
+func (p *lfuPolicy) used(e *cacheEntry)    { heap.Fix(&p.entries, e.index) }
+func (p *lfuPolicy) removed(e *cacheEntry) { heap.Remove(&p.entries, e.index) }
+
+func (p *lfuPolicy) victim() *cacheEntry {
+	if len(p.entries) == 0 {
+		return nil
+	}
+	return p.entries[0]
+}
+
+// lfuHeap is a min-heap of entries by use.
+type lfuHeap []*cacheEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].hits != h[j].hits {
+		return h[i].hits < h[j].hits
+	}
+	return h[i].lastUsed().Before(h[j].lastUsed())
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*cacheEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// Get returns the cached response for key and its age if it is no older
+// than staleAge, reporting it as stale if it's older than maxAge.
+func (c *weatherCache) Get(key string, maxAge, staleAge time.Duration) (*models.CurrentConditions, time.Duration, cacheResult) {
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	var age time.Duration
+	if ok {
+		if age = now.Sub(entry.fetchedAt); age <= staleAge {
+			entry.hits++
+			entry.lastHit = now
+			c.policy.used(entry)
+		}
+	}
+	c.mu.Unlock()
+
+	result := cacheHit
+	switch {
+	case !ok || age > staleAge:
+		result = cacheMiss
+	case age > maxAge:
+		result = cacheStale
+	}
+	cacheRequests.Inc(string(result))
+	if result == cacheMiss {
+		return nil, 0, result
+	}
+	return entry.data, age, result
+}
+
+// Put caches a freshly fetched response, evicting other entries if that
+// takes the cache past its bounds.
+func (c *weatherCache) Put(key string, data *models.CurrentConditions) {
+	entry := &cacheEntry{key: key, data: data, fetchedAt: time.Now(), size: entrySize(key, data)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[key]; ok {
+		entry.hits, entry.lastHit = old.hits, old.lastHit
+		c.remove(old)
+	}
+	c.entries[key] = entry
+	c.bytes += entry.size
+	// make room before the policy sees the new entry, which it might
+	// otherwise choose, having never been used
+	for c.overBounds() && len(c.entries) > 1 {
+		c.remove(c.policy.victim())
+		cacheEvictions.Inc("capacity")
+	}
+	c.policy.added(entry)
+	c.updateGauges()
+	if watch, ok := c.watches[key]; ok {
+		close(watch.next)
+		delete(c.watches, key)
+	}
+}
+
+// Watch returns what's cached for key, if anything, with when it was
+// fetched, and a channel that's closed when it's next replaced. It doesn't
+// count as a use of the entry. Call release when done waiting, so that
+// watches of keys that are never replaced don't pile up.
+func (c *weatherCache) Watch(key string) (data *models.CurrentConditions, fetchedAt time.Time, next <-chan struct{}, release func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok {
+		data, fetchedAt = entry.data, entry.fetchedAt
+	}
+	watch, ok := c.watches[key]
+	if !ok {
+		watch = &cacheWatch{next: make(chan struct{})}
+		c.watches[key] = watch
+	}
+	watch.waiters++
+	release = func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// after a Put the key may be watched afresh; leave that be
+		if watch.waiters--; watch.waiters == 0 && c.watches[key] == watch {
+			delete(c.watches, key)
+		}
+	}
+	return data, fetchedAt, watch.next, release
+}
+
+// overBounds reports whether the cache holds too much. The caller must hold
+// c.mu.
+func (c *weatherCache) overBounds() bool {
+	return c.maxEntries > 0 && len(c.entries) > c.maxEntries ||
+		c.maxBytes > 0 && c.bytes > c.maxBytes
+}
+
+// remove drops an entry. The caller must hold c.mu.
+func (c *weatherCache) remove(e *cacheEntry) {
+	delete(c.entries, e.key)
+	c.bytes -= e.size
+	c.policy.removed(e)
+}
+
+// updateGauges exports the cache's size. The caller must hold c.mu.
+func (c *weatherCache) updateGauges() {
+	cacheEntries.Set(float64(len(c.entries)))
+	cacheBytes.Set(float64(c.bytes))
+}
+
+// entrySize estimates the memory an entry holds: the structs plus the text
+// they point to.
+func entrySize(key string, data *models.CurrentConditions) int64 {
+	size := int64(unsafe.Sizeof(cacheEntry{})) + int64(unsafe.Sizeof(*data)) + int64(len(key))
+	for _, cond := range data.Conditions {
+		size += int64(unsafe.Sizeof(cond)) + int64(len(cond))
+	}
+	for _, alert := range data.Alerts {
+		size += int64(unsafe.Sizeof(alert)) + int64(len(alert.Event)+len(alert.Sender)+len(alert.Description))
+	}
+	if data.Temp != nil {
+		size += int64(unsafe.Sizeof(*data.Temp))
+	}
+	if data.FeelsLike != nil {
+		size += int64(unsafe.Sizeof(*data.FeelsLike))
+	}
+	return size
+}
+
+// expireEvery drops entries older than ttl, checking on the given interval,
+// until ctx is done.
+func (c *weatherCache) expireEvery(ctx context.Context, interval, ttl time.Duration) {
+	for range ticks(ctx, interval) {
+		c.mu.Lock()
+		for _, entry := range c.entries {
+			if time.Since(entry.fetchedAt) > ttl {
+				c.remove(entry)
+				cacheEvictions.Inc("expired")
+			}
+		}
+		c.updateGauges()
+		c.mu.Unlock()
+	}
+}
+
+// Kinds of cached response, each with its own TTL (see CACHE_TTLS).
+const (
+	cacheCurrent  = "current"
+	cacheForecast = "forecast"
+	cacheGeocode  = "geocode"
+	cacheAlerts   = "alerts"
+	cacheOverview = "overview"
+)
+
+// defaultCacheTTLs are how long each kind of response is cached for unless
+// configured otherwise. Forecasts are only updated every so often, and
+// places hardly ever move, but alerts must be fresh. Overviews describe the
+// whole day.
+var defaultCacheTTLs = map[string]time.Duration{
+	cacheCurrent:  10 * time.Minute,
+	cacheForecast: 30 * time.Minute,
+	cacheGeocode:  7 * 24 * time.Hour,
+	cacheAlerts:   time.Minute,
+	cacheOverview: time.Hour,
+}
+
+// parseCacheTTLs parses a CACHE_TTLS style spec ("kind=duration,..."),
+// overriding the defaults for the kinds it names. A TTL of 0 disables
+// caching of that kind.
+func parseCacheTTLs(spec string) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration, len(defaultCacheTTLs))
+	for kind, ttl := range defaultCacheTTLs {
+		ttls[kind] = ttl
+	}
+	for _, entry := range splitList(spec) {
+		i := strings.Index(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid cache TTL %q: want kind=duration", entry)
+		}
+		kind := entry[:i]
+		if _, ok := defaultCacheTTLs[kind]; !ok {
+			return nil, fmt.Errorf("unknown cache kind %q (want current, forecast, geocode, alerts or overview)", kind)
+		}
+		ttl, err := time.ParseDuration(entry[i+1:])
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid cache TTL %q: want a duration such as 30m", entry)
+		}
+		ttls[kind] = ttl
+	}
+	return ttls, nil
+}
+
+// responseCache holds provider responses other than current conditions,
+// which have weatherCache to themselves, for the TTL of their kind. A nil
+// responseCache caches nothing.
+type responseCache struct {
+	ttls       map[string]time.Duration
+	maxEntries int // 0 for no limit
+
+	mu      sync.Mutex
+	entries map[string]responseEntry // by kind and key
+}
+
+type responseEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func newResponseCache(ttls map[string]time.Duration, maxEntries int) *responseCache {
+	return &responseCache{ttls: ttls, maxEntries: maxEntries, entries: make(map[string]responseEntry)}
+}
+
+// TTL returns how long responses of a kind are cached for.
+func (rc *responseCache) TTL(kind string) time.Duration {
+	if rc == nil {
+		return 0
+	}
+	return rc.ttls[kind]
+}
+
+// Get returns the cached response of a kind for key, if it hasn't expired.
+func (rc *responseCache) Get(kind, key string) (interface{}, bool) {
+	if rc == nil || rc.ttls[kind] == 0 {
+		return nil, false
+	}
+	rc.mu.Lock()
+	entry, ok := rc.entries[kind+" "+key]
+	rc.mu.Unlock()
+	if !ok || time.Now().After(entry.expires) {
+		cacheRequests.Inc(kind + "_miss")
+		return nil, false
+	}
+	cacheRequests.Inc(kind + "_hit")
+	return entry.value, true
+}
+
+// Put caches a response of a kind for key. When full, expired entries are
+// dropped, and failing that the one closest to expiring.
+func (rc *responseCache) Put(kind, key string, value interface{}) {
+	if rc == nil || rc.ttls[kind] == 0 {
+		return
+	}
+	now := time.Now()
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	k := kind + " " + key
+	if _, ok := rc.entries[k]; !ok && rc.maxEntries > 0 && len(rc.entries) >= rc.maxEntries {
+		rc.expire(now)
+		if len(rc.entries) >= rc.maxEntries {
+			var soonest string
+			for k, entry := range rc.entries {
+				if soonest == "" || entry.expires.Before(rc.entries[soonest].expires) {
+					soonest = k
+				}
+			}
+			delete(rc.entries, soonest)
+			cacheEvictions.Inc("capacity")
+		}
+	}
+	rc.entries[k] = responseEntry{value: value, expires: now.Add(rc.ttls[kind])}
+}
+
+// expire drops expired entries. The caller must hold rc.mu.
+func (rc *responseCache) expire(now time.Time) {
+	for k, entry := range rc.entries {
+		if now.After(entry.expires) {
+			delete(rc.entries, k)
+			cacheEvictions.Inc("expired")
+		}
+	}
+}
+
+// expireEvery drops expired entries on the given interval until ctx is
+// done.
+func (rc *responseCache) expireEvery(ctx context.Context, interval time.Duration) {
+	for range ticks(ctx, interval) {
+		rc.mu.Lock()
+		rc.expire(time.Now())
+		rc.mu.Unlock()
+	}
+}
+
+// forecast returns the forecast blocks for a location, cached.
+func (s *server) forecast(lat, lon string, blocks []string) (*OWMForecastResponse, error) {
+	sorted := append([]string(nil), blocks...)
+	sort.Strings(sorted)
+	key := locationCacheKey(lat, lon) + " " + strings.Join(sorted, ",")
+	if v, ok := s.responses.Get(cacheForecast, key); ok {
+		return v.(*OWMForecastResponse), nil
+	}
+	data, err := s.owm.GetForecast(lat, lon, blocks)
+	if err != nil {
+		return nil, err
+	}
+	s.responses.Put(cacheForecast, key, data)
+	return data, nil
+}
+
+// geocode returns the places matching a query, cached.
+func (s *server) geocode(query string) ([]OWMGeocodeResult, error) {
+	key := strings.ToLower(strings.Join(strings.Fields(query), " "))
+	if v, ok := s.responses.Get(cacheGeocode, key); ok {
+		return v.([]OWMGeocodeResult), nil
+	}
+	results, err := s.owm.Geocode(query)
+	if err != nil {
+		return nil, err
+	}
+	s.responses.Put(cacheGeocode, key, results)
+	return results, nil
+}
+
+// nwsAlerts returns the NWS alerts in effect at a location, cached.
+func (s *server) nwsAlerts(lat, lon string) ([]NWSAlert, error) {
+	key := locationCacheKey(lat, lon)
+	if v, ok := s.responses.Get(cacheAlerts, key); ok {
+		return v.([]NWSAlert), nil
+	}
+	alerts, err := s.nws.GetAlerts(lat, lon)
+	if err != nil {
+		return nil, err
+	}
+	s.responses.Put(cacheAlerts, key, alerts)
+	return alerts, nil
+}
+
+// locationCacheKey is the key of a location's cached responses: coordinates
+// that parse are normalized, so equivalent spellings share an entry.
+func locationCacheKey(lat, lon string) string {
+	if loc, err := models.ParseLocation(lat, lon); err == nil {
+		return loc.Key()
+	}
+	return lat + "," + lon
+}
+
+// negativeCache remembers requests the provider rejected as invalid, such as
+// for coordinates that don't exist, so that a client repeating one doesn't
+// cost an upstream call each time. A nil negativeCache remembers nothing.
+type negativeCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]negativeEntry
+}
+
+type negativeEntry struct {
+	err     error
+	expires time.Time
+}
+
+func newNegativeCache(ttl time.Duration, maxEntries int) *negativeCache {
+	return &negativeCache{ttl: ttl, maxEntries: maxEntries, entries: make(map[string]negativeEntry)}
+}
+
+// Get returns the error remembered for key, if it hasn't expired.
+func (nc *negativeCache) Get(key string) (error, bool) {
+	if nc == nil {
+		return nil, false
+	}
+	nc.mu.Lock()
+	entry, ok := nc.entries[key]
+	nc.mu.Unlock()
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	cacheRequests.Inc("negative_hit")
+	return entry.err, true
+}
+
+// Put remembers err for key. When full, expired entries are dropped and, if
+// that's not enough, an arbitrary one: these are cheap to lose.
+func (nc *negativeCache) Put(key string, err error) {
+	if nc == nil {
+		return
+	}
+	now := time.Now()
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if _, ok := nc.entries[key]; !ok && len(nc.entries) >= nc.maxEntries {
+		for k, entry := range nc.entries {
+			if now.After(entry.expires) {
+				delete(nc.entries, k)
+			}
+		}
+		for k := range nc.entries {
+			if len(nc.entries) < nc.maxEntries {
+				break
+			}
+			delete(nc.entries, k)
+		}
+	}
+	nc.entries[key] = negativeEntry{err: err, expires: now.Add(nc.ttl)}
+}
+
+// cacheKeyStats describes a cache entry for the admin API.
+type cacheKeyStats struct {
+	Key       string     `json:"key"`
+	Hits      int64      `json:"hits"`
+	FetchedAt time.Time  `json:"fetched_at"`
+	LastHit   *time.Time `json:"last_hit,omitempty"`
+	Bytes     int64      `json:"bytes"`
+}
+
+// Hottest returns up to n entries with the most hits since they were first
+// cached, most first.
+func (c *weatherCache) Hottest(n int) []cacheKeyStats {
+	c.mu.Lock()
+	stats := make([]cacheKeyStats, 0, len(c.entries))
+	for key, entry := range c.entries {
+		s := cacheKeyStats{Key: key, Hits: entry.hits, FetchedAt: entry.fetchedAt.UTC(), Bytes: entry.size}
+		if !entry.lastHit.IsZero() {
+			lastHit := entry.lastHit.UTC()
+			s.LastHit = &lastHit
+		}
+		stats = append(stats, s)
+	}
+	c.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Hits != stats[j].Hits {
+			return stats[i].Hits > stats[j].Hits
+		}
+		return stats[i].Key < stats[j].Key
+	})
+	if len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+// Size returns the number of entries and their estimated memory use.
+func (c *weatherCache) Size() (int, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries), c.bytes
+}
+
+// cacheHandler serves cache statistics and the hottest keys:
+//
+//	GET /admin/cache?limit=N
+func (s *server) cacheHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+	limit := 20
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > 1000 {
+			w.WriteHeader(400)
+			w.Write([]byte("limit must be between 1 and 1000"))
+			return
+		}
+		limit = n
+	}
+	entries, bytes := s.cache.Size()
+	writeJSON(w, struct {
+		Entries int             `json:"entries"`
+		Bytes   int64           `json:"bytes"`
+		Hottest []cacheKeyStats `json:"hottest"`
+	}{entries, bytes, s.cache.Hottest(limit)})
+}
+
+// cacheStatus collects the results of the cache lookups made for a request,
+// for the X-Cache header and response metadata.
+type cacheStatus struct {
+	mu     sync.Mutex
+	result cacheResult   // "" until a lookup is made
+	age    time.Duration // of the oldest entry served
+}
+
+type cacheStatusKey struct{}
+
+// record notes a lookup's result. A request that made several lookups is
+// only as cached as its least cached one.
+func (cs *cacheStatus) record(result cacheResult, age time.Duration) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if age > cs.age {
+		cs.age = age
+	}
+	switch {
+	case cs.result == "", result == cacheMiss:
+		cs.result = result
+	case result == cacheStale && cs.result == cacheHit:
+		cs.result = result
+	}
+}
+
+func (cs *cacheStatus) get() (cacheResult, time.Duration) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.result, cs.age
+}
+
+func (cs *cacheStatus) header() string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	switch cs.result {
+	case cacheHit:
+		return "HIT"
+	case cacheMiss:
+		return "MISS"
+	case cacheStale:
+		return "STALE"
+	}
+	return ""
+}
+
+// recordCacheResult notes a lookup's result, and the age of the entry
+// served, against the request ctx belongs to, if any.
+func recordCacheResult(ctx context.Context, result cacheResult, age time.Duration) {
+	if cs, ok := ctx.Value(cacheStatusKey{}).(*cacheStatus); ok {
+		cs.record(result, age)
+	}
+}
+
+// cacheHeaders sets X-Cache on responses that were served from, or past, the
+// weather cache: HIT, MISS or STALE.
+func cacheHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cs := &cacheStatus{}
+		ctx := context.WithValue(r.Context(), cacheStatusKey{}, cs)
+		h.ServeHTTP(&cacheHeaderWriter{ResponseWriter: w, status: cs}, r.WithContext(ctx))
+	})
+}
+
+// cacheHeaderWriter adds X-Cache as the response header is written.
+type cacheHeaderWriter struct {
+	http.ResponseWriter
+	status      *cacheStatus
+	wroteHeader bool
+}
+
+func (cw *cacheHeaderWriter) WriteHeader(status int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		if v := cw.status.header(); v != "" {
+			cw.Header().Set("X-Cache", v)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *cacheHeaderWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(200)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush lets streaming handlers flush through the writer.
+func (cw *cacheHeaderWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,177 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+const icsTimeFormat = "20060102T150405Z"
+
+// calendarHandler serves an iCalendar (RFC 5545) feed for a location, for
+// calendar apps to subscribe to: an all-day event per forecast day, events
+// at sunrise and sunset, and an event spanning each alert's window. Calendar
+// apps can't set headers, so subscribers pass their key as ?api_key=.
+func (s *server) calendarHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lat, lon, _ := s.requestLocation(r, q)
+	loc, err := models.ParseLocation(lat, lon)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	data, err := s.forecast(lat, lon, []string{"daily"})
+	if err != nil {
+		s.upstreamFailed(err)
+		s.upstreamError(w, r, err)
+		return
+	}
+	alerts, err := s.locationAlerts(r.Context(), lat, lon)
+	if err != nil {
+		s.upstreamError(w, r, err)
+		return
+	}
+
+	stop := timePhase(r.Context(), phaseRender)
+	cal := newCalendar(loc, time.Now())
+	for _, day := range newOWMForecast(data).Daily {
+		cal.addDay(day)
+	}
+	for _, alert := range alerts {
+		cal.addAlert(alert)
+	}
+	body := cal.bytes()
+	stop()
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="weather.ics"`)
+	w.Write(body)
+}
+
+// calendar builds an iCalendar document for a location.
+type calendar struct {
+	buf   bytes.Buffer
+	loc   models.Location
+	stamp string
+}
+
+func newCalendar(loc models.Location, now time.Time) *calendar {
+	c := &calendar{loc: loc, stamp: now.UTC().Format(icsTimeFormat)}
+	c.line("BEGIN:VCALENDAR")
+	c.line("VERSION:2.0")
+	c.line("PRODID:-//banno-project//weather//EN")
+	c.line("CALSCALE:GREGORIAN")
+	c.line("METHOD:PUBLISH")
+	c.line("X-WR-CALNAME:" + icsEscape("Weather at "+loc.Key()))
+	// ask subscribers to refresh at least as often as the forecast changes
+	c.line("REFRESH-INTERVAL;VALUE=DURATION:PT3H")
+	c.line("X-PUBLISHED-TTL:PT3H")
+	return c
+}
+
+// uid derives a stable event UID, so refreshing the feed updates events
+// rather than duplicating them.
+func (c *calendar) uid(kind, id string) string {
+	return icsEscape(fmt.Sprintf("%s-%s-%s@banno-project", kind, id, c.loc.Key()))
+}
+
+// addDay adds an all-day event with the day's highlights, and events at
+// sunrise and sunset.
+func (c *calendar) addDay(day models.ForecastDay) {
+	date, err := time.Parse("2006-01-02", day.Date)
+	if err != nil {
+		return
+	}
+	summary := fmt.Sprintf("%s / %s", day.High.In(models.Fahrenheit), day.Low.In(models.Fahrenheit))
+	if len(day.Conditions) > 0 {
+		summary += ", " + strings.Join(day.Conditions, ", ")
+	}
+	if day.PrecipitationChance >= 0.3 {
+		summary += fmt.Sprintf(", %.0f%% chance of precipitation", day.PrecipitationChance*100)
+	}
+	c.line("BEGIN:VEVENT")
+	c.line("UID:" + c.uid("day", day.Date))
+	c.line("DTSTAMP:" + c.stamp)
+	c.line("DTSTART;VALUE=DATE:" + date.Format("20060102"))
+	c.line("DTEND;VALUE=DATE:" + date.AddDate(0, 0, 1).Format("20060102"))
+	c.line("SUMMARY:" + icsEscape(summary))
+	c.line("TRANSP:TRANSPARENT")
+	c.line("END:VEVENT")
+
+	for _, sun := range []struct {
+		name string
+		t    *time.Time
+	}{{"Sunrise", day.Sunrise}, {"Sunset", day.Sunset}} {
+		if sun.t == nil {
+			continue
+		}
+		c.line("BEGIN:VEVENT")
+		c.line("UID:" + c.uid(strings.ToLower(sun.name), day.Date))
+		c.line("DTSTAMP:" + c.stamp)
+		c.line("DTSTART:" + sun.t.UTC().Format(icsTimeFormat))
+		c.line("DTEND:" + sun.t.UTC().Format(icsTimeFormat))
+		c.line("SUMMARY:" + sun.name)
+		c.line("TRANSP:TRANSPARENT")
+		c.line("END:VEVENT")
+	}
+}
+
+// addAlert adds an event spanning an alert's window. Alerts without one
+// are left out.
+func (c *calendar) addAlert(alert models.Alert) {
+	if alert.Start.IsZero() || alert.End.Before(alert.Start) {
+		return
+	}
+	c.line("BEGIN:VEVENT")
+	c.line("UID:" + c.uid("alert", alert.Event+"-"+alert.Start.UTC().Format(icsTimeFormat)))
+	c.line("DTSTAMP:" + c.stamp)
+	c.line("DTSTART:" + alert.Start.UTC().Format(icsTimeFormat))
+	c.line("DTEND:" + alert.End.UTC().Format(icsTimeFormat))
+	c.line("SUMMARY:" + icsEscape(alert.Event))
+	var desc []string
+	for _, part := range []string{alert.Headline, alert.Description, alert.Sender} {
+		if part = strings.TrimSpace(part); part != "" {
+			desc = append(desc, part)
+		}
+	}
+	if len(desc) > 0 {
+		c.line("DESCRIPTION:" + icsEscape(strings.Join(desc, "\n\n")))
+	}
+	c.line("CATEGORIES:WEATHER ALERT")
+	c.line("END:VEVENT")
+}
+
+// bytes finishes the calendar and returns it.
+func (c *calendar) bytes() []byte {
+	c.line("END:VCALENDAR")
+	return c.buf.Bytes()
+}
+
+// line writes a content line, folded at 75 octets as RFC 5545 requires
+// without splitting a UTF-8 sequence.
+func (c *calendar) line(s string) {
+	max := 75
+	for len(s) > max {
+		n := max
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		c.buf.WriteString(s[:n])
+		c.buf.WriteString("\r\n ")
+		s = s[n:]
+		max = 74 // continuations start with a space
+	}
+	c.buf.WriteString(s)
+	c.buf.WriteString("\r\n")
+}
+
+// icsEscape escapes a TEXT value.
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,454 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+var capAlerts = newCounter("cap_alerts_total",
+	"CAP alerts ingested, by source and result.", "source", "result")
+
+// maxCAPBody bounds the size of a CAP document.
+const maxCAPBody = 1 << 20
+
+// capAlert is the subset of a CAP 1.2 alert that we use.
+type capAlert struct {
+	Identifier string    `xml:"identifier"`
+	Sender     string    `xml:"sender"`
+	Sent       time.Time `xml:"sent"`
+	Status     string    `xml:"status"`  // "Actual", "Exercise", "Test", ...
+	MsgType    string    `xml:"msgType"` // "Alert", "Update" or "Cancel"
+	References string    `xml:"references"`
+	Info       []struct {
+		Language    string `xml:"language"`
+		Event       string `xml:"event"`
+		Severity    string `xml:"severity"`
+		Headline    string `xml:"headline"`
+		Description string `xml:"description"`
+		SenderName  string `xml:"senderName"`
+		Effective   string `xml:"effective"`
+		Onset       string `xml:"onset"`
+		Expires     string `xml:"expires"`
+		Area        []struct {
+			Polygon []string `xml:"polygon"`
+			Circle  []string `xml:"circle"`
+		} `xml:"area"`
+	} `xml:"info"`
+}
+
+// parseCAP parses a CAP alert.
+func parseCAP(r io.Reader) (*capAlert, error) {
+	var alert capAlert
+	if err := xml.NewDecoder(r).Decode(&alert); err != nil {
+		return nil, err
+	}
+	if alert.Identifier == "" {
+		return nil, fmt.Errorf("not a CAP alert: no identifier")
+	}
+	return &alert, nil
+}
+
+// referencedIDs returns the identifiers of the alerts a CAP alert updates
+// or cancels. References are "sender,identifier,sent" triples separated by
+// spaces.
+func (c *capAlert) referencedIDs() []string {
+	var ids []string
+	for _, ref := range strings.Fields(c.References) {
+		if parts := strings.Split(ref, ","); len(parts) == 3 {
+			ids = append(ids, parts[1])
+		}
+	}
+	return ids
+}
+
+// alerts converts a CAP alert to our alerts, one per info block, skipping
+// those in languages other than English when there's a choice.
+func (c *capAlert) alerts(source string) ([]models.Alert, error) {
+	var alerts []models.Alert
+	english := false
+	for _, info := range c.Info {
+		if strings.HasPrefix(strings.ToLower(info.Language), "en") || info.Language == "" {
+			english = true
+		}
+	}
+	for _, info := range c.Info {
+		if english && info.Language != "" && !strings.HasPrefix(strings.ToLower(info.Language), "en") {
+			continue
+		}
+		alert := models.Alert{
+			Event:       info.Event,
+			Sender:      info.SenderName,
+			Severity:    info.Severity,
+			Headline:    info.Headline,
+			Description: info.Description,
+			Start:       c.Sent.UTC(),
+			Source:      source,
+		}
+		if alert.Sender == "" {
+			alert.Sender = c.Sender
+		}
+		// like NWS alerts, start at the onset if there is one
+		for _, raw := range []string{info.Effective, info.Onset} {
+			if raw == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid time %q", raw)
+			}
+			alert.Start = t.UTC()
+		}
+		if info.Expires != "" {
+			t, err := time.Parse(time.RFC3339, info.Expires)
+			if err != nil {
+				return nil, fmt.Errorf("invalid time %q", info.Expires)
+			}
+			alert.End = t.UTC()
+		}
+
+		var polygons [][][][2]float64
+		for _, area := range info.Area {
+			for _, raw := range area.Polygon {
+				ring, err := parseCAPPolygon(raw)
+				if err != nil {
+					return nil, err
+				}
+				polygons = append(polygons, [][][2]float64{ring})
+			}
+			for _, raw := range area.Circle {
+				ring, err := parseCAPCircle(raw)
+				if err != nil {
+					return nil, err
+				}
+				polygons = append(polygons, [][][2]float64{ring})
+			}
+		}
+		if len(polygons) > 0 {
+			alert.Geometry, _ = json.Marshal(map[string]interface{}{"type": "MultiPolygon", "coordinates": polygons})
+		}
+		alerts = append(alerts, alert)
+	}
+	return alerts, nil
+}
+
+// parseCAPPolygon parses a CAP polygon, "lat,lon" pairs separated by
+// spaces, into a GeoJSON ring.
+func parseCAPPolygon(raw string) ([][2]float64, error) {
+	var ring [][2]float64
+	for _, pair := range strings.Fields(raw) {
+		loc, err := models.ParseLocationPair(pair)
+		if err != nil {
+			return nil, fmt.Errorf("invalid polygon: %s", err)
+		}
+		ring = append(ring, [2]float64{loc.Lon, loc.Lat})
+	}
+	if len(ring) < 4 {
+		return nil, fmt.Errorf("invalid polygon: want at least 4 points")
+	}
+	return ring, nil
+}
+
+// parseCAPCircle parses a CAP circle, "lat,lon radius" with the radius in
+// km, into a GeoJSON ring approximating it.
+func parseCAPCircle(raw string) ([][2]float64, error) {
+	fields := strings.Fields(raw)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid circle %q", raw)
+	}
+	center, err := models.ParseLocationPair(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid circle: %s", err)
+	}
+	radius, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || radius <= 0 {
+		return nil, fmt.Errorf("invalid circle radius %q", fields[1])
+	}
+	const points = 32
+	dLat := radius / 111.32
+	dLon := dLat / math.Cos(center.Lat*math.Pi/180)
+	ring := make([][2]float64, 0, points+1)
+	for i := 0; i <= points; i++ {
+		theta := 2 * math.Pi * float64(i%points) / points
+		ring = append(ring, [2]float64{center.Lon + dLon*math.Cos(theta), center.Lat + dLat*math.Sin(theta)})
+	}
+	return ring, nil
+}
+
+// capStore holds the CAP alerts in effect, so they can be served and
+// notified without waiting for a provider to report them.
+type capStore struct {
+	mu     sync.Mutex
+	alerts map[string][]models.Alert // by CAP identifier
+}
+
+func newCAPStore() *capStore {
+	return &capStore{alerts: make(map[string][]models.Alert)}
+}
+
+// Put stores the alerts from a CAP alert, replacing those it updates or
+// cancels. It reports whether the alert is new to us.
+func (cs *capStore) Put(c *capAlert, alerts []models.Alert) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, id := range c.referencedIDs() {
+		delete(cs.alerts, id)
+	}
+	_, seen := cs.alerts[c.Identifier]
+	if c.MsgType == "Cancel" {
+		delete(cs.alerts, c.Identifier)
+		return false
+	}
+	cs.alerts[c.Identifier] = alerts
+	return !seen
+}
+
+// At returns the alerts in effect at a location.
+func (cs *capStore) At(loc models.Location, now time.Time) []models.Alert {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var out []models.Alert
+	for id, alerts := range cs.alerts {
+		expired := true
+		for _, alert := range alerts {
+			if alert.End.IsZero() || alert.End.After(now) {
+				expired = false
+			}
+			if !alert.End.IsZero() && !alert.End.After(now) {
+				continue
+			}
+			if alert.Geometry == nil {
+				continue
+			}
+			if inside, err := geometryContains(alert.Geometry, loc.Lon, loc.Lat); err == nil && inside {
+				out = append(out, alert)
+			}
+		}
+		if expired {
+			delete(cs.alerts, id)
+		}
+	}
+	return out
+}
+
+// ingestCAP takes in a CAP alert from source, pushing new ones straight to
+// the subscriptions in their area. Exercises and tests are ignored.
+func (s *server) ingestCAP(c *capAlert, source string) (int, error) {
+	if c.Status != "Actual" {
+		capAlerts.Inc(source, "ignored")
+		return 0, nil
+	}
+	alerts, err := c.alerts(source)
+	if err != nil {
+		capAlerts.Inc(source, "invalid")
+		return 0, err
+	}
+	if !s.cap.Put(c, alerts) {
+		capAlerts.Inc(source, "seen")
+		return 0, nil
+	}
+	capAlerts.Inc(source, "new")
+
+	notified := 0
+	for _, alert := range alerts {
+		if alert.Geometry == nil {
+			// no area to match subscriptions to; they'll hear about it
+			// from their provider
+			continue
+		}
+		key := alertKey(alert)
+		for _, sub := range s.subscriptions.All() {
+			if sub.rule() != "alerts" || containsString(sub.Notified, key) {
+				continue
+			}
+			inside, err := geometryContains(alert.Geometry, sub.Lon, sub.Lat)
+			if err != nil || !inside {
+				continue
+			}
+			s.deliverAlert(sub, alert)
+			if err := s.subscriptions.AddNotified(sub.ID, key); err != nil {
+				s.logger.Printf("Failed to save subscription %s: %s", sub.ID, err)
+			}
+			notified++
+		}
+	}
+	return notified, nil
+}
+
+// capIngestHandler receives CAP alerts pushed to us, authenticated with
+// CAP_INGEST_TOKEN as a bearer token. ?source= names the feed (by default
+// "cap"); naming it after the provider (e.g. "nws") lets us recognize its
+// alerts when the provider reports them too.
+func (s *server) capIngestHandler(w http.ResponseWriter, r *http.Request) {
+	if s.capIngestToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.capIngestToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(401)
+		w.Write([]byte("Unauthorized"))
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	source := r.URL.Query().Get("source")
+	if source == "" {
+		source = "cap"
+	}
+
+	c, err := parseCAP(io.LimitReader(r.Body, maxCAPBody))
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid CAP alert: %s", err)
+		return
+	}
+	notified, err := s.ingestCAP(c, source)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid CAP alert: %s", err)
+		return
+	}
+	w.WriteHeader(202)
+	writeJSON(w, &struct {
+		Identifier string `json:"identifier"`
+		Notified   int    `json:"notified"`
+	}{c.Identifier, notified})
+}
+
+// capFeed is a CAP Atom feed we poll.
+type capFeed struct {
+	name string
+	url  string
+	// seen holds the entries we've fetched, by ID, with when they were
+	// last updated
+	seen map[string]string
+}
+
+// parseCAPFeeds parses CAP_FEEDS: comma-separated "name=url" pairs.
+func parseCAPFeeds(raw string) ([]*capFeed, error) {
+	var feeds []*capFeed
+	for _, pair := range splitList(raw) {
+		// URLs may contain "=", names may not
+		i := strings.Index(pair, "=")
+		if i <= 0 || i == len(pair)-1 {
+			return nil, fmt.Errorf("want name=url, got %q", pair)
+		}
+		feeds = append(feeds, &capFeed{name: pair[:i], url: pair[i+1:], seen: make(map[string]string)})
+	}
+	return feeds, nil
+}
+
+// atomFeed is the subset of an Atom feed of CAP alerts that we use.
+type atomFeed struct {
+	Entries []struct {
+		ID      string `xml:"id"`
+		Updated string `xml:"updated"`
+		Links   []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+			Type string `xml:"type,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+// capGet fetches a CAP document.
+func (s *server) capGet(url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/cap+xml, application/atom+xml;q=0.9, application/xml;q=0.8")
+	resp, err := s.capValidators.Do(s.capClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxCAPBody*10))
+}
+
+// pollCAPFeed fetches the new and updated entries in a feed and ingests
+// them.
+func (s *server) pollCAPFeed(feed *capFeed) error {
+	body, err := s.capGet(feed.url)
+	if err != nil {
+		return err
+	}
+	var atom atomFeed
+	if err := xml.Unmarshal(body, &atom); err != nil {
+		return fmt.Errorf("invalid feed: %s", err)
+	}
+
+	current := make(map[string]bool, len(atom.Entries))
+	for _, entry := range atom.Entries {
+		current[entry.ID] = true
+		if feed.seen[entry.ID] == entry.Updated {
+			continue
+		}
+		href := ""
+		for _, link := range entry.Links {
+			if link.Rel == "" || link.Rel == "alternate" || link.Type == "application/cap+xml" {
+				href = link.Href
+			}
+		}
+		if href == "" {
+			href = entry.ID
+		}
+		doc, err := s.capGet(href)
+		if err != nil {
+			s.logger.Printf("Failed to fetch CAP alert %s: %s", href, err)
+			continue
+		}
+		c, err := parseCAP(bytes.NewReader(doc))
+		if err == nil {
+			_, err = s.ingestCAP(c, feed.name)
+		}
+		if err != nil {
+			s.logger.Printf("Invalid CAP alert %s: %s", href, err)
+		}
+		feed.seen[entry.ID] = entry.Updated
+	}
+	// forget entries that have left the feed
+	for id := range feed.seen {
+		if !current[id] {
+			delete(feed.seen, id)
+		}
+	}
+	return nil
+}
+
+// pollCAPFeedsEvery polls the CAP feeds every interval until ctx is done.
+// Only the leader polls, as only it notifies.
+func (s *server) pollCAPFeedsEvery(ctx context.Context, feeds []*capFeed, interval time.Duration) {
+	for {
+		if s.leader.IsLeader() {
+			for _, feed := range feeds {
+				if err := s.pollCAPFeed(feed); err != nil {
+					s.logger.Printf("Failed to poll CAP feed %s: %s", feed.name, err)
+				}
+			}
+		}
+		if !sleep(ctx, interval) {
+			return
+		}
+	}
+}
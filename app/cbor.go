@@ -0,0 +1,110 @@
+package app
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// cborContentType is the media type of CBOR (RFC 8949) responses: the JSON
+// data model in a binary encoding that small devices can decode without a
+// text parser. Any JSON response is available as CBOR to a client that asks
+// for it with Accept: application/cbor.
+const cborContentType = "application/cbor"
+
+// CBOR major types.
+const (
+	cborUnsigned = 0
+	cborNegative = 1
+	cborText     = 3
+	cborArray    = 4
+	cborMap      = 5
+)
+
+// encodeCBOR encodes a JSON document, as decoded with UseNumber, in CBOR.
+// Map keys are in the deterministic order RFC 8949 describes, so that the
+// same document always encodes the same way.
+func encodeCBOR(buf []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, 0xf6), nil
+	case bool:
+		if v {
+			return append(buf, 0xf5), nil
+		}
+		return append(buf, 0xf4), nil
+	case string:
+		buf = cborHead(buf, cborText, uint64(len(v)))
+		return append(buf, v...), nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			if n < 0 {
+				return cborHead(buf, cborNegative, uint64(-1-n)), nil
+			}
+			return cborHead(buf, cborUnsigned, uint64(n)), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		var b [9]byte
+		b[0] = 0xfb // a double
+		binary.BigEndian.PutUint64(b[1:], math.Float64bits(f))
+		return append(buf, b[:]...), nil
+	case []interface{}:
+		buf = cborHead(buf, cborArray, uint64(len(v)))
+		for _, elem := range v {
+			var err error
+			if buf, err = encodeCBOR(buf, elem); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		// shorter keys encode shorter, so sort first by length
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+		buf = cborHead(buf, cborMap, uint64(len(v)))
+		for _, key := range keys {
+			buf = cborHead(buf, cborText, uint64(len(key)))
+			buf = append(buf, key...)
+			var err error
+			if buf, err = encodeCBOR(buf, v[key]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("can't encode %T in CBOR", v)
+}
+
+// cborHead encodes the head of a data item: its major type and argument.
+func cborHead(buf []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(buf, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		buf = append(buf, major|25, 0, 0)
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(n))
+	case n <= math.MaxUint32:
+		buf = append(buf, major|26, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(n))
+	default:
+		buf = append(buf, major|27, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[len(buf)-8:], n)
+	}
+	return buf
+}
@@ -0,0 +1,240 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// contextKey namespaces values stored in request contexts.
+type contextKey int
+
+const (
+	clientContextKey contextKey = iota
+	clientIPContextKey
+	providerContextKey
+	requestIDContextKey
+	maxAgeContextKey
+)
+
+// tier is a class of API client. Tiers differ in how stale the data they
+// are served may be.
+type tier struct {
+	Name   string
+	MaxAge time.Duration
+}
+
+// apiClient is a caller identified by API key.
+type apiClient struct {
+	ID         string // stable across secret rotations
+	Tier       *tier
+	DailyQuota int      // 0 means unlimited
+	Shape      keyShape // overrides the default response shape
+}
+
+// clientRegistry authenticates API keys, which come from a static list
+// (CLIENT_KEYS) and, optionally, a managed key store. With no static keys
+// and no key store the service is open, and every caller is treated as an
+// anonymous client. That's decided once, from the configuration: with a key
+// store the service stays closed even while it holds no active keys, so
+// revoking the last one doesn't open it up.
+type clientRegistry struct {
+	tiers     map[string]*tier
+	keys      map[string]*apiClient
+	store     *keyStore // optional
+	anonymous *apiClient
+	open      bool
+
+	mu       sync.Mutex
+	usageDay string
+	usage    map[string]int
+}
+
+// newClientRegistry parses a CLIENT_KEYS style spec ("key:tier,key:tier").
+func newClientRegistry(spec string, tiers map[string]*tier, anonymousTier string, anonymousQuota int, store *keyStore) (*clientRegistry, error) {
+	reg := &clientRegistry{
+		tiers: tiers,
+		keys:  make(map[string]*apiClient),
+		store: store,
+		usage: make(map[string]int),
+	}
+
+	anon, ok := tiers[anonymousTier]
+	if !ok {
+		return nil, fmt.Errorf("unknown tier %q", anonymousTier)
+	}
+	reg.anonymous = &apiClient{Tier: anon, DailyQuota: anonymousQuota}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid client key entry %q: want key:tier", entry)
+		}
+		t, ok := tiers[parts[1]]
+		if !ok {
+			return nil, fmt.Errorf("unknown tier %q for client key", parts[1])
+		}
+		// the ID must not reveal the key, since it shows up in tokens and logs
+		reg.keys[parts[0]] = &apiClient{ID: staticClientID(parts[0]), Tier: t}
+	}
+	reg.open = len(reg.keys) == 0 && store == nil
+	return reg, nil
+}
+
+// staticClientID derives the client ID for a CLIENT_KEYS entry.
+func staticClientID(key string) string {
+	return "static-" + hashSecret(key)[:12]
+}
+
+// Lookup returns the client for key, or nil if the key is unknown.
+func (reg *clientRegistry) Lookup(key string) *apiClient {
+	if client, ok := reg.keys[key]; ok {
+		return client
+	}
+	if reg.store != nil {
+		if rec, ok := reg.store.Find(key); ok {
+			return reg.managed(rec)
+		}
+	}
+	if reg.open {
+		return reg.anonymous
+	}
+	return nil
+}
+
+// managed returns the client for a managed key.
+func (reg *clientRegistry) managed(rec keyRecord) *apiClient {
+	t, ok := reg.tiers[rec.Tier]
+	if !ok {
+		t = reg.anonymous.Tier
+	}
+	return &apiClient{ID: rec.ID, Tier: t, DailyQuota: rec.DailyQuota, Shape: rec.keyShape}
+}
+
+// LookupID returns the active client with the given ID, or nil. It is used
+// to resolve bearer tokens, so that revoking a key also invalidates the
+// tokens issued for it.
+func (reg *clientRegistry) LookupID(id string) *apiClient {
+	for _, client := range reg.keys {
+		if client.ID == id {
+			return client
+		}
+	}
+	if reg.store != nil {
+		if rec, ok := reg.store.Get(id); ok && rec.RevokedAt == nil {
+			return reg.managed(rec)
+		}
+	}
+	return nil
+}
+
+// Allow counts a request against the client's daily quota, reporting
+// whether it is within the quota. Anonymous callers are counted by IP
+// address rather than collectively. Usage resets at midnight UTC.
+func (reg *clientRegistry) Allow(client *apiClient, ip net.IP) bool {
+	if client.DailyQuota == 0 {
+		return true
+	}
+	id := client.ID
+	if client == reg.anonymous {
+		id = "ip:" + ip.String()
+	}
+	today := time.Now().UTC().Format("2006-01-02")
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.usageDay != today {
+		reg.usageDay = today
+		reg.usage = make(map[string]int)
+	}
+	if reg.usage[id] >= client.DailyQuota {
+		return false
+	}
+	reg.usage[id]++
+	return true
+}
+
+// requestAPIKey extracts the caller's API key. Besides the X-API-Key header
+// it accepts ?api_key=, since embedded widgets and badges can't set headers.
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// requestClient identifies the caller from a bearer token, if one was
+// presented, or else from an API key.
+func (s *server) requestClient(r *http.Request) *apiClient {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") && len(s.tokenKey) > 0 {
+		return s.tokenClient(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return s.clients.Lookup(requestAPIKey(r))
+}
+
+// tokenClient returns the client a bearer token was issued to, or nil if
+// the token isn't valid.
+func (s *server) tokenClient(token string) *apiClient {
+	if len(s.tokenKey) == 0 {
+		return nil
+	}
+	claims, err := verifyToken(token, s.tokenKey, time.Now())
+	if err != nil {
+		return nil
+	}
+	return s.clients.LookupID(claims.Subject)
+}
+
+// authenticate identifies the calling client and stores it in the request
+// context for the handlers downstream, reshaping their JSON responses if
+// the client wants them in a different shape or encoding.
+func (s *server) authenticate(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := s.requestClient(r)
+		if client == nil {
+			w.WriteHeader(401)
+			w.Write([]byte("Missing or invalid API key"))
+			return
+		}
+		// any JSON response may be re-encoded as CBOR, depending on
+		// Accept, including those to clients that didn't ask for it
+		addVary(w.Header(), "Accept")
+		if unacceptableProtobuf(w, r) {
+			return
+		}
+		if !s.clients.Allow(client, clientIPFromContext(r.Context())) {
+			w.Header().Set("Retry-After", strconv.Itoa(secondsUntilMidnightUTC()))
+			w.WriteHeader(429)
+			w.Write([]byte("Daily quota exceeded"))
+			return
+		}
+		ctx := context.WithValue(r.Context(), clientContextKey, client)
+		if shape := s.requestShape(r, client); !shape.plain() {
+			sw := &shapingWriter{ResponseWriter: w, ctx: ctx, shape: shape}
+			defer sw.finish()
+			w = sw
+		}
+		h(w, r.WithContext(ctx))
+	}
+}
+
+// clientFromContext returns the authenticated client, or nil.
+func clientFromContext(ctx context.Context) *apiClient {
+	client, _ := ctx.Value(clientContextKey).(*apiClient)
+	return client
+}
+
+// secondsUntilMidnightUTC is when daily quotas next reset.
+func secondsUntilMidnightUTC() int {
+	now := time.Now().UTC()
+	return int(now.Truncate(24*time.Hour).Add(24*time.Hour).Sub(now).Seconds()) + 1
+}
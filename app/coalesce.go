@@ -0,0 +1,46 @@
+package app
+
+import "sync"
+
+var coalescedRequests = newCounter("upstream_coalesced_total",
+	"Requests that shared an in-flight upstream fetch instead of making their own.")
+
+// flight is an in-progress call shared by concurrent callers.
+type flight struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+// flightGroup coalesces concurrent calls for the same key into one, so a
+// burst of requests for a location costs a single upstream fetch.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// Do calls fn, unless a call for key is already in progress, in which case
+// it waits for that call and returns its result.
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		coalescedRequests.Inc()
+		<-f.done
+		return f.val, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	f.val, f.err = fn()
+
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	close(f.done)
+	return f.val, f.err
+}
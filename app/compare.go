@@ -0,0 +1,156 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// Comparison is the response of the compare endpoint.
+type Comparison struct {
+	A      PointWeather     `json:"a"`
+	B      PointWeather     `json:"b"`
+	Deltas ComparisonDeltas `json:"deltas"`
+}
+
+// ComparisonDeltas describes how location A differs from location B.
+type ComparisonDeltas struct {
+	// Temperature and FeelsLike are A minus B, in °F, or nil if either is
+	// unknown.
+	Temperature *float64 `json:"temperature"`
+	FeelsLike   *float64 `json:"feels_like"`
+	// WorseAlerts is "a" or "b", or "" when neither location's alerts are
+	// worse than the other's.
+	WorseAlerts string `json:"worse_alerts"`
+}
+
+// difference returns a minus b in °F, or nil if either is unknown. A
+// difference isn't itself a Temperature: 10°C warmer is 18°F warmer, not
+// 50°F.
+func difference(a, b *models.Temperature) *float64 {
+	if a == nil || b == nil {
+		return nil
+	}
+	d := a.F() - b.F()
+	return &d
+}
+
+// comparedFeature is the GeoJSON properties of one of the compared
+// locations.
+type comparedFeature struct {
+	Name string `json:"name"` // "a" or "b"
+	PointWeather
+}
+
+// alertSeverity ranks an alert by its event name, following the National
+// Weather Service's naming: warnings are worse than watches, which are
+// worse than advisories, which are worse than anything else.
+func alertSeverity(event string) int {
+	event = strings.ToLower(event)
+	switch {
+	case strings.Contains(event, "warning"):
+		return 3
+	case strings.Contains(event, "watch"):
+		return 2
+	case strings.Contains(event, "advisory"):
+		return 1
+	}
+	return 0
+}
+
+// worseAlerts compares two sets of alerts by their most severe alert, then
+// by how many there are. It returns 1 if a is worse, -1 if b is worse, and
+// 0 otherwise.
+func worseAlerts(a, b []string) int {
+	maxSeverity := func(alerts []string) int {
+		max := -1
+		for _, alert := range alerts {
+			if s := alertSeverity(alert); s > max {
+				max = s
+			}
+		}
+		return max
+	}
+	switch sa, sb := maxSeverity(a), maxSeverity(b); {
+	case sa > sb:
+		return 1
+	case sa < sb:
+		return -1
+	case len(a) > len(b):
+		return 1
+	case len(a) < len(b):
+		return -1
+	}
+	return 0
+}
+
+// compareHandler compares the current weather at two locations, given as
+// ?a=lat,lon&b=lat,lon.
+func (s *server) compareHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var locs [2]models.Location
+	for i, name := range []string{"a", "b"} {
+		loc, err := models.ParseLocationPair(q.Get(name))
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(name + ": " + err.Error()))
+			return
+		}
+		locs[i] = loc
+	}
+
+	var (
+		wg      sync.WaitGroup
+		data    [2]*models.CurrentConditions
+		fetched [2]error
+	)
+	for i, loc := range locs {
+		wg.Add(1)
+		go func(i int, loc models.Location) {
+			defer wg.Done()
+			lat, lon := loc.Strings()
+			data[i], fetched[i] = s.fetchWeather(r.Context(), lat, lon)
+		}(i, loc)
+	}
+	wg.Wait()
+	for _, err := range fetched {
+		if err != nil {
+			s.upstreamError(w, r, err)
+			return
+		}
+	}
+
+	a := newPointWeather(locs[0], data[0])
+	b := newPointWeather(locs[1], data[1])
+	comparison := Comparison{
+		A: a,
+		B: b,
+		Deltas: ComparisonDeltas{
+			Temperature: difference(a.Temperature, b.Temperature),
+			FeelsLike:   difference(a.FeelsLike, b.FeelsLike),
+		},
+	}
+	switch worseAlerts(a.Alerts, b.Alerts) {
+	case 1:
+		comparison.Deltas.WorseAlerts = "a"
+	case -1:
+		comparison.Deltas.WorseAlerts = "b"
+	}
+	if wantsGeoJSON(w, r, q) {
+		// the deltas go in a foreign member, as RFC 7946 allows
+		writeGeoJSON(w, struct {
+			*GeoJSONFeatureCollection
+			Deltas ComparisonDeltas `json:"deltas"`
+		}{
+			featureCollection([]GeoJSONFeature{
+				pointFeature(a.Lat, a.Lon, comparedFeature{"a", a}),
+				pointFeature(b.Lat, b.Lon, comparedFeature{"b", b}),
+			}),
+			comparison.Deltas,
+		})
+		return
+	}
+	writeJSON(w, &comparison)
+}
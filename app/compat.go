@@ -0,0 +1,44 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Response compatibility modes. Legacy keeps the weather response to the
+// fields it had at first, alerts, conditions and temperature, for clients
+// that can't cope with more; extended adds the fields introduced since.
+const (
+	compatExtended = "extended"
+	compatLegacy   = "legacy"
+)
+
+func parseCompat(mode string) (string, error) {
+	switch mode = strings.ToLower(mode); mode {
+	case "":
+		return compatExtended, nil
+	case compatExtended, compatLegacy:
+		return mode, nil
+	}
+	return "", fmt.Errorf("%q (want %s or %s)", mode, compatExtended, compatLegacy)
+}
+
+// responseCompat returns the compatibility mode for a request: ?compat= if
+// it's given, and otherwise the server's default, RESPONSE_COMPAT.
+func (s *server) responseCompat(r *http.Request, q url.Values) (string, error) {
+	if mode := q.Get("compat"); mode != "" {
+		return parseCompat(mode)
+	}
+	if s.compat == "" {
+		return compatExtended, nil
+	}
+	return s.compat, nil
+}
+
+// legacy strips the fields old clients don't know about.
+func (w *Weather) legacy() {
+	w.Location = nil
+	w.Meta = nil
+}
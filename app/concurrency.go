@@ -0,0 +1,67 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var concurrencyRejected = newCounter("concurrency_rejected_total",
+	"Requests rejected because a concurrency limit was reached, by route pattern.", "route")
+
+// concurrencyLimits caps in-flight requests globally and per route, so that
+// expensive endpoints can't starve cheap ones. Routes are identified by the
+// ServeMux pattern they match.
+type concurrencyLimits struct {
+	mux    *http.ServeMux
+	global *limiter            // optional
+	routes map[string]*limiter // by mux pattern
+}
+
+// parseRouteLimits parses a ROUTE_CONCURRENCY style spec, e.g.
+// "/weather/=100,/admin/history/import=1".
+func parseRouteLimits(spec string, queueDepth int) (map[string]*limiter, error) {
+	routes := make(map[string]*limiter)
+	for _, entry := range splitList(spec) {
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid route limit %q: want pattern=limit", entry)
+		}
+		n, err := strconv.Atoi(entry[i+1:])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid route limit %q: limit must be a positive integer", entry)
+		}
+		routes[entry[:i]] = newLimiter(n, queueDepth)
+	}
+	return routes, nil
+}
+
+// Middleware enforces the limits in front of the mux. Operational endpoints
+// are exempt from the global limit.
+func (cl *concurrencyLimits) Middleware(h http.Handler) http.Handler {
+	if cl.global == nil && len(cl.routes) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := cl.mux.Handler(r)
+		global := cl.global
+		if isOperationalPath(r.URL.Path) {
+			global = nil
+		}
+		for _, l := range []*limiter{global, cl.routes[pattern]} {
+			if l == nil {
+				continue
+			}
+			if err := l.Acquire(); err != nil {
+				concurrencyRejected.Inc(pattern)
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(503)
+				w.Write([]byte("Too many concurrent requests, please retry"))
+				return
+			}
+			defer l.Release()
+		}
+		h.ServeHTTP(w, r)
+	})
+}
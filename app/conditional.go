@@ -0,0 +1,118 @@
+package app
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+var conditionalRequests = newCounter("upstream_conditional_requests_total",
+	"Conditional requests to providers, by provider and result: modified or not_modified.", "provider", "result")
+
+const (
+	// maxValidatedResponses bounds the responses a validatorCache keeps.
+	maxValidatedResponses = 1000
+	// maxValidatedBody is the largest body kept; bigger ones are always
+	// fetched in full.
+	maxValidatedBody = 4 << 20
+)
+
+// validatorCache makes requests to a provider conditional. It keeps the
+// validators (ETag and Last-Modified) of the last successful response from
+// each URL along with its body, sends them with the next request, and on a
+// 304 Not Modified hands back the body it kept. That saves the provider
+// sending, and us decoding over the network, what hasn't changed. A nil
+// validatorCache makes plain requests.
+type validatorCache struct {
+	provider string
+
+	mu      sync.Mutex
+	entries map[string]validatedResponse
+}
+
+type validatedResponse struct {
+	etag         string
+	lastModified string
+	body         []byte
+}
+
+func newValidatorCache(provider string) *validatorCache {
+	return &validatorCache{provider: provider, entries: make(map[string]validatedResponse)}
+}
+
+// Do sends req with client, conditionally if we have validators for its
+// URL. A 304 comes back as the 200 it stands for, so callers needn't care
+// whether the request was conditional.
+func (vc *validatorCache) Do(client *http.Client, req *http.Request) (*http.Response, error) {
+	if vc == nil || req.Method != "GET" {
+		return client.Do(req)
+	}
+	key := req.URL.String()
+	vc.mu.Lock()
+	cached, ok := vc.entries[key]
+	vc.mu.Unlock()
+	if ok {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == 304 && ok:
+		conditionalRequests.Inc(vc.provider, "not_modified")
+		resp.Body.Close()
+		resp.StatusCode, resp.Status = 200, "200 OK"
+		resp.Body = ioutil.NopCloser(bytes.NewReader(cached.body))
+		resp.ContentLength = int64(len(cached.body))
+		return resp, nil
+	case resp.StatusCode != 200:
+		return resp, nil
+	}
+	if ok {
+		conditionalRequests.Inc(vc.provider, "modified")
+	}
+
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return resp, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxValidatedBody+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if len(body) > maxValidatedBody {
+		// too big to keep; hand it on as it comes
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	vc.put(key, validatedResponse{etag: etag, lastModified: lastModified, body: body})
+	return resp, nil
+}
+
+// put keeps a response, making room by dropping an arbitrary one if full.
+func (vc *validatorCache) put(key string, r validatedResponse) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if _, ok := vc.entries[key]; !ok && len(vc.entries) >= maxValidatedResponses {
+		for k := range vc.entries {
+			delete(vc.entries, k)
+			break
+		}
+	}
+	vc.entries[key] = r
+}
@@ -0,0 +1,170 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// conditionRule is a test of the current weather, written as
+// field_op:value, e.g. "temp_gt:90" or "condition_has:rain". Temperatures
+// are in °F unless they say otherwise, as in "temp_lt:0C".
+type conditionRule struct {
+	Raw   string
+	Field string
+	Op    string
+	Temp  models.Temperature
+	Text  string
+}
+
+// conditionFields maps each rule field to the operators it supports.
+var conditionFields = map[string][]string{
+	"temp":       {"gt", "gte", "lt", "lte", "eq"},
+	"feels_like": {"gt", "gte", "lt", "lte", "eq"},
+	"condition":  {"has"},
+	"alert":      {"has"},
+}
+
+// parseConditionRule parses a rule such as "temp_gt:90".
+func parseConditionRule(raw string) (conditionRule, error) {
+	rule := conditionRule{Raw: raw}
+	parts := strings.SplitN(raw, ":", 2)
+	i := strings.LastIndex(parts[0], "_")
+	if len(parts) != 2 || i < 0 {
+		return rule, fmt.Errorf("Invalid rule %q: want field_op:value, e.g. temp_gt:90", raw)
+	}
+	rule.Field, rule.Op = parts[0][:i], parts[0][i+1:]
+	ops, ok := conditionFields[rule.Field]
+	if !ok {
+		return rule, fmt.Errorf("Invalid rule %q: unknown field %q", raw, rule.Field)
+	}
+	if !containsString(ops, rule.Op) {
+		return rule, fmt.Errorf("Invalid rule %q: %s supports %s", raw, rule.Field, strings.Join(ops, ", "))
+	}
+	if rule.Op == "has" {
+		rule.Text = strings.ToLower(strings.TrimSpace(parts[1]))
+		if rule.Text == "" {
+			return rule, fmt.Errorf("Invalid rule %q: missing value", raw)
+		}
+		return rule, nil
+	}
+	t, err := models.ParseTemperature(parts[1])
+	if err != nil {
+		return rule, fmt.Errorf("Invalid rule %q: %s", raw, err)
+	}
+	rule.Temp = t
+	return rule, nil
+}
+
+// eval tests the rule against the current weather.
+func (rule conditionRule) eval(w PointWeather) bool {
+	switch rule.Field {
+	case "temp", "feels_like":
+		t := w.Temperature
+		if rule.Field == "feels_like" {
+			t = w.FeelsLike
+		}
+		if t == nil {
+			// an unknown temperature passes no test
+			return false
+		}
+		// compare in the rule's unit, so eq means what it says
+		v, want := t.In(rule.Temp.Unit()), rule.Temp
+		switch rule.Op {
+		case "gt":
+			return want.Less(v)
+		case "gte":
+			return !v.Less(want)
+		case "lt":
+			return v.Less(want)
+		case "lte":
+			return !want.Less(v)
+		case "eq":
+			return v == want
+		}
+	case "condition", "alert":
+		list := w.Conditions
+		if rule.Field == "alert" {
+			list = w.Alerts
+		}
+		for _, item := range list {
+			if strings.Contains(strings.ToLower(item), rule.Text) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ConditionCheck is the response of the conditions check endpoint.
+type ConditionCheck struct {
+	Result bool                 `json:"result"`
+	Rules  []ConditionRuleCheck `json:"rules"`
+}
+
+// ConditionRuleCheck is the result of one rule.
+type ConditionRuleCheck struct {
+	Rule   string `json:"rule"`
+	Result bool   `json:"result"`
+}
+
+// conditionsCheckHandler tests the current weather at a location against
+// one or more ?rule= parameters, so other systems can gate behaviour on the
+// weather with one call. Rules must all hold, or with ?match=any, at least
+// one.
+func (s *server) conditionsCheckHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if len(q["rule"]) == 0 {
+		w.WriteHeader(400)
+		w.Write([]byte("Missing rule parameter"))
+		return
+	}
+	matchAny := false
+	switch q.Get("match") {
+	case "", "all":
+	case "any":
+		matchAny = true
+	default:
+		w.WriteHeader(400)
+		w.Write([]byte("match must be all or any"))
+		return
+	}
+	rules := make([]conditionRule, 0, len(q["rule"]))
+	for _, raw := range q["rule"] {
+		rule, err := parseConditionRule(raw)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		rules = append(rules, rule)
+	}
+
+	lat, lon, _ := s.requestLocation(r, q)
+	loc, err := models.ParseLocation(lat, lon)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	data, err := s.fetchWeather(r.Context(), lat, lon)
+	if err != nil {
+		s.upstreamError(w, r, err)
+		return
+	}
+	weather := newPointWeather(loc, data)
+
+	check := ConditionCheck{Result: !matchAny, Rules: make([]ConditionRuleCheck, len(rules))}
+	for i, rule := range rules {
+		ok := rule.eval(weather)
+		check.Rules[i] = ConditionRuleCheck{Rule: rule.Raw, Result: ok}
+		if matchAny {
+			check.Result = check.Result || ok
+		} else {
+			check.Result = check.Result && ok
+		}
+	}
+	writeJSON(w, &check)
+}
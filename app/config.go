@@ -0,0 +1,152 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// Config is what the server is built from: its settings, named and written
+// as the environment variables they're usually read from, and where it logs.
+type Config struct {
+	Vars   map[string]string
+	Logger *log.Logger // defaults to the standard logger
+}
+
+// ConfigFromEnv takes the settings from the process environment.
+func ConfigFromEnv() Config {
+	vars := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			vars[kv[:i]] = kv[i+1:]
+		}
+	}
+	return Config{Vars: vars}
+}
+
+// configError is an invalid setting. The readers below panic with one,
+// which New turns back into an error.
+type configError string
+
+func (e configError) Error() string {
+	return string(e)
+}
+
+// invalid panics with a configError for the named setting.
+func invalid(name string, err interface{}) {
+	panic(configError(fmt.Sprintf("invalid %s environment variable: %s", name, err)))
+}
+
+// get returns a setting, or "" when it's unset.
+func (c Config) get(name string) string {
+	return c.Vars[name]
+}
+
+// duration reads a duration (e.g. "90m", "2160h"), returning def when the
+// setting is unset.
+func (c Config) duration(name string, def time.Duration) time.Duration {
+	raw := c.get(name)
+	if raw == "" {
+		return def
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		invalid(name, err)
+	}
+	return d
+}
+
+// integer reads an integer, returning def when the setting is unset.
+func (c Config) integer(name string, def int) int {
+	raw := c.get(name)
+	if raw == "" {
+		return def
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		invalid(name, err)
+	}
+	return n
+}
+
+// fileMode reads octal file permissions, e.g. "0660", returning def when the
+// setting is unset.
+func (c Config) fileMode(name string, def os.FileMode) os.FileMode {
+	raw := c.get(name)
+	if raw == "" {
+		return def
+	}
+	mode, err := strconv.ParseUint(raw, 8, 32)
+	if err != nil || mode > 0777 {
+		invalid(name, fmt.Sprintf("%q", raw))
+	}
+	return os.FileMode(mode)
+}
+
+// splitList splits a comma separated value, dropping empty items.
+func splitList(raw string) []string {
+	var out []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// boolean reads a boolean ("1", "true", "0", "false", ...), returning def
+// when the setting is unset.
+func (c Config) boolean(name string, def bool) bool {
+	raw := c.get(name)
+	if raw == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		invalid(name, err)
+	}
+	return b
+}
+
+// temperature reads a temperature such as "75", "24C" or "297K", returning
+// def when the setting is unset. Bare numbers are in degrees Fahrenheit.
+func (c Config) temperature(name string, def models.Temperature) models.Temperature {
+	raw := c.get(name)
+	if raw == "" {
+		return def
+	}
+	t, err := models.ParseTemperature(raw)
+	if err != nil {
+		invalid(name, err)
+	}
+	return t
+}
+
+// float reads a floating point number, returning def when the setting is
+// unset.
+func (c Config) float(name string, def float64) float64 {
+	raw := c.get(name)
+	if raw == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		invalid(name, err)
+	}
+	return f
+}
+
+// fraction reads a number strictly between 0 and 1, such as an SLO's
+// target, returning def when the setting is unset.
+func (c Config) fraction(name string, def float64) float64 {
+	f := c.float(name, def)
+	if f <= 0 || f >= 1 {
+		invalid(name, "must be between 0 and 1")
+	}
+	return f
+}
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// maxDegreeDayRange bounds the date range of requests over daily history.
+const maxDegreeDayRange = 366 * 5
+
+// DegreeDays is the response of the degree days endpoint.
+type DegreeDays struct {
+	Base    models.Temperature `json:"base"`
+	From    string             `json:"from"`
+	To      string             `json:"to"`
+	Heating float64            `json:"heating"`
+	Cooling float64            `json:"cooling"`
+	Days    []DegreeDay        `json:"days"`
+	// MissingDays counts days in the range we have no observations for,
+	// which leave the totals short.
+	MissingDays int `json:"missing_days"`
+}
+
+// DegreeDay is the degree days for a single day. Degree days are in °F
+// days.
+type DegreeDay struct {
+	Date    string             `json:"date"`
+	Mean    models.Temperature `json:"mean"`
+	Heating float64            `json:"heating"`
+	Cooling float64            `json:"cooling"`
+	Samples int                `json:"samples"`
+}
+
+// degreeDaysHandler computes heating and cooling degree days at a location
+// over a date range, from the observations in the history store. Each day's
+// mean temperature is the average of its low and high, the usual method,
+// and degree days are how far that falls below (heating) or above (cooling)
+// ?base=, 65°F by default (other units may be given, e.g. 18C). The range
+// defaults to the 30 days to yesterday.
+func (s *server) degreeDaysHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lat, lon, _ := s.requestLocation(r, q)
+	loc, err := models.ParseLocation(lat, lon)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	base := models.DegreesF(65)
+	if raw := q.Get("base"); raw != "" {
+		if base, err = models.ParseTemperature(raw); err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Invalid base: %q", raw)
+			return
+		}
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	from, to, span, err := parseDateRange(q, today.AddDate(0, 0, -30), today.AddDate(0, 0, -1))
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	dd := DegreeDays{
+		Base: base,
+		From: from.Format("2006-01-02"),
+		To:   to.Format("2006-01-02"),
+		Days: []DegreeDay{},
+	}
+	for _, day := range s.history.DailySummaries(loc, dd.From, dd.To) {
+		mean := (day.MinTemp.F() + day.MaxTemp.F()) / 2
+		d := DegreeDay{
+			Date:    day.Date,
+			Mean:    models.DegreesF(mean),
+			Heating: math.Max(0, base.F()-mean),
+			Cooling: math.Max(0, mean-base.F()),
+			Samples: day.Samples,
+		}
+		dd.Heating += d.Heating
+		dd.Cooling += d.Cooling
+		dd.Days = append(dd.Days, d)
+	}
+	dd.MissingDays = span - len(dd.Days)
+	writeJSON(w, &dd)
+}
+
+// parseDateRange parses the ?from= and ?to= dates of a request over stored
+// history, which default to from and to. It returns the range and the
+// number of days in it.
+func parseDateRange(q url.Values, from, to time.Time) (time.Time, time.Time, int, error) {
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if raw := q.Get(bound.name); raw != "" {
+			var err error
+			if *bound.t, err = time.Parse("2006-01-02", raw); err != nil {
+				return from, to, 0, fmt.Errorf("Invalid %s: want a date (2006-01-02)", bound.name)
+			}
+		}
+	}
+	span := int(to.Sub(from).Hours()/24) + 1
+	if span < 1 {
+		return from, to, 0, fmt.Errorf("from must not be after to")
+	}
+	if span > maxDegreeDayRange {
+		return from, to, 0, fmt.Errorf("Date range is too long; at most %d days are allowed", maxDegreeDayRange)
+	}
+	return from, to, span, nil
+}
@@ -0,0 +1,330 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+var (
+	deliveryRetries = newCounter("delivery_retries_total",
+		"Retried notification deliveries, by result.", "result")
+	deadLetters = newGauge("dead_letters",
+		"Notification deliveries that ran out of retries.")
+)
+
+// delivery is a notification that failed to deliver, waiting to be retried
+// or, once it has run out of attempts, dead.
+type delivery struct {
+	ID      string `json:"id"`
+	Channel string `json:"channel"` // "webhook" or "telegram"
+	// Target is the webhook URL, or the ID of the telegram subscription.
+	Target string `json:"target"`
+	// What to send: a notification for webhooks, or an alert for a
+	// subscription.
+	Notification *notification `json:"notification,omitempty"`
+	Subscription *subscription `json:"subscription,omitempty"`
+	Alert        *models.Alert `json:"alert,omitempty"`
+
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error"`
+	CreatedAt   time.Time  `json:"created_at"`
+	NextAttempt time.Time  `json:"next_attempt,omitempty"`
+	DeadAt      *time.Time `json:"dead_at,omitempty"` // set once it's out of retries
+}
+
+// deliveryQueue holds failed deliveries: those to retry, and the dead
+// letters that ran out of attempts. When path is set they are persisted as
+// a JSON file; otherwise they only live in memory.
+type deliveryQueue struct {
+	path        string
+	maxAttempts int
+	backoff     time.Duration // before the first retry; doubles for each one after
+
+	mu      sync.Mutex
+	records map[string]*delivery
+}
+
+// maxDeliveryBackoff caps the wait between retries.
+const maxDeliveryBackoff = time.Hour
+
+// openDeliveryQueue loads the delivery queue at path, creating it on first
+// save. An empty path gives an in-memory queue.
+func openDeliveryQueue(path string, maxAttempts int, backoff time.Duration) (*deliveryQueue, error) {
+	dq := &deliveryQueue{
+		path:        path,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		records:     make(map[string]*delivery),
+	}
+	if path == "" {
+		return dq, nil
+	}
+	var records []*delivery
+	if err := loadJSONFile(path, &records); err != nil {
+		return nil, err
+	}
+	for _, rec := range records {
+		dq.records[rec.ID] = rec
+	}
+	dq.updateGauge()
+	return dq, nil
+}
+
+// save writes the queue to disk. The caller must hold dq.mu.
+func (dq *deliveryQueue) save() error {
+	if dq.path == "" {
+		return nil
+	}
+	return saveJSONFile(dq.path, dq.sorted())
+}
+
+// sorted returns the deliveries, oldest first. The caller must hold dq.mu.
+func (dq *deliveryQueue) sorted() []*delivery {
+	records := make([]*delivery, 0, len(dq.records))
+	for _, rec := range dq.records {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+	return records
+}
+
+// updateGauge counts the dead letters. The caller must hold dq.mu.
+func (dq *deliveryQueue) updateGauge() {
+	dead := 0
+	for _, rec := range dq.records {
+		if rec.DeadAt != nil {
+			dead++
+		}
+	}
+	deadLetters.Set(float64(dead))
+}
+
+// schedule records a failed attempt, setting when to try next or, if that
+// was the last attempt, marking the delivery dead.
+func (dq *deliveryQueue) schedule(d *delivery, err error, now time.Time) {
+	d.Attempts++
+	d.LastError = err.Error()
+	if d.Attempts >= dq.maxAttempts {
+		dead := now.UTC()
+		d.DeadAt = &dead
+		d.NextAttempt = time.Time{}
+		return
+	}
+	wait := dq.backoff
+	for i := 1; i < d.Attempts && wait < maxDeliveryBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxDeliveryBackoff {
+		wait = maxDeliveryBackoff
+	}
+	d.NextAttempt = now.Add(wait).UTC()
+}
+
+// Add queues a delivery whose first attempt failed with err.
+func (dq *deliveryQueue) Add(d delivery, err error) error {
+	now := time.Now()
+	d.ID = randomHex(8)
+	d.CreatedAt = now.UTC()
+	dq.schedule(&d, err, now)
+
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	dq.records[d.ID] = &d
+	dq.updateGauge()
+	return dq.save()
+}
+
+// Due returns the deliveries due for another attempt.
+func (dq *deliveryQueue) Due(now time.Time) []delivery {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	var out []delivery
+	for _, rec := range dq.sorted() {
+		if rec.DeadAt == nil && !rec.NextAttempt.After(now) {
+			out = append(out, *rec)
+		}
+	}
+	return out
+}
+
+// Attempted records the result of retrying a delivery: delivered ones are
+// dropped, and failed ones rescheduled or marked dead. It reports whether
+// the delivery is now dead.
+func (dq *deliveryQueue) Attempted(id string, err error) (bool, error) {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	rec, ok := dq.records[id]
+	if !ok {
+		// deleted while we were retrying it
+		return false, nil
+	}
+	if err == nil {
+		delete(dq.records, id)
+	} else {
+		dq.schedule(rec, err, time.Now())
+	}
+	dq.updateGauge()
+	return rec.DeadAt != nil, dq.save()
+}
+
+// List returns the dead deliveries, or those waiting to be retried, oldest
+// first.
+func (dq *deliveryQueue) List(dead bool) []delivery {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	out := []delivery{}
+	for _, rec := range dq.sorted() {
+		if (rec.DeadAt != nil) == dead {
+			out = append(out, *rec)
+		}
+	}
+	return out
+}
+
+// Requeue gives a delivery a fresh set of attempts, starting now.
+func (dq *deliveryQueue) Requeue(id string) (delivery, error) {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	rec, ok := dq.records[id]
+	if !ok {
+		return delivery{}, ErrNotFound
+	}
+	prev := *rec
+	rec.Attempts = 0
+	rec.DeadAt = nil
+	rec.NextAttempt = time.Now().UTC()
+	if err := dq.save(); err != nil {
+		*rec = prev
+		return delivery{}, err
+	}
+	dq.updateGauge()
+	return *rec, nil
+}
+
+// Delete discards a delivery.
+func (dq *deliveryQueue) Delete(id string) (delivery, error) {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	rec, ok := dq.records[id]
+	if !ok {
+		return delivery{}, ErrNotFound
+	}
+	delete(dq.records, id)
+	if err := dq.save(); err != nil {
+		dq.records[id] = rec
+		return delivery{}, err
+	}
+	dq.updateGauge()
+	return *rec, nil
+}
+
+// queueDelivery queues a failed delivery for retry.
+func (s *server) queueDelivery(d delivery, err error) {
+	if err := s.deliveries.Add(d, s.redactor.Error(err)); err != nil {
+		s.logger.Printf("Failed to queue %s delivery to %s for retry: %s", d.Channel, d.Target, err)
+	}
+}
+
+// redeliver retries a delivery.
+func (s *server) redeliver(d delivery) error {
+	switch {
+	case d.Notification != nil:
+		for _, ch := range s.notifiers {
+			if ch.Channel() != d.Channel || ch.Target() != d.Target {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			entry := auditEntry{Channel: ch.Channel(), Recipient: ch.Target(), Type: d.Notification.Type}
+			err := s.audited(entry, d.Notification, func() error { return ch.Notify(ctx, *d.Notification) })
+			result := "ok"
+			if err != nil {
+				result = "error"
+			}
+			notificationsSent.Inc(ch.Channel(), result)
+			return err
+		}
+		return fmt.Errorf("%s %s is no longer configured", d.Channel, d.Target)
+	case d.Subscription != nil && d.Alert != nil:
+		if _, err := s.subscriptions.Get(d.Subscription.ID); err != nil {
+			return fmt.Errorf("subscription %s: %w", d.Subscription.ID, err)
+		}
+		return s.sendAlert(*d.Subscription, *d.Alert)
+	}
+	return fmt.Errorf("nothing to deliver")
+}
+
+// retryDeliveriesEvery retries the deliveries that are due every interval.
+// Only the leader retries, as only it delivers.
+func (s *server) retryDeliveriesEvery(ctx context.Context, interval time.Duration) {
+	for range ticks(ctx, interval) {
+		if !s.leader.IsLeader() {
+			continue
+		}
+		for _, d := range s.deliveries.Due(time.Now()) {
+			err := s.redeliver(d)
+			dead, saveErr := s.deliveries.Attempted(d.ID, s.redactor.Error(err))
+			switch {
+			case err == nil:
+				deliveryRetries.Inc("ok")
+			case dead:
+				deliveryRetries.Inc("dead")
+				s.logger.Printf("Giving up on %s delivery %s to %s after %d attempts: %s", d.Channel, d.ID, d.Target, d.Attempts+1, err)
+			default:
+				deliveryRetries.Inc("error")
+			}
+			if saveErr != nil {
+				s.logger.Printf("Failed to save delivery queue: %s", saveErr)
+			}
+		}
+	}
+}
+
+// deliveriesHandler serves the dead letter API:
+//
+//	GET    /admin/deliveries               list dead deliveries; ?status=pending for those awaiting retry
+//	POST   /admin/deliveries/{id}/requeue  retry a delivery afresh
+//	DELETE /admin/deliveries/{id}          discard a delivery
+func (s *server) deliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/deliveries"), "/")
+	parts := strings.Split(rest, "/")
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case rest == "" && r.Method == "GET":
+		status := r.URL.Query().Get("status")
+		if status != "" && status != "dead" && status != "pending" {
+			w.WriteHeader(400)
+			w.Write([]byte("status must be dead or pending"))
+			return
+		}
+		json.NewEncoder(w).Encode(s.deliveries.List(status != "pending"))
+
+	case len(parts) == 2 && parts[1] == "requeue" && r.Method == "POST":
+		d, err := s.deliveries.Requeue(parts[0])
+		if err != nil {
+			s.storageError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(d)
+
+	case len(parts) == 1 && r.Method == "DELETE":
+		d, err := s.deliveries.Delete(parts[0])
+		if err != nil {
+			s.storageError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(d)
+
+	default:
+		w.WriteHeader(404)
+	}
+}
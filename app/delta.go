@@ -0,0 +1,148 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deltaContentType is the media type of delta responses: a JSON merge patch
+// (RFC 7396) that turns the representation the client has into the current
+// one. Fields that changed or appeared are set, fields that disappeared are
+// null, and meta is always there.
+const deltaContentType = "application/merge-patch+json"
+
+// maxDeltaSnapshots bounds the representations a deltaSnapshots keeps.
+const maxDeltaSnapshots = 1000
+
+// deltaSnapshots remembers recent representations of current conditions so
+// that frequent pollers can be sent only what changed since their last
+// fetch. Representations are kept by ETag, so identical ones are kept once,
+// and by variant (the location and everything else in the request that
+// shapes the response) and observation time, for clients that would rather
+// say when than which.
+type deltaSnapshots struct {
+	mu     sync.Mutex
+	byTag  map[string]map[string]json.RawMessage
+	byTime map[string]string // ETags by variant and observation time
+}
+
+func newDeltaSnapshots() *deltaSnapshots {
+	return &deltaSnapshots{
+		byTag:  make(map[string]map[string]json.RawMessage),
+		byTime: make(map[string]string),
+	}
+}
+
+// representationTag returns the ETag of a representation: a hash of all but
+// its meta, which is different in every response.
+func representationTag(obj map[string]json.RawMessage) string {
+	content := make(map[string]json.RawMessage, len(obj))
+	for name, value := range obj {
+		if name != "meta" {
+			content[name] = value
+		}
+	}
+	b, _ := json.Marshal(content)
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:12]) + `"`
+}
+
+func timeKey(variant string, t time.Time) string {
+	return variant + " " + t.UTC().Format(time.RFC3339Nano)
+}
+
+// Remember keeps a representation, returning its ETag. When full, it makes
+// room by dropping arbitrary ones.
+func (ds *deltaSnapshots) Remember(variant string, observedAt time.Time, obj map[string]json.RawMessage) string {
+	tag := representationTag(obj)
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if _, ok := ds.byTag[tag]; !ok && len(ds.byTag) >= maxDeltaSnapshots {
+		for t := range ds.byTag {
+			delete(ds.byTag, t)
+			break
+		}
+	}
+	ds.byTag[tag] = obj
+	if !observedAt.IsZero() {
+		key := timeKey(variant, observedAt)
+		if _, ok := ds.byTime[key]; !ok && len(ds.byTime) >= maxDeltaSnapshots {
+			for k := range ds.byTime {
+				delete(ds.byTime, k)
+				break
+			}
+		}
+		ds.byTime[key] = tag
+	}
+	return tag
+}
+
+// Base returns the representation a ?since= refers to, by ETag or, for the
+// variant, by observation time.
+func (ds *deltaSnapshots) Base(variant, since string) (string, map[string]json.RawMessage, bool) {
+	tag := `"` + strings.Trim(strings.TrimPrefix(since, "W/"), `"`) + `"`
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if t, err := parseTimeParam(since); err == nil {
+		tag = ds.byTime[timeKey(variant, t)]
+	}
+	obj, ok := ds.byTag[tag]
+	return tag, obj, ok
+}
+
+// mergePatch returns the merge patch from base to obj.
+func mergePatch(base, obj map[string]json.RawMessage) map[string]json.RawMessage {
+	patch := make(map[string]json.RawMessage)
+	for name, value := range obj {
+		if old, ok := base[name]; !ok || name == "meta" || !bytes.Equal(old, value) {
+			patch[name] = value
+		}
+	}
+	for name := range base {
+		if _, ok := obj[name]; !ok {
+			patch[name] = json.RawMessage("null")
+		}
+	}
+	return patch
+}
+
+// writeDelta remembers a representation of current conditions and tags the
+// response with its ETag. If the request's ?since= names an earlier
+// representation, by ETag or observation time, it writes a merge patch from
+// that one, or a 304 if nothing changed, and returns true. Otherwise, as
+// when the earlier one has been forgotten, the caller sends the whole thing.
+func (s *server) writeDelta(w http.ResponseWriter, r *http.Request, variant string, observedAt time.Time, body interface{}) bool {
+	obj, err := toObject(body)
+	if err != nil {
+		return false
+	}
+	tag := s.deltas.Remember(variant, observedAt, obj)
+	w.Header().Set("ETag", tag)
+
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		return false
+	}
+	if t, err := parseTimeParam(since); err == nil && !observedAt.IsZero() && !observedAt.After(t) {
+		w.WriteHeader(304)
+		return true
+	}
+	baseTag, base, ok := s.deltas.Base(variant, since)
+	if !ok {
+		return false
+	}
+	if baseTag == tag {
+		w.WriteHeader(304)
+		return true
+	}
+	w.Header().Set("Content-Type", deltaContentType)
+	w.Header().Set("Delta-Base", baseTag)
+	writeJSON(w, mergePatch(base, obj))
+	return true
+}
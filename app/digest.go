@@ -0,0 +1,238 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// Digest summarizes the coming day or week at a location.
+type Digest struct {
+	Name        string               `json:"name,omitempty"`
+	Lat         float64              `json:"lat"`
+	Lon         float64              `json:"lon"`
+	Period      string               `json:"period"` // "daily" or "weekly"
+	Days        []models.ForecastDay `json:"days"`
+	Alerts      []models.Alert       `json:"alerts"`
+	Summary     string               `json:"summary"`
+	GeneratedAt time.Time            `json:"generated_at"`
+}
+
+// DigestList is the response of the digest endpoint.
+type DigestList struct {
+	Digests []Digest `json:"digests"`
+}
+
+// composeDigest builds the digest for a location: the daily forecast for
+// the period and the notable alerts in effect.
+func (s *server) composeDigest(ctx context.Context, name string, loc models.Location, period string) (Digest, error) {
+	lat, lon := loc.Strings()
+	data, err := s.forecast(lat, lon, []string{"daily"})
+	if err != nil {
+		s.upstreamFailed(err)
+		return Digest{}, err
+	}
+	alerts, err := s.locationAlerts(ctx, lat, lon)
+	if err != nil {
+		return Digest{}, err
+	}
+
+	days := append([]models.ForecastDay{}, newOWMForecast(data).Daily...)
+	n := 1
+	if period == "weekly" {
+		n = 7
+	}
+	if len(days) > n {
+		days = days[:n]
+	}
+	d := Digest{
+		Name:        name,
+		Lat:         loc.Lat,
+		Lon:         loc.Lon,
+		Period:      period,
+		Days:        days,
+		Alerts:      []models.Alert{},
+		GeneratedAt: time.Now().UTC(),
+	}
+	for _, alert := range alerts {
+		if notableAlert(alert) {
+			d.Alerts = append(d.Alerts, alert)
+		}
+	}
+	d.Summary = summarizeDigest(d)
+	return d, nil
+}
+
+// notableAlert reports whether an alert is worth a digest's attention:
+// advisories and worse by name, or anything NWS rates severe.
+func notableAlert(alert models.Alert) bool {
+	return alertSeverity(alert.Event) > 0 || alert.Severity == "Severe" || alert.Severity == "Extreme"
+}
+
+// summarizeDigest describes a digest in a sentence or two, e.g. "Today:
+// high 72°F, low 55°F, 40% chance of precipitation, light rain. Alerts:
+// Flood Watch."
+func summarizeDigest(d Digest) string {
+	var b strings.Builder
+	switch {
+	case len(d.Days) == 0:
+		b.WriteString("No forecast available.")
+	case d.Period == "weekly":
+		lowest, highest, wettest := d.Days[0], d.Days[0], d.Days[0]
+		for _, day := range d.Days[1:] {
+			if day.Low.Less(lowest.Low) {
+				lowest = day
+			}
+			if highest.High.Less(day.High) {
+				highest = day
+			}
+			if day.PrecipitationChance > wettest.PrecipitationChance {
+				wettest = day
+			}
+		}
+		fmt.Fprintf(&b, "This week: highs up to %s (%s), lows down to %s (%s)",
+			highest.High.In(models.Fahrenheit), weekday(highest.Date), lowest.Low.In(models.Fahrenheit), weekday(lowest.Date))
+		if wettest.PrecipitationChance > 0 {
+			fmt.Fprintf(&b, ", wettest on %s with a %.0f%% chance of precipitation",
+				weekday(wettest.Date), wettest.PrecipitationChance*100)
+		}
+		b.WriteString(".")
+	default:
+		day := d.Days[0]
+		fmt.Fprintf(&b, "Today: high %s, low %s, %.0f%% chance of precipitation",
+			day.High.In(models.Fahrenheit), day.Low.In(models.Fahrenheit), day.PrecipitationChance*100)
+		if len(day.Conditions) > 0 {
+			b.WriteString(", " + strings.Join(day.Conditions, ", "))
+		}
+		b.WriteString(".")
+	}
+	if len(d.Alerts) > 0 {
+		events := make([]string, 0, len(d.Alerts))
+		for _, alert := range d.Alerts {
+			if !containsString(events, alert.Event) {
+				events = append(events, alert.Event)
+			}
+		}
+		b.WriteString(" Alerts: " + strings.Join(events, ", ") + ".")
+	}
+	return b.String()
+}
+
+// weekday returns the short weekday name of a YYYY-MM-DD date.
+func weekday(date string) string {
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return date
+	}
+	return t.Weekday().String()[:3]
+}
+
+// digestHandler serves digests for a location given as ?lat=&lon=, or
+// otherwise for each of the calling client's saved locations. ?period=
+// selects "daily" (the default) or "weekly".
+func (s *server) digestHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	period := q.Get("period")
+	if period == "" {
+		period = "daily"
+	}
+	if !containsString(digestPeriods, period) {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Unknown period %q (available: %s)", period, strings.Join(digestPeriods, ", "))
+		return
+	}
+
+	var targets []savedLocation
+	if q.Get("lat") != "" || q.Get("lon") != "" {
+		loc, err := models.ParseLocation(q.Get("lat"), q.Get("lon"))
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		targets = []savedLocation{{Lat: loc.Lat, Lon: loc.Lon}}
+	} else {
+		targets = s.locations.List(clientFromContext(r.Context()).ID)
+	}
+
+	list := DigestList{Digests: []Digest{}}
+	for _, target := range targets {
+		d, err := s.composeDigest(r.Context(), target.Name, target.location(), period)
+		if err != nil {
+			s.upstreamError(w, r, err)
+			return
+		}
+		list.Digests = append(list.Digests, d)
+	}
+	writeJSON(w, &list)
+}
+
+// parseDigestSchedule parses DIGEST_TIME ("07:00", UTC) and DIGEST_WEEKDAY
+// (e.g. "monday"), the time of day digests are sent and the day weekly
+// digests go out.
+func parseDigestSchedule(at, day string) (time.Duration, time.Weekday, error) {
+	t, err := time.Parse("15:04", at)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid time of day %q: want HH:MM", at)
+	}
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	for wd := time.Sunday; wd <= time.Saturday; wd++ {
+		if strings.EqualFold(day, wd.String()) {
+			return offset, wd, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid weekday %q", day)
+}
+
+// nextDigest returns the first time after now that is offset past midnight
+// UTC.
+func nextDigest(now time.Time, offset time.Duration) time.Time {
+	next := now.UTC().Truncate(24 * time.Hour).Add(offset)
+	if !next.After(now) {
+		next = next.Add(24 * time.Hour)
+	}
+	return next
+}
+
+// sendDigestsEvery sends digests for the saved locations that asked for
+// them each day at offset past midnight UTC; weekly digests go out on
+// weeklyOn. It stops when ctx is done.
+func (s *server) sendDigestsEvery(ctx context.Context, offset time.Duration, weeklyOn time.Weekday) {
+	for {
+		next := nextDigest(time.Now(), offset)
+		if !sleep(ctx, time.Until(next)) {
+			return
+		}
+		if !s.leader.IsLeader() {
+			continue
+		}
+		s.sendDigests(next.Weekday() == weeklyOn)
+	}
+}
+
+// sendDigests sends the daily digests and, if weekly is set, the weekly
+// ones. Failures are logged and don't hold up the other locations.
+func (s *server) sendDigests(weekly bool) {
+	sent := 0
+	for _, saved := range s.locations.All() {
+		if saved.Digest != "daily" && !(weekly && saved.Digest == "weekly") {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		d, err := s.composeDigest(ctx, saved.Name, saved.location(), saved.Digest)
+		if err == nil {
+			err = s.notify(ctx, notification{Type: "digest", ClientID: saved.ClientID, Data: d})
+		}
+		cancel()
+		if err != nil {
+			s.logger.Printf("Failed to send digest for saved location %s: %s", saved.ID, err)
+			continue
+		}
+		sent++
+	}
+	s.logger.Printf("Sent %d digests", sent)
+}
@@ -0,0 +1,190 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+const usgsProvider = "usgs"
+
+const (
+	// maxQuakeRadius bounds the radius of an earthquake request, in km.
+	maxQuakeRadius = 2000
+	// maxQuakeDays bounds how far back an earthquake request looks.
+	maxQuakeDays = 30
+	// maxQuakes bounds the number of earthquakes returned.
+	maxQuakes = 200
+)
+
+// USGSService is a client for the USGS earthquake catalog.
+type USGSService struct {
+	client  *http.Client
+	baseURL string
+}
+
+// Earthquake is an earthquake from the USGS catalog.
+type Earthquake struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Magnitude  float64   `json:"magnitude"`
+	Place      string    `json:"place"`
+	Lat        float64   `json:"lat"`
+	Lon        float64   `json:"lon"`
+	DepthKm    float64   `json:"depth_km"`
+	DistanceKm float64   `json:"distance_km"`
+	// Alert is the USGS PAGER alert level for expected impact: green,
+	// yellow, orange or red. Most earthquakes have none.
+	Alert   string `json:"alert,omitempty"`
+	Tsunami bool   `json:"tsunami"` // whether a tsunami message was issued
+	URL     string `json:"url"`
+}
+
+// GetEarthquakes returns the earthquakes of at least minMagnitude within
+// radiusKm of loc since since, most recent first.
+func (u *USGSService) GetEarthquakes(loc models.Location, radiusKm, minMagnitude float64, since time.Time) ([]Earthquake, error) {
+	lat, lon := loc.Strings()
+	params := url.Values{}
+	params.Add("format", "geojson")
+	params.Add("latitude", lat)
+	params.Add("longitude", lon)
+	params.Add("maxradiuskm", strconv.FormatFloat(radiusKm, 'f', -1, 64))
+	params.Add("minmagnitude", strconv.FormatFloat(minMagnitude, 'f', -1, 64))
+	params.Add("starttime", since.UTC().Format("2006-01-02T15:04:05"))
+	params.Add("orderby", "time")
+	params.Add("limit", strconv.Itoa(maxQuakes))
+
+	resp, err := u.client.Get(u.baseURL + "/fdsnws/event/1/query?" + params.Encode())
+	if err != nil {
+		return nil, &UpstreamError{Provider: usgsProvider, Class: ErrUpstreamUnavailable, Message: err.Error()}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 204 {
+		return []Earthquake{}, nil
+	}
+	if resp.StatusCode != 200 {
+		// errors are plain text
+		msg := resp.Status
+		if body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024)); err == nil && len(body) > 0 {
+			msg = strings.TrimSpace(string(body))
+		}
+		return nil, &UpstreamError{
+			Provider:   usgsProvider,
+			Class:      classifyStatus(resp.StatusCode),
+			StatusCode: resp.StatusCode,
+			Message:    msg,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now(), 0),
+		}
+	}
+
+	var collection struct {
+		Features []struct {
+			ID         string `json:"id"`
+			Properties struct {
+				Mag     float64 `json:"mag"`
+				Place   string  `json:"place"`
+				Time    int64   `json:"time"` // ms
+				Alert   string  `json:"alert"`
+				Tsunami int     `json:"tsunami"`
+				URL     string  `json:"url"`
+			} `json:"properties"`
+			Geometry struct {
+				Coordinates []float64 `json:"coordinates"` // lon, lat, depth
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&collection); err != nil {
+		return nil, &UpstreamError{Provider: usgsProvider, Class: ErrUpstreamUnavailable, StatusCode: resp.StatusCode, Message: err.Error()}
+	}
+	quakes := make([]Earthquake, 0, len(collection.Features))
+	for _, f := range collection.Features {
+		if len(f.Geometry.Coordinates) < 3 {
+			continue
+		}
+		p := f.Properties
+		quake := Earthquake{
+			ID:        f.ID,
+			Time:      time.Unix(0, p.Time*int64(time.Millisecond)).UTC(),
+			Magnitude: p.Mag,
+			Place:     p.Place,
+			Lon:       f.Geometry.Coordinates[0],
+			Lat:       f.Geometry.Coordinates[1],
+			DepthKm:   f.Geometry.Coordinates[2],
+			Alert:     p.Alert,
+			Tsunami:   p.Tsunami == 1,
+			URL:       p.URL,
+		}
+		quake.DistanceKm = math.Round(haversineKm(loc, models.Location{Lat: quake.Lat, Lon: quake.Lon})*10) / 10
+		quakes = append(quakes, quake)
+	}
+	return quakes, nil
+}
+
+// EarthquakeList is the response of the earthquakes endpoint.
+type EarthquakeList struct {
+	RadiusKm     float64      `json:"radius_km"`
+	MinMagnitude float64      `json:"min_magnitude"`
+	Days         int          `json:"days"`
+	Earthquakes  []Earthquake `json:"earthquakes"` // most recent first
+}
+
+// earthquakesHandler lists the earthquakes of at least ?min_magnitude= (2.5
+// by default) within ?radius_km= (250 by default) of a location over the
+// last ?days= (7 by default).
+func (s *server) earthquakesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	radius, minMagnitude, days := 250.0, 2.5, 7
+	if raw := q.Get("radius_km"); raw != "" {
+		var err error
+		if radius, err = strconv.ParseFloat(raw, 64); err != nil || radius <= 0 || radius > maxQuakeRadius {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "radius_km must be a number between 0 and %d", maxQuakeRadius)
+			return
+		}
+	}
+	if raw := q.Get("min_magnitude"); raw != "" {
+		var err error
+		if minMagnitude, err = strconv.ParseFloat(raw, 64); err != nil || minMagnitude < -1 || minMagnitude > 10 {
+			w.WriteHeader(400)
+			w.Write([]byte("min_magnitude must be a number between -1 and 10"))
+			return
+		}
+	}
+	if raw := q.Get("days"); raw != "" {
+		var err error
+		if days, err = strconv.Atoi(raw); err != nil || days < 1 || days > maxQuakeDays {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "days must be a whole number between 1 and %d", maxQuakeDays)
+			return
+		}
+	}
+
+	lat, lon, _ := s.requestLocation(r, q)
+	loc, err := models.ParseLocation(lat, lon)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	quakes, err := s.usgs.GetEarthquakes(loc, radius, minMagnitude, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		upstreamErrors.Inc(errorClass(err))
+		s.upstreamError(w, r, err)
+		return
+	}
+	writeJSON(w, &EarthquakeList{
+		RadiusKm:     radius,
+		MinMagnitude: minMagnitude,
+		Days:         days,
+		Earthquakes:  quakes,
+	})
+}
@@ -0,0 +1,131 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Classes of upstream failure. Errors returned by providers wrap exactly one
+// of these, so callers can use errors.Is to decide how to react.
+var (
+	ErrBadRequest          = errors.New("bad request")
+	ErrProviderAuth        = errors.New("provider authentication failed")
+	ErrNotFound            = errors.New("not found")
+	ErrRateLimited         = errors.New("rate limited")
+	ErrUpstreamUnavailable = errors.New("upstream unavailable")
+	ErrMalformedResponse   = errors.New("malformed response")
+)
+
+var upstreamErrors = newCounter("upstream_errors_total",
+	"Failed upstream requests, by error class.", "class")
+
+// UpstreamError is a failed request to a weather provider.
+type UpstreamError struct {
+	Provider   string // defaults to openweathermap
+	Class      error  // one of the Err* classes above
+	StatusCode int    // HTTP status from the provider, if we got that far
+	Message    string
+	RetryAfter time.Duration // how long the provider asked us to back off, if it did
+}
+
+func (e *UpstreamError) Error() string {
+	provider := e.Provider
+	if provider == "" {
+		provider = owmProvider
+	}
+	return fmt.Sprintf("Error from %s service: %s", provider, e.Message)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Class
+}
+
+// classifyStatus maps a provider HTTP status to an error class.
+func classifyStatus(code int) error {
+	switch {
+	case code == 400:
+		return ErrBadRequest
+	case code == 401 || code == 403:
+		return ErrProviderAuth
+	case code == 404:
+		return ErrNotFound
+	case code == 429:
+		return ErrRateLimited
+	default:
+		return ErrUpstreamUnavailable
+	}
+}
+
+// errorClass returns a short, metric-friendly name for err's class.
+func errorClass(err error) string {
+	switch {
+	case errors.Is(err, ErrBadRequest):
+		return "bad_request"
+	case errors.Is(err, ErrProviderAuth):
+		return "auth"
+	case errors.Is(err, ErrNotFound):
+		return "not_found"
+	case errors.Is(err, ErrRateLimited):
+		return "rate_limited"
+	case errors.Is(err, ErrUpstreamUnavailable):
+		return "unavailable"
+	case errors.Is(err, ErrMalformedResponse):
+		return "malformed"
+	case errors.Is(err, ErrSaturated):
+		return "saturated"
+	default:
+		return "other"
+	}
+}
+
+// upstreamError reports a failed weather lookup to the client, with a status
+// code matching the class of failure, and to the error reporting service if
+// such failures keep happening.
+func (s *server) upstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	msg := fmt.Sprintf("Failed to retrieve weather data: %s", err.Error())
+	s.logger.Println(msg)
+	s.sentry.UpstreamFailed(r, err)
+
+	switch {
+	case errors.Is(err, ErrBadRequest):
+		w.WriteHeader(400)
+	case errors.Is(err, ErrNotFound):
+		w.WriteHeader(404)
+	case errors.Is(err, ErrProviderAuth):
+		// don't leak provider details; it's our problem, not the client's
+		w.WriteHeader(503)
+		msg = "Weather provider authentication failed"
+	case errors.Is(err, ErrRateLimited):
+		retryAfter := time.Minute
+		var upstream *UpstreamError
+		if errors.As(err, &upstream) && upstream.RetryAfter > 0 {
+			retryAfter = upstream.RetryAfter
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		w.WriteHeader(503)
+	case errors.Is(err, ErrUpstreamUnavailable), errors.Is(err, ErrMalformedResponse):
+		w.WriteHeader(502)
+	case errors.Is(err, ErrSaturated):
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(503)
+	default:
+		w.WriteHeader(500)
+	}
+	w.Write([]byte(msg))
+}
+
+// storageError reports a failed operation on one of the service's stores.
+func (s *server) storageError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNotFound) {
+		w.WriteHeader(404)
+		w.Write([]byte("Not found"))
+		return
+	}
+	s.logger.Printf("Storage operation failed: %s", err)
+	w.WriteHeader(500)
+	w.Write([]byte("Internal error"))
+}
@@ -0,0 +1,98 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var injectedFaults = newCounter("injected_faults_total",
+	"Faults injected into upstream requests, by kind.", "kind")
+
+// faultTransport injects failures into upstream requests so that consumers
+// of this service can test how they cope with it misbehaving. Each kind of
+// fault fires independently at its configured rate (0 to 1).
+type faultTransport struct {
+	next http.RoundTripper
+
+	latency       time.Duration
+	latencyRate   float64
+	errorRate     float64
+	malformedRate float64
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newFaultTransport(next http.RoundTripper) *faultTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &faultTransport{next: next, rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Enabled reports whether any fault has a non-zero rate.
+func (t *faultTransport) Enabled() bool {
+	return t.latencyRate > 0 || t.errorRate > 0 || t.malformedRate > 0
+}
+
+// roll reports whether an event with probability rate should happen.
+func (t *faultTransport) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rng.Float64() < rate
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.roll(t.latencyRate) {
+		injectedFaults.Inc("latency")
+		select {
+		case <-time.After(t.latency):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	if t.roll(t.errorRate) {
+		injectedFaults.Inc("error")
+		if t.roll(0.5) {
+			return nil, errors.New("injected fault: connection reset")
+		}
+		body := []byte(`{"message":"injected fault"}`)
+		return &http.Response{
+			Status:        "500 Internal Server Error",
+			StatusCode:    500,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": {"application/json"}},
+			Body:          ioutil.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || !t.roll(t.malformedRate) {
+		return resp, err
+	}
+
+	// truncate the body mid-document, as a dropped connection would
+	injectedFaults.Inc("malformed")
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	body = body[:len(body)/2]
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
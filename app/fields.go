@@ -0,0 +1,55 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// parseFields splits a comma separated ?fields= value. A nil result means
+// the client did not ask for a projection.
+func parseFields(raw string) []string {
+	return splitList(raw)
+}
+
+// selectFields projects the JSON representation of v down to the given
+// top-level fields. Unknown field names are reported as an error so typos
+// don't silently produce empty responses.
+func selectFields(v interface{}, fields []string) (map[string]json.RawMessage, error) {
+	all, err := toObject(v)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		val, ok := all[f]
+		if !ok {
+			known := make([]string, 0, len(all))
+			for k := range all {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("Unknown field %q (available: %s)", f, strings.Join(known, ", "))
+		}
+		selected[f] = val
+	}
+	return selected, nil
+}
+
+// toObject converts v to its JSON object representation, keyed by field name.
+func toObject(v interface{}) (map[string]json.RawMessage, error) {
+	if obj, ok := v.(map[string]json.RawMessage); ok {
+		return obj, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
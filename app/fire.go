@@ -0,0 +1,121 @@
+package app
+
+import (
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// fireThresholds are the red flag criteria: weather at least this dry,
+// windy and hot makes fires start easily and spread fast.
+type fireThresholds struct {
+	Humidity float64            `json:"humidity"`    // at or below, %
+	Wind     float64            `json:"wind"`        // sustained, at or above, mph
+	Gust     float64            `json:"gust"`        // at or above, mph
+	Temp     models.Temperature `json:"temperature"` // at or above
+}
+
+// fireRisks are the risk levels, least to most severe.
+var fireRisks = []string{"low", "moderate", "high", "extreme"}
+
+// FireRisk is the response of the fire risk endpoint.
+type FireRisk struct {
+	Temperature *models.Temperature `json:"temperature"` // nil if unknown
+	Humidity    float64             `json:"humidity"`
+	WindSpeed   float64             `json:"wind_speed"`
+	WindGust    float64             `json:"wind_gust"`
+	// FosbergIndex is the Fosberg fire weather index, 0-100; above 50 is
+	// significant. It's nil if the temperature is unknown.
+	FosbergIndex *float64 `json:"fosberg_index"`
+	Dry          bool     `json:"dry"`
+	Windy        bool     `json:"windy"`
+	Hot          bool     `json:"hot"`
+	Risk         string   `json:"risk"`
+	// RedFlag is set while a red flag warning is in effect.
+	RedFlag    bool           `json:"red_flag"`
+	Alerts     []models.Alert `json:"alerts"` // fire weather alerts in effect
+	Thresholds fireThresholds `json:"thresholds"`
+}
+
+// fosbergIndex computes the Fosberg fire weather index from temperature,
+// relative humidity (%) and wind speed (mph).
+func fosbergIndex(t models.Temperature, humidity, wind float64) float64 {
+	temp := t.F() // the formula is in °F
+	var m float64 // equilibrium moisture content
+	switch {
+	case humidity < 10:
+		m = 0.03229 + 0.281073*humidity - 0.000578*humidity*temp
+	case humidity <= 50:
+		m = 2.22749 + 0.160107*humidity - 0.01478*temp
+	default:
+		m = 21.0606 + 0.005565*humidity*humidity - 0.00035*humidity*temp - 0.483199*humidity
+	}
+	m /= 30
+	eta := 1 - 2*m + 1.5*m*m - 0.5*m*m*m
+	return math.Min(100, math.Max(0, eta*math.Sqrt(1+wind*wind)/0.3002))
+}
+
+// fireRiskHandler assesses the fire danger at a location from the current
+// temperature, humidity and wind, and surfaces any fire weather alerts. Each
+// red flag criterion met raises the risk a level; a Fosberg index above 50
+// or a fire weather watch makes it at least high, and a red flag warning
+// makes it extreme.
+func (s *server) fireRiskHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lat, lon, _ := s.requestLocation(r, q)
+	data, err := s.fetchWeather(r.Context(), lat, lon)
+	if err != nil {
+		s.upstreamError(w, r, err)
+		return
+	}
+	alerts, err := s.locationAlerts(r.Context(), lat, lon)
+	if err != nil {
+		s.upstreamError(w, r, err)
+		return
+	}
+
+	t := s.fireThresholds
+	risk := FireRisk{
+		Temperature: data.Temp,
+		Humidity:    data.Humidity,
+		WindSpeed:   data.WindSpeed,
+		WindGust:    data.WindGust,
+		Dry:         data.Humidity <= t.Humidity,
+		Windy:       data.WindSpeed >= t.Wind || data.WindGust >= t.Gust,
+		Alerts:      []models.Alert{},
+		Thresholds:  t,
+	}
+	if data.Temp != nil {
+		fosberg := math.Round(fosbergIndex(*data.Temp, data.Humidity, data.WindSpeed)*10) / 10
+		risk.FosbergIndex = &fosberg
+		risk.Hot = !data.Temp.Less(t.Temp)
+	}
+	level := 0
+	for _, met := range []bool{risk.Dry, risk.Windy, risk.Hot} {
+		if met {
+			level++
+		}
+	}
+	if risk.FosbergIndex != nil && *risk.FosbergIndex > 50 && level < 2 {
+		level = 2
+	}
+	for _, alert := range alerts {
+		event := strings.ToLower(alert.Event)
+		switch {
+		case strings.Contains(event, "red flag"):
+			risk.RedFlag = true
+			level = 3
+		case strings.Contains(event, "fire"):
+			if level < 2 {
+				level = 2
+			}
+		default:
+			continue
+		}
+		risk.Alerts = append(risk.Alerts, alert)
+	}
+	risk.Risk = fireRisks[level]
+	writeJSON(w, &risk)
+}
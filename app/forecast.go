@@ -0,0 +1,135 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// forecastBlocks are the onecall blocks the forecast endpoint can return.
+var forecastBlocks = []string{"hourly", "daily"}
+
+// Forecast is the response of the forecast endpoint.
+type Forecast struct {
+	models.Forecast
+	Location *ResolvedLocation `json:"location,omitempty"`
+}
+
+// forecastHandler serves the hourly and daily forecast for a location.
+// ?include= narrows the response to some of the blocks, which also narrows
+// what we ask for and decode upstream.
+func (s *server) forecastHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lat, lon, resolved := s.requestLocation(r, q)
+
+	blocks := splitList(q.Get("include"))
+	if blocks == nil {
+		blocks = forecastBlocks
+	}
+	for _, block := range blocks {
+		if !containsString(forecastBlocks, block) {
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("Unknown forecast block %q (available: %s)",
+				block, strings.Join(forecastBlocks, ", "))))
+			return
+		}
+	}
+
+	data, err := s.forecast(lat, lon, blocks)
+	if err != nil {
+		s.upstreamFailed(err)
+		s.upstreamError(w, r, err)
+		return
+	}
+
+	forecast := Forecast{Forecast: newOWMForecast(data), Location: resolved}
+	if wantsGeoJSON(w, r, q) {
+		feature, err := locationFeature(lat, lon, &forecast)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		writeGeoJSON(w, &feature)
+		return
+	}
+	writeJSON(w, &forecast)
+}
+
+// unixTime converts a unix timestamp, where 0 means none, to a time.
+func unixTime(sec int64) *time.Time {
+	if sec == 0 {
+		return nil
+	}
+	t := time.Unix(sec, 0).UTC()
+	return &t
+}
+
+// decodeObjectFields reads a JSON object from dec, decoding the members
+// named in targets into the values they map to. All other members are
+// skipped token by token, so they're never materialized.
+func decodeObjectFields(dec *json.Decoder, targets map[string]interface{}) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if target, ok := targets[tok.(string)]; ok {
+			if err := dec.Decode(target); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := skipValue(dec); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// skipValue consumes the next JSON value from dec.
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %q, got %v", delim, tok)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
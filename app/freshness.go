@@ -0,0 +1,51 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// parseMaxAge parses a ?max_age= given as a duration ("120s", "2m") or a
+// number of seconds.
+func parseMaxAge(raw string) (time.Duration, error) {
+	if secs, err := strconv.Atoi(raw); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(raw)
+}
+
+// requestFreshness lets clients say how old current conditions may be with
+// ?max_age=, for when their tier's allowance is too stale for the job at
+// hand. Cached conditions older than that are refreshed from the provider
+// before the response is sent. A client can ask for fresher data than its
+// tier gets but not staler, and not fresher than maxAgeFloor, so that it
+// can't have every request go upstream.
+func (s *server) requestFreshness(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := r.URL.Query().Get("max_age")
+		if raw == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		maxAge, err := parseMaxAge(raw)
+		if err != nil || maxAge < 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("max_age must be a duration, such as 120s, or a number of seconds"))
+			return
+		}
+		if maxAge < s.maxAgeFloor {
+			w.WriteHeader(400)
+			w.Write([]byte("max_age must be at least " + s.maxAgeFloor.String()))
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), maxAgeContextKey, maxAge)))
+	})
+}
+
+// requestedMaxAge returns the max_age the request asked for, if any.
+func requestedMaxAge(ctx context.Context) (time.Duration, bool) {
+	maxAge, ok := ctx.Value(maxAgeContextKey).(time.Duration)
+	return maxAge, ok
+}
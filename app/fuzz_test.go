@@ -0,0 +1,144 @@
+//go:build go1.18
+// +build go1.18
+
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fuzzRoutes are the GET routes whose queries are fuzzed.
+var fuzzRoutes = []string{
+	"/weather/", "/widget", "/badge", "/forecast", "/geocode", "/compare",
+	"/route-weather", "/weather/area", "/weather/observed", "/agri/frost-risk",
+	"/agri/season", "/fire-risk", "/outdoor-score", "/snow", "/hazards",
+	"/tropical", "/earthquakes", "/degree-days", "/alerts", "/alerts/history",
+	"/alerts/recent", "/locations", "/digest", "/conditions/check",
+	"/calendar.ics",
+}
+
+// fuzzApp is the whole service, with every upstream request answered by
+// upstream instead of the network.
+type fuzzApp struct {
+	*App
+	upstream *staticTransport
+}
+
+func newFuzzApp(tb testing.TB) *fuzzApp {
+	a, err := New(Config{
+		Vars:   map[string]string{"API_KEY": "fuzz", "STARTUP_CHECK": "0", "CAP_INGEST_TOKEN": "fuzz"},
+		Logger: log.New(ioutil.Discard, "", 0),
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	upstream := &staticTransport{body: []byte(benchOneCall)}
+	// the providers share one client
+	a.server.owm.client.Transport = upstream
+	return &fuzzApp{App: a, upstream: upstream}
+}
+
+// get serves a GET request for target, starting from empty caches so
+// that the upstream response is used, and empty history so that memory use
+// stays flat.
+func (a *fuzzApp) get(t *testing.T, target string) {
+	a.server.cache = newWeatherCache()
+	a.server.responses = newResponseCache(a.server.responses.ttls, 0)
+	a.server.history = newHistoryStore()
+	a.do(t, "GET", target, "")
+}
+
+func (a *fuzzApp) do(t *testing.T, method, target, body string) {
+	req, err := http.NewRequest(method, target, strings.NewReader(body))
+	if err != nil {
+		return // not a request we could be sent
+	}
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Authorization", "Bearer fuzz")
+	rec := httptest.NewRecorder()
+	a.Handler().ServeHTTP(rec, req)
+	checkResponse(t, target, rec)
+}
+
+// checkResponse fails if a successful JSON response isn't valid JSON: an
+// encoding error part way through is reported after the status is sent.
+func checkResponse(t *testing.T, target string, rec *httptest.ResponseRecorder) {
+	if rec.Code != 200 || !strings.Contains(rec.Header().Get("Content-Type"), "json") {
+		return
+	}
+	if body := rec.Body.Bytes(); len(body) == 0 || !json.Valid(body) {
+		t.Errorf("%s: invalid JSON response: %q", target, body)
+	}
+}
+
+// FuzzQuery feeds arbitrary queries to the GET routes.
+func FuzzQuery(f *testing.F) {
+	f.Add(uint8(0), "lat=30.489772&lon=-99.771335")
+	f.Add(uint8(0), "q=Austin&fields=temperature,alerts&format=geojson")
+	f.Add(uint8(2), "lat=30.49&lon=-99.77&style=flat&units=metric")
+	f.Add(uint8(3), "lat=30.49&lon=-99.77&hours=12&days=3")
+	f.Add(uint8(5), "a=30.49,-99.77&b=47.61,-122.33")
+	f.Add(uint8(6), "points=30.49,-99.77;30.27,-97.74&depart=2020-09-13T12:00:00Z&speed=60")
+	f.Add(uint8(7), "bbox=30,-100,30.2,-99.8&grid=0.1")
+	f.Add(uint8(9), "lat=30.49&lon=-99.77&crop=tomato")
+	f.Add(uint8(17), "lat=30.49&lon=-99.77&base=50F&from=2020-01-01&to=2020-02-01")
+	f.Add(uint8(19), "lat=30.49&lon=-99.77&since=2020-01-01T00:00:00Z&limit=10&cursor=abc")
+	f.Add(uint8(23), "lat=30.49&lon=-99.77&rule=temp_lt:0C&rule=wind_gt:20")
+
+	a := newFuzzApp(f)
+	f.Fuzz(func(t *testing.T, route uint8, query string) {
+		a.upstream.body = []byte(benchOneCall)
+		a.get(t, fuzzRoutes[int(route)%len(fuzzRoutes)]+"?"+query)
+	})
+}
+
+// FuzzProviderResponse feeds arbitrary onecall responses through the routes
+// that decode them.
+func FuzzProviderResponse(f *testing.F) {
+	f.Add([]byte(benchOneCall))
+	f.Add([]byte(`{"current":{"dt":1600000000,"temp":1e308,"feels_like":-1e308,"humidity":-5,"weather":null}}`))
+	f.Add([]byte(`{"hourly":[{"dt":1600000000,"temp":40,"pop":0.1}],"daily":[{"dt":1600000000,"temp":{"min":60,"max":90}}]}`))
+	f.Add([]byte(`{"current":{},"alerts":[{"event":"","start":-1,"end":9223372036854775807}]}`))
+	f.Add([]byte(`[]`))
+
+	a := newFuzzApp(f)
+	f.Fuzz(func(t *testing.T, body []byte) {
+		a.upstream.body = body
+		for _, target := range []string{
+			"/weather/?lat=30.49&lon=-99.77",
+			"/weather/?lat=30.49&lon=-99.77&format=geojson",
+			"/compare?a=30.49,-99.77&b=47.61,-122.33",
+			"/forecast?lat=30.49&lon=-99.77",
+			"/fire-risk?lat=30.49&lon=-99.77",
+			"/outdoor-score?lat=30.49&lon=-99.77",
+			"/agri/frost-risk?lat=30.49&lon=-99.77",
+			"/alerts?lat=30.49&lon=-99.77",
+			"/badge?lat=30.49&lon=-99.77",
+			"/widget?lat=30.49&lon=-99.77",
+			"/snow?lat=30.49&lon=-99.77",
+			"/conditions/check?lat=30.49&lon=-99.77&rule=temp_lt:32",
+		} {
+			a.get(t, target)
+		}
+	})
+}
+
+// FuzzCAP feeds arbitrary CAP documents through ingestion and out of the
+// routes that report them.
+func FuzzCAP(f *testing.F) {
+	f.Add([]byte(`<?xml version="1.0"?><alert xmlns="urn:oasis:names:tc:emergency:cap:1.2"><identifier>x</identifier><sender>w</sender><sent>2020-09-13T12:00:00-05:00</sent><status>Actual</status><msgType>Alert</msgType><scope>Public</scope><info><event>Flood Warning</event><urgency>Immediate</urgency><severity>Severe</severity><certainty>Observed</certainty><expires>2020-09-14T12:00:00-05:00</expires><area><areaDesc>Here</areaDesc><polygon>30,-100 30,-99 31,-99 30,-100</polygon><circle>30.5,-99.5 10</circle></area></info></alert>`))
+
+	a := newFuzzApp(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		a.server.cap = newCAPStore()
+		a.do(t, "POST", "/ingest/cap", string(data))
+		a.get(t, "/alerts?lat=30.49&lon=-99.77")
+		a.get(t, "/alerts/recent")
+	})
+}
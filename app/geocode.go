@@ -0,0 +1,47 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Place is a named location matching a geocoding query.
+type Place struct {
+	Name    string  `json:"name"`
+	State   string  `json:"state,omitempty"`
+	Country string  `json:"country"`
+	Lat     float64 `json:"lat"`
+	Lon     float64 `json:"lon"`
+}
+
+// geocodeHandler looks up the coordinates of places matching ?q=, such as
+// "Austin, TX, US", best match first.
+func (s *server) geocodeHandler(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		w.WriteHeader(400)
+		w.Write([]byte("Missing q parameter"))
+		return
+	}
+
+	results, err := s.geocode(query)
+	if err != nil {
+		s.upstreamFailed(err)
+		s.upstreamError(w, r, err)
+		return
+	}
+
+	places := make([]Place, 0, len(results))
+	for _, result := range results {
+		places = append(places, Place(result))
+	}
+	if wantsGeoJSON(w, r, r.URL.Query()) {
+		features := make([]GeoJSONFeature, len(places))
+		for i := range places {
+			features[i] = pointFeature(places[i].Lat, places[i].Lon, &places[i])
+		}
+		writeGeoJSON(w, featureCollection(features))
+		return
+	}
+	writeJSON(w, places)
+}
@@ -0,0 +1,142 @@
+package app
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// geoIPBlock is a network with a known approximate location.
+type geoIPBlock struct {
+	network *net.IPNet
+	start   net.IP // 16-byte form of network.IP, for sorting
+	loc     models.Location
+}
+
+// geoIPDB maps addresses to approximate locations.
+type geoIPDB struct {
+	blocks []geoIPBlock // sorted by start, non-overlapping
+}
+
+// loadGeoIPDB reads a GeoIP database in the CSV layout of MaxMind's
+// GeoLite2 City "Blocks" files: a header row naming (at least) the network,
+// latitude and longitude columns. IPv4 and IPv6 files may be concatenated
+// by passing several paths.
+func loadGeoIPDB(paths ...string) (*geoIPDB, error) {
+	db := &geoIPDB{}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		err = db.load(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	sort.Slice(db.blocks, func(i, j int) bool {
+		return bytes.Compare(db.blocks[i].start, db.blocks[j].start) < 0
+	})
+	return db, nil
+}
+
+func (db *geoIPDB) load(r io.Reader) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	cols := map[string]int{}
+	for i, name := range header {
+		cols[name] = i
+	}
+	netCol, ok1 := cols["network"]
+	latCol, ok2 := cols["latitude"]
+	lonCol, ok3 := cols["longitude"]
+	if !ok1 || !ok2 || !ok3 {
+		return fmt.Errorf("missing network, latitude or longitude column")
+	}
+
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) <= netCol || len(record) <= latCol || len(record) <= lonCol {
+			continue
+		}
+		_, network, err := net.ParseCIDR(record[netCol])
+		if err != nil {
+			continue
+		}
+		lat, err1 := strconv.ParseFloat(record[latCol], 64)
+		lon, err2 := strconv.ParseFloat(record[lonCol], 64)
+		if err1 != nil || err2 != nil {
+			// some blocks only have a country, with no coordinates
+			continue
+		}
+		db.blocks = append(db.blocks, geoIPBlock{
+			network: network,
+			start:   network.IP.To16(),
+			loc:     models.Location{Lat: lat, Lon: lon},
+		})
+	}
+}
+
+// Lookup returns the approximate location of ip.
+func (db *geoIPDB) Lookup(ip net.IP) (models.Location, bool) {
+	if ip == nil {
+		return models.Location{}, false
+	}
+	ip16 := ip.To16()
+	// find the last block starting at or before ip
+	i := sort.Search(len(db.blocks), func(i int) bool {
+		return bytes.Compare(db.blocks[i].start, ip16) > 0
+	}) - 1
+	if i >= 0 && db.blocks[i].network.Contains(ip) {
+		return db.blocks[i].loc, true
+	}
+	return models.Location{}, false
+}
+
+// ResolvedLocation tells the client where we looked up weather for, when
+// they didn't say.
+type ResolvedLocation struct {
+	Lat    float64 `json:"lat"`
+	Lon    float64 `json:"lon"`
+	Source string  `json:"source"`
+}
+
+// requestLocation returns the lat/lon a request asks about. If it gives
+// neither and a GeoIP database is configured, the caller's approximate
+// location is used instead, and returned as resolved.
+func (s *server) requestLocation(r *http.Request, q url.Values) (lat, lon string, resolved *ResolvedLocation) {
+	lat, lon = q.Get("lat"), q.Get("lon")
+	if lat != "" || lon != "" || s.geoIP == nil {
+		return lat, lon, nil
+	}
+
+	loc, ok := s.geoIP.Lookup(clientIPFromContext(r.Context()))
+	if !ok {
+		return lat, lon, nil
+	}
+	resolved = &ResolvedLocation{Lat: loc.Lat, Lon: loc.Lon, Source: "geoip"}
+	lat, lon = loc.Strings()
+	return lat, lon, resolved
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+const geoJSONContentType = "application/geo+json"
+
+// GeoJSONGeometry is a GeoJSON geometry. Positions are [lon, lat].
+type GeoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+// GeoJSONFeature is a GeoJSON Feature.
+type GeoJSONFeature struct {
+	Type       string      `json:"type"`
+	Geometry   interface{} `json:"geometry"` // GeoJSONGeometry, raw JSON, or nil
+	Properties interface{} `json:"properties"`
+}
+
+// GeoJSONFeatureCollection is a GeoJSON FeatureCollection.
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+// wantsGeoJSON reports whether the client asked for GeoJSON, either with
+// ?format=geojson or by asking for application/geo+json.
+func wantsGeoJSON(w http.ResponseWriter, r *http.Request, q url.Values) bool {
+	return q.Get("format") == "geojson" || negotiate(w, r, geoJSONContentType)
+}
+
+// pointFeature returns a Point feature at lat/lon.
+func pointFeature(lat, lon float64, properties interface{}) GeoJSONFeature {
+	return GeoJSONFeature{
+		Type:       "Feature",
+		Geometry:   GeoJSONGeometry{Type: "Point", Coordinates: [2]float64{lon, lat}},
+		Properties: properties,
+	}
+}
+
+// locationFeature returns a Point feature at the location given by the
+// lat/lon query parameters.
+func locationFeature(lat, lon string, properties interface{}) (GeoJSONFeature, error) {
+	loc, err := models.ParseLocation(lat, lon)
+	if err != nil {
+		return GeoJSONFeature{}, err
+	}
+	return pointFeature(loc.Lat, loc.Lon, properties), nil
+}
+
+func featureCollection(features []GeoJSONFeature) *GeoJSONFeatureCollection {
+	if features == nil {
+		features = []GeoJSONFeature{}
+	}
+	return &GeoJSONFeatureCollection{Type: "FeatureCollection", Features: features}
+}
+
+// writeGeoJSON writes a GeoJSON response.
+func writeGeoJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", geoJSONContentType)
+	writeJSON(w, v)
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// geometryContains reports whether a GeoJSON Polygon, MultiPolygon or
+// GeometryCollection contains the point lon/lat. Other geometry types have
+// no area, so contain nothing.
+func geometryContains(raw json.RawMessage, lon, lat float64) (bool, error) {
+	var g struct {
+		Type        string            `json:"type"`
+		Coordinates json.RawMessage   `json:"coordinates"`
+		Geometries  []json.RawMessage `json:"geometries"`
+	}
+	if err := json.Unmarshal(raw, &g); err != nil {
+		return false, err
+	}
+
+	switch g.Type {
+	case "Polygon":
+		var rings [][][2]float64
+		if err := json.Unmarshal(g.Coordinates, &rings); err != nil {
+			return false, err
+		}
+		return polygonContains(rings, lon, lat), nil
+	case "MultiPolygon":
+		var polygons [][][][2]float64
+		if err := json.Unmarshal(g.Coordinates, &polygons); err != nil {
+			return false, err
+		}
+		for _, rings := range polygons {
+			if polygonContains(rings, lon, lat) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "GeometryCollection":
+		for _, child := range g.Geometries {
+			if ok, err := geometryContains(child, lon, lat); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	case "Point", "MultiPoint", "LineString", "MultiLineString":
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown geometry type %q", g.Type)
+}
+
+// polygonContains reports whether a polygon, given as an exterior ring
+// followed by any holes, contains the point.
+func polygonContains(rings [][][2]float64, lon, lat float64) bool {
+	if len(rings) == 0 || !ringContains(rings[0], lon, lat) {
+		return false
+	}
+	for _, hole := range rings[1:] {
+		if ringContains(hole, lon, lat) {
+			return false
+		}
+	}
+	return true
+}
+
+// ringContains is the even-odd ray casting test. Alert areas are small
+// enough that treating coordinates as planar is fine.
+func ringContains(ring [][2]float64, lon, lat float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
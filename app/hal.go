@@ -0,0 +1,91 @@
+package app
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const halContentType = "application/hal+json"
+
+// halLink is a HAL link object.
+type halLink struct {
+	Href string `json:"href"`
+	Type string `json:"type,omitempty"`
+}
+
+// wantsHAL reports whether the client opted into the HAL hypermedia format,
+// either with ?format=hal or by asking for application/hal+json.
+func wantsHAL(w http.ResponseWriter, r *http.Request, q url.Values) bool {
+	return q.Get("format") == "hal" || negotiate(w, r, halContentType)
+}
+
+// negotiate reports whether the request's Accept header asks for
+// mediaType, marking the response as varying by Accept so that shared
+// caches don't hand one client's representation to another.
+func negotiate(w http.ResponseWriter, r *http.Request, mediaType string) bool {
+	addVary(w.Header(), "Accept")
+	return accepts(r, mediaType)
+}
+
+// addVary adds a request header to the response's Vary unless it's there.
+func addVary(h http.Header, name string) {
+	for _, vary := range h.Values("Vary") {
+		for _, v := range strings.Split(vary, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
+// accepts reports whether the request's Accept header lists mediaType,
+// other than with q=0, which rules it out.
+func accepts(r *http.Request, mediaType string) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil || mt != mediaType {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// locationLinks returns links to the resources available for a location.
+func locationLinks(lat, lon string) map[string]halLink {
+	params := url.Values{}
+	params.Set("lat", lat)
+	params.Set("lon", lon)
+	query := params.Encode()
+
+	return map[string]halLink{
+		"self":     {Href: "/weather/?" + query},
+		"widget":   {Href: "/widget?" + query, Type: "text/html"},
+		"badge":    {Href: "/badge?" + query, Type: "image/svg+xml"},
+		"history":  {Href: "/weather/observed?" + query},
+		"forecast": {Href: "/forecast?" + query},
+		"alerts":   {Href: "/alerts?" + query},
+	}
+}
+
+// halResource decorates the JSON object representation of v with _links.
+func halResource(v interface{}, links map[string]halLink) (map[string]json.RawMessage, error) {
+	obj, err := toObject(v)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(links)
+	if err != nil {
+		return nil, err
+	}
+	obj["_links"] = encoded
+	return obj, nil
+}
@@ -0,0 +1,203 @@
+package app_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cstrahan/banno-project/app"
+)
+
+// Paths the fake openweathermap answers on.
+const (
+	oneCallPath  = "/data/2.5/onecall"
+	oneCall3Path = "/data/3.0/onecall"
+	checkPath    = "/data/2.5/weather"
+)
+
+// oneCallBody is a typical onecall response for the current weather.
+const oneCallBody = `{"lat":30.49,"lon":-99.77,"current":{"dt":1600000000,"temp":93.2,"feels_like":95.1,
+"humidity":40,"wind_speed":8,"weather":[{"description":"clear sky"}]},
+"alerts":[{"sender_name":"NWS Austin/San Antonio","event":"Heat Advisory","start":1600000000,"end":1600050000}]}`
+
+// upstreamResponse is a response scripted for the fake openweathermap.
+type upstreamResponse struct {
+	Status int
+	Header http.Header
+	Body   string
+	Delay  time.Duration // before responding
+}
+
+// ok is a successful response with body.
+func ok(body string) upstreamResponse {
+	return upstreamResponse{Status: 200, Body: body}
+}
+
+// failure is an error response, with the JSON body openweathermap sends.
+func failure(status int, message string) upstreamResponse {
+	return upstreamResponse{Status: status, Body: `{"cod":` + strconv.Itoa(status) + `,"message":"` + message + `"}`}
+}
+
+// fakeOWM stands in for openweathermap. Responses are scripted per path
+// and served in order, the last one repeating; unscripted paths get a
+// successful onecall response or an empty object.
+type fakeOWM struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	scripts  map[string][]upstreamResponse
+	requests map[string][]*http.Request
+}
+
+func newFakeOWM(t *testing.T) *fakeOWM {
+	f := &fakeOWM{
+		scripts:  make(map[string][]upstreamResponse),
+		requests: make(map[string][]*http.Request),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// Script sets the responses to requests for path, replacing any left over
+// from an earlier script.
+func (f *fakeOWM) Script(path string, responses ...upstreamResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.scripts[path] = responses
+}
+
+// Requests returns the requests made for path so far.
+func (f *fakeOWM) Requests(path string) []*http.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*http.Request(nil), f.requests[path]...)
+}
+
+func (f *fakeOWM) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests[r.URL.Path] = append(f.requests[r.URL.Path], r)
+	resp := ok("{}")
+	switch r.URL.Path {
+	case oneCallPath:
+		resp = ok(oneCallBody)
+	case oneCall3Path:
+		// as for a key without a 3.0 subscription
+		resp = failure(401, "Please note that using One Call 3.0 requires a separate subscription")
+	}
+	if script := f.scripts[r.URL.Path]; len(script) > 0 {
+		resp = script[0]
+		if len(script) > 1 {
+			f.scripts[r.URL.Path] = script[1:]
+		}
+	}
+	f.mu.Unlock()
+
+	if resp.Delay > 0 {
+		time.Sleep(resp.Delay)
+	}
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.Status)
+	w.Write([]byte(resp.Body))
+}
+
+// harness runs the whole service, background jobs included, against a
+// fake openweathermap.
+type harness struct {
+	t   *testing.T
+	owm *fakeOWM
+	url string
+
+	logs lockedBuffer
+}
+
+// newHarness starts the service with the given settings on top of the
+// harness defaults, stopping it when the test ends.
+func newHarness(t *testing.T, vars map[string]string) *harness {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newHarnessOn(t, vars, ln)
+}
+
+// newHarnessOn is newHarness serving on ln.
+func newHarnessOn(t *testing.T, vars map[string]string, ln net.Listener) *harness {
+	h := &harness{t: t, owm: newFakeOWM(t)}
+	config := app.Config{
+		Vars: map[string]string{
+			"API_KEY":       "test",
+			"OWM_URL":       h.owm.URL,
+			"STARTUP_CHECK": "0",
+		},
+		Logger: log.New(&h.logs, "", log.Lmicroseconds),
+	}
+	for name, value := range vars {
+		config.Vars[name] = value
+	}
+	a, err := app.New(config)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+
+	h.url = "http://" + ln.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- a.Serve(ctx, ln) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Serve: %s", err)
+		}
+		if t.Failed() {
+			t.Logf("service logs:\n%s", h.logs.String())
+		}
+	})
+	return h
+}
+
+// get requests path from the service, returning the response with its body
+// read.
+func (h *harness) get(path string) (*http.Response, string) {
+	h.t.Helper()
+	resp, err := http.Get(h.url + path)
+	if err != nil {
+		h.t.Fatalf("GET %s: %s", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		h.t.Fatalf("GET %s: %s", path, err)
+	}
+	return resp, string(body)
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use, for collecting
+// logs.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
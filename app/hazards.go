@@ -0,0 +1,263 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+const (
+	// hazardQuakeRadius and hazardQuakeMagnitude pick the earthquakes worth
+	// listing as hazards: strong enough to be felt, near enough to matter.
+	hazardQuakeRadius    = 300
+	hazardQuakeMagnitude = 4
+	// hazardQuakeWindow is how long an earthquake stays on the list.
+	hazardQuakeWindow = 24 * time.Hour
+	// hazardStormRadius is how near a storm's center must be to count as a
+	// hazard when the location is outside its cone.
+	hazardStormRadius = 300
+)
+
+// hazardSeverities are the severity levels, least to most severe.
+var hazardSeverities = []string{"minor", "moderate", "severe", "extreme"}
+
+// Hazard is a normalized threat at a location, whatever its source.
+type Hazard struct {
+	Type        string     `json:"type"` // weather, air_quality, tropical or earthquake
+	Title       string     `json:"title"`
+	Severity    string     `json:"severity"`
+	Source      string     `json:"source"`
+	Start       time.Time  `json:"start"`
+	End         *time.Time `json:"end,omitempty"` // absent if open-ended
+	Description string     `json:"description,omitempty"`
+	URL         string     `json:"url,omitempty"`
+}
+
+// HazardList is the response of the hazards endpoint.
+type HazardList struct {
+	Hazards []Hazard `json:"hazards"` // most severe first
+	// Unavailable lists the hazard types that couldn't be checked, so an
+	// empty list isn't mistaken for an all clear.
+	Unavailable []string `json:"unavailable,omitempty"`
+}
+
+// hazardSeverity normalizes a weather alert's severity. Alerts without one
+// (openweathermap's) are judged by their name.
+func hazardSeverity(alert models.Alert) string {
+	severity := strings.ToLower(alert.Severity)
+	if containsString(hazardSeverities, severity) {
+		return severity
+	}
+	switch alertSeverity(alert.Event) {
+	case 3:
+		return "severe"
+	case 2:
+		return "moderate"
+	}
+	return "minor"
+}
+
+// hazardsHandler lists the hazards at a location: weather alerts, poor air
+// quality, tropical cyclones threatening it and recent strong earthquakes
+// nearby. Sources are checked concurrently; those that fail are listed as
+// unavailable rather than failing the request, unless all of them fail.
+func (s *server) hazardsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lat, lon, _ := s.requestLocation(r, q)
+	loc, err := models.ParseLocation(lat, lon)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	checks := []struct {
+		kind  string
+		check func() ([]Hazard, error)
+	}{
+		{"weather", func() ([]Hazard, error) { return s.weatherHazards(r.Context(), lat, lon) }},
+		{"air_quality", func() ([]Hazard, error) { return s.airQualityHazards(lat, lon) }},
+		{"tropical", func() ([]Hazard, error) { return s.tropicalHazards(loc) }},
+		{"earthquake", func() ([]Hazard, error) { return s.earthquakeHazards(loc) }},
+	}
+	var (
+		wg      sync.WaitGroup
+		found   = make([][]Hazard, len(checks))
+		checked = make([]error, len(checks))
+	)
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, check func() ([]Hazard, error)) {
+			defer wg.Done()
+			found[i], checked[i] = check()
+		}(i, c.check)
+	}
+	wg.Wait()
+
+	list := HazardList{Hazards: []Hazard{}}
+	for i, c := range checks {
+		if err := checked[i]; err != nil {
+			s.logger.Printf("Failed to check %s hazards: %s", c.kind, err)
+			list.Unavailable = append(list.Unavailable, c.kind)
+			continue
+		}
+		list.Hazards = append(list.Hazards, found[i]...)
+	}
+	if len(list.Unavailable) == len(checks) {
+		s.upstreamError(w, r, checked[0])
+		return
+	}
+	rank := func(h Hazard) int {
+		for i, severity := range hazardSeverities {
+			if h.Severity == severity {
+				return i
+			}
+		}
+		return -1
+	}
+	sort.SliceStable(list.Hazards, func(i, j int) bool {
+		a, b := list.Hazards[i], list.Hazards[j]
+		if rank(a) != rank(b) {
+			return rank(a) > rank(b)
+		}
+		return a.Start.Before(b.Start)
+	})
+	writeJSON(w, &list)
+}
+
+func (s *server) weatherHazards(ctx context.Context, lat, lon string) ([]Hazard, error) {
+	alerts, err := s.locationAlerts(ctx, lat, lon)
+	if err != nil {
+		return nil, err
+	}
+	var hazards []Hazard
+	for _, alert := range alerts {
+		h := Hazard{
+			Type:        "weather",
+			Title:       alert.Event,
+			Severity:    hazardSeverity(alert),
+			Source:      alert.Source,
+			Start:       alert.Start,
+			Description: alert.Headline,
+		}
+		if !alert.End.IsZero() {
+			end := alert.End
+			h.End = &end
+		}
+		hazards = append(hazards, h)
+	}
+	return hazards, nil
+}
+
+func (s *server) airQualityHazards(lat, lon string) ([]Hazard, error) {
+	air, err := s.owm.GetAirQuality(lat, lon)
+	if err != nil {
+		s.upstreamFailed(err)
+		return nil, err
+	}
+	if len(air.List) == 0 {
+		return nil, nil
+	}
+	var h Hazard
+	switch air.List[0].Main.AQI {
+	case 4:
+		h = Hazard{Title: "Poor air quality", Severity: "moderate"}
+	case 5:
+		h = Hazard{Title: "Very poor air quality", Severity: "severe"}
+	default:
+		return nil, nil
+	}
+	h.Type = "air_quality"
+	h.Source = owmProvider
+	h.Start = time.Now().UTC().Truncate(time.Hour)
+	h.Description = "Sensitive groups should avoid outdoor exertion."
+	if h.Severity == "severe" {
+		h.Description = "Everyone should avoid outdoor exertion."
+	}
+	return []Hazard{h}, nil
+}
+
+func (s *server) tropicalHazards(loc models.Location) ([]Hazard, error) {
+	storms, err := s.nhc.ActiveStorms()
+	if err != nil {
+		upstreamErrors.Inc(errorClass(err))
+		return nil, err
+	}
+	var hazards []Hazard
+	for _, storm := range storms {
+		inCone := false
+		if storm.Cone != nil {
+			inCone, _ = geometryContains(storm.Cone, loc.Lon, loc.Lat)
+		}
+		distance := haversineKm(loc, models.Location{Lat: storm.Lat, Lon: storm.Lon})
+		if !inCone && distance > hazardStormRadius {
+			continue
+		}
+		severity := "moderate"
+		switch {
+		case storm.Classification == "Hurricane" && storm.WindSpeed >= 111: // category 3 and up
+			severity = "extreme"
+		case storm.Classification == "Hurricane":
+			severity = "severe"
+		}
+		description := fmt.Sprintf("Center is %.0f km away, moving %s.", distance, storm.Movement)
+		if storm.Movement == "" {
+			description = fmt.Sprintf("Center is %.0f km away.", distance)
+		}
+		if inCone {
+			description += " This location is in the forecast cone."
+		}
+		hazards = append(hazards, Hazard{
+			Type:        "tropical",
+			Title:       storm.Classification + " " + storm.Name,
+			Severity:    severity,
+			Source:      nhcProvider,
+			Start:       storm.UpdatedAt,
+			Description: description,
+			URL:         storm.AdvisoryURL,
+		})
+	}
+	return hazards, nil
+}
+
+func (s *server) earthquakeHazards(loc models.Location) ([]Hazard, error) {
+	quakes, err := s.usgs.GetEarthquakes(loc, hazardQuakeRadius, hazardQuakeMagnitude, time.Now().Add(-hazardQuakeWindow))
+	if err != nil {
+		upstreamErrors.Inc(errorClass(err))
+		return nil, err
+	}
+	var hazards []Hazard
+	for _, quake := range quakes {
+		// the PAGER alert, when there is one, reflects the expected impact
+		severity := map[string]string{"red": "extreme", "orange": "severe", "yellow": "moderate"}[quake.Alert]
+		if severity == "" {
+			severity = "minor"
+			switch {
+			case quake.Magnitude >= 6:
+				severity = "severe"
+			case quake.Magnitude >= 5:
+				severity = "moderate"
+			}
+		}
+		description := fmt.Sprintf("%.0f km away, %.0f km deep.", quake.DistanceKm, quake.DepthKm)
+		if quake.Tsunami {
+			description += " A tsunami message was issued."
+		}
+		hazards = append(hazards, Hazard{
+			Type:        "earthquake",
+			Title:       fmt.Sprintf("M%.1f earthquake %s", quake.Magnitude, quake.Place),
+			Severity:    severity,
+			Source:      usgsProvider,
+			Start:       quake.Time,
+			Description: description,
+			URL:         quake.URL,
+		})
+	}
+	return hazards, nil
+}
@@ -0,0 +1,85 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// readiness tracks whether the service should be sent traffic. Components
+// mark themselves not ready with a reason; the service is ready when no
+// component objects.
+type readiness struct {
+	mu       sync.Mutex
+	notReady map[string]string
+}
+
+func newReadiness() *readiness {
+	return &readiness{notReady: make(map[string]string)}
+}
+
+// SetNotReady marks component as not ready, for the given reason. It
+// reports whether the component was previously ready.
+func (r *readiness) SetNotReady(component, reason string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, was := r.notReady[component]
+	r.notReady[component] = reason
+	return !was
+}
+
+// SetReady clears any objection from component. It reports whether the
+// component was previously not ready.
+func (r *readiness) SetReady(component string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, was := r.notReady[component]
+	delete(r.notReady, component)
+	return was
+}
+
+// IsReady reports whether the component is currently ready.
+func (r *readiness) IsReady(component string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, notReady := r.notReady[component]
+	return !notReady
+}
+
+// readyHandler answers orchestrator readiness probes.
+func (r *readiness) readyHandler(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	components := make([]string, 0, len(r.notReady))
+	for c := range r.notReady {
+		components = append(components, c)
+	}
+	sort.Strings(components)
+	reasons := make([]string, len(components))
+	for i, c := range components {
+		reasons[i] = fmt.Sprintf("%s: %s", c, r.notReady[c])
+	}
+	r.mu.Unlock()
+
+	if len(reasons) > 0 {
+		w.WriteHeader(503)
+		for _, reason := range reasons {
+			fmt.Fprintln(w, reason)
+		}
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// healthHandler answers liveness probes; if we can respond, we're alive.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// isOperationalPath reports whether path serves operators rather than API
+// clients. Protective middleware leaves these alone; they're how operators
+// see what is going on.
+func isOperationalPath(path string) bool {
+	return path == "/healthz" || path == "/readyz" || path == "/metrics" || strings.HasPrefix(path, "/admin/")
+}
@@ -0,0 +1,140 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var upstreamHedges = newCounter("upstream_hedged_requests_total",
+	"Hedged requests sent to the provider, by whether they answered first: won or lost.", "result")
+
+// hedger tames tail latency: if a request hasn't been answered within
+// delay, it sends the same request again, to the alternate provider if
+// there is one, and takes whichever answers first. The other is cancelled.
+// Hedging spends quota, so delay should sit well out in the latency tail,
+// around the 95th percentile. A nil hedger sends requests once.
+type hedger struct {
+	delay time.Duration
+	// alternate, if set, is the scheme and host hedged requests go to: a
+	// mirror or proxy of the same API.
+	alternate *url.URL
+}
+
+func newHedger(delay time.Duration, alternate string) (*hedger, error) {
+	h := &hedger{delay: delay}
+	if alternate != "" {
+		u, err := url.Parse(alternate)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("not an absolute URL: %q", alternate)
+		}
+		h.alternate = u
+	}
+	return h, nil
+}
+
+type hedgedResult struct {
+	resp   *http.Response
+	err    error
+	cancel context.CancelFunc
+	hedge  bool
+}
+
+// Get fetches u with client, hedging if it's slow to answer. A failure
+// doesn't win the race unless both requests fail.
+func (h *hedger) Get(client *http.Client, u string) (*http.Response, error) {
+	if h == nil {
+		return client.Get(u)
+	}
+	results := make(chan hedgedResult, 2)
+	send := func(u string, hedge bool) {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if err != nil {
+			results <- hedgedResult{err: err, cancel: cancel, hedge: hedge}
+			return
+		}
+		resp, err := client.Do(req)
+		results <- hedgedResult{resp: resp, err: err, cancel: cancel, hedge: hedge}
+	}
+	go send(u, false)
+
+	timer := time.NewTimer(h.delay)
+	defer timer.Stop()
+	var first hedgedResult
+	select {
+	case first = <-results:
+		if first.err == nil {
+			return winner(first), nil
+		}
+		// failed fast; no point hedging
+		first.cancel()
+		return nil, first.err
+	case <-timer.C:
+	}
+
+	go send(h.hedgeURL(u), true)
+	first = <-results
+	if first.err != nil {
+		first.cancel()
+		first = <-results
+		h.observe(first)
+		if first.err != nil {
+			first.cancel()
+			return nil, first.err
+		}
+		return winner(first), nil
+	}
+	h.observe(first)
+	// let the loser finish in the background, then discard it
+	go func() {
+		loser := <-results
+		loser.cancel()
+		if loser.err == nil {
+			loser.resp.Body.Close()
+		}
+	}()
+	return winner(first), nil
+}
+
+func (h *hedger) observe(r hedgedResult) {
+	if r.hedge {
+		upstreamHedges.Inc("won")
+	} else {
+		upstreamHedges.Inc("lost")
+	}
+}
+
+// hedgeURL returns where to send the hedge for u.
+func (h *hedger) hedgeURL(u string) string {
+	if h.alternate == nil {
+		return u
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	parsed.Scheme, parsed.Host = h.alternate.Scheme, h.alternate.Host
+	return parsed.String()
+}
+
+// winner returns r's response, arranging for its request's context to be
+// released once the body is closed.
+func winner(r hedgedResult) *http.Response {
+	r.resp.Body = &cancelingBody{ReadCloser: r.resp.Body, cancel: r.cancel}
+	return r.resp
+}
+
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
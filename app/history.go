@@ -0,0 +1,465 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// maxHistoryRecords bounds how many observations per location (and alerts
+// overall) the history store keeps; the oldest records are dropped first.
+const maxHistoryRecords = 100000
+
+// observation is a single recorded reading of current conditions.
+type observation struct {
+	Location   models.Location    `json:"location"`
+	Time       time.Time          `json:"time"`
+	Temp       models.Temperature `json:"temp"`
+	FeelsLike  models.Temperature `json:"feels_like"`
+	Conditions []string           `json:"conditions"`
+	Precip     float64            `json:"precip,omitempty"` // inches in the hour before
+}
+
+// alertRecord is a single alert seen for a location.
+type alertRecord struct {
+	Seq      int64           `json:"-"`
+	Location models.Location `json:"location"`
+	Event    string          `json:"event"`
+	Sender   string          `json:"sender"`
+	Severity string          `json:"severity,omitempty"`
+	Source   string          `json:"source,omitempty"`
+	Start    time.Time       `json:"start"`
+	End      time.Time       `json:"end"`
+	SeenAt   time.Time       `json:"seen_at"`
+}
+
+// key identifies an alert for de-duplication.
+func (a alertRecord) key() string {
+	return a.Location.Key() + "|" + a.Event + "|" + a.Start.Format(time.RFC3339)
+}
+
+// historyStore keeps what the service has observed. Observations are kept
+// per location, ordered by observation time, so that backfilled data slots
+// in where it belongs. Alerts are kept in the order they were seen, each
+// with a monotonically increasing sequence number that doubles as a stable
+// pagination cursor.
+//
+// When path is set the store is loaded from and periodically saved to a
+// JSON file there.
+type historyStore struct {
+	mu           sync.Mutex
+	seq          int64
+	observations map[string][]observation
+	daily        map[string][]dailyAggregate
+	alerts       []alertRecord
+	seenAlerts   map[string]bool
+
+	path   string
+	dirty  bool
+	logger *log.Logger
+}
+
+// historySnapshot is the on-disk representation of a historyStore. Alerts
+// keep their sequence numbers, and AlertSeq is the last one handed out, so
+// that pagination cursors stay good across restarts.
+type historySnapshot struct {
+	Observations []observation    `json:"observations"`
+	Daily        []dailyAggregate `json:"daily"`
+	Alerts       []storedAlert    `json:"alerts"`
+	AlertSeq     int64            `json:"alert_seq,omitempty"`
+}
+
+// storedAlert is an alertRecord as saved, sequence number included.
+type storedAlert struct {
+	alertRecord
+	Seq int64 `json:"seq,omitempty"`
+}
+
+func newHistoryStore() *historyStore {
+	return &historyStore{
+		observations: make(map[string][]observation),
+		daily:        make(map[string][]dailyAggregate),
+		seenAlerts:   make(map[string]bool),
+		logger:       log.Default(),
+	}
+}
+
+// openHistoryStore returns a history store persisted at path.
+func openHistoryStore(path string) (*historyStore, error) {
+	h := newHistoryStore()
+	h.path = path
+
+	var snap historySnapshot
+	if err := loadJSONFile(path, &snap); err != nil {
+		return nil, err
+	}
+	for _, agg := range snap.Daily {
+		key := agg.Location.Key()
+		h.daily[key] = append(h.daily[key], agg)
+	}
+	for _, aggs := range h.daily {
+		sort.Slice(aggs, func(i, j int) bool { return aggs[i].Date < aggs[j].Date })
+	}
+	h.Upsert(snap.Observations)
+	for _, a := range snap.Alerts {
+		// files from before sequence numbers were saved have none, and
+		// are numbered as they're loaded
+		a.alertRecord.Seq = a.Seq
+		h.addAlert(a.alertRecord)
+	}
+	if snap.AlertSeq > h.seq {
+		h.seq = snap.AlertSeq
+	}
+	h.dirty = false
+	return h, nil
+}
+
+// Save writes the store to disk if it has changed since the last save.
+func (h *historyStore) Save() error {
+	if h.path == "" {
+		return nil
+	}
+
+	h.mu.Lock()
+	if !h.dirty {
+		h.mu.Unlock()
+		return nil
+	}
+	var snap historySnapshot
+	for _, obs := range h.observations {
+		snap.Observations = append(snap.Observations, obs...)
+	}
+	for _, aggs := range h.daily {
+		snap.Daily = append(snap.Daily, aggs...)
+	}
+	for _, a := range h.alerts {
+		snap.Alerts = append(snap.Alerts, storedAlert{a, a.Seq})
+	}
+	snap.AlertSeq = h.seq
+	h.dirty = false
+	h.mu.Unlock()
+
+	if err := saveJSONFile(h.path, &snap); err != nil {
+		h.mu.Lock()
+		h.dirty = true
+		h.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// saveEvery periodically saves the store until ctx is done.
+func (h *historyStore) saveEvery(ctx context.Context, interval time.Duration) {
+	for range ticks(ctx, interval) {
+		if err := h.Save(); err != nil {
+			h.logger.Printf("Failed to save history: %s", err)
+		}
+	}
+}
+
+// Record stores the observation and alerts in the current conditions. There's
+// no observation without a temperature; a missing feels like temperature
+// defaults to the temperature, as it does on import.
+func (h *historyStore) Record(loc models.Location, data *models.CurrentConditions) {
+	now := time.Now().UTC()
+
+	if temp := data.Temp; temp != nil {
+		conditions := append([]string{}, data.Conditions...)
+		feelsLike := *temp
+		if data.FeelsLike != nil {
+			feelsLike = *data.FeelsLike
+		}
+		h.Upsert([]observation{{
+			Location:   loc,
+			Time:       data.Time,
+			Temp:       *temp,
+			FeelsLike:  feelsLike,
+			Conditions: conditions,
+			Precip:     data.Precip,
+		}})
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, alert := range data.Alerts {
+		h.addAlert(alertRecord{
+			Location: loc,
+			Event:    alert.Event,
+			Sender:   alert.Sender,
+			Source:   alert.Source,
+			Start:    alert.Start,
+			End:      alert.End,
+			SeenAt:   now,
+		})
+	}
+}
+
+// RecordAlerts stores alerts other than those reported along with the
+// current conditions, which Record stores.
+func (h *historyStore) RecordAlerts(loc models.Location, alerts []models.Alert) {
+	now := time.Now().UTC()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, alert := range alerts {
+		h.addAlert(alertRecord{
+			Location: loc,
+			Event:    alert.Event,
+			Sender:   alert.Sender,
+			Severity: alert.Severity,
+			Source:   alert.Source,
+			Start:    alert.Start,
+			End:      alert.End,
+			SeenAt:   now,
+		})
+	}
+}
+
+// Upsert inserts observations, replacing any existing observation for the
+// same location and time. It reports how many were inserted and updated.
+// Observations for days that have already been compacted into a daily
+// aggregate are ignored, so re-importing old data doesn't count it twice.
+func (h *historyStore) Upsert(observations []observation) (inserted, updated int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, obs := range observations {
+		key := obs.Location.Key()
+		if h.compacted(key, obs.Time) {
+			continue
+		}
+		list := h.observations[key]
+		i := sort.Search(len(list), func(i int) bool {
+			return !list[i].Time.Before(obs.Time)
+		})
+		if i < len(list) && list[i].Time.Equal(obs.Time) {
+			list[i] = obs
+			updated++
+		} else {
+			list = append(list, observation{})
+			copy(list[i+1:], list[i:])
+			list[i] = obs
+			if len(list) > maxHistoryRecords {
+				list = list[len(list)-maxHistoryRecords:]
+			}
+			inserted++
+		}
+		h.observations[key] = list
+	}
+
+	if inserted+updated > 0 {
+		h.dirty = true
+	}
+	return inserted, updated
+}
+
+// addAlert appends an alert unless it has been seen before, numbering it
+// unless it already has a sequence number. The caller must hold h.mu.
+func (h *historyStore) addAlert(record alertRecord) {
+	if h.seenAlerts[record.key()] {
+		return
+	}
+	h.seenAlerts[record.key()] = true
+	if record.Seq == 0 {
+		h.seq++
+		record.Seq = h.seq
+	} else if record.Seq > h.seq {
+		h.seq = record.Seq
+	}
+	h.alerts = append(h.alerts, record)
+	if len(h.alerts) > maxHistoryRecords {
+		dropped := len(h.alerts) - maxHistoryRecords
+		for _, a := range h.alerts[:dropped] {
+			delete(h.seenAlerts, a.key())
+		}
+		h.alerts = h.alerts[dropped:]
+	}
+	h.dirty = true
+}
+
+// Observations returns up to limit observations for loc, newest first,
+// starting before the given time (the zero time means from the newest).
+func (h *historyStore) Observations(loc models.Location, before time.Time, limit int) []observation {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	list := h.observations[loc.Key()]
+	end := len(list)
+	if !before.IsZero() {
+		end = sort.Search(len(list), func(i int) bool {
+			return !list[i].Time.Before(before)
+		})
+	}
+	var out []observation
+	for i := end - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, list[i])
+	}
+	return out
+}
+
+// RecentAlerts returns up to limit alerts across all locations, most
+// recently seen first, starting before the given sequence number.
+func (h *historyStore) RecentAlerts(before int64, limit int) []alertRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var out []alertRecord
+	for i := len(h.alerts) - 1; i >= 0 && len(out) < limit; i-- {
+		if a := h.alerts[i]; before == 0 || a.Seq < before {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// alertQuery selects alerts from the archive.
+type alertQuery struct {
+	Location models.Location
+	// From and To select alerts in effect at any time in [From, To). The
+	// zero time leaves that end of the range open.
+	From, To time.Time
+	// Event matches alerts whose event contains it, ignoring case.
+	Event string
+}
+
+func (q alertQuery) matches(a alertRecord) bool {
+	return a.Location.Key() == q.Location.Key() &&
+		(q.From.IsZero() || a.End.After(q.From)) &&
+		(q.To.IsZero() || a.Start.Before(q.To)) &&
+		(q.Event == "" || strings.Contains(strings.ToLower(a.Event), strings.ToLower(q.Event)))
+}
+
+// AlertHistory returns up to limit alerts matching q, most recently seen
+// first, starting before the given sequence number.
+func (h *historyStore) AlertHistory(q alertQuery, before int64, limit int) []alertRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var out []alertRecord
+	for i := len(h.alerts) - 1; i >= 0 && len(out) < limit; i-- {
+		if a := h.alerts[i]; (before == 0 || a.Seq < before) && q.matches(a) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// observedHandler lists the observations recorded for a location.
+func (s *server) observedHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	loc, err := models.ParseLocation(q.Get("lat"), q.Get("lon"))
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var before time.Time
+	if page.Before > 0 {
+		before = time.Unix(0, page.Before)
+	}
+
+	// fetch one extra record to learn whether there is a next page
+	items := s.history.Observations(loc, before, page.Limit+1)
+	var next int64
+	if len(items) > page.Limit {
+		items = items[:page.Limit]
+		next = items[len(items)-1].Time.UnixNano()
+	}
+	if items == nil {
+		items = []observation{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newPageResponse(r, items, next))
+}
+
+// alertHistoryHandler lists the alerts seen for a location, optionally
+// narrowed to a time range and event.
+func (s *server) alertHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lat, lon, _ := s.requestLocation(r, q)
+	loc, err := models.ParseLocation(lat, lon)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	query := alertQuery{Location: loc, Event: strings.TrimSpace(q.Get("event"))}
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &query.From}, {"to", &query.To}} {
+		if raw := q.Get(bound.name); raw != "" {
+			if *bound.t, err = parseTimeParam(raw); err != nil {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "Invalid %s: want a date (2006-01-02) or RFC 3339 time", bound.name)
+				return
+			}
+		}
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	items := s.history.AlertHistory(query, page.Before, page.Limit+1)
+	var next int64
+	if len(items) > page.Limit {
+		items = items[:page.Limit]
+		next = items[len(items)-1].Seq
+	}
+	if items == nil {
+		items = []alertRecord{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newPageResponse(r, items, next))
+}
+
+// parseTimeParam parses a query parameter given as a date or a time.
+func parseTimeParam(raw string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", raw); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, raw)
+}
+
+// recentAlertsHandler lists the alerts seen across all locations.
+func (s *server) recentAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePage(r)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	items := s.history.RecentAlerts(page.Before, page.Limit+1)
+	var next int64
+	if len(items) > page.Limit {
+		items = items[:page.Limit]
+		next = items[len(items)-1].Seq
+	}
+	if items == nil {
+		items = []alertRecord{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newPageResponse(r, items, next))
+}
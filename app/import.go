@@ -0,0 +1,343 @@
+package app
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// importBatchSize is how many rows are upserted (and reported) at a time.
+const importBatchSize = 1000
+
+// importProgress reports how far an import has got.
+type importProgress struct {
+	Rows     int    `json:"rows"`
+	Inserted int    `json:"inserted"`
+	Updated  int    `json:"updated"`
+	Done     bool   `json:"done,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// importHistory backfills h from r, which holds either an openweathermap
+// history bulk export ("json") or a CSV file with a header row ("csv"), with
+// temperatures in unit. Rows are upserted, so re-running an import is
+// harmless. progress, if not nil, is called after every batch.
+func importHistory(h *historyStore, r io.Reader, format string, unit models.TempUnit, progress func(importProgress)) (importProgress, error) {
+	var p importProgress
+	batch := make([]observation, 0, importBatchSize)
+	flush := func() {
+		inserted, updated := h.Upsert(batch)
+		p.Inserted += inserted
+		p.Updated += updated
+		batch = batch[:0]
+		if progress != nil {
+			progress(p)
+		}
+	}
+	emit := func(obs observation) {
+		p.Rows++
+		batch = append(batch, obs)
+		if len(batch) == importBatchSize {
+			flush()
+		}
+	}
+
+	var err error
+	switch format {
+	case "csv":
+		err = readCSVObservations(r, unit, emit)
+	case "json":
+		err = readBulkJSONObservations(r, unit, emit)
+	default:
+		err = fmt.Errorf("Unknown import format: %q", format)
+	}
+	if len(batch) > 0 {
+		flush()
+	}
+	p.Done = err == nil
+	return p, err
+}
+
+// readCSVObservations reads observations from a CSV file. Columns are
+// located by header name, which lets it read openweathermap's bulk CSV
+// exports as well as hand-made files. lat, lon, temp and either dt (unix
+// seconds) or time (RFC 3339) are required; feels_like,
+// weather_description, rain_1h and snow_1h (millimeters, as in
+// openweathermap's exports) are optional. Temperatures are in unit.
+func readCSVObservations(r io.Reader, unit models.TempUnit, emit func(observation)) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("Failed to read CSV header: %s", err)
+	}
+	cols := make(map[string]int, len(header))
+	for i, name := range header {
+		cols[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{"lat", "lon", "temp"} {
+		if _, ok := cols[required]; !ok {
+			return fmt.Errorf("CSV is missing required column %q", required)
+		}
+	}
+	_, hasDt := cols["dt"]
+	_, hasTime := cols["time"]
+	if !hasDt && !hasTime {
+		return fmt.Errorf("CSV is missing a dt or time column")
+	}
+
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		field := func(name string) string {
+			if i, ok := cols[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		loc, err := models.ParseLocation(field("lat"), field("lon"))
+		if err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+		var at time.Time
+		if hasDt {
+			secs, err := strconv.ParseInt(field("dt"), 10, 64)
+			if err != nil {
+				return fmt.Errorf("line %d: invalid dt %q", line, field("dt"))
+			}
+			at = time.Unix(secs, 0).UTC()
+		} else if at, err = time.Parse(time.RFC3339, field("time")); err != nil {
+			return fmt.Errorf("line %d: invalid time %q", line, field("time"))
+		}
+		temp, err := strconv.ParseFloat(field("temp"), 64)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid temp %q", line, field("temp"))
+		}
+		feelsLike := temp
+		if raw := field("feels_like"); raw != "" {
+			if feelsLike, err = strconv.ParseFloat(raw, 64); err != nil {
+				return fmt.Errorf("line %d: invalid feels_like %q", line, raw)
+			}
+		}
+		conditions := []string{}
+		if desc := field("weather_description"); desc != "" {
+			conditions = append(conditions, desc)
+		}
+		var rain, snow owmPrecip
+		for _, col := range []struct {
+			name string
+			mm   *float64
+		}{{"rain_1h", &rain.OneHour}, {"snow_1h", &snow.OneHour}} {
+			if raw := field(col.name); raw != "" {
+				if *col.mm, err = strconv.ParseFloat(raw, 64); err != nil {
+					return fmt.Errorf("line %d: invalid %s %q", line, col.name, raw)
+				}
+			}
+		}
+
+		emit(observation{
+			Location:   loc,
+			Time:       at.UTC(),
+			Temp:       models.NewTemperature(temp, unit),
+			FeelsLike:  models.NewTemperature(feelsLike, unit),
+			Conditions: conditions,
+			Precip:     precipInches(rain, snow),
+		})
+	}
+}
+
+// owmBulkRecord is one entry of an openweathermap history bulk export.
+// Temperatures are in whatever units the export was ordered in.
+type owmBulkRecord struct {
+	Dt   int64   `json:"dt"`
+	Lat  float64 `json:"lat"`
+	Lon  float64 `json:"lon"`
+	Main struct {
+		Temp      float64 `json:"temp"`
+		FeelsLike float64 `json:"feels_like"`
+	} `json:"main"`
+	Weather []struct {
+		Description string `json:"description"`
+	} `json:"weather"`
+	Rain owmPrecip `json:"rain"`
+	Snow owmPrecip `json:"snow"`
+}
+
+// readBulkJSONObservations streams the records of an openweathermap history
+// bulk export (a JSON array), so large exports needn't fit in memory.
+// Temperatures are in unit.
+func readBulkJSONObservations(r io.Reader, unit models.TempUnit, emit func(observation)) error {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return fmt.Errorf("Expected a JSON array of history records")
+	}
+	for i := 0; dec.More(); i++ {
+		var rec owmBulkRecord
+		if err := dec.Decode(&rec); err != nil {
+			return fmt.Errorf("record %d: %s", i, err)
+		}
+		loc, err := models.ParseLocation(models.Location{Lat: rec.Lat, Lon: rec.Lon}.Strings())
+		if err != nil {
+			return fmt.Errorf("record %d: %s", i, err)
+		}
+		conditions := make([]string, 0, len(rec.Weather))
+		for _, cond := range rec.Weather {
+			conditions = append(conditions, cond.Description)
+		}
+		emit(observation{
+			Location:   loc,
+			Time:       time.Unix(rec.Dt, 0).UTC(),
+			Temp:       models.NewTemperature(rec.Main.Temp, unit),
+			FeelsLike:  models.NewTemperature(rec.Main.FeelsLike, unit),
+			Conditions: conditions,
+			Precip:     precipInches(rec.Rain, rec.Snow),
+		})
+	}
+	return nil
+}
+
+// parseOWMUnits maps an openweathermap units name to the temperature unit
+// it uses.
+func parseOWMUnits(units string) (models.TempUnit, error) {
+	switch units {
+	case "imperial":
+		return models.Fahrenheit, nil
+	case "metric":
+		return models.Celsius, nil
+	case "standard":
+		return models.Kelvin, nil
+	}
+	return 0, fmt.Errorf("unknown units %q: want imperial, metric or standard", units)
+}
+
+// importFormatFor guesses the import format from a file name or media type.
+func importFormatFor(name string) string {
+	if mediaType, _, err := mime.ParseMediaType(name); err == nil {
+		switch mediaType {
+		case "text/csv":
+			return "csv"
+		case "application/json":
+			return "json"
+		}
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv":
+		return "csv"
+	case ".json":
+		return "json"
+	}
+	return ""
+}
+
+// ImportCommand implements `banno-project import [-format csv|json] [-units
+// imperial|metric|standard] FILE...`, backfilling the history store at
+// HISTORY_PATH.
+func ImportCommand(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "", "input format: csv or json (default: from file extension)")
+	units := flags.String("units", "imperial", "openweathermap units of the temperatures: imperial (°F), metric (°C) or standard (K)")
+	flags.Parse(args)
+	unit, err := parseOWMUnits(*units)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	path := os.Getenv("HISTORY_PATH")
+	if path == "" {
+		log.Fatal("HISTORY_PATH must be set to import history")
+	}
+	history, err := openHistoryStore(path)
+	if err != nil {
+		log.Fatalf("Failed to open history store: %s", err)
+	}
+
+	for _, name := range flags.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileFormat := *format
+		if fileFormat == "" {
+			fileFormat = importFormatFor(name)
+		}
+		p, err := importHistory(history, f, fileFormat, unit, func(p importProgress) {
+			log.Printf("%s: %d rows (%d inserted, %d updated)", name, p.Rows, p.Inserted, p.Updated)
+		})
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: import failed after %d rows: %s", name, p.Rows, err)
+		}
+		if err := history.Save(); err != nil {
+			log.Fatalf("Failed to save history: %s", err)
+		}
+	}
+}
+
+// importHandler backfills the history store from the request body. Progress
+// is streamed back as newline delimited JSON, one line per batch. ?units=
+// gives the units of its temperatures, as openweathermap names them;
+// imperial (°F) by default.
+func (s *server) importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(405)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = importFormatFor(r.Header.Get("Content-Type"))
+	}
+	if format != "csv" && format != "json" {
+		w.WriteHeader(400)
+		w.Write([]byte("Unknown import format: use ?format=csv or ?format=json"))
+		return
+	}
+	units := r.URL.Query().Get("units")
+	if units == "" {
+		units = "imperial"
+	}
+	unit, err := parseOWMUnits(units)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	p, err := importHistory(s.history, r.Body, format, unit, func(p importProgress) {
+		enc.Encode(p)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err == nil {
+		err = s.history.Save()
+	}
+	if err != nil {
+		s.logger.Printf("History import failed after %d rows: %s", p.Rows, err)
+		p.Error = err.Error()
+	}
+	enc.Encode(p)
+}
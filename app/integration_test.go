@@ -0,0 +1,1341 @@
+package app_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cstrahan/banno-project/app"
+)
+
+const weatherPath = "/weather/?lat=30.49&lon=-99.77"
+
+func TestWeather(t *testing.T) {
+	h := newHarness(t, nil)
+	resp, body := h.get(weatherPath)
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	want := `{"alerts":["Heat Advisory"],"conditions":["clear sky"],"temperature":"hot","meta":`
+	if !strings.HasPrefix(body, want) {
+		t.Errorf("body %s, want %s...", body, want)
+	}
+	reqs := h.owm.Requests(oneCallPath)
+	if len(reqs) != 1 {
+		t.Fatalf("%d upstream requests, want 1", len(reqs))
+	}
+	if q := reqs[0].URL.Query(); q.Get("appid") != "test" || q.Get("units") != "imperial" {
+		t.Errorf("upstream query %s", reqs[0].URL.RawQuery)
+	}
+}
+
+func TestWeatherIsCached(t *testing.T) {
+	h := newHarness(t, nil)
+	for i := 0; i < 3; i++ {
+		if resp, body := h.get(weatherPath); resp.StatusCode != 200 {
+			t.Fatalf("status %d: %s", resp.StatusCode, body)
+		}
+	}
+	if n := len(h.owm.Requests(oneCallPath)); n != 1 {
+		t.Errorf("%d upstream requests, want 1", n)
+	}
+}
+
+func TestResponseMeta(t *testing.T) {
+	h := newHarness(t, nil)
+	var metas []*app.Meta
+	for i := 0; i < 2; i++ {
+		resp, body := h.get(weatherPath)
+		var weather app.Weather
+		if err := json.Unmarshal([]byte(body), &weather); err != nil || weather.Meta == nil {
+			t.Fatalf("status %d, want a meta block: %s", resp.StatusCode, body)
+		}
+		if id := resp.Header.Get("X-Request-Id"); id == "" || id != weather.Meta.RequestID {
+			t.Errorf("X-Request-Id %q, want the meta request_id %q", id, weather.Meta.RequestID)
+		}
+		metas = append(metas, weather.Meta)
+	}
+	if m := metas[0]; m.Provider != "openweathermap" || m.Cache != "miss" || m.ObservedAt == nil {
+		t.Errorf("first meta %+v, want a miss observed by openweathermap", m)
+	}
+	if m := metas[1]; m.Cache != "hit" || m.RequestID == metas[0].RequestID {
+		t.Errorf("second meta %+v, want a hit with its own request ID", m)
+	}
+
+	req, _ := http.NewRequest("GET", h.url+weatherPath, nil)
+	req.Header.Set("X-Request-Id", "upstream-proxy.42")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if id := resp.Header.Get("X-Request-Id"); id != "upstream-proxy.42" {
+		t.Errorf("X-Request-Id %q, want the caller's", id)
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	h := newHarness(t, nil)
+	for _, want := range [][]string{{"cache;", "upstream;", "encode;", "total;"}, {"cache;", "encode;", "total;"}} {
+		resp, body := h.get(weatherPath)
+		timing := resp.Header.Get("Server-Timing")
+		for _, phase := range want {
+			if !strings.Contains(timing, phase) {
+				t.Errorf("Server-Timing %q, want %s (%s)", timing, phase, body)
+			}
+		}
+		if len(want) == 3 && strings.Contains(timing, "upstream;") {
+			t.Errorf("Server-Timing %q for a cache hit, want no upstream", timing)
+		}
+	}
+	if _, body := h.get("/metrics"); !strings.Contains(body, `request_phase_seconds_total{phase="upstream"}`) {
+		t.Errorf("no upstream phase metric")
+	}
+}
+
+func TestServerTimingSettings(t *testing.T) {
+	h := newHarness(t, map[string]string{"SERVER_TIMING_ALLOW_ORIGIN": "https://rum.example.com"})
+	resp, body := h.get("/badge?lat=30.49&lon=-99.77")
+	if timing := resp.Header.Get("Server-Timing"); !strings.Contains(timing, "render;") {
+		t.Errorf("badge Server-Timing %q, want render time (%s)", timing, body)
+	}
+	if got := resp.Header.Get("Timing-Allow-Origin"); got != "https://rum.example.com" {
+		t.Errorf("Timing-Allow-Origin %q", got)
+	}
+
+	h = newHarness(t, map[string]string{"SERVER_TIMING": "0"})
+	if resp, _ := h.get(weatherPath); resp.Header.Get("Server-Timing") != "" {
+		t.Errorf("Server-Timing %q with SERVER_TIMING=0, want none", resp.Header.Get("Server-Timing"))
+	}
+}
+
+func TestLegacyCompat(t *testing.T) {
+	h := newHarness(t, map[string]string{"RESPONSE_COMPAT": "legacy"})
+	want := `{"alerts":["Heat Advisory"],"conditions":["clear sky"],"temperature":"hot"}`
+	if _, body := h.get(weatherPath); strings.TrimSpace(body) != want {
+		t.Errorf("body %s, want %s", body, want)
+	}
+	if _, body := h.get(weatherPath + "&compat=extended"); !strings.Contains(body, `"meta":`) {
+		t.Errorf("extended body %s, want the meta block", body)
+	}
+	if resp, body := h.get(weatherPath + "&compat=strict"); resp.StatusCode != 400 {
+		t.Errorf("unknown mode: status %d, want 400: %s", resp.StatusCode, body)
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	h := newHarness(t, map[string]string{"TIER_FREE_MAX_AGE": "1ns"})
+	for i := 0; i < 2; i++ {
+		if resp, body := h.get(weatherPath); resp.StatusCode != 200 {
+			t.Fatalf("status %d: %s", resp.StatusCode, body)
+		}
+	}
+	if n := len(h.owm.Requests(oneCallPath)); n != 2 {
+		t.Errorf("%d upstream requests, want 2", n)
+	}
+}
+
+func TestEntriesNearExpiryArePrefetched(t *testing.T) {
+	h := newHarness(t, map[string]string{"TIER_FREE_MAX_AGE": "200ms", "CACHE_PREFETCH_PERCENT": "50"})
+	h.get(weatherPath)
+	time.Sleep(120 * time.Millisecond)
+	resp, body := h.get(weatherPath)
+	if resp.StatusCode != 200 || resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("status %d, X-Cache %q, want a hit: %s", resp.StatusCode, resp.Header.Get("X-Cache"), body)
+	}
+	// the hit is refreshed in the background
+	for deadline := time.Now().Add(time.Second); len(h.owm.Requests(oneCallPath)) < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("entry near expiry wasn't refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestForecastCacheTTL(t *testing.T) {
+	for _, test := range []struct {
+		ttls string
+		want int
+	}{
+		{"", 1},
+		{"forecast=0", 2},
+	} {
+		h := newHarness(t, map[string]string{"CACHE_TTLS": test.ttls})
+		for i := 0; i < 2; i++ {
+			if resp, body := h.get("/forecast?lat=30.49&lon=-99.77"); resp.StatusCode != 200 {
+				t.Fatalf("CACHE_TTLS=%q: status %d: %s", test.ttls, resp.StatusCode, body)
+			}
+		}
+		if n := len(h.owm.Requests(oneCallPath)); n != test.want {
+			t.Errorf("CACHE_TTLS=%q: %d upstream requests, want %d", test.ttls, n, test.want)
+		}
+	}
+}
+
+func TestProviderProxy(t *testing.T) {
+	proxy := newFakeOWM(t)
+	h := newHarness(t, map[string]string{"OWM_URL": "http://owm.example", "OWM_PROXY": proxy.URL})
+	if resp, body := h.get(weatherPath); resp.StatusCode != 200 {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	reqs := proxy.Requests(oneCallPath)
+	if len(reqs) != 1 {
+		t.Fatalf("%d proxied requests, want 1", len(reqs))
+	}
+	if reqs[0].Host != "owm.example" {
+		t.Errorf("proxied request for %q, want owm.example", reqs[0].Host)
+	}
+}
+
+func TestProviderSelection(t *testing.T) {
+	meteo := newFakeOWM(t)
+	meteo.Script("/v1/forecast", ok(`{"current":{"time":1600000000,"temperature_2m":50,"apparent_temperature":48,"weather_code":61}}`))
+	h := newHarness(t, map[string]string{
+		"PROVIDER_SELECTION": "owm,open-meteo",
+		"OPEN_METEO":         "1",
+		"OPEN_METEO_URL":     meteo.URL,
+	})
+	resp, body := h.get(weatherPath + "&provider=open-meteo")
+	if resp.StatusCode != 200 || !strings.Contains(body, `"conditions":["light rain"]`) {
+		t.Errorf("status %d, want Open-Meteo's conditions: %s", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("X-Weather-Provider"); got != "open-meteo" {
+		t.Errorf("X-Weather-Provider %q, want open-meteo", got)
+	}
+	if n := len(h.owm.Requests(oneCallPath)); n != 0 {
+		t.Errorf("%d openweathermap requests, want none", n)
+	}
+	if resp, body := h.get(weatherPath + "&provider=nws"); resp.StatusCode != 400 {
+		t.Errorf("unselectable provider: status %d, want 400: %s", resp.StatusCode, body)
+	}
+}
+
+func TestConcurrentMissesShareAFetch(t *testing.T) {
+	h := newHarness(t, nil)
+	h.owm.Script(oneCallPath, upstreamResponse{Status: 200, Body: oneCallBody, Delay: 100 * time.Millisecond})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp, body := h.get(weatherPath); resp.StatusCode != 200 {
+				t.Errorf("status %d: %s", resp.StatusCode, body)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(h.owm.Requests(oneCallPath)); n != 1 {
+		t.Errorf("%d upstream requests, want 1", n)
+	}
+}
+
+func TestFailuresAreRetried(t *testing.T) {
+	h := newHarness(t, nil)
+	h.owm.Script(oneCallPath, failure(500, "Internal error"), ok(oneCallBody))
+	if resp, body := h.get(weatherPath); resp.StatusCode != 502 {
+		t.Errorf("first request: status %d, want 502: %s", resp.StatusCode, body)
+	}
+	// the failure isn't cached, so the next request goes upstream again
+	if resp, body := h.get(weatherPath); resp.StatusCode != 200 {
+		t.Errorf("second request: status %d, want 200: %s", resp.StatusCode, body)
+	}
+	if n := len(h.owm.Requests(oneCallPath)); n != 2 {
+		t.Errorf("%d upstream requests, want 2", n)
+	}
+}
+
+func TestSlowRequestsAreHedged(t *testing.T) {
+	h := newHarness(t, map[string]string{"UPSTREAM_HEDGE_DELAY": "50ms"})
+	h.owm.Script(oneCallPath, upstreamResponse{Status: 200, Body: oneCallBody, Delay: time.Second}, ok(oneCallBody))
+	start := time.Now()
+	if resp, body := h.get(weatherPath); resp.StatusCode != 200 {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("took %s, want the hedge to answer first", elapsed)
+	}
+	if n := len(h.owm.Requests(oneCallPath)); n != 2 {
+		t.Errorf("%d upstream requests, want 2", n)
+	}
+}
+
+func TestInvalidLocationsAreNegativelyCached(t *testing.T) {
+	h := newHarness(t, nil)
+	h.owm.Script(oneCallPath, failure(404, "city not found"), ok(oneCallBody))
+	for i := 0; i < 3; i++ {
+		if resp, body := h.get(weatherPath); resp.StatusCode != 404 {
+			t.Errorf("request %d: status %d, want 404: %s", i, resp.StatusCode, body)
+		}
+	}
+	if n := len(h.owm.Requests(oneCallPath)); n != 1 {
+		t.Errorf("%d upstream requests, want 1", n)
+	}
+}
+
+func TestInvalidLocationsAreNegativelyCachedAcrossOneCallVersions(t *testing.T) {
+	h := newHarness(t, map[string]string{"ONECALL_RECHECK": "200ms"})
+	// 3.0 is usable but doesn't know the location, and neither does 2.5
+	h.owm.Script(oneCall3Path, ok("{}"), failure(404, "city not found"), ok("{}"), failure(404, "city not found"))
+	h.owm.Script(oneCallPath, failure(404, "city not found"))
+
+	// falls back to 2.5 until the next probe
+	if resp, body := h.get(weatherPath); resp.StatusCode != 404 {
+		t.Fatalf("status %d, want 404: %s", resp.StatusCode, body)
+	}
+	time.Sleep(250 * time.Millisecond)
+	// still on 2.5 while the next probe finds 3.0 usable again
+	if resp, body := h.get(weatherPath); resp.StatusCode != 404 {
+		t.Fatalf("status %d, want 404: %s", resp.StatusCode, body)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(h.owm.Requests(oneCall3Path)) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("One Call 3.0 not probed again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	// back on 3.0
+	if resp, body := h.get(weatherPath); resp.StatusCode != 404 {
+		t.Fatalf("status %d, want 404: %s", resp.StatusCode, body)
+	}
+
+	if n := len(h.owm.Requests(oneCall3Path)); n != 3 {
+		t.Errorf("%d One Call 3.0 requests, want 3: two probes and the first request", n)
+	}
+	if n := len(h.owm.Requests(oneCallPath)); n != 1 {
+		t.Errorf("%d One Call 2.5 requests, want 1", n)
+	}
+}
+
+func TestErrorMapping(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		vars       map[string]string
+		upstream   upstreamResponse
+		status     int
+		retryAfter string
+		body       string
+	}{
+		{name: "bad request", upstream: failure(400, "wrong latitude"), status: 400, body: "wrong latitude"},
+		{name: "not found", upstream: failure(404, "city not found"), status: 404},
+		{name: "auth", upstream: failure(401, "Invalid API key"), status: 503, body: "Weather provider authentication failed"},
+		{name: "rate limited", upstream: upstreamResponse{
+			Status: 429,
+			Header: http.Header{"Retry-After": {"30"}},
+			Body:   `{"cod":429,"message":"too many requests"}`,
+		}, status: 503, retryAfter: "30"},
+		{name: "rate limited without retry-after", upstream: failure(429, "too many requests"), status: 503, retryAfter: "60"},
+		{name: "unavailable", upstream: failure(503, "maintenance"), status: 502},
+		{name: "not json", upstream: ok("<html>"), status: 502},
+		{
+			name:     "malformed in strict mode",
+			vars:     map[string]string{"STRICT_MODE": "reject"},
+			upstream: ok(`{"current":{"dt":1600000000,"humidity":40,"weather":[{"description":"clear sky"}]}}`),
+			status:   502,
+			body:     "current.temp is missing",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			h := newHarness(t, test.vars)
+			h.owm.Script(oneCallPath, test.upstream)
+			resp, body := h.get(weatherPath)
+			if resp.StatusCode != test.status {
+				t.Errorf("status %d, want %d: %s", resp.StatusCode, test.status, body)
+			}
+			if got := resp.Header.Get("Retry-After"); got != test.retryAfter {
+				t.Errorf("Retry-After %q, want %q", got, test.retryAfter)
+			}
+			if !strings.Contains(body, test.body) {
+				t.Errorf("body %q doesn't mention %q", body, test.body)
+			}
+		})
+	}
+}
+
+func TestAuthFailureMarksNotReady(t *testing.T) {
+	h := newHarness(t, nil)
+	if resp, body := h.get("/readyz"); resp.StatusCode != 200 {
+		t.Fatalf("readyz: status %d: %s", resp.StatusCode, body)
+	}
+	h.owm.Script(oneCallPath, failure(401, "Invalid API key"))
+	h.get(weatherPath)
+	if resp, body := h.get("/readyz"); resp.StatusCode != 503 || !strings.Contains(body, "provider") {
+		t.Errorf("readyz: status %d, want 503: %s", resp.StatusCode, body)
+	}
+}
+
+func TestOnlyAnAcceptedKeyMarksReady(t *testing.T) {
+	h := newHarness(t, map[string]string{"PROVIDER_RECHECK_INTERVAL": "20ms"})
+	h.owm.Script(oneCallPath, failure(401, "Invalid API key"))
+	h.owm.Script(checkPath, failure(503, "Service Unavailable"))
+	h.get(weatherPath)
+
+	// an outage says nothing about the key
+	deadline := time.Now().Add(5 * time.Second)
+	for len(h.owm.Requests(checkPath)) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("provider not rechecked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if resp, body := h.get("/readyz"); resp.StatusCode != 503 {
+		t.Errorf("readyz during an outage: status %d, want 503: %s", resp.StatusCode, body)
+	}
+
+	h.owm.Script(checkPath, ok("{}"))
+	for {
+		if resp, _ := h.get("/readyz"); resp.StatusCode == 200 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("still not ready once the provider accepted the key")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRejectedKeysLeaveThePool(t *testing.T) {
+	h := newHarness(t, map[string]string{"API_KEYS": "key-one,key-two", "TIER_FREE_MAX_AGE": "1ns"})
+	h.owm.Script(oneCallPath, failure(401, "Invalid API key"), ok(oneCallBody), ok(oneCallBody))
+	for i := 0; i < 2; i++ {
+		if resp, body := h.get(weatherPath); resp.StatusCode != 200 {
+			t.Fatalf("request %d: status %d: %s", i, resp.StatusCode, body)
+		}
+	}
+	reqs := h.owm.Requests(oneCallPath)
+	if len(reqs) != 3 {
+		t.Fatalf("%d upstream requests, want 3", len(reqs))
+	}
+	rejected, accepted := reqs[0].URL.Query().Get("appid"), reqs[1].URL.Query().Get("appid")
+	if rejected == accepted {
+		t.Errorf("retried with the rejected key %q", rejected)
+	}
+	if got := reqs[2].URL.Query().Get("appid"); got != accepted {
+		t.Errorf("next request used %q, want %q", got, accepted)
+	}
+}
+
+func TestOneCallVersionDetection(t *testing.T) {
+	h := newHarness(t, map[string]string{"TIER_FREE_MAX_AGE": "1ns"})
+	// the probe and the first request find 3.0 usable; then the
+	// subscription lapses
+	h.owm.Script(oneCall3Path, ok("{}"), ok(oneCallBody), failure(401, "Invalid API key"))
+	for i := 0; i < 3; i++ {
+		if resp, body := h.get(weatherPath); resp.StatusCode != 200 {
+			t.Fatalf("request %d: status %d: %s", i, resp.StatusCode, body)
+		}
+	}
+	if n := len(h.owm.Requests(oneCall3Path)); n != 3 {
+		t.Errorf("%d One Call 3.0 requests, want 3", n)
+	}
+	// the refused request fell back to 2.5, and so did the next
+	if n := len(h.owm.Requests(oneCallPath)); n != 2 {
+		t.Errorf("%d One Call 2.5 requests, want 2", n)
+	}
+}
+
+func TestSummarySources(t *testing.T) {
+	h := newHarness(t, nil)
+	resp, body := h.get("/summary?lat=30.49&lon=-99.77")
+	if resp.StatusCode != 200 || !strings.Contains(body, `"source":"local"`) {
+		t.Errorf("without One Call 3.0: status %d, want a local summary: %s", resp.StatusCode, body)
+	}
+	if resp, body := h.get("/summary?lat=30.49&lon=-99.77&source=openweathermap"); resp.StatusCode != 501 {
+		t.Errorf("asking for the provider's without One Call 3.0: status %d, want 501: %s", resp.StatusCode, body)
+	}
+
+	h = newHarness(t, nil)
+	h.owm.Script(oneCall3Path, ok("{}"))
+	h.owm.Script(oneCall3Path+"/overview", ok(`{"date":"2020-09-13","weather_overview":"A hot, clear day."}`))
+	resp, body = h.get("/summary?lat=30.49&lon=-99.77")
+	want := `{"summary":"A hot, clear day.","source":"openweathermap","date":"2020-09-13"}`
+	if resp.StatusCode != 200 || strings.TrimSpace(body) != want {
+		t.Errorf("with One Call 3.0: status %d, body %s, want %s", resp.StatusCode, body, want)
+	}
+}
+
+func TestStartupCheck(t *testing.T) {
+	owm := newFakeOWM(t)
+	owm.Script(checkPath, failure(401, "Invalid API key"))
+	_, err := app.New(app.Config{Vars: map[string]string{
+		"API_KEY": "wrong",
+		"OWM_URL": owm.URL,
+	}})
+	if err == nil || !strings.Contains(err.Error(), "rejected API_KEY") {
+		t.Errorf("New: %v, want the key rejected", err)
+	}
+}
+
+func TestInvalidBodiesGetFieldErrors(t *testing.T) {
+	h := newHarness(t, nil)
+	body := `{"waypoints": [[30.27, -97.74], [29.76]], "speed_kmh": 0, "departure": "tomorrow", "stops": 2}`
+	resp, err := http.Post(h.url+"/route-weather", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var invalid app.InvalidBody
+	if err := json.NewDecoder(resp.Body).Decode(&invalid); err != nil || resp.StatusCode != 400 {
+		t.Fatalf("status %d, want 400 with field errors (%v)", resp.StatusCode, err)
+	}
+	got := make(map[string]bool)
+	for _, e := range invalid.Errors {
+		got[e.Field] = true
+	}
+	for _, field := range []string{"waypoints[1]", "speed_kmh", "departure", "stops"} {
+		if !got[field] {
+			t.Errorf("no error for %s in %+v", field, invalid.Errors)
+		}
+	}
+	if n := len(h.owm.Requests(oneCallPath)); n != 0 {
+		t.Errorf("%d upstream requests, want none", n)
+	}
+}
+
+func TestIdempotentLocationCreation(t *testing.T) {
+	h := newHarness(t, nil)
+	post := func(key, body string) *http.Response {
+		req, _ := http.NewRequest("POST", h.url+"/locations", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	home := `{"name": "Home", "lat": 47.61, "lon": -122.33}`
+	for i, want := range []string{"", "true"} {
+		resp := post("retry-1", home)
+		if resp.StatusCode != 201 || resp.Header.Get("Idempotent-Replayed") != want {
+			t.Errorf("request %d: status %d, Idempotent-Replayed %q, want 201 and %q",
+				i+1, resp.StatusCode, resp.Header.Get("Idempotent-Replayed"), want)
+		}
+	}
+	if resp := post("retry-1", `{"name": "Work", "lat": 47.6, "lon": -122.3}`); resp.StatusCode != 422 {
+		t.Errorf("reused key: status %d, want 422", resp.StatusCode)
+	}
+	if _, body := h.get("/locations"); strings.Count(body, `"id"`) != 1 {
+		t.Errorf("saved locations %s, want one", body)
+	}
+}
+
+func TestDeletedLocationsCanBeRestored(t *testing.T) {
+	h := newHarness(t, nil)
+	do := func(method, path, body string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, h.url+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+	_, body := do("POST", "/locations", `{"name": "Home", "lat": 47.61, "lon": -122.33}`)
+	var saved struct{ ID string }
+	if err := json.Unmarshal([]byte(body), &saved); err != nil {
+		t.Fatalf("save: %s", body)
+	}
+	do("DELETE", "/locations/"+saved.ID, "")
+	if _, body := h.get("/locations"); strings.Contains(body, saved.ID) {
+		t.Errorf("deleted location still listed: %s", body)
+	}
+	if _, body := h.get("/locations?deleted=1"); !strings.Contains(body, saved.ID) {
+		t.Errorf("deleted location not listed as restorable: %s", body)
+	}
+	if resp, body := do("POST", "/locations/"+saved.ID+"/restore", ""); resp.StatusCode != 200 {
+		t.Fatalf("restore: status %d: %s", resp.StatusCode, body)
+	}
+	if _, body := h.get("/locations"); !strings.Contains(body, saved.ID) {
+		t.Errorf("restored location not listed: %s", body)
+	}
+	if resp, _ := do("POST", "/locations/"+saved.ID+"/restore", ""); resp.StatusCode != 404 {
+		t.Errorf("restoring a live location: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestAccountExportImport(t *testing.T) {
+	h := newHarness(t, map[string]string{"CLIENT_KEYS": "alpha:free,beta:free"})
+	post := func(path, key, body string) (*http.Response, string) {
+		resp, err := http.Post(h.url+path+"?api_key="+key, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+	post("/locations", "alpha", `{"name": "Home", "lat": 47.61, "lon": -122.33, "digest": "daily"}`)
+	post("/locations", "alpha", `{"name": "Cabin", "lat": 46.85, "lon": -121.76}`)
+
+	resp, export := h.get("/account/export?api_key=alpha")
+	if resp.StatusCode != 200 || !strings.Contains(export, `"name":"Cabin"`) {
+		t.Fatalf("export: status %d: %s", resp.StatusCode, export)
+	}
+	for i, want := range []string{`{"imported":2,"skipped":0}`, `{"imported":0,"skipped":2}`} {
+		if resp, body := post("/account/import", "beta", export); resp.StatusCode != 200 || strings.TrimSpace(body) != want {
+			t.Errorf("import %d: status %d, body %s, want %s", i+1, resp.StatusCode, body, want)
+		}
+	}
+	if _, body := h.get("/locations?api_key=beta"); !strings.Contains(body, `"digest":"daily"`) || strings.Count(body, `"id"`) != 2 {
+		t.Errorf("imported locations %s, want both, digest included", body)
+	}
+	if resp, body := post("/account/import", "beta", `{"version": 2, "locations": []}`); resp.StatusCode != 400 {
+		t.Errorf("unknown version: status %d, want 400: %s", resp.StatusCode, body)
+	}
+}
+
+func TestPopularLocationsArePromoted(t *testing.T) {
+	h := newHarness(t, map[string]string{
+		"ADMIN_TOKEN":          "secret",
+		"POPULAR_TOP_K":        "1",
+		"POPULAR_MIN_REQUESTS": "2",
+		"POPULAR_WINDOW":       "200ms",
+	})
+	for i := 0; i < 3; i++ {
+		h.get(weatherPath)
+	}
+	h.get("/weather/?lat=47.61&lon=-122.33")
+	// promoted at the end of the first window, and until the end of the next
+	time.Sleep(300 * time.Millisecond)
+
+	req, _ := http.NewRequest("GET", h.url+"/admin/monitors", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "30.49,-99.77") || strings.Contains(string(body), "47.61") {
+		t.Errorf("monitors %s, want just the popular location", body)
+	}
+
+	req.URL.Path = "/admin/popular"
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ = ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `"reason":"3 requests between`) {
+		t.Errorf("popular %s, want the promotion explained", body)
+	}
+}
+
+func TestResponseShape(t *testing.T) {
+	h := newHarness(t, map[string]string{"RESPONSE_NAMING": "camelCase", "RESPONSE_ENVELOPE": "1"})
+	_, body := h.get(weatherPath)
+	if !strings.HasPrefix(body, `{"data":{`) || !strings.Contains(body, `"ageSeconds":`) {
+		t.Errorf("body %s, want camelCase fields in a data envelope", body)
+	}
+	resp, err := http.Post(h.url+"/locations", "application/json", strings.NewReader(`{"lat": 91}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 400 || !strings.HasPrefix(string(raw), `{"error":{`) {
+		t.Errorf("status %d, body %s, want the field errors in an error envelope", resp.StatusCode, raw)
+	}
+
+	// a managed key overrides the defaults
+	h = newHarness(t, map[string]string{
+		"ADMIN_TOKEN": "secret",
+		"KEYS_PATH":   t.TempDir() + "/keys.json",
+	})
+	req, _ := http.NewRequest("POST", h.url+"/admin/keys", strings.NewReader(`{"name": "app", "naming": "camelCase", "envelope": true}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key struct {
+		Secret string `json:"secret"`
+		Naming string `json:"naming"`
+	}
+	json.NewDecoder(resp.Body).Decode(&key)
+	resp.Body.Close()
+	if resp.StatusCode != 201 || key.Naming != "camelCase" {
+		t.Fatalf("creating key: status %d, naming %q", resp.StatusCode, key.Naming)
+	}
+	if _, body := h.get(weatherPath + "&api_key=" + key.Secret); !strings.HasPrefix(body, `{"data":{`) || !strings.Contains(body, `"ageSeconds":`) {
+		t.Errorf("body %s, want the key's shape", body)
+	}
+}
+
+func TestProtobufWeather(t *testing.T) {
+	h := newHarness(t, nil)
+	req, _ := http.NewRequest("GET", h.url+weatherPath, nil)
+	req.Header.Set("Accept", "application/x-protobuf")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-protobuf" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	// alerts (field 1), conditions (2) and temperature (3), length-delimited
+	want := "\x0a\x0dHeat Advisory\x12\x09clear sky\x1a\x03hot"
+	if !strings.HasPrefix(string(body), want) {
+		t.Errorf("body %q, want it to start with %q", body, want)
+	}
+
+	if vary := resp.Header.Get("Vary"); vary != "Accept" {
+		t.Errorf("protobuf Vary %q, want Accept", vary)
+	}
+	if resp, _ := h.get(weatherPath); resp.Header.Get("Vary") != "Accept" {
+		t.Errorf("JSON Vary %q, want Accept", resp.Header.Get("Vary"))
+	}
+
+	req.Header.Set("Accept", "application/x-protobuf;q=0, application/json")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q with protobuf at q=0, want application/json", ct)
+	}
+
+	// elsewhere there's only JSON
+	req, _ = http.NewRequest("GET", h.url+"/forecast?lat=30.49&lon=-99.77", nil)
+	for accept, want := range map[string]int{"application/x-protobuf": 406, "application/x-protobuf, application/json;q=0.5": 200} {
+		req.Header.Set("Accept", accept)
+		if resp, err = http.DefaultClient.Do(req); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("/forecast with Accept %q: status %d, want %d", accept, resp.StatusCode, want)
+		}
+	}
+	if resp, _ := h.get("/forecast?lat=30.49&lon=-99.77&format=protobuf"); resp.StatusCode != 406 {
+		t.Errorf("/forecast?format=protobuf: status %d, want 406", resp.StatusCode)
+	}
+
+	if resp, body := h.get(weatherPath + "&format=protobuf&fields=alerts"); resp.StatusCode != 400 {
+		t.Errorf("fields with protobuf: status %d, want 400: %s", resp.StatusCode, body)
+	}
+}
+
+func TestCBORResponses(t *testing.T) {
+	h := newHarness(t, nil)
+	req, _ := http.NewRequest("GET", h.url+weatherPath, nil)
+	req.Header.Set("Accept", "application/cbor")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/cbor" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	if vary := resp.Header.Get("Vary"); vary != "Accept" {
+		t.Errorf("Vary %q, want Accept", vary)
+	}
+	if n, _ := strconv.Atoi(resp.Header.Get("Content-Length")); n != len(body) {
+		t.Errorf("Content-Length %d for %d bytes", n, len(body))
+	}
+	// alerts: ["Heat Advisory"], as a text key and an array of one text string
+	if body[0]&0xe0 != 0xa0 {
+		t.Errorf("body %x, want a CBOR map", body)
+	}
+	if want := "\x66alerts\x81\x6dHeat Advisory"; !strings.Contains(string(body), want) {
+		t.Errorf("body %q, want it to contain %q", body, want)
+	}
+	if resp, _ := h.get("/locations"); resp.Header.Get("Vary") != "Accept" {
+		t.Errorf("JSON Vary %q, want Accept", resp.Header.Get("Vary"))
+	}
+}
+
+func TestHALWeather(t *testing.T) {
+	h := newHarness(t, nil)
+	resp, body := h.get(weatherPath + "&format=hal")
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	var doc struct {
+		Links map[string]struct{ Href string } `json:"_links"`
+	}
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatalf("%s: %s", err, body)
+	}
+	for rel, want := range map[string]string{
+		"self":     "/weather/?lat=30.49&lon=-99.77",
+		"forecast": "/forecast?lat=30.49&lon=-99.77",
+		"alerts":   "/alerts?lat=30.49&lon=-99.77",
+	} {
+		if got := doc.Links[rel].Href; got != want {
+			t.Errorf("%s link %q, want %q", rel, got, want)
+		}
+	}
+	for rel, link := range doc.Links {
+		if resp, body := h.get(link.Href); resp.StatusCode != 200 {
+			t.Errorf("%s link %s: status %d: %s", rel, link.Href, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	h := newHarness(t, map[string]string{"TIER_FREE_MAX_AGE": "1ns"})
+	poll := func(query string) (*http.Response, app.Weather) {
+		resp, body := h.get("/weather/poll?lat=30.49&lon=-99.77&" + query)
+		var weather app.Weather
+		if resp.StatusCode == 200 {
+			if err := json.Unmarshal([]byte(body), &weather); err != nil {
+				t.Fatalf("%s: %s", err, body)
+			}
+		}
+		return resp, weather
+	}
+
+	resp, first := poll("")
+	if resp.StatusCode != 200 || first.Meta.ObservedAt == nil {
+		t.Fatalf("status %d, meta %+v, want the current conditions at once", resp.StatusCode, first.Meta)
+	}
+	since := first.Meta.ObservedAt.Format(time.RFC3339)
+	if resp, _ := poll("since=" + since + "&timeout=1"); resp.StatusCode != 204 {
+		t.Errorf("status %d with nothing newer, want 204", resp.StatusCode)
+	}
+
+	// a poll waiting when newer conditions arrive gets them
+	done := make(chan app.Weather)
+	go func() {
+		_, weather := poll("since=" + since + "&timeout=10")
+		done <- weather
+	}()
+	time.Sleep(100 * time.Millisecond)
+	h.owm.Script(oneCallPath, ok(strings.Replace(oneCallBody, `"dt":1600000000`, `"dt":1600000600`, 1)))
+	h.get(weatherPath)
+	select {
+	case weather := <-done:
+		if weather.Meta == nil || !weather.Meta.ObservedAt.After(*first.Meta.ObservedAt) {
+			t.Errorf("meta %+v, want conditions observed after %s", weather.Meta, since)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the poll wasn't answered when newer conditions arrived")
+	}
+}
+
+func TestDeltaResponses(t *testing.T) {
+	h := newHarness(t, map[string]string{"TIER_FREE_MAX_AGE": "1ns"})
+	resp, body := h.get(weatherPath)
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatalf("no ETag: %s", body)
+	}
+	var first app.Weather
+	json.Unmarshal([]byte(body), &first)
+	observed := first.Meta.ObservedAt.Format(time.RFC3339)
+
+	for _, since := range []string{etag, observed} {
+		if resp, body := h.get(weatherPath + "&since=" + url.QueryEscape(since)); resp.StatusCode != 304 {
+			t.Errorf("since=%s with nothing new: status %d, want 304: %s", since, resp.StatusCode, body)
+		}
+	}
+
+	newer := strings.Replace(oneCallBody, `"dt":1600000000`, `"dt":1600000600`, 1)
+	h.owm.Script(oneCallPath, ok(strings.Replace(newer, "clear sky", "light rain", 1)))
+	for _, since := range []string{etag, observed} {
+		resp, body := h.get(weatherPath + "&since=" + url.QueryEscape(since))
+		if ct := resp.Header.Get("Content-Type"); resp.StatusCode != 200 || ct != "application/merge-patch+json" {
+			t.Fatalf("since=%s: status %d, Content-Type %q, want a merge patch: %s", since, resp.StatusCode, ct, body)
+		}
+		if resp.Header.Get("Delta-Base") != etag {
+			t.Errorf("Delta-Base %q, want %q", resp.Header.Get("Delta-Base"), etag)
+		}
+		if !strings.Contains(body, `"conditions":["light rain"]`) || !strings.Contains(body, `"meta":`) || strings.Contains(body, `"alerts"`) {
+			t.Errorf("since=%s: patch %s, want just the conditions and meta", since, body)
+		}
+	}
+
+	if resp, body := h.get(weatherPath + `&since="unknown"`); resp.StatusCode != 200 || !strings.Contains(body, `"alerts"`) {
+		t.Errorf("unknown since: status %d, want the whole response: %s", resp.StatusCode, body)
+	}
+}
+
+func TestRequestedMaxAge(t *testing.T) {
+	h := newHarness(t, map[string]string{"MAX_AGE_FLOOR": "10ms"})
+	h.get(weatherPath)
+	h.get(weatherPath + "&max_age=60")
+	if n := len(h.owm.Requests(oneCallPath)); n != 1 {
+		t.Fatalf("%d upstream requests with fresh enough data, want 1", n)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if resp, body := h.get(weatherPath + "&max_age=20ms"); resp.StatusCode != 200 {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	if n := len(h.owm.Requests(oneCallPath)); n != 2 {
+		t.Errorf("%d upstream requests with data older than max_age, want 2", n)
+	}
+
+	for _, maxAge := range []string{"1ms", "soon", "-5"} {
+		if resp, body := h.get(weatherPath + "&max_age=" + maxAge); resp.StatusCode != 400 {
+			t.Errorf("max_age=%s: status %d, want 400: %s", maxAge, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestRevokingTheLastKeyKeepsTheServiceClosed(t *testing.T) {
+	h := newHarness(t, map[string]string{
+		"ADMIN_TOKEN": "secret",
+		"KEYS_PATH":   t.TempDir() + "/keys.json",
+	})
+	admin := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, h.url+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp, _ := h.get(weatherPath); resp.StatusCode != 401 {
+		t.Errorf("no keys yet: status %d, want 401", resp.StatusCode)
+	}
+
+	resp := admin("POST", "/admin/keys", `{"name": "only"}`)
+	var key struct {
+		ID     string `json:"id"`
+		Secret string `json:"secret"`
+	}
+	json.NewDecoder(resp.Body).Decode(&key)
+	resp.Body.Close()
+	if resp, body := h.get(weatherPath + "&api_key=" + key.Secret); resp.StatusCode != 200 {
+		t.Fatalf("status %d with the key: %s", resp.StatusCode, body)
+	}
+
+	admin("DELETE", "/admin/keys/"+key.ID, "").Body.Close()
+	for _, query := range []string{"&api_key=" + key.Secret, "&api_key=bogus", ""} {
+		if resp, _ := h.get(weatherPath + query); resp.StatusCode != 401 {
+			t.Errorf("after revoking the last key, %q: status %d, want 401", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestLongPollsDontCauseShedding(t *testing.T) {
+	h := newHarness(t, map[string]string{"SHED_P99_THRESHOLD": "200ms", "SHED_MAX_FRACTION": "1"})
+	if resp, _ := h.get("/weather/poll?lat=30.49&lon=-99.77&since=2100-01-01T00:00:00Z&timeout=1"); resp.StatusCode != 204 {
+		t.Fatalf("poll: status %d, want 204", resp.StatusCode)
+	}
+	// the shedder recomputes p99 at most once a second
+	time.Sleep(time.Second)
+	for i := 0; i < 20; i++ {
+		if resp, _ := h.get(weatherPath); resp.StatusCode == 503 {
+			t.Fatalf("request %d was shed after a long poll", i)
+		}
+	}
+}
+
+func TestLongPollGoesUpstreamOnce(t *testing.T) {
+	h := newHarness(t, map[string]string{"TIER_FREE_MAX_AGE": "1ns"})
+	if resp, _ := h.get("/weather/poll?lat=30.49&lon=-99.77&since=2100-01-01T00:00:00Z&timeout=2"); resp.StatusCode != 204 {
+		t.Fatalf("status %d, want 204", resp.StatusCode)
+	}
+	if n := len(h.owm.Requests(oneCallPath)); n != 1 {
+		t.Errorf("%d upstream requests while polling, want 1", n)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	// issue returns a token for a new managed key on a service with the
+	// given TOKEN_TTL
+	issue := func(ttl string) (*harness, string) {
+		h := newHarness(t, map[string]string{
+			"ADMIN_TOKEN":       "secret",
+			"KEYS_PATH":         t.TempDir() + "/keys.json",
+			"TOKEN_SIGNING_KEY": "signing-key",
+			"TOKEN_TTL":         ttl,
+		})
+		req, _ := http.NewRequest("POST", h.url+"/admin/keys", strings.NewReader(`{"name": "app"}`))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var key struct {
+			ID     string `json:"id"`
+			Secret string `json:"secret"`
+		}
+		json.NewDecoder(resp.Body).Decode(&key)
+		resp.Body.Close()
+
+		resp, err = http.PostForm(h.url+"/token", url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {key.ID},
+			"client_secret": {key.Secret + "x"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 401 {
+			t.Errorf("bad secret: status %d, want 401", resp.StatusCode)
+		}
+
+		req, _ = http.NewRequest("POST", h.url+"/token", strings.NewReader("grant_type=client_credentials"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(key.ID, key.Secret)
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var token struct {
+			AccessToken string `json:"access_token"`
+		}
+		json.NewDecoder(resp.Body).Decode(&token)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || token.AccessToken == "" {
+			t.Fatalf("issuing a token: status %d", resp.StatusCode)
+		}
+		return h, token.AccessToken
+	}
+	status := func(h *harness, token string) int {
+		req, _ := http.NewRequest("GET", h.url+weatherPath, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	h, token := issue("15m")
+	if got := status(h, token); got != 200 {
+		t.Errorf("valid token: status %d, want 200", got)
+	}
+	parts := strings.Split(token, ".")
+	// the same client, for longer
+	var claims map[string]interface{}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(payload, &claims)
+	claims["exp"] = 4102444800
+	payload, _ = json.Marshal(claims)
+	forged := base64.RawURLEncoding.EncodeToString(payload)
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	sig := []byte(parts[2])
+	sig[0] ^= 1
+	for name, tampered := range map[string]string{
+		"changed claims":    parts[0] + "." + forged + "." + parts[2],
+		"changed signature": parts[0] + "." + parts[1] + "." + string(sig),
+		"no signature":      none + "." + parts[1] + ".",
+		"not a token":       "bogus",
+	} {
+		if got := status(h, tampered); got != 401 {
+			t.Errorf("%s: status %d, want 401", name, got)
+		}
+	}
+
+	h, token = issue("1ns")
+	if got := status(h, token); got != 401 {
+		t.Errorf("expired token: status %d, want 401", got)
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	status := func(h *harness, forwardedFor string) int {
+		req, _ := http.NewRequest("GET", h.url+weatherPath, nil)
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	h := newHarness(t, map[string]string{
+		"TRUSTED_PROXIES": "127.0.0.1",
+		"IP_ALLOWLIST":    "10.0.0.0/8, 2001:db8::/32",
+		"IP_DENYLIST":     "10.1.0.0/16, 10.2.3.4",
+	})
+	for client, want := range map[string]int{
+		"10.9.8.7":      200,
+		"2001:db8::1":   200,
+		"10.1.2.3":      403, // denied within the allowed block
+		"10.2.3.4":      403, // a bare address is a single host
+		"10.2.3.5":      200,
+		"192.0.2.1":     403,
+		"2001:db9::1":   403,
+		"":              403, // the proxy itself isn't on the allowlist
+		"10.9.8.7, ::1": 403, // the client is the last untrusted hop
+	} {
+		if got := status(h, client); got != want {
+			t.Errorf("from %q: status %d, want %d", client, got, want)
+		}
+	}
+
+	// forwarding headers from anyone but a trusted proxy are ignored
+	h = newHarness(t, map[string]string{"IP_ALLOWLIST": "10.0.0.0/8"})
+	if got := status(h, "10.9.8.7"); got != 403 {
+		t.Errorf("spoofed X-Forwarded-For: status %d, want 403", got)
+	}
+
+	h = newHarness(t, map[string]string{"IP_DENYLIST": "192.0.2.0/24"})
+	if got := status(h, ""); got != 200 {
+		t.Errorf("not on the denylist: status %d, want 200", got)
+	}
+	h = newHarness(t, map[string]string{"IP_DENYLIST": "127.0.0.0/8"})
+	if got := status(h, ""); got != 403 {
+		t.Errorf("on the denylist: status %d, want 403", got)
+	}
+}
+
+func TestSlashCommandSignatures(t *testing.T) {
+	discordKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize))
+	h := newHarness(t, map[string]string{
+		"SLACK_SIGNING_SECRET": "slack-secret",
+		"DISCORD_PUBLIC_KEY":   hex.EncodeToString(discordKey.Public().(ed25519.PublicKey)),
+	})
+	post := func(h *harness, header http.Header, body string) (int, string) {
+		req, _ := http.NewRequest("POST", h.url+"/slash", strings.NewReader(body))
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	slack := func(secret string, ts time.Time, body string) http.Header {
+		stamp := strconv.FormatInt(ts.Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte("v0:" + stamp + ":" + body))
+		return http.Header{
+			"Content-Type":              {"application/x-www-form-urlencoded"},
+			"X-Slack-Request-Timestamp": {stamp},
+			"X-Slack-Signature":         {"v0=" + hex.EncodeToString(mac.Sum(nil))},
+		}
+	}
+	discord := func(key ed25519.PrivateKey, ts time.Time, body string) http.Header {
+		stamp := strconv.FormatInt(ts.Unix(), 10)
+		return http.Header{
+			"Content-Type":          {"application/json"},
+			"X-Signature-Timestamp": {stamp},
+			"X-Signature-Ed25519":   {hex.EncodeToString(ed25519.Sign(key, []byte(stamp+body)))},
+		}
+	}
+	now := time.Now()
+	const slackBody = "command=%2Fweather&text=30.49%2C-99.77"
+	const discordBody = `{"type":2,"data":{"name":"weather","options":[{"value":"30.49,-99.77"}]}}`
+
+	if status, body := post(h, slack("slack-secret", now, slackBody), slackBody); status != 200 || !strings.Contains(body, `"in_channel"`) {
+		t.Errorf("signed Slack command: status %d: %s", status, body)
+	}
+	if status, body := post(h, discord(discordKey, now, discordBody), discordBody); status != 200 || !strings.Contains(body, `"embeds"`) {
+		t.Errorf("signed Discord command: status %d: %s", status, body)
+	}
+	if status, body := post(h, discord(discordKey, now, `{"type":1}`), `{"type":1}`); status != 200 || body != "{\"type\":1}\n" {
+		t.Errorf("Discord ping: status %d: %s", status, body)
+	}
+	// just within the allowed skew either way
+	for _, skew := range []time.Duration{-4 * time.Minute, 4 * time.Minute} {
+		if status, _ := post(h, slack("slack-secret", now.Add(skew), slackBody), slackBody); status != 200 {
+			t.Errorf("Slack command %s off: status %d, want 200", skew, status)
+		}
+		if status, _ := post(h, discord(discordKey, now.Add(skew), discordBody), discordBody); status != 200 {
+			t.Errorf("Discord command %s off: status %d, want 200", skew, status)
+		}
+	}
+
+	otherKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{8}, ed25519.SeedSize))
+	for name, req := range map[string]struct {
+		header http.Header
+		body   string
+	}{
+		"Slack, wrong secret":         {slack("other-secret", now, slackBody), slackBody},
+		"Slack, altered body":         {slack("slack-secret", now, slackBody), slackBody + "x"},
+		"Slack, stale":                {slack("slack-secret", now.Add(-10*time.Minute), slackBody), slackBody},
+		"Slack, from the future":      {slack("slack-secret", now.Add(10*time.Minute), slackBody), slackBody},
+		"Discord, wrong key":          {discord(otherKey, now, discordBody), discordBody},
+		"Discord, altered body":       {discord(discordKey, now, discordBody), `{"type":1}`},
+		"Discord, stale":              {discord(discordKey, now.Add(-10*time.Minute), discordBody), discordBody},
+		"Discord, from the future":    {discord(discordKey, now.Add(10*time.Minute), discordBody), discordBody},
+		"no signature":                {http.Header{}, slackBody},
+		"Slack, bad timestamp header": {http.Header{"X-Slack-Request-Timestamp": {"soon"}, "X-Slack-Signature": {"v0=00"}}, slackBody},
+	} {
+		if status, body := post(h, req.header, req.body); status != 401 {
+			t.Errorf("%s: status %d, want 401: %s", name, status, body)
+		}
+	}
+
+	// a platform without its key configured is turned away
+	h = newHarness(t, nil)
+	if status, _ := post(h, slack("", now, slackBody), slackBody); status != 401 {
+		t.Errorf("Slack without SLACK_SIGNING_SECRET: status %d, want 401", status)
+	}
+	if status, _ := post(h, discord(discordKey, now, discordBody), discordBody); status != 401 {
+		t.Errorf("Discord without DISCORD_PUBLIC_KEY: status %d, want 401", status)
+	}
+}
+
+func TestWebhookSignatures(t *testing.T) {
+	// the receiver checks signatures as the webhookNotifier docs say to,
+	// with the secret it shares with us
+	var mu sync.Mutex
+	verified := make(map[string]bool)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		ts := r.Header.Get("X-Weather-Timestamp")
+		mac := hmac.New(sha256.New, []byte("shared-secret"))
+		mac.Write([]byte("v1:" + ts + ":"))
+		mac.Write(body)
+		want := "v1=" + hex.EncodeToString(mac.Sum(nil))
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		ok := err == nil && time.Since(time.Unix(sec, 0)) < 5*time.Minute &&
+			hmac.Equal([]byte(want), []byte(r.Header.Get("X-Weather-Signature"))) &&
+			r.Header.Get("X-Weather-Delivery") == "n-"+strings.TrimPrefix(r.URL.Path, "/")
+		mu.Lock()
+		verified[r.URL.Path] = ok
+		mu.Unlock()
+		if !ok {
+			w.WriteHeader(401)
+			return
+		}
+		w.WriteHeader(204)
+	}))
+	defer receiver.Close()
+
+	// a delivery to each webhook, due now
+	var deliveries []map[string]interface{}
+	for _, name := range []string{"good", "wrong-secret", "unsigned"} {
+		deliveries = append(deliveries, map[string]interface{}{
+			"id":           "d-" + name,
+			"channel":      "webhook",
+			"target":       receiver.URL + "/" + name,
+			"notification": map[string]interface{}{"id": "n-" + name, "type": "digest", "data": map[string]string{"name": name}},
+			"attempts":     1,
+			"created_at":   time.Now(),
+		})
+	}
+	path := t.TempDir() + "/deliveries.json"
+	b, _ := json.Marshal(deliveries)
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	h := newHarness(t, map[string]string{
+		"ADMIN_TOKEN":             "secret",
+		"DELIVERIES_PATH":         path,
+		"DELIVERY_RETRY_INTERVAL": "10ms",
+		"NOTIFY_WEBHOOKS":         receiver.URL + "/good," + receiver.URL + "/wrong-secret," + receiver.URL + "/unsigned",
+		"NOTIFY_WEBHOOK_SECRETS":  receiver.URL + "/good=shared-secret," + receiver.URL + "/wrong-secret=other-secret",
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(verified)
+		mu.Unlock()
+		if n == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of 3 webhooks called", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	for path, want := range map[string]bool{"/good": true, "/wrong-secret": false, "/unsigned": false} {
+		if verified[path] != want {
+			t.Errorf("%s: signature verified %t, want %t", path, verified[path], want)
+		}
+	}
+	mu.Unlock()
+
+	// rejected deliveries stay queued for another try
+	req, _ := http.NewRequest("GET", h.url+"/admin/deliveries?status=pending", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pending []struct {
+		ID        string `json:"id"`
+		LastError string `json:"last_error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&pending)
+	resp.Body.Close()
+	if len(pending) != 2 {
+		t.Fatalf("pending deliveries %+v, want the two rejected ones", pending)
+	}
+	for _, d := range pending {
+		if d.ID == "d-good" || !strings.Contains(d.LastError, "401") {
+			t.Errorf("pending delivery %+v, want a rejected one", d)
+		}
+	}
+}
+
+func TestAlertCursorsSurviveRestarts(t *testing.T) {
+	// as saved after the oldest alerts were trimmed
+	path := t.TempDir() + "/history.json"
+	seeded := `{"alerts": [
+		{"seq": 10, "location": {"lat": 1, "lon": 1}, "event": "Flood Watch", "start": "2020-01-01T00:00:00Z"},
+		{"seq": 20, "location": {"lat": 1, "lon": 1}, "event": "Wind Advisory", "start": "2020-01-02T00:00:00Z"},
+		{"seq": 30, "location": {"lat": 1, "lon": 1}, "event": "Frost Advisory", "start": "2020-01-03T00:00:00Z"}
+	], "alert_seq": 30}`
+	if err := ioutil.WriteFile(path, []byte(seeded), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cursor := func(seq int) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(seq)))
+	}
+	page := func(h *harness, query string) (events []string, next string) {
+		t.Helper()
+		resp, body := h.get("/alerts/recent?limit=1" + query)
+		var p struct {
+			Items      []struct{ Event string }
+			NextCursor string `json:"next_cursor"`
+		}
+		if err := json.Unmarshal([]byte(body), &p); err != nil || resp.StatusCode != 200 {
+			t.Fatalf("status %d: %s", resp.StatusCode, body)
+		}
+		for _, item := range p.Items {
+			events = append(events, item.Event)
+		}
+		return events, p.NextCursor
+	}
+
+	t.Run("before", func(t *testing.T) {
+		h := newHarness(t, map[string]string{"HISTORY_PATH": path})
+		if events, _ := page(h, "&cursor="+cursor(30)); len(events) != 1 || events[0] != "Wind Advisory" {
+			t.Errorf("page after a saved cursor: %v, want Wind Advisory", events)
+		}
+		h.get(weatherPath) // sees a heat advisory
+		if events, next := page(h, ""); len(events) != 1 || events[0] != "Heat Advisory" || next != cursor(31) {
+			t.Errorf("newest alert: %v, next cursor %s, want Heat Advisory numbered after the saved ones", events, next)
+		}
+	})
+	t.Run("after", func(t *testing.T) {
+		h := newHarness(t, map[string]string{"HISTORY_PATH": path})
+		if events, _ := page(h, "&cursor="+cursor(31)); len(events) != 1 || events[0] != "Frost Advisory" {
+			t.Errorf("page after a cursor from before the restart: %v, want Frost Advisory", events)
+		}
+		h.get("/weather/?lat=47.61&lon=-122.33")
+		if _, next := page(h, ""); next != cursor(32) {
+			t.Errorf("next cursor %s, want the new alert numbered after the saved ones", next)
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseCIDRs parses a list of CIDR blocks. Bare addresses are accepted and
+// treated as single-host blocks.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, item := range list {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// containsIP reports whether any of nets contains ip.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipFilter is network-level access control. Denied addresses are always
+// rejected; when an allowlist is configured, only addresses on it are let
+// through. It relies on realIP having run first.
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// Allowed reports whether ip may access the service.
+func (f *ipFilter) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return len(f.allow) == 0 && len(f.deny) == 0
+	}
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+// Middleware rejects requests from addresses that aren't allowed before they
+// reach h.
+func (f *ipFilter) Middleware(h http.Handler) http.Handler {
+	if len(f.allow) == 0 && len(f.deny) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !f.Allowed(clientIPFromContext(r.Context())) {
+			w.WriteHeader(403)
+			w.Write([]byte("Forbidden"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,161 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	apiKeyRequests = newCounter("upstream_api_key_requests_total",
+		"Requests made with each API key in the pool, by its position in API_KEYS.", "key")
+	apiKeyDisabled = newCounter("upstream_api_key_disabled_total",
+		"Times each API key was taken out of rotation, by reason: auth or rate_limited.", "key", "reason")
+)
+
+// apiKey is one key in a keyPool. Quotas are per key, so each has its own
+// rateGate.
+type apiKey struct {
+	value  string
+	label  string // safe to show in metrics and logs
+	weight int
+	gate   *rateGate
+
+	disabledUntil time.Time // guarded by the pool's mu
+}
+
+// keyPool spreads requests over several API keys, as when load is split
+// across free-tier accounts. Each request goes out with a key chosen at
+// random in proportion to the keys' weights. A key the provider rejects is
+// taken out of rotation for authBackoff, one it rate limits until its
+// Retry-After has passed, and the request is retried with another.
+type keyPool struct {
+	keys        []*apiKey
+	authBackoff time.Duration
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// parseAPIKeys parses API_KEYS: a comma-separated list of keys, each
+// optionally followed by a colon and a weight (the default is 1).
+func parseAPIKeys(spec string) ([]string, []int, error) {
+	var keys []string
+	var weights []int
+	for _, item := range splitList(spec) {
+		key, weight := item, 1
+		if i := strings.LastIndex(item, ":"); i >= 0 {
+			w, err := strconv.Atoi(item[i+1:])
+			if err != nil || w < 1 {
+				return nil, nil, fmt.Errorf("key %d: weight must be a positive integer", len(keys)+1)
+			}
+			key, weight = item[:i], w
+		}
+		if key == "" {
+			return nil, nil, fmt.Errorf("key %d is empty", len(keys)+1)
+		}
+		keys = append(keys, key)
+		weights = append(weights, weight)
+	}
+	if len(keys) == 0 {
+		return nil, nil, errors.New("no keys")
+	}
+	return keys, weights, nil
+}
+
+func newKeyPool(keys []string, weights []int, authBackoff time.Duration, newGate func() *rateGate) *keyPool {
+	p := &keyPool{authBackoff: authBackoff, rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	for i, key := range keys {
+		p.keys = append(p.keys, &apiKey{
+			value:  key,
+			label:  strconv.Itoa(i + 1),
+			weight: weights[i],
+			gate:   newGate(),
+		})
+	}
+	return p
+}
+
+// pick chooses a key that hasn't been tried yet from those in rotation.
+// If none are in rotation, the first pick is the key due back soonest, so
+// that requests still fail the way the provider says; nil means there's
+// nothing left to try.
+func (p *keyPool) pick(tried map[*apiKey]bool) *apiKey {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	total := 0
+	var soonest *apiKey
+	for _, key := range p.keys {
+		switch {
+		case tried[key]:
+		case key.disabledUntil.After(now):
+			if soonest == nil || key.disabledUntil.Before(soonest.disabledUntil) {
+				soonest = key
+			}
+		default:
+			total += key.weight
+		}
+	}
+	if total == 0 {
+		if len(tried) > 0 {
+			return nil
+		}
+		return soonest
+	}
+	n := p.rng.Intn(total)
+	for _, key := range p.keys {
+		if tried[key] || key.disabledUntil.After(now) {
+			continue
+		}
+		if n -= key.weight; n < 0 {
+			return key
+		}
+	}
+	return nil // unreachable
+}
+
+func (p *keyPool) disable(key *apiKey, d time.Duration, reason string) {
+	p.mu.Lock()
+	if until := time.Now().Add(d); until.After(key.disabledUntil) {
+		key.disabledUntil = until
+	}
+	p.mu.Unlock()
+	apiKeyDisabled.Inc(key.label, reason)
+}
+
+// Do calls fetch with a key from the pool, moving on to another key when
+// the provider rejects or rate limits the one used. It returns the last
+// error if no key succeeds.
+func (p *keyPool) Do(fetch func(key *apiKey) error) error {
+	tried := make(map[*apiKey]bool)
+	var err error
+	for key := p.pick(tried); key != nil; key = p.pick(tried) {
+		tried[key] = true
+		apiKeyRequests.Inc(key.label)
+		if err = fetch(key); err == nil {
+			return nil
+		}
+		var uerr *UpstreamError
+		switch {
+		case errors.Is(err, ErrProviderAuth):
+			p.disable(key, p.authBackoff, "auth")
+		case errors.As(err, &uerr) && uerr.StatusCode == 429:
+			backoff := uerr.RetryAfter
+			if backoff <= 0 {
+				backoff = time.Minute
+			}
+			p.disable(key, backoff, "rate_limited")
+		case errors.Is(err, ErrRateLimited):
+			// our own gate holding back; another key may have quota left
+		default:
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,310 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyRecord is a managed API key. Only a hash of the secret is stored; the
+// secret itself is shown once, when the key is created or rotated.
+type keyRecord struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Tier       string     `json:"tier"`
+	DailyQuota int        `json:"daily_quota"` // 0 means unlimited
+	SecretHash string     `json:"secret_hash"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+
+	// after a rotation the previous secret keeps working for a grace
+	// period, so clients can be updated without downtime
+	PreviousSecretHash string     `json:"previous_secret_hash,omitempty"`
+	PreviousExpiresAt  *time.Time `json:"previous_expires_at,omitempty"`
+
+	keyShape
+}
+
+// keyStore persists managed API keys as a JSON file.
+type keyStore struct {
+	path string
+
+	mu      sync.Mutex
+	records map[string]*keyRecord
+}
+
+// openKeyStore loads the key store at path, creating it on first save.
+func openKeyStore(path string) (*keyStore, error) {
+	ks := &keyStore{path: path, records: make(map[string]*keyRecord)}
+	var records []*keyRecord
+	if err := loadJSONFile(path, &records); err != nil {
+		return nil, err
+	}
+	for _, rec := range records {
+		ks.records[rec.ID] = rec
+	}
+	return ks, nil
+}
+
+// save writes the store to disk. The caller must hold ks.mu.
+func (ks *keyStore) save() error {
+	records := make([]*keyRecord, 0, len(ks.records))
+	for _, rec := range ks.records {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+	return saveJSONFile(ks.path, records)
+}
+
+// hashSecret returns the stored form of a key secret.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Find returns a copy of the active key whose current (or, within the grace
+// period, previous) secret is secret.
+func (ks *keyStore) Find(secret string) (keyRecord, bool) {
+	hash := hashSecret(secret)
+	now := time.Now()
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	for _, rec := range ks.records {
+		if rec.RevokedAt != nil {
+			continue
+		}
+		if rec.SecretHash == hash {
+			return *rec, true
+		}
+		if rec.PreviousSecretHash == hash && rec.PreviousExpiresAt != nil && now.Before(*rec.PreviousExpiresAt) {
+			return *rec, true
+		}
+	}
+	return keyRecord{}, false
+}
+
+// Get returns a copy of the key with the given ID.
+func (ks *keyStore) Get(id string) (keyRecord, bool) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	rec, ok := ks.records[id]
+	if !ok {
+		return keyRecord{}, false
+	}
+	return *rec, true
+}
+
+// Create adds a new key, returning it along with its secret.
+func (ks *keyStore) Create(name, tier string, dailyQuota int, shape keyShape) (keyRecord, string, error) {
+	secret := "bp_" + randomHex(16)
+	rec := &keyRecord{
+		ID:         randomHex(8),
+		Name:       name,
+		Tier:       tier,
+		DailyQuota: dailyQuota,
+		SecretHash: hashSecret(secret),
+		CreatedAt:  time.Now().UTC(),
+		keyShape:   shape,
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.records[rec.ID] = rec
+	if err := ks.save(); err != nil {
+		delete(ks.records, rec.ID)
+		return keyRecord{}, "", err
+	}
+	return *rec, secret, nil
+}
+
+// List returns all keys, including revoked ones, oldest first.
+func (ks *keyStore) List() []keyRecord {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	out := make([]keyRecord, 0, len(ks.records))
+	for _, rec := range ks.records {
+		out = append(out, *rec)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// Revoke disables a key. Revoked keys are kept for the record.
+func (ks *keyStore) Revoke(id string) (keyRecord, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	rec, ok := ks.records[id]
+	if !ok {
+		return keyRecord{}, ErrNotFound
+	}
+	if rec.RevokedAt == nil {
+		now := time.Now().UTC()
+		rec.RevokedAt = &now
+		if err := ks.save(); err != nil {
+			rec.RevokedAt = nil
+			return keyRecord{}, err
+		}
+	}
+	return *rec, nil
+}
+
+// Rotate issues a new secret for a key. The old secret remains valid for
+// grace.
+func (ks *keyStore) Rotate(id string, grace time.Duration) (keyRecord, string, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	rec, ok := ks.records[id]
+	if !ok || rec.RevokedAt != nil {
+		return keyRecord{}, "", ErrNotFound
+	}
+
+	old := *rec
+	secret := "bp_" + randomHex(16)
+	now := time.Now().UTC()
+	expires := now.Add(grace)
+	rec.PreviousSecretHash = rec.SecretHash
+	rec.PreviousExpiresAt = &expires
+	rec.SecretHash = hashSecret(secret)
+	rec.RotatedAt = &now
+	if err := ks.save(); err != nil {
+		*rec = old
+		return keyRecord{}, "", err
+	}
+	return *rec, secret, nil
+}
+
+// keyView is the admin API representation of a key; it never includes
+// secret hashes.
+type keyView struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Tier       string     `json:"tier"`
+	DailyQuota int        `json:"daily_quota"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	Secret     string     `json:"secret,omitempty"`
+	keyShape
+}
+
+func newKeyView(rec keyRecord, secret string) keyView {
+	return keyView{
+		ID:         rec.ID,
+		Name:       rec.Name,
+		Tier:       rec.Tier,
+		DailyQuota: rec.DailyQuota,
+		CreatedAt:  rec.CreatedAt,
+		RotatedAt:  rec.RotatedAt,
+		RevokedAt:  rec.RevokedAt,
+		Secret:     secret,
+		keyShape:   rec.keyShape,
+	}
+}
+
+// keysHandler serves the key management API:
+//
+//	GET    /admin/keys            list keys
+//	POST   /admin/keys            create a key: {"name", "tier", "daily_quota", "naming", "envelope"}
+//	DELETE /admin/keys/{id}       revoke a key
+//	POST   /admin/keys/{id}/rotate issue a new secret
+func (s *server) keysHandler(w http.ResponseWriter, r *http.Request) {
+	if s.clients.store == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Key management is disabled; set KEYS_PATH to enable it"))
+		return
+	}
+	store := s.clients.store
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/keys"), "/")
+	parts := strings.Split(rest, "/")
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case rest == "" && r.Method == "GET":
+		keys := store.List()
+		views := make([]keyView, len(keys))
+		for i, rec := range keys {
+			views[i] = newKeyView(rec, "")
+		}
+		json.NewEncoder(w).Encode(views)
+
+	case rest == "" && r.Method == "POST":
+		var req struct {
+			Name       string `json:"name"`
+			Tier       string `json:"tier"`
+			DailyQuota int    `json:"daily_quota"`
+			keyShape
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Invalid request body: %s", err)
+			return
+		}
+		if req.Tier == "" {
+			req.Tier = s.clients.anonymous.Tier.Name
+		}
+		if _, ok := s.clients.tiers[req.Tier]; !ok {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Unknown tier: %q", req.Tier)
+			return
+		}
+		if req.DailyQuota < 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("daily_quota must not be negative"))
+			return
+		}
+		if req.Naming != "" {
+			naming, err := parseNaming(req.Naming)
+			if err != nil {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "Invalid naming: %s", err)
+				return
+			}
+			req.Naming = naming
+		}
+		rec, secret, err := store.Create(req.Name, req.Tier, req.DailyQuota, req.keyShape)
+		if err != nil {
+			s.storageError(w, err)
+			return
+		}
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(newKeyView(rec, secret))
+
+	case len(parts) == 1 && r.Method == "DELETE":
+		rec, err := store.Revoke(parts[0])
+		if err != nil {
+			s.storageError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(newKeyView(rec, ""))
+
+	case len(parts) == 2 && parts[1] == "rotate" && r.Method == "POST":
+		rec, secret, err := store.Rotate(parts[0], s.keyRotationGrace)
+		if err != nil {
+			s.storageError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(newKeyView(rec, secret))
+
+	default:
+		w.WriteHeader(404)
+	}
+}
@@ -0,0 +1,312 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var leaderGauge = newGauge("leader",
+	"Whether this replica is the leader that runs background jobs.")
+
+// elector decides which of several replicas is the leader. Only the leader
+// runs background jobs (the scheduler, digests and Telegram polling), so
+// replicas don't each send the same notifications.
+type elector interface {
+	// Acquire tries to become the leader, or to stay it, and reports
+	// whether we are. It's called every renewal interval.
+	Acquire(ctx context.Context) (bool, error)
+	// Release gives up leadership, if we have it, so another replica can
+	// take over without waiting for it to expire.
+	Release(ctx context.Context) error
+}
+
+// leadership tracks whether we're the leader, renewing it periodically. A
+// nil *leadership is always the leader, for single-replica deployments.
+type leadership struct {
+	elector elector
+	renew   time.Duration
+	logger  *log.Logger
+
+	mu      sync.Mutex
+	leader  bool
+	stopped bool
+}
+
+// IsLeader reports whether we're the leader.
+func (l *leadership) IsLeader() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leader
+}
+
+// run acquires and renews leadership until ctx is done. If renewal fails we
+// step down straight away: another replica may take over once our claim
+// expires, and two leaders are worse than none for a moment.
+func (l *leadership) run(ctx context.Context) {
+	leaderGauge.Set(0)
+	for {
+		acquireCtx, cancel := context.WithTimeout(ctx, l.renew)
+		leader, err := l.elector.Acquire(acquireCtx)
+		cancel()
+		if err != nil {
+			l.logger.Printf("Failed to renew leadership: %s", err)
+			leader = false
+		}
+
+		l.mu.Lock()
+		if l.stopped {
+			// released while we were renewing
+			l.mu.Unlock()
+			return
+		}
+		changed := leader != l.leader
+		l.leader = leader
+		l.mu.Unlock()
+		if changed && leader {
+			l.logger.Println("Became the leader; running background jobs")
+			leaderGauge.Set(1)
+		} else if changed {
+			l.logger.Println("Lost leadership; pausing background jobs")
+			leaderGauge.Set(0)
+		}
+		if !sleep(ctx, l.renew) {
+			return
+		}
+	}
+}
+
+// Release gives up leadership for good, on shutdown.
+func (l *leadership) Release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.stopped = true
+	l.mu.Unlock()
+	l.StepDown()
+}
+
+// StepDown gives up leadership, if we have it, so another replica can take
+// over without waiting for it to expire. Unlike Release, it's for while run
+// isn't running, and we're a candidate again once it's started again: a
+// restart steps down for the replacement, and if the replacement fails to
+// start, takes leadership back.
+func (l *leadership) StepDown() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.leader = false
+	l.mu.Unlock()
+	leaderGauge.Set(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := l.elector.Release(ctx); err != nil {
+		l.logger.Printf("Failed to release leadership: %s", err)
+	}
+}
+
+// waitForLeadership blocks until we're the leader, reporting false if ctx
+// was done first.
+func (l *leadership) waitForLeadership(ctx context.Context) bool {
+	for !l.IsLeader() {
+		if !sleep(ctx, time.Second) {
+			return false
+		}
+	}
+	return true
+}
+
+// leaderIdentity names this process in leader elections. The pid tells a
+// process apart from the replacement it starts on a restart.
+func leaderIdentity() string {
+	name := os.Getenv("POD_NAME")
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	return fmt.Sprintf("%s_%d", name, os.Getpid())
+}
+
+// serviceAccountDir holds the credentials Kubernetes mounts into pods.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeLease elects a leader with a Kubernetes Lease object. The lease is
+// updated with the resourceVersion we read, so of two replicas racing for
+// it, the API server only lets one win.
+type kubeLease struct {
+	client    *http.Client
+	apiURL    string
+	token     string
+	namespace string
+	name      string
+	identity  string
+	duration  time.Duration
+}
+
+// kubeMicroTime is the format of the Lease's timestamps.
+const kubeMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// newKubeLease configures a lease elector from the pod's service account.
+// The service account needs get, create and update on leases in its
+// namespace.
+func newKubeLease(name, identity string, duration time.Duration) (*kubeLease, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in Kubernetes")
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s/ca.crt", serviceAccountDir)
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return &kubeLease{
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		apiURL:    "https://" + host + ":" + port,
+		token:     strings.TrimSpace(string(token)),
+		namespace: strings.TrimSpace(string(namespace)),
+		name:      name,
+		identity:  identity,
+		duration:  duration,
+	}, nil
+}
+
+// lease is the part of a coordination.k8s.io/v1 Lease we use.
+type lease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace,omitempty"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+	} `json:"spec"`
+}
+
+// expired reports whether the lease's holder has let it lapse.
+func (l *lease) expired(now time.Time) bool {
+	if l.Spec.HolderIdentity == "" {
+		return true
+	}
+	renewed, err := time.Parse(kubeMicroTime, l.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return now.After(renewed.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+func (k *kubeLease) url() string {
+	return fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", k.apiURL, k.namespace)
+}
+
+// do makes an API call, decoding the response into out. It returns the
+// response status, which callers check for 404 and 409.
+func (k *kubeLease) do(ctx context.Context, method, url string, in, out interface{}) (int, error) {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, &body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == 404 || resp.StatusCode == 409:
+		return resp.StatusCode, nil
+	case resp.StatusCode/100 != 2:
+		return resp.StatusCode, fmt.Errorf("kubernetes %s lease: %s", strings.ToLower(method), resp.Status)
+	}
+	if out == nil {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (k *kubeLease) Acquire(ctx context.Context) (bool, error) {
+	now := time.Now()
+	var current lease
+	status, err := k.do(ctx, "GET", k.url()+"/"+k.name, nil, &current)
+	if err != nil {
+		return false, err
+	}
+
+	next := current
+	if status == 404 {
+		next.APIVersion, next.Kind = "coordination.k8s.io/v1", "Lease"
+		next.Metadata.Name, next.Metadata.Namespace = k.name, k.namespace
+	} else if current.Spec.HolderIdentity != k.identity && !current.expired(now) {
+		return false, nil
+	}
+	if next.Spec.HolderIdentity != k.identity {
+		next.Spec.HolderIdentity = k.identity
+		next.Spec.AcquireTime = now.UTC().Format(kubeMicroTime)
+	}
+	next.Spec.LeaseDurationSeconds = int(k.duration.Seconds())
+	next.Spec.RenewTime = now.UTC().Format(kubeMicroTime)
+
+	if status == 404 {
+		status, err = k.do(ctx, "POST", k.url(), &next, nil)
+	} else {
+		status, err = k.do(ctx, "PUT", k.url()+"/"+k.name, &next, nil)
+	}
+	if err != nil {
+		return false, err
+	}
+	// 409: another replica got there first
+	return status != 409 && status != 404, nil
+}
+
+func (k *kubeLease) Release(ctx context.Context) error {
+	var current lease
+	status, err := k.do(ctx, "GET", k.url()+"/"+k.name, nil, &current)
+	if err != nil || status == 404 || current.Spec.HolderIdentity != k.identity {
+		return err
+	}
+	current.Spec.HolderIdentity = ""
+	_, err = k.do(ctx, "PUT", k.url()+"/"+k.name, &current, nil)
+	return err
+}
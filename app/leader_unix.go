@@ -0,0 +1,58 @@
+//go:build !windows
+// +build !windows
+
+package app
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// fileLock elects a leader with an exclusive lock on a file, for replicas
+// sharing a host or a filesystem that supports locking. The lock is
+// released when its holder exits, however it exits.
+type fileLock struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File // set while we hold the lock
+}
+
+func newFileLock(path string) (elector, error) {
+	return &fileLock{path: path}, nil
+}
+
+func (l *fileLock) Acquire(ctx context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		return true, nil
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return false, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+		return false, err
+	}
+	l.file = f
+	return true, nil
+}
+
+func (l *fileLock) Release(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	// closing the file releases the lock
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,9 @@
+package app
+
+import "fmt"
+
+// Windows has no flock; use Kubernetes leases there instead.
+
+func newFileLock(path string) (elector, error) {
+	return nil, fmt.Errorf("file locks are not supported on Windows")
+}
@@ -0,0 +1,181 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+const lightningProvider = "xweather"
+
+const (
+	// maxLightningRadius bounds the radius of a lightning request, in km.
+	maxLightningRadius = 300
+	// maxLightningAge bounds how far back a lightning request looks.
+	maxLightningAge = time.Hour
+	// lightningAllClear is how long after the last strike it's safe to go
+	// back outside.
+	lightningAllClear = 30 * time.Minute
+)
+
+// LightningService is a client for the Xweather lightning API.
+type LightningService struct {
+	client       *http.Client
+	baseURL      string
+	clientID     string
+	clientSecret string
+}
+
+// Strike is a lightning strike.
+type Strike struct {
+	Time        time.Time `json:"time"`
+	Lat         float64   `json:"lat"`
+	Lon         float64   `json:"lon"`
+	DistanceKm  float64   `json:"distance_km"`
+	Type        string    `json:"type"`                   // "cloud-to-ground" or "intra-cloud"
+	PeakCurrent float64   `json:"peak_current,omitempty"` // kA
+}
+
+// GetStrikes returns the strikes within radiusKm of a point over the last
+// age, nearest first.
+func (l *LightningService) GetStrikes(lat, lon string, radiusKm float64, age time.Duration) ([]Strike, error) {
+	params := url.Values{}
+	params.Add("p", lat+","+lon)
+	params.Add("radius", strconv.FormatFloat(radiusKm, 'f', -1, 64)+"km")
+	params.Add("from", fmt.Sprintf("-%dminutes", int(age.Minutes())))
+	params.Add("limit", "1000")
+	params.Add("client_id", l.clientID)
+	params.Add("client_secret", l.clientSecret)
+
+	resp, err := l.client.Get(l.baseURL + "/lightning/closest?" + params.Encode())
+	if err != nil {
+		// the URL holds our credentials
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return nil, &UpstreamError{Provider: lightningProvider, Class: ErrUpstreamUnavailable, Message: err.Error()}
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Error *struct {
+			Code        string `json:"code"`
+			Description string `json:"description"`
+		} `json:"error"`
+		Response []struct {
+			Loc struct {
+				Lat  float64 `json:"lat"`
+				Long float64 `json:"long"`
+			} `json:"loc"`
+			Ob struct {
+				Timestamp int64 `json:"timestamp"`
+				Pulse     struct {
+					Type    string  `json:"type"` // "cg" or "ic"
+					PeakAmp float64 `json:"peakamp"`
+				} `json:"pulse"`
+			} `json:"ob"`
+			RelativeTo struct {
+				DistanceKm float64 `json:"distanceKM"`
+			} `json:"relativeTo"`
+		} `json:"response"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, &UpstreamError{Provider: lightningProvider, Class: ErrUpstreamUnavailable, StatusCode: resp.StatusCode, Message: err.Error()}
+	}
+	// "no data" is reported as an error, but just means no strikes
+	if body.Error != nil && body.Error.Code != "warn_no_data" {
+		status := resp.StatusCode
+		if status == 200 {
+			status = 502
+		}
+		return nil, &UpstreamError{
+			Provider:   lightningProvider,
+			Class:      classifyStatus(status),
+			StatusCode: resp.StatusCode,
+			Message:    body.Error.Description,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now(), 0),
+		}
+	}
+
+	strikes := make([]Strike, 0, len(body.Response))
+	for _, r := range body.Response {
+		strike := Strike{
+			Time:        time.Unix(r.Ob.Timestamp, 0).UTC(),
+			Lat:         r.Loc.Lat,
+			Lon:         r.Loc.Long,
+			DistanceKm:  r.RelativeTo.DistanceKm,
+			Type:        "cloud-to-ground",
+			PeakCurrent: r.Ob.Pulse.PeakAmp / 1000,
+		}
+		if r.Ob.Pulse.Type == "ic" {
+			strike.Type = "intra-cloud"
+		}
+		strikes = append(strikes, strike)
+	}
+	sort.Slice(strikes, func(i, j int) bool { return strikes[i].DistanceKm < strikes[j].DistanceKm })
+	return strikes, nil
+}
+
+// LightningReport is the response of the lightning endpoint.
+type LightningReport struct {
+	RadiusKm float64  `json:"radius_km"`
+	Minutes  int      `json:"minutes"`
+	Count    int      `json:"count"`
+	Strikes  []Strike `json:"strikes"` // nearest first
+}
+
+// lightningHandler lists the lightning strikes within ?radius_km= (50 by
+// default) of a location over the last ?minutes= (15 by default).
+func (s *server) lightningHandler(w http.ResponseWriter, r *http.Request) {
+	if s.lightning == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Lightning data is not configured"))
+		return
+	}
+	q := r.URL.Query()
+	radius := 50.0
+	if raw := q.Get("radius_km"); raw != "" {
+		var err error
+		if radius, err = strconv.ParseFloat(raw, 64); err != nil || radius <= 0 || radius > maxLightningRadius {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "radius_km must be a number between 0 and %d", maxLightningRadius)
+			return
+		}
+	}
+	minutes := 15
+	if raw := q.Get("minutes"); raw != "" {
+		var err error
+		if minutes, err = strconv.Atoi(raw); err != nil || minutes < 1 || minutes > int(maxLightningAge.Minutes()) {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "minutes must be a whole number between 1 and %d", int(maxLightningAge.Minutes()))
+			return
+		}
+	}
+
+	lat, lon, _ := s.requestLocation(r, q)
+	if _, err := models.ParseLocation(lat, lon); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	strikes, err := s.lightning.GetStrikes(lat, lon, radius, time.Duration(minutes)*time.Minute)
+	if err != nil {
+		upstreamErrors.Inc(errorClass(err))
+		s.upstreamError(w, r, err)
+		return
+	}
+	writeJSON(w, &LightningReport{
+		RadiusKm: radius,
+		Minutes:  minutes,
+		Count:    len(strikes),
+		Strikes:  strikes,
+	})
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrSaturated is returned when a concurrency limiter's queue is full.
+var ErrSaturated = errors.New("too many requests in flight")
+
+// limiter bounds how many callers may run at once. Callers beyond the limit
+// wait in a queue of bounded depth; once that is full they are turned away
+// immediately with ErrSaturated, so overload sheds load rather than piling
+// up goroutines.
+type limiter struct {
+	slots    chan struct{}
+	maxQueue int
+
+	mu     sync.Mutex
+	queued int
+}
+
+func newLimiter(maxConcurrency, maxQueue int) *limiter {
+	return &limiter{
+		slots:    make(chan struct{}, maxConcurrency),
+		maxQueue: maxQueue,
+	}
+}
+
+// Acquire takes a slot, waiting in the queue if necessary. Every successful
+// Acquire must be paired with a Release.
+func (l *limiter) Acquire() error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	l.mu.Lock()
+	if l.queued >= l.maxQueue {
+		l.mu.Unlock()
+		return ErrSaturated
+	}
+	l.queued++
+	l.mu.Unlock()
+
+	l.slots <- struct{}{}
+
+	l.mu.Lock()
+	l.queued--
+	l.mu.Unlock()
+	return nil
+}
+
+// Release returns a slot taken by Acquire.
+func (l *limiter) Release() {
+	<-l.slots
+}
+
+// InFlight returns the number of slots currently held.
+func (l *limiter) InFlight() int {
+	return len(l.slots)
+}
+
+// Queued returns the number of callers waiting for a slot.
+func (l *limiter) Queued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.queued
+}
@@ -0,0 +1,39 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// listen opens the socket to serve on. addr is a TCP address like ":8080",
+// or a unix domain socket path like "unix:///run/banno/http.sock". A unix
+// socket is created with the given permissions, if mode is non-zero.
+func listen(addr string, mode os.FileMode) (net.Listener, error) {
+	path := strings.TrimPrefix(addr, "unix://")
+	if path == addr {
+		return net.Listen("tcp", addr)
+	}
+
+	// a socket left behind by a previous run would make Listen fail, but
+	// don't pull it out from under a process that's still serving on it
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
@@ -0,0 +1,142 @@
+package app
+
+import (
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	shedRequests = newCounter("loadshed_requests_total",
+		"Requests rejected by adaptive load shedding, by trigger.", "reason")
+	shedFraction = newGauge("loadshed_fraction",
+		"Fraction of requests currently being shed.")
+	shedP99 = newGauge("loadshed_p99_latency_seconds",
+		"Recent p99 request latency, as seen by the load shedder.")
+	httpInFlight = newGauge("http_in_flight_requests",
+		"Requests currently being served.")
+)
+
+// latencyWindowSize is how many recent request latencies the load shedder
+// keeps to estimate p99.
+const latencyWindowSize = 1024
+
+// loadShedder rejects a fraction of requests with 503 when the service is
+// overloaded, so the requests it does accept stay fast. The fraction grows
+// with how far recent p99 latency or the in-flight count is over its
+// threshold, but never exceeds maxFraction, so some traffic always gets
+// through to show when things have recovered.
+type loadShedder struct {
+	p99Threshold time.Duration // 0 disables
+	maxInFlight  int           // 0 disables
+	maxFraction  float64
+
+	mu        sync.Mutex
+	inFlight  int
+	latencies [latencyWindowSize]time.Duration
+	n         int // total latencies recorded
+	p99       time.Duration
+	p99At     time.Time
+	rng       *rand.Rand
+}
+
+func newLoadShedder(p99Threshold time.Duration, maxInFlight int, maxFraction float64) *loadShedder {
+	return &loadShedder{
+		p99Threshold: p99Threshold,
+		maxInFlight:  maxInFlight,
+		maxFraction:  maxFraction,
+		rng:          rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// recentP99 returns the p99 of the latency window, recomputing it at most
+// once a second. The caller must hold ls.mu.
+func (ls *loadShedder) recentP99(now time.Time) time.Duration {
+	if now.Sub(ls.p99At) < time.Second {
+		return ls.p99
+	}
+	n := ls.n
+	if n > latencyWindowSize {
+		n = latencyWindowSize
+	}
+	if n > 0 {
+		sorted := make([]time.Duration, n)
+		copy(sorted, ls.latencies[:n])
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		ls.p99 = sorted[(n*99-1)/100]
+	}
+	ls.p99At = now
+	shedP99.Set(ls.p99.Seconds())
+	return ls.p99
+}
+
+// admit decides whether to serve a request, returning the reason if not.
+func (ls *loadShedder) admit() (bool, string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	var fraction float64
+	reason := ""
+	if ls.maxInFlight > 0 && ls.inFlight >= ls.maxInFlight {
+		fraction = 1 - float64(ls.maxInFlight)/float64(ls.inFlight+1)
+		reason = "in_flight"
+	}
+	if ls.p99Threshold > 0 {
+		if p99 := ls.recentP99(time.Now()); p99 > ls.p99Threshold {
+			if f := 1 - float64(ls.p99Threshold)/float64(p99); f > fraction {
+				fraction, reason = f, "latency"
+			}
+		}
+	}
+	if fraction > ls.maxFraction {
+		fraction = ls.maxFraction
+	}
+	shedFraction.Set(fraction)
+
+	if fraction > 0 && ls.rng.Float64() < fraction {
+		return false, reason
+	}
+	ls.inFlight++
+	httpInFlight.Set(float64(ls.inFlight))
+	return true, ""
+}
+
+// done records the completion of an admitted request, adding its latency
+// to the window if sample is set.
+func (ls *loadShedder) done(latency time.Duration, sample bool) {
+	ls.mu.Lock()
+	ls.inFlight--
+	httpInFlight.Set(float64(ls.inFlight))
+	if sample {
+		ls.latencies[ls.n%latencyWindowSize] = latency
+		ls.n++
+	}
+	ls.mu.Unlock()
+}
+
+// Middleware applies load shedding to h. Operational endpoints are never
+// shed.
+func (ls *loadShedder) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isOperationalPath(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if ok, reason := ls.admit(); !ok {
+			shedRequests.Inc(reason)
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(503)
+			w.Write([]byte("Service overloaded, please retry"))
+			return
+		}
+		// long polls are slow on purpose; they still take a slot, but
+		// their latency says nothing about load
+		sample := !isLongPoll(r.URL.Path)
+		start := time.Now()
+		defer func() { ls.done(time.Since(start), sample) }()
+		h.ServeHTTP(w, r)
+	})
+}
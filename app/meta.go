@@ -0,0 +1,71 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// Meta describes where a response's data came from and how fresh it is,
+// so that clients can reason about staleness without parsing headers.
+type Meta struct {
+	Provider   string     `json:"provider"`
+	ObservedAt *time.Time `json:"observed_at,omitempty"` // when the provider measured or modelled it
+	// AgeSeconds is how long ago we fetched the data from the provider: 0
+	// unless it came from our cache.
+	AgeSeconds int64  `json:"age_seconds"`
+	Cache      string `json:"cache,omitempty"` // hit, miss or stale
+	RequestID  string `json:"request_id,omitempty"`
+}
+
+// newMeta describes conditions fetched for the request ctx belongs to.
+func newMeta(ctx context.Context, data *models.CurrentConditions) *Meta {
+	meta := &Meta{Provider: providerFromContext(ctx), RequestID: requestIDFromContext(ctx)}
+	if meta.Provider == "" {
+		meta.Provider = owmProvider
+	}
+	if !data.Time.IsZero() {
+		t := data.Time
+		meta.ObservedAt = &t
+	}
+	if cs, ok := ctx.Value(cacheStatusKey{}).(*cacheStatus); ok {
+		result, age := cs.get()
+		meta.Cache = string(result)
+		meta.AgeSeconds = int64(age / time.Second)
+	}
+	return meta
+}
+
+// validRequestID matches request IDs we accept from clients and proxies.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// requestIDs gives every request an ID, echoed in X-Request-Id, for
+// matching a client's report up with our logs. An ID passed in by a client
+// or proxy is kept if it looks sane.
+func requestIDs(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-Id", id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey, id)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDFromContext returns the request's ID, if it has one.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
@@ -0,0 +1,131 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metrics is the process-wide registry served at /metrics.
+var metrics = &metricsRegistry{}
+
+// metricsRegistry is a minimal Prometheus-compatible metrics registry.
+type metricsRegistry struct {
+	mu   sync.Mutex
+	vecs []*metricVec
+}
+
+// metricVec is a counter or gauge, partitioned by label values.
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (m *metricsRegistry) register(kind, name, help string, labels []string) *metricVec {
+	v := &metricVec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+	m.mu.Lock()
+	m.vecs = append(m.vecs, v)
+	m.mu.Unlock()
+	return v
+}
+
+// newCounter registers a monotonically increasing metric.
+func newCounter(name, help string, labels ...string) *metricVec {
+	return metrics.register("counter", name, help, labels)
+}
+
+// newGauge registers a metric that can go up and down.
+func newGauge(name, help string, labels ...string) *metricVec {
+	return metrics.register("gauge", name, help, labels)
+}
+
+// labelSep joins label values into map keys. It can't appear in valid
+// UTF-8, so keys are unambiguous.
+const labelSep = "\xff"
+
+// labelEscaper escapes label values for the exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// labelKey joins label values into a map key. Rendering to the exposition
+// format is left until the metrics are scraped, keeping updates cheap.
+func (v *metricVec) labelKey(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", v.name, len(values), len(v.labels)))
+	}
+	return strings.Join(values, labelSep)
+}
+
+// formatLabels renders a map key as label pairs, e.g. {class="x"}.
+func (v *metricVec) formatLabels(key string) string {
+	if len(v.labels) == 0 {
+		return ""
+	}
+	values := strings.Split(key, labelSep)
+	pairs := make([]string, len(values))
+	for i, val := range values {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, v.labels[i], labelEscaper.Replace(val))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Inc adds one to the metric with the given label values.
+func (v *metricVec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+// Add adds delta to the metric with the given label values.
+func (v *metricVec) Add(delta float64, labelValues ...string) {
+	key := v.labelKey(labelValues)
+	v.mu.Lock()
+	v.values[key] += delta
+	v.mu.Unlock()
+}
+
+// Set sets the metric with the given label values.
+func (v *metricVec) Set(value float64, labelValues ...string) {
+	key := v.labelKey(labelValues)
+	v.mu.Lock()
+	v.values[key] = value
+	v.mu.Unlock()
+}
+
+// Write writes all metrics in the Prometheus text exposition format.
+func (m *metricsRegistry) Write(w io.Writer) {
+	m.mu.Lock()
+	vecs := append([]*metricVec(nil), m.vecs...)
+	m.mu.Unlock()
+	sort.Slice(vecs, func(i, j int) bool { return vecs[i].name < vecs[j].name })
+
+	for _, v := range vecs {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+		v.mu.Lock()
+		keys := make([]string, 0, len(v.values))
+		for k := range v.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s%s %g\n", v.name, v.formatLabels(k), v.values[k])
+		}
+		v.mu.Unlock()
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.Write(w)
+}
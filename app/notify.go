@@ -0,0 +1,136 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var notificationsSent = newCounter("notifications_total",
+	"Notification deliveries, by channel and result.", "channel", "result")
+
+// notification is something we push to clients rather than wait for them
+// to ask for.
+type notification struct {
+	// ID is the same for every attempt to deliver the notification, so
+	// receivers can drop duplicates.
+	ID       string      `json:"id"`
+	Type     string      `json:"type"` // e.g. "digest"
+	ClientID string      `json:"client_id,omitempty"`
+	SentAt   time.Time   `json:"sent_at"`
+	Data     interface{} `json:"data"`
+}
+
+// notifier delivers notifications over one channel.
+type notifier interface {
+	Channel() string
+	Target() string // where on the channel, e.g. a URL
+	Notify(ctx context.Context, n notification) error
+}
+
+// webhookNotifier POSTs notifications as JSON to a URL.
+//
+// When the webhook has a secret, requests are signed so the receiver can
+// tell they came from us, the same way Slack signs its requests:
+//
+//	X-Weather-Delivery:  the notification's ID
+//	X-Weather-Timestamp: when the request was sent, in unix seconds
+//	X-Weather-Signature: "v1=" + hex(HMAC-SHA256(secret, "v1:" + timestamp + ":" + body))
+//
+// To verify a request, recompute the signature over the raw body and
+// compare it in constant time, reject timestamps more than five minutes
+// from now, and drop delivery IDs already seen within that window. Retries
+// are signed afresh but keep their delivery ID.
+type webhookNotifier struct {
+	client *http.Client
+	url    string
+	secret []byte // optional
+}
+
+func (wh *webhookNotifier) Channel() string { return "webhook" }
+func (wh *webhookNotifier) Target() string  { return wh.url }
+
+func (wh *webhookNotifier) Notify(ctx context.Context, n notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", wh.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(wh.secret) > 0 {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Weather-Delivery", n.ID)
+		req.Header.Set("X-Weather-Timestamp", ts)
+		req.Header.Set("X-Weather-Signature", signWebhook(wh.secret, ts, body))
+	}
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s returned %s", wh.url, resp.Status)
+	}
+	return nil
+}
+
+// signWebhook signs a webhook body sent at ts.
+func signWebhook(secret []byte, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "v1:%s:", ts)
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseWebhookSecrets parses NOTIFY_WEBHOOK_SECRETS: comma-separated
+// "url=secret" pairs giving the secret to sign each webhook with. Every URL
+// must be one of the webhooks.
+func parseWebhookSecrets(raw string, webhooks []string) (map[string][]byte, error) {
+	secrets := make(map[string][]byte)
+	for _, pair := range splitList(raw) {
+		// URLs may contain "=", secrets may not
+		i := strings.LastIndex(pair, "=")
+		if i < 0 || i == len(pair)-1 {
+			return nil, fmt.Errorf("want url=secret, got %q", pair)
+		}
+		url, secret := pair[:i], pair[i+1:]
+		if !containsString(webhooks, url) {
+			return nil, fmt.Errorf("%s is not in NOTIFY_WEBHOOKS", url)
+		}
+		secrets[url] = []byte(secret)
+	}
+	return secrets, nil
+}
+
+// notify delivers a notification over every configured channel, returning
+// the first error. Failed deliveries are queued for retry.
+func (s *server) notify(ctx context.Context, n notification) error {
+	n.ID = randomHex(8)
+	n.SentAt = time.Now().UTC()
+	var firstErr error
+	for _, ch := range s.notifiers {
+		entry := auditEntry{Channel: ch.Channel(), Recipient: ch.Target(), Type: n.Type}
+		err := s.audited(entry, n, func() error { return ch.Notify(ctx, n) })
+		if err != nil {
+			notificationsSent.Inc(ch.Channel(), "error")
+			s.queueDelivery(delivery{Channel: ch.Channel(), Target: ch.Target(), Notification: &n}, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		notificationsSent.Inc(ch.Channel(), "ok")
+	}
+	return firstErr
+}
@@ -0,0 +1,275 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+const nwsProvider = "nws"
+
+// NWSService is a client for the US National Weather Service API. We use
+// it for alerts, which (unlike openweathermap's) come with the geometry of
+// the affected area, and for station observations when a client asks for
+// NWS's current conditions.
+type NWSService struct {
+	client    *http.Client
+	baseURL   string
+	userAgent string // NWS asks for contact details here
+	// alerts rarely change between polls, and NWS supports ETags
+	validators *validatorCache // optional
+
+	mu       sync.Mutex
+	stations map[string]string // the nearest station to each point asked about
+}
+
+// NWSAlert is the subset of an NWS alert feature that we care about.
+type NWSAlert struct {
+	Geometry   json.RawMessage `json:"geometry"` // null for zone-based alerts
+	Properties struct {
+		Event       string     `json:"event"`
+		SenderName  string     `json:"senderName"`
+		Severity    string     `json:"severity"`
+		Headline    string     `json:"headline"`
+		Description string     `json:"description"`
+		Onset       *time.Time `json:"onset"`
+		Effective   time.Time  `json:"effective"`
+		Ends        *time.Time `json:"ends"`
+		Expires     time.Time  `json:"expires"`
+	} `json:"properties"`
+}
+
+// GetAlerts returns the alerts in effect at a point.
+func (n *NWSService) GetAlerts(lat, lon string) ([]NWSAlert, error) {
+	var collection struct {
+		Features []NWSAlert `json:"features"`
+	}
+	if err := n.get(n.baseURL+"/alerts/active?point="+lat+","+lon, &collection); err != nil {
+		return nil, err
+	}
+	return collection.Features, nil
+}
+
+// get fetches a GeoJSON document from the API, decoding it into v.
+// Failures are returned as *UpstreamError.
+func (n *NWSService) get(u string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return &UpstreamError{Provider: nwsProvider, Class: ErrBadRequest, Message: err.Error()}
+	}
+	req.Header.Set("Accept", "application/geo+json")
+	req.Header.Set("User-Agent", n.userAgent)
+
+	resp, err := n.validators.Do(n.client, req)
+	if err != nil {
+		return &UpstreamError{Provider: nwsProvider, Class: ErrUpstreamUnavailable, Message: err.Error()}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		// errors are application/problem+json
+		var problem struct {
+			Detail string `json:"detail"`
+		}
+		msg := resp.Status
+		if json.NewDecoder(resp.Body).Decode(&problem) == nil && problem.Detail != "" {
+			msg = problem.Detail
+		}
+		return &UpstreamError{
+			Provider:   nwsProvider,
+			Class:      classifyStatus(resp.StatusCode),
+			StatusCode: resp.StatusCode,
+			Message:    msg,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now(), 0),
+		}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return &UpstreamError{
+			Provider:   nwsProvider,
+			Class:      ErrUpstreamUnavailable,
+			StatusCode: resp.StatusCode,
+			Message:    err.Error(),
+		}
+	}
+	return nil
+}
+
+// newNWSAlert maps an NWS alert onto the provider-agnostic model.
+func newNWSAlert(a NWSAlert) models.Alert {
+	p := a.Properties
+	alert := models.Alert{
+		Event:       p.Event,
+		Sender:      p.SenderName,
+		Severity:    p.Severity,
+		Headline:    p.Headline,
+		Description: p.Description,
+		Start:       p.Effective.UTC(),
+		End:         p.Expires.UTC(),
+		Source:      nwsProvider,
+	}
+	if p.Onset != nil {
+		alert.Start = p.Onset.UTC()
+	}
+	if p.Ends != nil {
+		alert.End = p.Ends.UTC()
+	}
+	if len(a.Geometry) > 0 && string(a.Geometry) != "null" {
+		alert.Geometry = a.Geometry
+	}
+	return alert
+}
+
+// NWSObservation is the subset of a station observation that we care
+// about.
+type NWSObservation struct {
+	Properties struct {
+		Timestamp             time.Time   `json:"timestamp"`
+		TextDescription       string      `json:"textDescription"`
+		Temperature           nwsQuantity `json:"temperature"`
+		HeatIndex             nwsQuantity `json:"heatIndex"`
+		WindChill             nwsQuantity `json:"windChill"`
+		RelativeHumidity      nwsQuantity `json:"relativeHumidity"`
+		WindSpeed             nwsQuantity `json:"windSpeed"`
+		WindGust              nwsQuantity `json:"windGust"`
+		PrecipitationLastHour nwsQuantity `json:"precipitationLastHour"`
+	} `json:"properties"`
+}
+
+// nwsQuantity is a measurement with its unit, e.g. "wmoUnit:degC". The
+// value is null if the station didn't measure it.
+type nwsQuantity struct {
+	Value    *float64 `json:"value"`
+	UnitCode string   `json:"unitCode"`
+}
+
+// temperature returns q as a temperature, or nil if it wasn't measured.
+func (q nwsQuantity) temperature() *models.Temperature {
+	if q.Value == nil {
+		return nil
+	}
+	t := models.DegreesC(*q.Value)
+	if strings.HasSuffix(q.UnitCode, ":degF") {
+		t = models.DegreesF(*q.Value)
+	}
+	return &t
+}
+
+// mph returns q, a speed, in miles per hour.
+func (q nwsQuantity) mph() float64 {
+	if q.Value == nil {
+		return 0
+	}
+	switch {
+	case strings.HasSuffix(q.UnitCode, ":m_s-1"):
+		return *q.Value * 2.23694
+	case strings.HasSuffix(q.UnitCode, ":km_h-1"):
+		return *q.Value / 1.609344
+	}
+	return *q.Value
+}
+
+// inches returns q, a length, in inches.
+func (q nwsQuantity) inches() float64 {
+	if q.Value == nil {
+		return 0
+	}
+	switch {
+	case strings.HasSuffix(q.UnitCode, ":m"):
+		return *q.Value / 0.0254
+	case strings.HasSuffix(q.UnitCode, ":mm"):
+		return *q.Value / 25.4
+	}
+	return *q.Value
+}
+
+// GetLatestObservation returns the latest observation from the station
+// nearest a point. Points outside the US fail with ErrNotFound.
+func (n *NWSService) GetLatestObservation(lat, lon string) (*NWSObservation, error) {
+	station, err := n.station(lat, lon)
+	if err != nil {
+		return nil, err
+	}
+	var obs NWSObservation
+	if err := n.get(n.baseURL+"/stations/"+url.PathEscape(station)+"/observations/latest", &obs); err != nil {
+		return nil, err
+	}
+	return &obs, nil
+}
+
+// station returns the identifier of the observation station nearest a
+// point. Stations don't move, so each point is only looked up once.
+func (n *NWSService) station(lat, lon string) (string, error) {
+	key := lat + "," + lon
+	n.mu.Lock()
+	station, ok := n.stations[key]
+	n.mu.Unlock()
+	if ok {
+		return station, nil
+	}
+
+	var point struct {
+		Properties struct {
+			ObservationStations string `json:"observationStations"`
+		} `json:"properties"`
+	}
+	if err := n.get(n.baseURL+"/points/"+key, &point); err != nil {
+		return "", err
+	}
+	var stations struct {
+		Features []struct {
+			Properties struct {
+				StationIdentifier string `json:"stationIdentifier"`
+			} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := n.get(point.Properties.ObservationStations, &stations); err != nil {
+		return "", err
+	}
+	// nearest first
+	if len(stations.Features) == 0 {
+		return "", &UpstreamError{Provider: nwsProvider, Class: ErrNotFound, Message: "no observation stations near " + key}
+	}
+	station = stations.Features[0].Properties.StationIdentifier
+
+	n.mu.Lock()
+	if n.stations == nil {
+		n.stations = make(map[string]string)
+	}
+	n.stations[key] = station
+	n.mu.Unlock()
+	return station, nil
+}
+
+// newNWSConditions maps a station observation onto the provider-agnostic
+// model. Observations come without alerts; those are added separately.
+func newNWSConditions(obs *NWSObservation) *models.CurrentConditions {
+	p := obs.Properties
+	current := &models.CurrentConditions{
+		Time:      p.Timestamp.UTC(),
+		Temp:      p.Temperature.temperature(),
+		FeelsLike: p.Temperature.temperature(),
+		WindSpeed: p.WindSpeed.mph(),
+		WindGust:  p.WindGust.mph(),
+		Precip:    p.PrecipitationLastHour.inches(),
+		Alerts:    []models.Alert{},
+	}
+	// NWS reports whichever of these applies
+	if t := p.HeatIndex.temperature(); t != nil {
+		current.FeelsLike = t
+	} else if t := p.WindChill.temperature(); t != nil {
+		current.FeelsLike = t
+	}
+	if p.RelativeHumidity.Value != nil {
+		current.Humidity = *p.RelativeHumidity.Value
+	}
+	if p.TextDescription != "" {
+		current.Conditions = []string{strings.ToLower(p.TextDescription)}
+	}
+	return current
+}
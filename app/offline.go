@@ -0,0 +1,67 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+var offlineRequests = newCounter("offline_requests_total",
+	"Upstream requests answered in offline mode, by result.", "result")
+
+// offlineTransport stands in for the network in OFFLINE mode: no request
+// ever leaves the process. Requests are answered from JSON fixture files in
+// dir, named after the last element of the API path. A fixture specific to
+// a location, e.g. "onecall_30.49,-99.77.json", takes precedence over the
+// generic "onecall.json". Without a fixture, the request fails with 503.
+type offlineTransport struct {
+	dir string
+}
+
+func (t *offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	name := path.Base(req.URL.Path)
+	var candidates []string
+	if t.dir != "" {
+		if loc, err := models.ParseLocation(req.URL.Query().Get("lat"), req.URL.Query().Get("lon")); err == nil {
+			candidates = append(candidates, filepath.Join(t.dir, name+"_"+loc.Key()+".json"))
+		}
+		candidates = append(candidates, filepath.Join(t.dir, name+".json"))
+	}
+
+	for _, candidate := range candidates {
+		body, err := ioutil.ReadFile(candidate)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		offlineRequests.Inc("fixture")
+		return offlineResponse(req, 200, body), nil
+	}
+
+	offlineRequests.Inc("miss")
+	msg := fmt.Sprintf(`{"message":"offline mode: no fixture for %s"}`, strings.TrimPrefix(req.URL.Path, "/"))
+	return offlineResponse(req, 503, []byte(msg)), nil
+}
+
+func offlineResponse(req *http.Request, status int, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
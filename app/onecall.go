@@ -0,0 +1,164 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// One Call API versions. openweathermap is retiring 2.5; 3.0 returns the
+// same blocks (plus a daily summary) but needs its own subscription, which
+// a key may not have yet.
+const (
+	oneCall25   = "2.5"
+	oneCall30   = "3.0"
+	oneCallAuto = "auto"
+)
+
+var oneCallVersionGauge = newGauge("upstream_onecall_version",
+	"One Call API version in use: 1 for the current one.", "version")
+
+// oneCallVersion decides which One Call API version to call. Pinned to a
+// version, it always uses that one. In auto mode, for the migration window,
+// it probes whether our key can use 3.0, falling back to 2.5 if not, and
+// probes again every recheck so that a new subscription is picked up. A
+// 3.0 request that's refused also falls back to 2.5, until the next probe.
+type oneCallVersion struct {
+	mode    string
+	recheck time.Duration
+
+	mu      sync.Mutex
+	version string // "" until the first probe
+	next    time.Time
+	probing bool
+}
+
+func newOneCallVersion(mode string, recheck time.Duration) (*oneCallVersion, error) {
+	switch mode {
+	case "":
+		mode = oneCallAuto
+	case oneCall25, oneCall30, oneCallAuto:
+	default:
+		return nil, fmt.Errorf("%q (want %s, %s or %s)", mode, oneCall25, oneCall30, oneCallAuto)
+	}
+	v := &oneCallVersion{mode: mode, recheck: recheck}
+	if mode != oneCallAuto {
+		v.set(mode, time.Time{})
+	}
+	return v, nil
+}
+
+// Get returns the version to use, running probe to decide if it's time.
+// probe reports whether 3.0 is usable; a nil error means it is.
+func (v *oneCallVersion) Get(probe func() error) string {
+	if v == nil {
+		return oneCall25
+	}
+	if v.mode != oneCallAuto {
+		return v.mode
+	}
+	v.mu.Lock()
+	if v.version != "" && (v.probing || time.Now().Before(v.next)) {
+		version := v.version
+		v.mu.Unlock()
+		return version
+	}
+	first := v.version == ""
+	if !first {
+		// carry on with the current version while we look again
+		v.probing = true
+		version := v.version
+		v.mu.Unlock()
+		go v.probe(probe)
+		return version
+	}
+	// the first probe holds everyone up; we don't know what to call yet
+	defer v.mu.Unlock()
+	v.decide(probe())
+	return v.version
+}
+
+func (v *oneCallVersion) probe(probe func() error) {
+	err := probe()
+	v.mu.Lock()
+	v.probing = false
+	v.decide(err)
+	v.mu.Unlock()
+}
+
+// decide records the outcome of a probe. The caller holds v.mu.
+func (v *oneCallVersion) decide(err error) {
+	now := time.Now()
+	switch {
+	case err == nil:
+		v.set(oneCall30, now.Add(v.recheck))
+	case errors.Is(err, ErrProviderAuth) || errors.Is(err, ErrNotFound):
+		v.set(oneCall25, now.Add(v.recheck))
+	default:
+		// inconclusive; stay put, or start on 2.5, and look again soon
+		version := v.version
+		if version == "" {
+			version = oneCall25
+		}
+		v.set(version, now.Add(time.Minute))
+	}
+}
+
+// set records the version in use. The caller holds v.mu, if it matters.
+func (v *oneCallVersion) set(version string, next time.Time) {
+	v.version, v.next = version, next
+	for _, each := range []string{oneCall25, oneCall30} {
+		value := 0.0
+		if each == version {
+			value = 1
+		}
+		oneCallVersionGauge.Set(value, each)
+	}
+}
+
+// Fallback returns the 2.5 equivalent of u if it's a 3.0 request that
+// failed in a way 2.5 might not, switching to 2.5 until the next probe.
+func (v *oneCallVersion) Fallback(u string, err error) (string, bool) {
+	if v == nil || v.mode != oneCallAuto || !strings.Contains(u, oneCallPath(oneCall30)) {
+		return "", false
+	}
+	if !errors.Is(err, ErrProviderAuth) && !errors.Is(err, ErrNotFound) {
+		return "", false
+	}
+	v.mu.Lock()
+	v.set(oneCall25, time.Now().Add(v.recheck))
+	v.mu.Unlock()
+	return strings.Replace(u, oneCallPath(oneCall30), oneCallPath(oneCall25), 1), true
+}
+
+func oneCallPath(version string) string {
+	return "/data/" + version + "/onecall"
+}
+
+// oneCallEndpoint returns the One Call URL for params in the version in use.
+func (o *OWMService) oneCallEndpoint(params url.Values) string {
+	return o.endpoint(oneCallPath(o.oneCall.Get(o.probeOneCall30)), params)
+}
+
+// probeOneCall30 makes the smallest 3.0 request there is, to see whether
+// our key may use it. It goes straight out, with the first key if we have
+// several, so that a refusal doesn't count against the key.
+func (o *OWMService) probeOneCall30() error {
+	params := url.Values{}
+	params.Add("lat", "0")
+	params.Add("lon", "0")
+	params.Add("exclude", "current,minutely,hourly,daily,alerts")
+	u := o.endpoint(oneCallPath(oneCall30), params)
+	gate := o.gate
+	if o.keys != nil {
+		u, gate = withAppID(u, o.keys.keys[0].value), o.keys.keys[0].gate
+	}
+	return o.fetchWith(u, gate, func(dec *json.Decoder) error {
+		var discard struct{}
+		return dec.Decode(&discard)
+	})
+}
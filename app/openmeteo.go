@@ -0,0 +1,180 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+const openMeteoProvider = "open-meteo"
+
+// OpenMeteoService is a client for the Open-Meteo forecast API. We use it
+// for snow depth and freezing level, which openweathermap doesn't report,
+// and for recent snowfall.
+type OpenMeteoService struct {
+	client  *http.Client
+	baseURL string
+}
+
+// OpenMeteoSnow is the hourly snow data for a location, in metric units.
+// Values are nil for hours the model has no data for.
+type OpenMeteoSnow struct {
+	Hourly struct {
+		Time          []int64    `json:"time"`
+		Snowfall      []*float64 `json:"snowfall"`              // cm
+		SnowDepth     []*float64 `json:"snow_depth"`            // m
+		FreezingLevel []*float64 `json:"freezing_level_height"` // m
+	} `json:"hourly"`
+}
+
+// GetSnow returns hourly snow data at a point from pastDays ago to the end
+// of today.
+func (o *OpenMeteoService) GetSnow(lat, lon string, pastDays int) (*OpenMeteoSnow, error) {
+	params := url.Values{}
+	params.Add("latitude", lat)
+	params.Add("longitude", lon)
+	params.Add("hourly", "snowfall,snow_depth,freezing_level_height")
+	params.Add("past_days", strconv.Itoa(pastDays))
+	params.Add("forecast_days", "1")
+	params.Add("timeformat", "unixtime")
+	params.Add("timezone", "GMT")
+
+	var data OpenMeteoSnow
+	if err := o.get(params, &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// get fetches a forecast, decoding it into v. Failures are returned as
+// *UpstreamError.
+func (o *OpenMeteoService) get(params url.Values, v interface{}) error {
+	resp, err := o.client.Get(o.baseURL + "/v1/forecast?" + params.Encode())
+	if err != nil {
+		return &UpstreamError{Provider: openMeteoProvider, Class: ErrUpstreamUnavailable, Message: err.Error()}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		msg := resp.Status
+		if json.NewDecoder(resp.Body).Decode(&body) == nil && body.Reason != "" {
+			msg = body.Reason
+		}
+		return &UpstreamError{
+			Provider:   openMeteoProvider,
+			Class:      classifyStatus(resp.StatusCode),
+			StatusCode: resp.StatusCode,
+			Message:    msg,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now(), 0),
+		}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return &UpstreamError{
+			Provider:   openMeteoProvider,
+			Class:      ErrUpstreamUnavailable,
+			StatusCode: resp.StatusCode,
+			Message:    err.Error(),
+		}
+	}
+	return nil
+}
+
+// OpenMeteoCurrent is the current weather at a location, in the US units
+// we ask for.
+type OpenMeteoCurrent struct {
+	Current struct {
+		Time                int64               `json:"time"`
+		Temperature         *models.Temperature `json:"temperature_2m"`
+		ApparentTemperature *models.Temperature `json:"apparent_temperature"`
+		RelativeHumidity    float64             `json:"relative_humidity_2m"`
+		Precipitation       float64             `json:"precipitation"` // inches
+		WeatherCode         *int                `json:"weather_code"`
+		WindSpeed           float64             `json:"wind_speed_10m"`
+		WindGusts           float64             `json:"wind_gusts_10m"`
+		UVIndex             float64             `json:"uv_index"`
+	} `json:"current"`
+}
+
+// GetCurrent returns the current weather at a point.
+func (o *OpenMeteoService) GetCurrent(lat, lon string) (*OpenMeteoCurrent, error) {
+	params := url.Values{}
+	params.Add("latitude", lat)
+	params.Add("longitude", lon)
+	params.Add("current", "temperature_2m,apparent_temperature,relative_humidity_2m,precipitation,weather_code,wind_speed_10m,wind_gusts_10m,uv_index")
+	// Temperature decodes bare numbers as °F
+	params.Add("temperature_unit", "fahrenheit")
+	params.Add("wind_speed_unit", "mph")
+	params.Add("precipitation_unit", "inch")
+	params.Add("timeformat", "unixtime")
+
+	var data OpenMeteoCurrent
+	if err := o.get(params, &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// wmoWeatherCodes describes the WMO weather interpretation codes Open-Meteo
+// reports, in the words openweathermap would use.
+var wmoWeatherCodes = map[int]string{
+	0:  "clear sky",
+	1:  "mainly clear",
+	2:  "partly cloudy",
+	3:  "overcast clouds",
+	45: "fog",
+	48: "depositing rime fog",
+	51: "light drizzle",
+	53: "drizzle",
+	55: "heavy intensity drizzle",
+	56: "light freezing drizzle",
+	57: "freezing drizzle",
+	61: "light rain",
+	63: "moderate rain",
+	65: "heavy intensity rain",
+	66: "light freezing rain",
+	67: "freezing rain",
+	71: "light snow",
+	73: "snow",
+	75: "heavy snow",
+	77: "snow grains",
+	80: "light shower rain",
+	81: "shower rain",
+	82: "heavy intensity shower rain",
+	85: "light shower snow",
+	86: "heavy shower snow",
+	95: "thunderstorm",
+	96: "thunderstorm with light hail",
+	99: "thunderstorm with heavy hail",
+}
+
+// newOpenMeteoConditions maps Open-Meteo's current weather onto the
+// provider-agnostic model. Open-Meteo has no alerts.
+func newOpenMeteoConditions(data *OpenMeteoCurrent) *models.CurrentConditions {
+	c := data.Current
+	current := &models.CurrentConditions{
+		Time:      time.Unix(c.Time, 0).UTC(),
+		Temp:      c.Temperature,
+		FeelsLike: c.ApparentTemperature,
+		Humidity:  c.RelativeHumidity,
+		WindSpeed: c.WindSpeed,
+		WindGust:  c.WindGusts,
+		UVI:       c.UVIndex,
+		Precip:    c.Precipitation,
+		Alerts:    []models.Alert{},
+	}
+	if c.WeatherCode != nil {
+		current.Conditions = []string{}
+		if desc, ok := wmoWeatherCodes[*c.WeatherCode]; ok {
+			current.Conditions = append(current.Conditions, desc)
+		}
+	}
+	return current
+}
@@ -0,0 +1,164 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// outdoorFactors are the inputs to the outdoor score, in the order they're
+// reported.
+var outdoorFactors = []string{"temperature", "humidity", "wind", "uv", "aqi"}
+
+// defaultOutdoorWeights weight the outdoor score unless OUTDOOR_WEIGHTS or
+// ?weights= says otherwise. Air quality counts for more than comfort, since
+// exercise means breathing hard.
+var defaultOutdoorWeights = map[string]float64{
+	"temperature": 3,
+	"humidity":    1,
+	"wind":        1,
+	"uv":          1,
+	"aqi":         3,
+}
+
+// parseOutdoorWeights parses weights such as "temperature=2,aqi=4". Factors
+// left out keep their weight in base.
+func parseOutdoorWeights(spec string, base map[string]float64) (map[string]float64, error) {
+	weights := make(map[string]float64, len(base))
+	for name, weight := range base {
+		weights[name] = weight
+	}
+	for _, entry := range splitList(spec) {
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid weight %q: want factor=weight", entry)
+		}
+		name := entry[:i]
+		if !containsString(outdoorFactors, name) {
+			return nil, fmt.Errorf("invalid weight %q: factors are %s", entry, strings.Join(outdoorFactors, ", "))
+		}
+		weight, err := strconv.ParseFloat(entry[i+1:], 64)
+		if err != nil || weight < 0 || math.IsInf(weight, 0) {
+			return nil, fmt.Errorf("invalid weight %q: weight must be a non-negative number", entry)
+		}
+		weights[name] = weight
+	}
+	total := 0.0
+	for _, weight := range weights {
+		total += weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("at least one weight must be positive")
+	}
+	return weights, nil
+}
+
+// OutdoorScore is the response of the outdoor score endpoint.
+type OutdoorScore struct {
+	Score   int             `json:"score"` // 0-100
+	Label   string          `json:"label"`
+	Factors []OutdoorFactor `json:"factors"`
+}
+
+// OutdoorFactor is one input to the outdoor score.
+type OutdoorFactor struct {
+	Name   string  `json:"name"`
+	Value  float64 `json:"value"`
+	Score  float64 `json:"score"` // 0-100
+	Weight float64 `json:"weight"`
+}
+
+// outdoorFactorScore rates how pleasant one factor is for exercising
+// outside, from 100 (ideal) to 0.
+func outdoorFactorScore(name string, value float64) float64 {
+	var score float64
+	switch name {
+	case "temperature": // feels like, °F: 55-75 is ideal
+		score = 100 - 4*math.Max(55-value, value-75)
+	case "humidity": // %
+		score = 100 - 2.5*(value-60)
+	case "wind": // mph
+		score = 100 - 4*(value-10)
+	case "uv": // index
+		score = 100 - 100*(value-2)/9
+	case "aqi": // 1 (good) to 5 (very poor)
+		score = 100 - 25*(value-1)
+	}
+	return math.Min(100, math.Max(0, score))
+}
+
+// outdoorLabel describes an outdoor score.
+func outdoorLabel(score int) string {
+	switch {
+	case score >= 80:
+		return "great"
+	case score >= 60:
+		return "good"
+	case score >= 40:
+		return "fair"
+	}
+	return "poor"
+}
+
+// outdoorScoreHandler rates conditions for outdoor activity at a location
+// from 0 to 100: each of temperature, humidity, wind, UV and air quality is
+// scored, and the score is their weighted average. ?weights= adjusts the
+// weighting, e.g. weights=aqi=5,uv=0.
+func (s *server) outdoorScoreHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	weights, err := parseOutdoorWeights(q.Get("weights"), s.outdoorWeights)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid weights: %s", err)
+		return
+	}
+
+	lat, lon, _ := s.requestLocation(r, q)
+	data, err := s.fetchWeather(r.Context(), lat, lon)
+	if err != nil {
+		s.upstreamError(w, r, err)
+		return
+	}
+	air, err := s.owm.GetAirQuality(lat, lon)
+	if err != nil {
+		s.upstreamFailed(err)
+		s.upstreamError(w, r, err)
+		return
+	}
+	if len(air.List) == 0 {
+		s.upstreamError(w, r, &UpstreamError{Class: ErrUpstreamUnavailable, Message: "no air quality data"})
+		return
+	}
+
+	values := map[string]float64{
+		"humidity": data.Humidity,
+		"wind":     data.WindSpeed,
+		"uv":       data.UVI,
+		"aqi":      float64(air.List[0].Main.AQI),
+	}
+	// an unknown temperature is left out of the score, not guessed at
+	if data.FeelsLike != nil {
+		values["temperature"] = data.FeelsLike.F()
+	}
+	result := OutdoorScore{Factors: make([]OutdoorFactor, 0, len(outdoorFactors))}
+	var sum, total float64
+	for _, name := range outdoorFactors {
+		if _, ok := values[name]; !ok {
+			continue
+		}
+		f := OutdoorFactor{
+			Name:   name,
+			Value:  values[name],
+			Score:  math.Round(outdoorFactorScore(name, values[name])),
+			Weight: weights[name],
+		}
+		sum += f.Score * f.Weight
+		total += f.Weight
+		result.Factors = append(result.Factors, f)
+	}
+	result.Score = int(math.Round(sum / total))
+	result.Label = outdoorLabel(result.Score)
+	writeJSON(w, &result)
+}
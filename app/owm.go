@@ -0,0 +1,429 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+const owmProvider = "openweathermap"
+
+var (
+	upstreamInFlight = newGauge("upstream_in_flight",
+		"Outbound provider requests currently in flight.")
+	upstreamQueued = newGauge("upstream_queued",
+		"Outbound provider requests waiting for a free slot.")
+	upstreamShed = newCounter("upstream_shed_total",
+		"Outbound provider requests refused because the queue was full.")
+)
+
+// OWMService is a client for openweathermap.
+type OWMService struct {
+	client   *http.Client
+	baseURL  string
+	appid    string
+	gate     *rateGate       // optional
+	keys     *keyPool        // optional; replaces appid and gate
+	oneCall  *oneCallVersion // optional; 2.5 if unset
+	pool     *limiter        // optional
+	negative *negativeCache  // optional
+	hedge    *hedger         // optional
+	logger   *log.Logger
+	// strict, if set, validates responses: strictFlag or strictReject.
+	strict string
+}
+
+func (o *OWMService) GetWeather(lat, lon string) (*OWMApiResponse, error) {
+	var data OWMApiResponse
+	if o.strict == "" {
+		if err := o.get(o.urlFor(lat, lon), &data); err != nil {
+			return nil, err
+		}
+		return &data, nil
+	}
+
+	// keep the raw response, to tell absent fields from zero ones
+	var raw json.RawMessage
+	if err := o.get(o.urlFor(lat, lon), &raw); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, &UpstreamError{Class: ErrUpstreamUnavailable, StatusCode: 200, Message: err.Error()}
+	}
+	if err := o.validated("weather", validateWeather(raw, &data)); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// Check makes a cheap request to verify that the provider is reachable and
+// accepts our API key.
+func (o *OWMService) Check() error {
+	params := url.Values{}
+	params.Add("lat", "0")
+	params.Add("lon", "0")
+	var data struct{}
+	return o.get(o.endpoint("/data/2.5/weather", params), &data)
+}
+
+// GetForecast fetches the hourly and/or daily forecast for a location. Only
+// the requested blocks are decoded; the rest of the (large) onecall payload
+// is skipped as it streams past.
+func (o *OWMService) GetForecast(lat, lon string, blocks []string) (*OWMForecastResponse, error) {
+	var data OWMForecastResponse
+	targets := make(map[string]interface{}, len(blocks))
+	for _, block := range blocks {
+		switch block {
+		case "hourly":
+			targets[block] = &data.Hourly
+		case "daily":
+			targets[block] = &data.Daily
+		}
+	}
+	err := o.fetch(o.forecastURLFor(lat, lon, blocks), func(dec *json.Decoder) error {
+		return decodeObjectFields(dec, targets)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if o.strict != "" {
+		if err := o.validated("forecast", validateForecast(&data)); err != nil {
+			return nil, err
+		}
+	}
+	return &data, nil
+}
+
+// Geocode looks up places matching a name like "Austin, TX, US".
+func (o *OWMService) Geocode(query string) ([]OWMGeocodeResult, error) {
+	params := url.Values{}
+	params.Add("q", query)
+	params.Add("limit", "5")
+	var results []OWMGeocodeResult
+	if err := o.get(o.endpoint("/geo/1.0/direct", params), &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// GetAirQuality fetches the current air quality for a location.
+func (o *OWMService) GetAirQuality(lat, lon string) (*OWMAirQuality, error) {
+	params := url.Values{}
+	params.Add("lat", lat)
+	params.Add("lon", lon)
+	var data OWMAirQuality
+	if err := o.get(o.endpoint("/data/2.5/air_pollution", params), &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// get fetches u, decoding the JSON response into v. Failures are returned
+// as *UpstreamError.
+func (o *OWMService) get(u string, v interface{}) error {
+	return o.fetch(u, func(dec *json.Decoder) error {
+		return dec.Decode(v)
+	})
+}
+
+// fetch fetches u, handing a successful response body to decode.
+func (o *OWMService) fetch(u string, decode func(*json.Decoder) error) error {
+	if err, ok := o.negative.Get(u); ok {
+		return err
+	}
+	err := o.fetchUncached(u, decode)
+	fallback, fellBack := o.oneCall.Fallback(u, err)
+	if fellBack {
+		err = o.fetchUncached(fallback, decode)
+	}
+	// asking again won't change the answer, for a while at least. Callers
+	// ask for the version in use, which is 2.5 after a fallback until the
+	// next probe, so the answer goes under both.
+	if errors.Is(err, ErrBadRequest) || errors.Is(err, ErrNotFound) {
+		o.negative.Put(u, err)
+		if fellBack {
+			o.negative.Put(fallback, err)
+		}
+	}
+	return err
+}
+
+func (o *OWMService) fetchUncached(u string, decode func(*json.Decoder) error) error {
+	if o.pool != nil {
+		if err := o.pool.Acquire(); err != nil {
+			upstreamShed.Inc()
+			return err
+		}
+		upstreamInFlight.Set(float64(o.pool.InFlight()))
+		upstreamQueued.Set(float64(o.pool.Queued()))
+		defer func() {
+			o.pool.Release()
+			upstreamInFlight.Set(float64(o.pool.InFlight()))
+		}()
+	}
+	if o.keys == nil {
+		return o.fetchWith(u, o.gate, decode)
+	}
+	return o.keys.Do(func(key *apiKey) error {
+		return o.fetchWith(withAppID(u, key.value), key.gate, decode)
+	})
+}
+
+// fetchWith fetches u, keeping within gate's pacing if there is one.
+func (o *OWMService) fetchWith(u string, gate *rateGate, decode func(*json.Decoder) error) error {
+	if gate != nil {
+		if err := gate.Wait(); err != nil {
+			return err
+		}
+	}
+
+	resp, err := o.hedge.Get(o.client, u)
+	if err != nil {
+		// the URL carries our appid, so leave it out
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return &UpstreamError{Class: ErrUpstreamUnavailable, Message: err.Error()}
+	}
+	defer resp.Body.Close()
+	if gate != nil {
+		gate.Observe(resp)
+	}
+
+	if resp.StatusCode != 200 {
+		// error bodies aren't always JSON; fall back to the status text
+		var body struct {
+			Message string `json:"message"`
+		}
+		msg := resp.Status
+		if json.NewDecoder(resp.Body).Decode(&body) == nil && body.Message != "" {
+			msg = body.Message
+		}
+		return &UpstreamError{
+			Class:      classifyStatus(resp.StatusCode),
+			StatusCode: resp.StatusCode,
+			Message:    msg,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now(), 0),
+		}
+	}
+	if err := decode(json.NewDecoder(resp.Body)); err != nil {
+		return &UpstreamError{Class: ErrUpstreamUnavailable, StatusCode: resp.StatusCode, Message: err.Error()}
+	}
+	return nil
+}
+
+// endpoint returns the URL for an API path, with our credentials and
+// preferred units added to params. With a key pool, the key is added as
+// each request is sent instead.
+func (o *OWMService) endpoint(path string, params url.Values) string {
+	base, _ := url.Parse(o.baseURL + path)
+	if o.keys == nil {
+		params.Add("appid", o.appid)
+	}
+	// Temperature decodes bare numbers as °F, so this must stay imperial
+	params.Add("units", "imperial")
+	base.RawQuery = params.Encode()
+	return base.String()
+}
+
+// withAppID returns u with key added as its appid.
+func withAppID(u, key string) string {
+	sep := "?"
+	if strings.Contains(u, "?") {
+		sep = "&"
+	}
+	return u + sep + "appid=" + url.QueryEscape(key)
+}
+
+func (o *OWMService) urlFor(lat, lon string) string {
+	params := url.Values{}
+	params.Add("lat", lat)
+	params.Add("lon", lon)
+	// all we need is 'current' and 'alerts'
+	params.Add("exclude", "minutely,hourly,daily")
+	return o.oneCallEndpoint(params)
+}
+
+// forecastURLFor returns the onecall URL for the given forecast blocks,
+// excluding everything else the API lets us exclude.
+func (o *OWMService) forecastURLFor(lat, lon string, blocks []string) string {
+	exclude := []string{"current", "minutely", "alerts"}
+	for _, block := range forecastBlocks {
+		if !containsString(blocks, block) {
+			exclude = append(exclude, block)
+		}
+	}
+	params := url.Values{}
+	params.Add("lat", lat)
+	params.Add("lon", lon)
+	params.Add("exclude", strings.Join(exclude, ","))
+	return o.oneCallEndpoint(params)
+}
+
+// OWMApiResponse is a subset of response fields (those that we care about)
+// from http://api.openweathermap.org/.
+type OWMApiResponse struct {
+	Current struct {
+		Dt        int64               `json:"dt"`
+		Temp      *models.Temperature `json:"temp"`       // nil if left out, rather than 0°F
+		FeelsLike *models.Temperature `json:"feels_like"` // likewise
+		Humidity  float64             `json:"humidity"`
+		WindSpeed float64             `json:"wind_speed"`
+		WindGust  float64             `json:"wind_gust"`
+		UVI       float64             `json:"uvi"`
+		Weather   []struct {
+			Description string `json:"description"`
+		} `json:"weather"`
+		Rain owmPrecip `json:"rain"`
+		Snow owmPrecip `json:"snow"`
+	} `json:"current"`
+	Alerts []struct {
+		SenderName  string `json:"sender_name"`
+		Event       string `json:"event"`
+		Start       int64  `json:"start"`
+		End         int64  `json:"end"`
+		Description string `json:"description"`
+	} `json:"alerts"`
+}
+
+// OWMAirQuality is the subset of an air pollution response that we care
+// about.
+type OWMAirQuality struct {
+	List []struct {
+		Main struct {
+			AQI int `json:"aqi"` // 1 (good) to 5 (very poor)
+		} `json:"main"`
+	} `json:"list"`
+}
+
+// owmPrecip is the precipitation over the last hour, which openweathermap
+// reports in millimeters whatever the units.
+type owmPrecip struct {
+	OneHour float64 `json:"1h"`
+}
+
+// precipInches converts an hour's rain and snow (as water) to inches.
+func precipInches(rain, snow owmPrecip) float64 {
+	return (rain.OneHour + snow.OneHour) / 25.4
+}
+
+// OWMForecastResponse is the subset of the onecall forecast blocks that we
+// care about.
+type OWMForecastResponse struct {
+	Hourly []struct {
+		Dt        int64              `json:"dt"`
+		Temp      models.Temperature `json:"temp"`
+		FeelsLike models.Temperature `json:"feels_like"`
+		DewPoint  models.Temperature `json:"dew_point"`
+		WindSpeed float64            `json:"wind_speed"`
+		Pop       float64            `json:"pop"`
+		Snow      owmPrecip          `json:"snow"`
+		Weather   []struct {
+			Description string `json:"description"`
+		} `json:"weather"`
+	} `json:"hourly"`
+	Daily []struct {
+		Dt      int64 `json:"dt"`
+		Sunrise int64 `json:"sunrise"`
+		Sunset  int64 `json:"sunset"`
+		Temp    struct {
+			Min models.Temperature `json:"min"`
+			Max models.Temperature `json:"max"`
+		} `json:"temp"`
+		Pop     float64 `json:"pop"`
+		Snow    float64 `json:"snow"`    // mm
+		Summary string  `json:"summary"` // One Call 3.0 only
+		Weather []struct {
+			Description string `json:"description"`
+		} `json:"weather"`
+	} `json:"daily"`
+}
+
+// OWMGeocodeResult is a place returned by the geocoding API.
+type OWMGeocodeResult struct {
+	Name    string  `json:"name"`
+	State   string  `json:"state"`
+	Country string  `json:"country"`
+	Lat     float64 `json:"lat"`
+	Lon     float64 `json:"lon"`
+}
+
+// newOWMConditions maps a current weather response onto the
+// provider-agnostic model.
+func newOWMConditions(data *OWMApiResponse) *models.CurrentConditions {
+	c := data.Current
+	current := &models.CurrentConditions{
+		Time:      time.Unix(c.Dt, 0).UTC(),
+		Temp:      c.Temp,
+		FeelsLike: c.FeelsLike,
+		Humidity:  c.Humidity,
+		WindSpeed: c.WindSpeed,
+		WindGust:  c.WindGust,
+		UVI:       c.UVI,
+		Precip:    precipInches(c.Rain, c.Snow),
+		Alerts:    make([]models.Alert, 0, len(data.Alerts)),
+	}
+	// conditions stay nil if openweathermap left them out, as opposed to
+	// reporting none
+	if c.Weather != nil {
+		current.Conditions = make([]string, 0, len(c.Weather))
+	}
+	for _, cond := range c.Weather {
+		current.Conditions = append(current.Conditions, cond.Description)
+	}
+	for _, a := range data.Alerts {
+		current.Alerts = append(current.Alerts, models.Alert{
+			Event:       a.Event,
+			Sender:      a.SenderName,
+			Description: a.Description,
+			Start:       time.Unix(a.Start, 0).UTC(),
+			End:         time.Unix(a.End, 0).UTC(),
+			Source:      owmProvider,
+		})
+	}
+	return current
+}
+
+// newOWMForecast maps a forecast response onto the provider-agnostic model.
+func newOWMForecast(data *OWMForecastResponse) models.Forecast {
+	var forecast models.Forecast
+	for _, hour := range data.Hourly {
+		conditions := make([]string, 0, len(hour.Weather))
+		for _, cond := range hour.Weather {
+			conditions = append(conditions, cond.Description)
+		}
+		forecast.Hourly = append(forecast.Hourly, models.ForecastHour{
+			Time:                time.Unix(hour.Dt, 0).UTC(),
+			Temperature:         hour.Temp,
+			FeelsLike:           hour.FeelsLike,
+			DewPoint:            hour.DewPoint,
+			WindSpeed:           hour.WindSpeed,
+			PrecipitationChance: hour.Pop,
+			Conditions:          conditions,
+		})
+	}
+	for _, day := range data.Daily {
+		conditions := make([]string, 0, len(day.Weather))
+		for _, cond := range day.Weather {
+			conditions = append(conditions, cond.Description)
+		}
+		forecast.Daily = append(forecast.Daily, models.ForecastDay{
+			Date:                time.Unix(day.Dt, 0).UTC().Format("2006-01-02"),
+			Low:                 day.Temp.Min,
+			High:                day.Temp.Max,
+			PrecipitationChance: day.Pop,
+			Conditions:          conditions,
+			Sunrise:             unixTime(day.Sunrise),
+			Sunset:              unixTime(day.Sunset),
+			Summary:             day.Summary,
+		})
+	}
+	return forecast
+}
@@ -0,0 +1,77 @@
+package app
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// pageRequest is a parsed limit/cursor pair. Cursors are opaque to clients;
+// internally they are the sort key (a sequence number or timestamp) of the
+// last record returned.
+type pageRequest struct {
+	Limit  int
+	Before int64
+}
+
+// parsePage reads the limit and cursor query parameters.
+func parsePage(r *http.Request) (pageRequest, error) {
+	q := r.URL.Query()
+	page := pageRequest{Limit: defaultPageLimit}
+
+	if raw := q.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return page, fmt.Errorf("Invalid limit: must be between 1 and %d", maxPageLimit)
+		}
+		page.Limit = limit
+	}
+
+	if raw := q.Get("cursor"); raw != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(raw)
+		if err != nil {
+			return page, fmt.Errorf("Invalid cursor")
+		}
+		before, err := strconv.ParseInt(string(decoded), 10, 64)
+		if err != nil || before < 1 {
+			return page, fmt.Errorf("Invalid cursor")
+		}
+		page.Before = before
+	}
+
+	return page, nil
+}
+
+// encodeCursor returns the opaque cursor for the page following key.
+func encodeCursor(key int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(key, 10)))
+}
+
+// pageResponse is the envelope for paginated lists.
+type pageResponse struct {
+	Items      interface{}        `json:"items"`
+	NextCursor string             `json:"next_cursor,omitempty"`
+	Links      map[string]halLink `json:"_links"`
+}
+
+// newPageResponse builds the envelope for items. next is the sort key of
+// the final item, or 0 when there are no further pages.
+func newPageResponse(r *http.Request, items interface{}, next int64) pageResponse {
+	resp := pageResponse{
+		Items: items,
+		Links: map[string]halLink{"self": {Href: r.URL.RequestURI()}},
+	}
+	if next > 0 {
+		resp.NextCursor = encodeCursor(next)
+		q := r.URL.Query()
+		q.Set("cursor", resp.NextCursor)
+		resp.Links["next"] = halLink{Href: r.URL.Path + "?" + q.Encode()}
+	}
+	return resp
+}
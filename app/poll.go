@@ -0,0 +1,108 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// isLongPoll reports whether path is the long poll, whose requests are
+// held open for up to POLL_TIMEOUT.
+func isLongPoll(path string) bool {
+	return path == "/weather/poll"
+}
+
+// pollHandler serves /weather/poll, a long poll for clients that can't use
+// server-sent events or WebSockets. It answers as soon as there are current
+// conditions observed after ?since=, or with 204 No Content once ?timeout=
+// seconds pass without any; the timeout is POLL_TIMEOUT by default and at
+// most. A client polls again with the meta.observed_at of the last response
+// as since, or the same since after a 204.
+//
+// A poll goes to the provider at most once, when it starts, if what's
+// cached is too old for the client. After that it only waits to be woken
+// when the location's cached conditions are replaced, by the scheduler, a
+// prefetch or another request, so that many pollers don't add up to a
+// steady stream of upstream requests.
+func (s *server) pollHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lat, lon, resolved := s.requestLocation(r, q)
+	loc, err := models.ParseLocation(lat, lon)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	var since time.Time
+	if raw := q.Get("since"); raw != "" {
+		if since, err = parseTimeParam(raw); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("Invalid since: " + err.Error()))
+			return
+		}
+	}
+	timeout := s.pollTimeout
+	if raw := q.Get("timeout"); raw != "" {
+		secs, err := strconv.Atoi(raw)
+		if err != nil || secs < 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("timeout must be a whole number of seconds"))
+			return
+		}
+		if d := time.Duration(secs) * time.Second; d < timeout {
+			timeout = d
+		}
+	}
+	key := conditionsKey(r.Context(), loc)
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	// watch before fetching, so that an update in between isn't missed
+	_, fetchedAt, updated, release := s.cache.Watch(key)
+	defer func() { release() }()
+	data, err := s.fetchWeather(r.Context(), lat, lon)
+	if err != nil {
+		s.upstreamError(w, r, err)
+		return
+	}
+	for {
+		observed := data.Time
+		if observed.IsZero() {
+			// the provider didn't say; go by when we fetched it
+			observed = fetchedAt
+		}
+		if observed.After(since) {
+			weather := newWeather(data)
+			weather.Location = resolved
+			weather.Meta = newMeta(r.Context(), data)
+			writeJSON(w, &weather)
+			return
+		}
+
+		select {
+		case <-updated:
+		case <-deadline.C:
+			w.WriteHeader(204)
+			return
+		case <-r.Context().Done():
+			return
+		}
+		release()
+		var cached *models.CurrentConditions
+		if cached, fetchedAt, updated, release = s.cache.Watch(key); cached != nil {
+			data = cached
+		}
+	}
+}
+
+// conditionsKey returns the key fetchWeather caches current conditions at
+// loc under for the request ctx belongs to.
+func conditionsKey(ctx context.Context, loc models.Location) string {
+	if provider := providerFromContext(ctx); provider != "" && provider != owmProvider {
+		return provider + " " + loc.Key()
+	}
+	return loc.Key()
+}
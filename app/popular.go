@@ -0,0 +1,155 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+var popularPromoted = newGauge("popular_locations_promoted",
+	"Locations promoted into the monitored set for being among the most requested.")
+
+// maxPopularCandidates bounds how many distinct locations are counted in a
+// window, so that a scan of coordinates can't grow the counts without
+// limit. Once it's reached only locations already counted are.
+const maxPopularCandidates = 10000
+
+// promotion is a location promoted for its popularity, with why.
+type promotion struct {
+	Location   models.Location `json:"location"`
+	Requests   int             `json:"requests"`
+	Rank       int             `json:"rank"`
+	Reason     string          `json:"reason,omitempty"`
+	PromotedAt *time.Time      `json:"promoted_at,omitempty"`
+}
+
+// popularity counts requests for current conditions by location and, at
+// the end of every window, promotes the topK most requested into the
+// scheduler's monitored set, so that they're kept fresh ahead of demand.
+// A location must have had at least minRequests in the window to qualify.
+// Each window's promotions replace the last one's.
+type popularity struct {
+	topK        int
+	minRequests int
+	window      time.Duration
+
+	mu          sync.Mutex
+	counts      map[string]*promotion // this window's, by location key
+	windowStart time.Time
+	promoted    []promotion
+}
+
+func newPopularity(topK, minRequests int, window time.Duration) *popularity {
+	return &popularity{
+		topK:        topK,
+		minRequests: minRequests,
+		window:      window,
+		counts:      make(map[string]*promotion),
+		windowStart: time.Now(),
+	}
+}
+
+// Record counts a request for a location.
+func (p *popularity) Record(loc models.Location) {
+	if p == nil {
+		return
+	}
+	key := loc.Key()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.counts[key]
+	if !ok {
+		if len(p.counts) >= maxPopularCandidates {
+			return
+		}
+		c = &promotion{Location: loc}
+		p.counts[key] = c
+	}
+	c.Requests++
+}
+
+// ranked returns the counts, most requested first. The caller holds p.mu.
+func (p *popularity) ranked() []promotion {
+	ranked := make([]promotion, 0, len(p.counts))
+	for _, c := range p.counts {
+		ranked = append(ranked, *c)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Requests != ranked[j].Requests {
+			return ranked[i].Requests > ranked[j].Requests
+		}
+		return ranked[i].Location.Key() < ranked[j].Location.Key()
+	})
+	for i := range ranked {
+		ranked[i].Rank = i + 1
+	}
+	return ranked
+}
+
+// Promote ends the window, returning the locations that earned promotion.
+func (p *popularity) Promote() []promotion {
+	now := time.Now().UTC()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	promoted := []promotion{}
+	for _, c := range p.ranked() {
+		if len(promoted) == p.topK || c.Requests < p.minRequests {
+			break
+		}
+		c.PromotedAt = &now
+		c.Reason = fmt.Sprintf("%d requests between %s and %s, #%d of %d locations requested",
+			c.Requests, p.windowStart.UTC().Format(time.RFC3339), now.Format(time.RFC3339), c.Rank, len(p.counts))
+		promoted = append(promoted, c)
+	}
+	p.promoted = promoted
+	p.counts = make(map[string]*promotion)
+	p.windowStart = now
+	popularPromoted.Set(float64(len(promoted)))
+	return promoted
+}
+
+// promoteEvery promotes the most popular locations at the end of every
+// window until ctx is done, having the scheduler poll them every interval.
+func (s *server) promoteEvery(ctx context.Context, interval time.Duration) {
+	for range ticks(ctx, s.popular.window) {
+		promoted := s.popular.Promote()
+		locs := make(map[models.Location]time.Duration, len(promoted))
+		for _, p := range promoted {
+			locs[p.Location] = interval
+		}
+		s.scheduler.Sync("popular", locs)
+		s.logger.Printf("Promoted %d popular locations", len(promoted))
+	}
+}
+
+// popularHandler shows what was promoted at the end of the last window and
+// why, and how this window's counts stand.
+func (s *server) popularHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+	if s.popular == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Popular location discovery is off; set POPULAR_TOP_K to enable it"))
+		return
+	}
+	s.popular.mu.Lock()
+	promoted := append([]promotion{}, s.popular.promoted...)
+	candidates := s.popular.ranked()
+	windowStart := s.popular.windowStart.UTC()
+	s.popular.mu.Unlock()
+	if len(candidates) > s.popular.topK {
+		candidates = candidates[:s.popular.topK]
+	}
+	writeJSON(w, struct {
+		Promoted    []promotion `json:"promoted"`
+		WindowStart time.Time   `json:"window_start"`
+		Candidates  []promotion `json:"candidates"` // leading this window
+	}{promoted, windowStart, candidates})
+}
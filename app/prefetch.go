@@ -0,0 +1,58 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+var cachePrefetches = newCounter("cache_prefetches_total",
+	"Background refreshes of cache entries near expiry, by result: ok or failed.", "result")
+
+// prefetcher refreshes cache entries in the background as they near expiry,
+// so that a location that keeps being asked for is never fetched while a
+// client waits. An entry served within the last fraction of its max age
+// triggers a refresh; only one runs per key at a time. A nil prefetcher
+// never refreshes.
+type prefetcher struct {
+	fraction float64
+
+	mu       sync.Mutex
+	inFlight map[string]bool
+}
+
+func newPrefetcher(fraction float64) *prefetcher {
+	return &prefetcher{fraction: fraction, inFlight: make(map[string]bool)}
+}
+
+// Due reports whether an entry of the given age, served to a caller
+// accepting up to maxAge, should be refreshed.
+func (p *prefetcher) Due(age, maxAge time.Duration) bool {
+	if p == nil {
+		return false
+	}
+	return age >= maxAge-time.Duration(float64(maxAge)*p.fraction)
+}
+
+// Start runs refresh for key in the background, unless one already is.
+func (p *prefetcher) Start(key string, refresh func() error) {
+	p.mu.Lock()
+	if p.inFlight[key] {
+		p.mu.Unlock()
+		return
+	}
+	p.inFlight[key] = true
+	p.mu.Unlock()
+
+	go func() {
+		defer func() {
+			p.mu.Lock()
+			delete(p.inFlight, key)
+			p.mu.Unlock()
+		}()
+		if err := refresh(); err != nil {
+			cachePrefetches.Inc("failed")
+			return
+		}
+		cachePrefetches.Inc("ok")
+	}()
+}
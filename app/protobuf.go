@@ -0,0 +1,182 @@
+package app
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// protobufContentType is the media type of binary responses, encoded as the
+// messages in ui/weather.proto describe. They're a fraction of the size of
+// the JSON, for clients on metered or constrained links.
+const protobufContentType = "application/x-protobuf"
+
+// wantsProtobuf reports whether the client asked for a binary response,
+// either with ?format=protobuf or by asking for application/x-protobuf.
+func wantsProtobuf(w http.ResponseWriter, r *http.Request, q url.Values) bool {
+	return q.Get("format") == "protobuf" || negotiate(w, r, protobufContentType)
+}
+
+// protobufPaths are the routes with a protobuf representation. It's only
+// current conditions, which is what constrained clients poll.
+var protobufPaths = map[string]bool{"/weather/": true}
+
+// unacceptableProtobuf answers 406 Not Acceptable to a request for protobuf
+// from a route without it, rather than have the client get JSON it can't
+// read, returning true if it did. Clients that also accept something else
+// get that instead.
+func unacceptableProtobuf(w http.ResponseWriter, r *http.Request) bool {
+	if protobufPaths[r.URL.Path] {
+		return false
+	}
+	if r.URL.Query().Get("format") != "protobuf" && !acceptsOnly(r, protobufContentType) {
+		return false
+	}
+	w.WriteHeader(406)
+	w.Write([]byte("Protobuf responses are only available from /weather/"))
+	return true
+}
+
+// acceptsOnly reports whether mediaType is the only media type the
+// request's Accept header allows.
+func acceptsOnly(r *http.Request, mediaType string) bool {
+	found := false
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		if mt != mediaType {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// Protocol Buffers wire types.
+const (
+	wireVarint = 0
+	wire64Bit  = 1
+	wireBytes  = 2
+)
+
+// protoMessage is a response that can be encoded as a protobuf message.
+type protoMessage interface {
+	marshalProto(e *protoEncoder)
+}
+
+// protoEncoder writes the protobuf wire format. There's no code generation
+// or reflection: each message encodes its own fields, by number, and like
+// proto3 leaves out those at their zero value.
+type protoEncoder struct {
+	buf []byte
+}
+
+func (e *protoEncoder) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf = append(e.buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func (e *protoEncoder) key(field, wireType int) {
+	e.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (e *protoEncoder) bytes(field int, b []byte) {
+	e.key(field, wireBytes)
+	e.varint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *protoEncoder) string(field int, s string) {
+	if s != "" {
+		e.bytes(field, []byte(s))
+	}
+}
+
+// strings encodes a repeated string field.
+func (e *protoEncoder) strings(field int, ss []string) {
+	for _, s := range ss {
+		e.bytes(field, []byte(s))
+	}
+}
+
+func (e *protoEncoder) int64(field int, v int64) {
+	if v != 0 {
+		e.key(field, wireVarint)
+		e.varint(uint64(v))
+	}
+}
+
+func (e *protoEncoder) double(field int, v float64) {
+	if v != 0 {
+		e.key(field, wire64Bit)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		e.buf = append(e.buf, b[:]...)
+	}
+}
+
+func (e *protoEncoder) message(field int, m protoMessage) {
+	var sub protoEncoder
+	m.marshalProto(&sub)
+	e.bytes(field, sub.buf)
+}
+
+// timestamp encodes a google.protobuf.Timestamp.
+func (e *protoEncoder) timestamp(field int, t time.Time) {
+	var sub protoEncoder
+	sub.int64(1, t.Unix())
+	sub.int64(2, int64(t.Nanosecond()))
+	e.bytes(field, sub.buf)
+}
+
+func (w *Weather) marshalProto(e *protoEncoder) {
+	e.strings(1, w.Alerts)
+	e.strings(2, w.Conditions)
+	e.string(3, w.Temperature)
+	if w.Location != nil {
+		e.message(4, w.Location)
+	}
+	if w.Meta != nil {
+		e.message(5, w.Meta)
+	}
+}
+
+func (l *ResolvedLocation) marshalProto(e *protoEncoder) {
+	e.double(1, l.Lat)
+	e.double(2, l.Lon)
+	e.string(3, l.Source)
+}
+
+func (m *Meta) marshalProto(e *protoEncoder) {
+	e.string(1, m.Provider)
+	if m.ObservedAt != nil {
+		e.timestamp(2, *m.ObservedAt)
+	}
+	e.int64(3, m.AgeSeconds)
+	e.string(4, m.Cache)
+	e.string(5, m.RequestID)
+}
+
+// writeProtobuf writes m as a binary response to the request ctx belongs
+// to.
+func writeProtobuf(ctx context.Context, w http.ResponseWriter, m protoMessage) error {
+	stop := timePhase(ctx, phaseEncode)
+	var e protoEncoder
+	m.marshalProto(&e)
+	stop()
+	w.Header().Set("Content-Type", protobufContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.buf)))
+	_, err := w.Write(e.buf)
+	return err
+}
@@ -0,0 +1,148 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// providerNames maps the names clients may pass in ?provider= to the
+// providers of current conditions.
+var providerNames = map[string]string{
+	"owm":             owmProvider,
+	owmProvider:       owmProvider,
+	nwsProvider:       nwsProvider,
+	openMeteoProvider: openMeteoProvider,
+}
+
+// parseProviderSelection parses PROVIDER_SELECTION, the providers clients
+// may choose between with ?provider=, checking that each is configured.
+// Nil means clients can't choose.
+func (s *server) parseProviderSelection(spec string) (map[string]bool, error) {
+	names := splitList(spec)
+	if len(names) == 0 {
+		return nil, nil
+	}
+	allowed := make(map[string]bool)
+	for _, name := range names {
+		provider, ok := providerNames[strings.ToLower(name)]
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("unknown provider %q (want owm, nws or open-meteo)", name)
+		case provider == nwsProvider && s.nws == nil:
+			return nil, fmt.Errorf("nws needs NWS_ALERTS=1")
+		case provider == openMeteoProvider && s.openMeteo == nil:
+			return nil, fmt.Errorf("open-meteo needs OPEN_METEO=1")
+		}
+		allowed[provider] = true
+	}
+	return allowed, nil
+}
+
+// selectProvider lets clients choose where current conditions come from
+// with ?provider=, to compare sources or stick with one they trust. The
+// choice is echoed in X-Weather-Provider. Only the providers allowed by
+// PROVIDER_SELECTION may be chosen.
+func (s *server) selectProvider(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("provider")
+		if name == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if s.providers == nil {
+			w.WriteHeader(400)
+			w.Write([]byte("Choosing a provider isn't enabled"))
+			return
+		}
+		provider := providerNames[strings.ToLower(name)]
+		if !s.providers[provider] {
+			var available []string
+			for name, provider := range providerNames {
+				if s.providers[provider] && name != owmProvider {
+					available = append(available, name)
+				}
+			}
+			sort.Strings(available)
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Unknown provider %q (available: %s)", name, strings.Join(available, ", "))
+			return
+		}
+		w.Header().Set("X-Weather-Provider", provider)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), providerContextKey, provider)))
+	})
+}
+
+// providerFromContext returns the provider the request chose, if any.
+func providerFromContext(ctx context.Context) string {
+	provider, _ := ctx.Value(providerContextKey).(string)
+	return provider
+}
+
+// fetchWeatherFrom retrieves current weather for a location from a provider
+// other than openweathermap. It's cached like openweathermap's, but not
+// recorded in the history store, which keeps one source's observations.
+func (s *server) fetchWeatherFrom(ctx context.Context, provider, lat, lon string) (*models.CurrentConditions, error) {
+	loc, err := models.ParseLocation(lat, lon)
+	if err != nil {
+		return nil, &UpstreamError{Provider: provider, Class: ErrBadRequest, Message: err.Error()}
+	}
+	key := provider + " " + loc.Key()
+	maxAge := s.maxAge(ctx)
+	stop := timePhase(ctx, phaseCache)
+	data, age, result := s.cache.Get(key, maxAge, maxAge)
+	stop()
+	recordCacheResult(ctx, result, age)
+	if result != cacheMiss {
+		return data, nil
+	}
+
+	defer timePhase(ctx, phaseUpstream)()
+
+	v, err := s.flights.Do(key, func() (interface{}, error) {
+		lat, lon := loc.Strings()
+		var data *models.CurrentConditions
+		var err error
+		switch provider {
+		case nwsProvider:
+			data, err = s.nwsConditions(lat, lon)
+		case openMeteoProvider:
+			var current *OpenMeteoCurrent
+			if current, err = s.openMeteo.GetCurrent(lat, lon); err == nil {
+				data = newOpenMeteoConditions(current)
+			}
+		}
+		if err != nil {
+			upstreamErrors.Inc(errorClass(err))
+			return nil, err
+		}
+		s.cache.Put(key, data)
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*models.CurrentConditions), nil
+}
+
+// nwsConditions returns the latest observation near a point, with the NWS
+// alerts in effect there.
+func (s *server) nwsConditions(lat, lon string) (*models.CurrentConditions, error) {
+	obs, err := s.nws.GetLatestObservation(lat, lon)
+	if err != nil {
+		return nil, err
+	}
+	alerts, err := s.nwsAlerts(lat, lon)
+	if err != nil {
+		return nil, err
+	}
+	data := newNWSConditions(obs)
+	for _, alert := range alerts {
+		data.Alerts = append(data.Alerts, newNWSAlert(alert))
+	}
+	return data, nil
+}
@@ -0,0 +1,56 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// proxyRoutes picks the proxy for each upstream request. Requests to a
+// provider with its own proxy setting (OWM_PROXY and so on) go through
+// that, or straight out if it's "direct"; everything else honours
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+type proxyRoutes struct {
+	mu     sync.RWMutex
+	byHost map[string]*url.URL // nil for direct
+}
+
+func newProxyRoutes() *proxyRoutes {
+	return &proxyRoutes{byHost: make(map[string]*url.URL)}
+}
+
+// Route sends requests to baseURL's host through proxy. An empty proxy
+// leaves the environment to decide.
+func (p *proxyRoutes) Route(baseURL, proxy string) error {
+	if proxy == "" {
+		return nil
+	}
+	base, err := url.Parse(baseURL)
+	if err != nil || base.Host == "" {
+		return fmt.Errorf("provider URL %q has no host", baseURL)
+	}
+	var via *url.URL
+	if !strings.EqualFold(proxy, "direct") {
+		via, err = url.Parse(proxy)
+		if err != nil || via.Scheme == "" || via.Host == "" {
+			return fmt.Errorf("not a proxy URL or direct")
+		}
+	}
+	p.mu.Lock()
+	p.byHost[strings.ToLower(base.Host)] = via
+	p.mu.Unlock()
+	return nil
+}
+
+// Proxy is an http.Transport's Proxy function.
+func (p *proxyRoutes) Proxy(req *http.Request) (*url.URL, error) {
+	p.mu.RLock()
+	via, ok := p.byHost[strings.ToLower(req.URL.Host)]
+	p.mu.RUnlock()
+	if ok {
+		return via, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
@@ -0,0 +1,122 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	upstreamRateLimit = newGauge("upstream_ratelimit_limit",
+		"Request quota per window, as last reported by the provider.")
+	upstreamRateRemaining = newGauge("upstream_ratelimit_remaining",
+		"Requests remaining in the current quota window, as last reported by the provider.")
+	upstreamRateReset = newGauge("upstream_ratelimit_reset_timestamp_seconds",
+		"Unix time at which the provider's quota window resets.")
+	upstreamThrottled = newCounter("upstream_throttled_total",
+		"Outbound requests delayed or refused to stay within the provider's rate limit, by outcome.", "outcome")
+)
+
+// rateGate paces outbound requests using the rate-limit headers the provider
+// sends back. Once the remaining quota drops below the low-water mark, the
+// remaining requests are spread evenly over what is left of the window
+// rather than spent immediately; after a 429 nothing is sent until the
+// provider's Retry-After has elapsed. Requests that would have to wait
+// longer than maxWait fail with ErrRateLimited instead.
+type rateGate struct {
+	maxWait  time.Duration
+	lowWater float64 // fraction of the limit
+
+	mu           sync.Mutex
+	limit        int // 0 if unknown
+	remaining    int
+	reset        time.Time
+	blockedUntil time.Time
+	next         time.Time
+}
+
+func newRateGate(maxWait time.Duration, lowWater float64) *rateGate {
+	return &rateGate{maxWait: maxWait, lowWater: lowWater}
+}
+
+// Wait blocks until a request may be sent.
+func (g *rateGate) Wait() error {
+	g.mu.Lock()
+	now := time.Now()
+	start := now
+	if g.blockedUntil.After(start) {
+		start = g.blockedUntil
+	}
+	if g.limit > 0 && g.reset.After(now) && float64(g.remaining) <= g.lowWater*float64(g.limit) {
+		if g.next.After(start) {
+			start = g.next
+		}
+		interval := g.reset.Sub(now) / time.Duration(g.remaining+1)
+		g.next = start.Add(interval)
+	}
+	wait := start.Sub(now)
+	if wait > g.maxWait {
+		g.mu.Unlock()
+		upstreamThrottled.Inc("refused")
+		return &UpstreamError{Class: ErrRateLimited, Message: "local rate limit reached", RetryAfter: wait}
+	}
+	if g.remaining > 0 {
+		// count this request against the quota until the provider tells us otherwise
+		g.remaining--
+	}
+	g.mu.Unlock()
+
+	if wait > 0 {
+		upstreamThrottled.Inc("delayed")
+		time.Sleep(wait)
+	}
+	return nil
+}
+
+// Observe updates the gate from a provider response's headers. It
+// understands the common X-RateLimit-* headers (with the reset given either
+// as a unix timestamp or as seconds from now) and Retry-After.
+func (g *rateGate) Observe(resp *http.Response) {
+	now := time.Now()
+	h := resp.Header
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if limit, err := strconv.Atoi(h.Get("X-RateLimit-Limit")); err == nil && limit > 0 {
+		g.limit = limit
+		upstreamRateLimit.Set(float64(limit))
+	}
+	if remaining, err := strconv.Atoi(h.Get("X-RateLimit-Remaining")); err == nil && remaining >= 0 {
+		g.remaining = remaining
+		upstreamRateRemaining.Set(float64(remaining))
+	}
+	if reset, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64); err == nil && reset > 0 {
+		// small values are relative; anything past 2001 is an absolute time
+		if reset < 1e9 {
+			g.reset = now.Add(time.Duration(reset) * time.Second)
+		} else {
+			g.reset = time.Unix(reset, 0)
+		}
+		upstreamRateReset.Set(float64(g.reset.Unix()))
+	}
+	if resp.StatusCode == 429 {
+		g.blockedUntil = now.Add(parseRetryAfter(h.Get("Retry-After"), now, time.Minute))
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date, returning def if it's missing or malformed.
+func parseRetryAfter(value string, now time.Time, def time.Duration) time.Duration {
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if d := at.Sub(now); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return def
+}
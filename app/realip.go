@@ -0,0 +1,73 @@
+package app
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// realIP derives the address of the client behind any trusted reverse
+// proxies. Forwarding headers are only believed when the request actually
+// came from one of trustedProxies; otherwise anyone could claim any address.
+type realIP struct {
+	trustedProxies []*net.IPNet
+}
+
+// clientIP returns the address of the client that made r. From a trusted
+// proxy, the client is the right-most X-Forwarded-For address that doesn't
+// belong to a trusted proxy, or failing that the X-Real-IP address.
+func (ri *realIP) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if !ri.trusted(r, ip) {
+		return ip
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			ip = hop
+			if !containsIP(ri.trustedProxies, hop) {
+				break
+			}
+		}
+		return ip
+	}
+	if real := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); real != nil {
+		return real
+	}
+	return ip
+}
+
+// trusted reports whether the peer that sent r is a trusted proxy. Peers on
+// a unix socket are local processes let in by the socket's permissions, so
+// they are trusted too.
+func (ri *realIP) trusted(r *http.Request, peer net.IP) bool {
+	if _, ok := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); ok {
+		return true
+	}
+	return peer != nil && containsIP(ri.trustedProxies, peer)
+}
+
+// Middleware records the client address in the request context, where
+// logging, access control and rate limiting pick it up.
+func (ri *realIP) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPContextKey, ri.clientIP(r))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIPFromContext returns the address recorded by realIP, or nil.
+func clientIPFromContext(ctx context.Context) net.IP {
+	ip, _ := ctx.Value(clientIPContextKey).(net.IP)
+	return ip
+}
@@ -0,0 +1,135 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// secretVars are the settings whose values must never be logged or sent to
+// clients. More can be listed in REDACT_SECRETS.
+var secretVars = []string{
+	"API_KEY", "ADMIN_TOKEN", "TOKEN_SIGNING_KEY", "SLACK_SIGNING_SECRET",
+	"CAP_INGEST_TOKEN", "TELEGRAM_BOT_TOKEN", "TELEGRAM_WEBHOOK_SECRET",
+	"LIGHTNING_CLIENT_SECRET", "SENTRY_DSN",
+}
+
+// minSecretLength is the shortest value redacted; replacing anything
+// shorter would mangle ordinary text.
+const minSecretLength = 6
+
+// redacted replaces secret values.
+const redacted = "[REDACTED]"
+
+// redactor replaces known secret values in text on its way out of the
+// process: log lines, error responses and stored error messages. A nil
+// redactor redacts nothing.
+type redactor struct {
+	replacer *strings.Replacer
+}
+
+func newRedactor(secrets []string) *redactor {
+	var pairs []string
+	for _, secret := range secrets {
+		if len(secret) >= minSecretLength {
+			pairs = append(pairs, secret, redacted)
+		}
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+	return &redactor{replacer: strings.NewReplacer(pairs...)}
+}
+
+// String returns s with any secrets replaced.
+func (r *redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+	return r.replacer.Replace(s)
+}
+
+// Error returns err with any secrets in its message replaced. Only the
+// message survives; use it for errors that are about to be reported or
+// stored, not ones still to be inspected.
+func (r *redactor) Error(err error) error {
+	if r == nil || err == nil {
+		return err
+	}
+	if msg := err.Error(); r.String(msg) != msg {
+		return errors.New(r.String(msg))
+	}
+	return err
+}
+
+// Writer returns a writer that redacts what's written to w. Each write is
+// redacted separately, which suits loggers: they write a line at a time.
+func (r *redactor) Writer(w io.Writer) io.Writer {
+	if r == nil {
+		return w
+	}
+	return &redactingWriter{w: w, r: r}
+}
+
+type redactingWriter struct {
+	w io.Writer
+	r *redactor
+}
+
+func (rw *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(rw.w, rw.r.String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Middleware redacts the bodies of error responses, which often carry the
+// text of an upstream error.
+func (r *redactor) Middleware(h http.Handler) http.Handler {
+	if r == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(&redactingResponseWriter{ResponseWriter: w, r: r}, req)
+	})
+}
+
+type redactingResponseWriter struct {
+	http.ResponseWriter
+	r           *redactor
+	wroteHeader bool
+	isError     bool
+}
+
+func (rw *redactingResponseWriter) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.wroteHeader = true
+		rw.isError = status >= 400
+		if rw.isError {
+			// redaction may change the length
+			rw.Header().Del("Content-Length")
+		}
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *redactingResponseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(200)
+	}
+	if !rw.isError {
+		return rw.ResponseWriter.Write(b)
+	}
+	if _, err := io.WriteString(rw.ResponseWriter, rw.r.String(string(b))); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush lets streaming handlers flush through the writer.
+func (rw *redactingResponseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,42 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// bufferPool recycles response buffers across requests.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// writeJSON encodes v as the response body. Encoding into a pooled buffer
+// first lets us send a Content-Length and saves growing a fresh buffer for
+// every response. A Content-Type already set by the caller is kept.
+func writeJSON(w io.Writer, v interface{}) error {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufferPool.Put(buf)
+
+	start := time.Now()
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+	if tw, ok := w.(*timingWriter); ok {
+		tw.timings.add(phaseEncode, time.Since(start))
+	}
+	if rw, ok := w.(http.ResponseWriter); ok {
+		h := rw.Header()
+		if h.Get("Content-Type") == "" {
+			h.Set("Content-Type", "application/json")
+		}
+		h.Set("Content-Length", strconv.Itoa(buf.Len()))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
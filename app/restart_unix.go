@@ -0,0 +1,176 @@
+//go:build !windows
+// +build !windows
+
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Environment variables a restarting parent uses to hand its listener, and
+// a pipe to report readiness on, to its replacement.
+const (
+	listenerFDEnv = "RESTART_LISTENER_FD"
+	readyFDEnv    = "RESTART_READY_FD"
+)
+
+// restartReadyTimeout bounds how long we wait for a replacement process to
+// come up before giving up on a restart.
+const restartReadyTimeout = time.Minute
+
+// inheritedListener returns the listener handed down by the process we're
+// replacing, or nil if we weren't started by a restart.
+func inheritedListener() (net.Listener, error) {
+	v := os.Getenv(listenerFDEnv)
+	if v == "" {
+		return nil, nil
+	}
+	os.Unsetenv(listenerFDEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", listenerFDEnv, v)
+	}
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// notifyParent tells the process we're replacing, if any, that we're about
+// to start serving so it can stop.
+func notifyParent() {
+	v := os.Getenv(readyFDEnv)
+	if v == "" {
+		return
+	}
+	os.Unsetenv(readyFDEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Invalid %s: %s", readyFDEnv, v)
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// handleRestarts restarts the service without dropping connections on
+// SIGHUP, until ctx is done. The background work is handed off, then a new
+// copy of the binary is started with the listening socket; once it's ready,
+// s stops accepting connections and drains the ones in flight, for up to
+// shutdownTimeout. If the replacement fails to start, the work is resumed.
+// The returned channel is closed when s has shut down.
+//
+// The replacement inherits our environment, so this picks up a new binary
+// and configuration read from files, not changed environment variables.
+// Under systemd, the unit needs NotifyAccess=all so the replacement can
+// report in as the new main process.
+func handleRestarts(ctx context.Context, s *http.Server, ln net.Listener, shutdownTimeout time.Duration, hooks restartHooks) <-chan struct{} {
+	done := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-sigs:
+			case <-ctx.Done():
+				return
+			}
+			hooks.logger.Println("Restarting")
+			hooks.handOff()
+			if err := restart(ln); err != nil {
+				hooks.logger.Printf("Restart failed: %s", err)
+				hooks.resume()
+				continue
+			}
+			break
+		}
+		signal.Stop(sigs)
+
+		hooks.logger.Println("Replacement is ready; draining connections")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			hooks.logger.Printf("Failed to drain connections: %s", err)
+		}
+		close(done)
+	}()
+	return done
+}
+
+// restart starts a replacement process that inherits ln, and waits for it
+// to report that it's ready.
+func restart(ln net.Listener) error {
+	filer, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return fmt.Errorf("can't pass a %T to another process", ln)
+	}
+	lnFile, err := filer.File()
+	if err != nil {
+		return err
+	}
+	defer lnFile.Close()
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// ExtraFiles start at fd 3
+	cmd.ExtraFiles = []*os.File{lnFile, readyW}
+	cmd.Env = append(os.Environ(), listenerFDEnv+"=3", readyFDEnv+"=4")
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+	go cmd.Wait()
+
+	// the pipe is closed without a write if the replacement dies first
+	result := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		if n, _ := ready.Read(b); n == 0 {
+			result <- errors.New("replacement exited before becoming ready")
+			return
+		}
+		result <- nil
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			cmd.Process.Kill()
+			return err
+		}
+		if ul, ok := ln.(*net.UnixListener); ok {
+			// the socket file is the replacement's now
+			ul.SetUnlinkOnClose(false)
+		}
+		sdNotify(fmt.Sprintf("MAINPID=%d", cmd.Process.Pid))
+		return nil
+	case <-time.After(restartReadyTimeout):
+		cmd.Process.Kill()
+		return errors.New("timed out waiting for replacement")
+	}
+}
@@ -0,0 +1,61 @@
+//go:build !windows
+// +build !windows
+
+package app_test
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// unpassableListener is a listener that can't be handed to a replacement
+// process, so that restarts fail.
+type unpassableListener struct{ net.Listener }
+
+func TestFailedRestartResumesBackgroundJobs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHarnessOn(t, map[string]string{
+		"LEADER_ELECTION":       "file",
+		"LEADER_LOCK_PATH":      t.TempDir() + "/leader.lock",
+		"LEADER_LEASE_DURATION": "300ms",
+		"MONITOR_LOCATIONS":     "30.49,-99.77",
+		"MONITOR_INTERVAL":      "100ms",
+	}, unpassableListener{ln})
+
+	// waitFor waits for the scheduler to poll and for us to be the leader
+	waitFor := func(when string) {
+		t.Helper()
+		polls := len(h.owm.Requests(oneCallPath))
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			_, metrics := h.get("/metrics")
+			if strings.Contains(metrics, "\nleader 1\n") && len(h.owm.Requests(oneCallPath)) > polls {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: scheduler and leadership didn't come up", when)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	waitFor("at startup")
+
+	syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(h.logs.String(), "Restart failed") {
+		if time.Now().After(deadline) {
+			t.Fatal("restart didn't fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitFor("after the failed restart")
+	if resp, body := h.get(weatherPath); resp.StatusCode != 200 {
+		t.Errorf("status %d after the failed restart: %s", resp.StatusCode, body)
+	}
+}
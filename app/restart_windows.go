@@ -0,0 +1,19 @@
+package app
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Restarts rely on passing file descriptors to a child process, which
+// Windows doesn't support; there the service simply runs until killed.
+
+func inheritedListener() (net.Listener, error) { return nil, nil }
+
+func notifyParent() {}
+
+func handleRestarts(ctx context.Context, s *http.Server, ln net.Listener, shutdownTimeout time.Duration, hooks restartHooks) <-chan struct{} {
+	return make(chan struct{})
+}
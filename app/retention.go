@@ -0,0 +1,162 @@
+package app
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+var (
+	historyRowsPruned = newCounter("history_rows_pruned_total",
+		"Raw observations removed from the history store by compaction.")
+	historyCompactions = newCounter("history_compactions_total",
+		"Completed history compaction runs.")
+	historyDailyAggregates = newGauge("history_daily_aggregates",
+		"Daily aggregates held in the history store.")
+	historyLastCompaction = newGauge("history_last_compaction_timestamp_seconds",
+		"Unix time of the last completed history compaction.")
+)
+
+// dailyAggregate summarizes a location's observations for one UTC day. Raw
+// observations are folded into these once they age out of the retention
+// window; aggregates are kept forever.
+type dailyAggregate struct {
+	Location models.Location    `json:"location"`
+	Date     string             `json:"date"` // YYYY-MM-DD, UTC
+	MinTemp  models.Temperature `json:"min_temp"`
+	MaxTemp  models.Temperature `json:"max_temp"`
+	MeanTemp models.Temperature `json:"mean_temp"`
+	// Precip is the day's precipitation in inches. Only hours with an
+	// observation are counted, so sparse history undercounts it.
+	Precip  float64 `json:"precip"`
+	Samples int     `json:"samples"`
+
+	// the hour being added, and the most precipitation seen for it, since
+	// observations within an hour report overlapping totals
+	hour       time.Time
+	hourPrecip float64
+}
+
+// add folds an observation into the aggregate. Observations must be added in
+// time order.
+func (a *dailyAggregate) add(obs observation) {
+	if hour := obs.Time.Truncate(time.Hour); a.Samples == 0 || !hour.Equal(a.hour) {
+		a.hour, a.hourPrecip = hour, 0
+	}
+	if obs.Precip > a.hourPrecip {
+		a.Precip += obs.Precip - a.hourPrecip
+		a.hourPrecip = obs.Precip
+	}
+	if a.Samples == 0 || obs.Temp.Less(a.MinTemp) {
+		a.MinTemp = obs.Temp
+	}
+	if a.Samples == 0 || a.MaxTemp.Less(obs.Temp) {
+		a.MaxTemp = obs.Temp
+	}
+	a.MeanTemp = models.DegreesF((a.MeanTemp.F()*float64(a.Samples) + obs.Temp.F()) / float64(a.Samples+1))
+	a.Samples++
+}
+
+// compacted reports whether the day containing t has already been folded
+// into a daily aggregate for the location. The caller must hold h.mu.
+func (h *historyStore) compacted(key string, t time.Time) bool {
+	date := t.UTC().Format("2006-01-02")
+	aggs := h.daily[key]
+	i := sort.Search(len(aggs), func(i int) bool { return aggs[i].Date >= date })
+	return i < len(aggs) && aggs[i].Date == date
+}
+
+// DailySummaries returns a day-by-day summary of a location's observations
+// from one date to another (YYYY-MM-DD, UTC, inclusive), oldest first. Days
+// that haven't been compacted yet are summarized from the raw observations;
+// days with no observations are left out.
+func (h *historyStore) DailySummaries(loc models.Location, from, to string) []dailyAggregate {
+	key := loc.Key()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var out []dailyAggregate
+	for _, agg := range h.daily[key] {
+		if agg.Date >= from && agg.Date <= to {
+			out = append(out, agg)
+		}
+	}
+	var raw *dailyAggregate
+	for _, obs := range h.observations[key] {
+		date := obs.Time.UTC().Format("2006-01-02")
+		if date < from || date > to {
+			continue
+		}
+		if raw == nil || raw.Date != date {
+			out = append(out, dailyAggregate{Location: obs.Location, Date: date})
+			raw = &out[len(out)-1]
+		}
+		raw.add(obs)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Date < out[j].Date })
+	return out
+}
+
+// Compact folds raw observations older than retention into daily aggregates
+// and drops them. Only whole days are compacted, so a day is either entirely
+// raw or entirely aggregated. It returns the number of observations pruned.
+func (h *historyStore) Compact(retention time.Duration, now time.Time) int {
+	// the cutoff is rounded down to midnight so we never split a day
+	cutoff := now.Add(-retention).UTC().Truncate(24 * time.Hour)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	pruned := 0
+	aggregates := 0
+	for key, list := range h.observations {
+		n := sort.Search(len(list), func(i int) bool { return !list[i].Time.Before(cutoff) })
+		if n > 0 {
+			byDate := make(map[string]*dailyAggregate)
+			var dates []string
+			for _, obs := range list[:n] {
+				date := obs.Time.UTC().Format("2006-01-02")
+				agg, ok := byDate[date]
+				if !ok {
+					agg = &dailyAggregate{Location: obs.Location, Date: date}
+					byDate[date] = agg
+					dates = append(dates, date)
+				}
+				agg.add(obs)
+			}
+			for _, date := range dates {
+				h.daily[key] = append(h.daily[key], *byDate[date])
+			}
+			sort.Slice(h.daily[key], func(i, j int) bool { return h.daily[key][i].Date < h.daily[key][j].Date })
+
+			if n == len(list) {
+				delete(h.observations, key)
+			} else {
+				h.observations[key] = append([]observation(nil), list[n:]...)
+			}
+			pruned += n
+			h.dirty = true
+		}
+	}
+	for _, aggs := range h.daily {
+		aggregates += len(aggs)
+	}
+
+	historyRowsPruned.Add(float64(pruned))
+	historyCompactions.Inc()
+	historyDailyAggregates.Set(float64(aggregates))
+	historyLastCompaction.Set(float64(now.Unix()))
+	return pruned
+}
+
+// compactEvery runs Compact on the given interval until ctx is done.
+func (h *historyStore) compactEvery(ctx context.Context, interval, retention time.Duration) {
+	for now := range ticks(ctx, interval) {
+		if pruned := h.Compact(retention, now); pruned > 0 {
+			h.logger.Printf("History compaction pruned %d observations", pruned)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+const (
+	// maxRouteSamples bounds how many points along a route we fetch
+	// forecasts for; each one is an upstream call.
+	maxRouteSamples = 50
+	// routeConcurrency is how many of a route's forecasts are fetched at once.
+	routeConcurrency = 4
+	earthRadiusKm    = 6371.0
+)
+
+// routeRequest is the body of a route weather request. The route is given
+// either as waypoints or as an encoded polyline.
+type routeRequest struct {
+	Waypoints  [][2]float64 `json:"waypoints"` // [lat, lon] pairs
+	Polyline   string       `json:"polyline"`  // Google encoded polyline
+	Departure  time.Time    `json:"departure"` // defaults to now
+	IntervalKm float64      `json:"interval_km"`
+	SpeedKmh   float64      `json:"speed_kmh"`
+}
+
+// RouteWeather is the response of the route weather endpoint.
+type RouteWeather struct {
+	DistanceKm float64      `json:"distance_km"`
+	Points     []RoutePoint `json:"points"`
+}
+
+// RoutePoint is the forecast at a point along a route, for when we expect
+// to get there. Points beyond the forecast horizon have no forecast.
+type RoutePoint struct {
+	Lat        float64              `json:"lat"`
+	Lon        float64              `json:"lon"`
+	DistanceKm float64              `json:"distance_km"`
+	Arrival    time.Time            `json:"arrival"`
+	Hour       *models.ForecastHour `json:"hour,omitempty"`
+	Day        *models.ForecastDay  `json:"day,omitempty"`
+}
+
+// routeWeatherHandler forecasts the weather along a route, sampling a point
+// every interval_km and using the forecast for the time we'd arrive there
+// driving at speed_kmh: hourly where available, otherwise daily.
+func (s *server) routeWeatherHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(405)
+		return
+	}
+
+	req := routeRequest{IntervalKm: 50, SpeedKmh: 80}
+	if !decodeBody(w, r, "POST /route-weather", 1<<20, &req) {
+		return
+	}
+	path, err := req.path()
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if req.Departure.IsZero() {
+		req.Departure = time.Now()
+	}
+
+	points, total := sampleRoute(path, req.IntervalKm)
+	if len(points) > maxRouteSamples {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Route is %.0f km; at most %d points can be sampled, so interval_km must be at least %.0f",
+			total, maxRouteSamples, math.Ceil(total/(maxRouteSamples-1)))
+		return
+	}
+	for i := range points {
+		hours := points[i].DistanceKm / req.SpeedKmh
+		points[i].Arrival = req.Departure.Add(time.Duration(hours * float64(time.Hour))).UTC().Truncate(time.Second)
+	}
+
+	if err := s.forecastRoute(points); err != nil {
+		s.upstreamError(w, r, err)
+		return
+	}
+	if wantsGeoJSON(w, r, r.URL.Query()) {
+		writeGeoJSON(w, routeFeatures(path, total, points))
+		return
+	}
+	writeJSON(w, &RouteWeather{DistanceKm: total, Points: points})
+}
+
+// routeFeatures returns the route as a LineString feature, followed by a
+// Point feature for each sampled point.
+func routeFeatures(path []models.Location, total float64, points []RoutePoint) *GeoJSONFeatureCollection {
+	line := make([][2]float64, len(path))
+	for i, loc := range path {
+		line[i] = [2]float64{loc.Lon, loc.Lat}
+	}
+	features := []GeoJSONFeature{{
+		Type:       "Feature",
+		Geometry:   GeoJSONGeometry{Type: "LineString", Coordinates: line},
+		Properties: map[string]float64{"distance_km": total},
+	}}
+	for i := range points {
+		features = append(features, pointFeature(points[i].Lat, points[i].Lon, &points[i]))
+	}
+	return featureCollection(features)
+}
+
+// forecastRoute fills in the forecast for each point.
+func (s *server) forecastRoute(points []RoutePoint) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, routeConcurrency)
+	)
+	for i := range points {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(p *RoutePoint) {
+			defer func() { <-sem; wg.Done() }()
+			lat, lon := models.Location{Lat: p.Lat, Lon: p.Lon}.Strings()
+			data, err := s.forecast(lat, lon, forecastBlocks)
+			if err != nil {
+				s.upstreamFailed(err)
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				return
+			}
+			p.Hour, p.Day = forecastAt(newOWMForecast(data), p.Arrival)
+		}(&points[i])
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// forecastAt picks the hourly forecast covering t, or failing that the
+// daily forecast for t's date.
+func forecastAt(forecast models.Forecast, t time.Time) (*models.ForecastHour, *models.ForecastDay) {
+	for i, hour := range forecast.Hourly {
+		if !t.Before(hour.Time) && t.Before(hour.Time.Add(time.Hour)) {
+			return &forecast.Hourly[i], nil
+		}
+	}
+	date := t.UTC().Format("2006-01-02")
+	for i, day := range forecast.Daily {
+		if day.Date == date {
+			return nil, &forecast.Daily[i]
+		}
+	}
+	return nil, nil
+}
+
+// path returns the route as a list of locations.
+func (req *routeRequest) path() ([]models.Location, error) {
+	var path []models.Location
+	switch {
+	case req.Polyline != "" && len(req.Waypoints) > 0:
+		return nil, errors.New("Give either waypoints or polyline, not both")
+	case req.Polyline != "":
+		var err error
+		if path, err = decodePolyline(req.Polyline); err != nil {
+			return nil, err
+		}
+	default:
+		for _, wp := range req.Waypoints {
+			loc, err := models.ParseLocation(fmt.Sprint(wp[0]), fmt.Sprint(wp[1]))
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, loc)
+		}
+	}
+	if len(path) < 2 {
+		return nil, errors.New("A route needs at least two points")
+	}
+	return path, nil
+}
+
+// sampleRoute returns points every intervalKm along path, always including
+// both ends, and the total length of the path.
+func sampleRoute(path []models.Location, intervalKm float64) ([]RoutePoint, float64) {
+	points := []RoutePoint{{Lat: path[0].Lat, Lon: path[0].Lon}}
+	travelled, next := 0.0, intervalKm
+	for i := 1; i < len(path); i++ {
+		from, to := path[i-1], path[i]
+		length := haversineKm(from, to)
+		for next <= travelled+length {
+			f := (next - travelled) / length
+			points = append(points, RoutePoint{
+				Lat:        from.Lat + f*(to.Lat-from.Lat),
+				Lon:        from.Lon + f*(to.Lon-from.Lon),
+				DistanceKm: next,
+			})
+			next += intervalKm
+			if len(points) > maxRouteSamples {
+				// the caller rejects the route; stop before we allocate
+				// a sample per metre
+				break
+			}
+		}
+		travelled += length
+	}
+	end := path[len(path)-1]
+	if last := points[len(points)-1]; travelled-last.DistanceKm > 0.001 {
+		points = append(points, RoutePoint{Lat: end.Lat, Lon: end.Lon, DistanceKm: travelled})
+	}
+	return points, travelled
+}
+
+// haversineKm is the great-circle distance between two locations.
+func haversineKm(a, b models.Location) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(b.Lat - a.Lat)
+	dLon := toRad(b.Lon - a.Lon)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(a.Lat))*math.Cos(toRad(b.Lat))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// decodePolyline decodes a route in Google's encoded polyline format, at
+// the standard precision of 5 decimal places.
+func decodePolyline(encoded string) ([]models.Location, error) {
+	var (
+		path     []models.Location
+		lat, lon int
+	)
+	for i := 0; i < len(encoded); {
+		var deltas [2]int
+		for j := range deltas {
+			var result, shift uint
+			for {
+				if i >= len(encoded) {
+					return nil, errors.New("Invalid polyline: truncated")
+				}
+				c := encoded[i]
+				i++
+				if c < 63 || c > 126 {
+					return nil, errors.New("Invalid polyline: bad character")
+				}
+				b := uint(c) - 63
+				result |= (b & 0x1f) << shift
+				shift += 5
+				if b < 0x20 {
+					break
+				}
+				if shift > 30 {
+					return nil, errors.New("Invalid polyline: value too large")
+				}
+			}
+			if result&1 != 0 {
+				deltas[j] = ^int(result >> 1)
+			} else {
+				deltas[j] = int(result >> 1)
+			}
+		}
+		lat += deltas[0]
+		lon += deltas[1]
+		loc, err := models.ParseLocation(fmt.Sprint(float64(lat)/1e5), fmt.Sprint(float64(lon)/1e5))
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, loc)
+	}
+	return path, nil
+}
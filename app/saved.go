@@ -0,0 +1,355 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// maxSavedLocations bounds how many locations one client can save.
+const maxSavedLocations = 50
+
+var errTooManyLocations = fmt.Errorf("At most %d locations can be saved", maxSavedLocations)
+
+// maxIdempotencyKey bounds the length of an Idempotency-Key header.
+const maxIdempotencyKey = 255
+
+var errIdempotencyKeyReused = errors.New("Idempotency-Key was already used to save a different location")
+
+// digestPeriods are the digest schedules a saved location can opt into.
+var digestPeriods = []string{"daily", "weekly"}
+
+// savedLocation is a location a client has saved, optionally with a digest
+// schedule.
+type savedLocation struct {
+	ID        string    `json:"id"`
+	ClientID  string    `json:"client_id"`
+	Name      string    `json:"name"`
+	Lat       float64   `json:"lat"`
+	Lon       float64   `json:"lon"`
+	Digest    string    `json:"digest,omitempty"` // "daily", "weekly" or ""
+	CreatedAt time.Time `json:"created_at"`
+	// IdempotencyKey is the key the location was created with, if any, so
+	// that a retried request returns it rather than saving it again.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// DeletedAt is set when the location is deleted. It's kept, and can be
+	// restored, until the store's retention has passed.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// sameRequest reports whether l was saved from the same request as other:
+// everything the client sent matches.
+func (l savedLocation) sameRequest(other savedLocation) bool {
+	return l.Name == other.Name && l.Lat == other.Lat && l.Lon == other.Lon && l.Digest == other.Digest
+}
+
+func (l savedLocation) location() models.Location {
+	return models.Location{Lat: l.Lat, Lon: l.Lon}
+}
+
+// locationStore holds clients' saved locations. When path is set they are
+// persisted as a JSON file; otherwise they only live in memory. Deleted
+// locations are kept for retention, in case the client wants them back.
+type locationStore struct {
+	path      string
+	retention time.Duration
+
+	mu      sync.Mutex
+	records map[string]*savedLocation
+}
+
+// openLocationStore loads the location store at path, creating it on first
+// save. An empty path gives an in-memory store.
+func openLocationStore(path string, retention time.Duration) (*locationStore, error) {
+	ls := &locationStore{path: path, retention: retention, records: make(map[string]*savedLocation)}
+	if path == "" {
+		return ls, nil
+	}
+	var records []*savedLocation
+	if err := loadJSONFile(path, &records); err != nil {
+		return nil, err
+	}
+	for _, rec := range records {
+		ls.records[rec.ID] = rec
+	}
+	return ls, nil
+}
+
+// save writes the store to disk. The caller must hold ls.mu.
+func (ls *locationStore) save() error {
+	if ls.path == "" {
+		return nil
+	}
+	return saveJSONFile(ls.path, ls.sorted())
+}
+
+// sorted returns the saved locations, oldest first. The caller must hold
+// ls.mu.
+func (ls *locationStore) sorted() []*savedLocation {
+	records := make([]*savedLocation, 0, len(ls.records))
+	for _, rec := range ls.records {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+	return records
+}
+
+// List returns a client's saved locations, oldest first.
+func (ls *locationStore) List(clientID string) []savedLocation {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	out := []savedLocation{}
+	for _, rec := range ls.sorted() {
+		if rec.ClientID == clientID && rec.DeletedAt == nil {
+			out = append(out, *rec)
+		}
+	}
+	return out
+}
+
+// Deleted returns a client's deleted locations that can still be restored,
+// oldest first.
+func (ls *locationStore) Deleted(clientID string) []savedLocation {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	out := []savedLocation{}
+	for _, rec := range ls.sorted() {
+		if rec.ClientID == clientID && rec.DeletedAt != nil && !ls.expired(rec.DeletedAt) {
+			out = append(out, *rec)
+		}
+	}
+	return out
+}
+
+// Home returns the client's home location: the one named "home", or failing
+// that the first one they saved.
+func (ls *locationStore) Home(clientID string) (savedLocation, bool) {
+	list := ls.List(clientID)
+	for _, saved := range list {
+		if strings.EqualFold(saved.Name, "home") {
+			return saved, true
+		}
+	}
+	if len(list) == 0 {
+		return savedLocation{}, false
+	}
+	return list[0], true
+}
+
+// All returns every client's saved locations, oldest first.
+func (ls *locationStore) All() []savedLocation {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	var out []savedLocation
+	for _, rec := range ls.sorted() {
+		if rec.DeletedAt == nil {
+			out = append(out, *rec)
+		}
+	}
+	return out
+}
+
+// Create saves a location for a client. If the client already saved one
+// with the same idempotency key, that one is returned instead, with created
+// false.
+func (ls *locationStore) Create(loc savedLocation) (saved savedLocation, created bool, err error) {
+	loc.ID = randomHex(8)
+	loc.CreatedAt = time.Now().UTC()
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	n := 0
+	for _, rec := range ls.records {
+		if rec.ClientID != loc.ClientID || rec.DeletedAt != nil {
+			continue
+		}
+		if loc.IdempotencyKey != "" && rec.IdempotencyKey == loc.IdempotencyKey {
+			if !rec.sameRequest(loc) {
+				return savedLocation{}, false, errIdempotencyKeyReused
+			}
+			return *rec, false, nil
+		}
+		n++
+	}
+	if n >= maxSavedLocations {
+		return savedLocation{}, false, errTooManyLocations
+	}
+	ls.records[loc.ID] = &loc
+	if err := ls.save(); err != nil {
+		delete(ls.records, loc.ID)
+		return savedLocation{}, false, err
+	}
+	return loc, true, nil
+}
+
+// Delete removes one of a client's saved locations, keeping it for
+// Restore until the retention has passed.
+func (ls *locationStore) Delete(clientID, id string) (savedLocation, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	rec, ok := ls.records[id]
+	if !ok || rec.ClientID != clientID || rec.DeletedAt != nil {
+		return savedLocation{}, ErrNotFound
+	}
+	now := time.Now().UTC()
+	rec.DeletedAt = &now
+	if err := ls.save(); err != nil {
+		rec.DeletedAt = nil
+		return savedLocation{}, err
+	}
+	return *rec, nil
+}
+
+// Restore brings back one of a client's deleted locations.
+func (ls *locationStore) Restore(clientID, id string) (savedLocation, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	rec, ok := ls.records[id]
+	if !ok || rec.ClientID != clientID || rec.DeletedAt == nil || ls.expired(rec.DeletedAt) {
+		return savedLocation{}, ErrNotFound
+	}
+	n := 0
+	for _, other := range ls.records {
+		if other.ClientID == clientID && other.DeletedAt == nil {
+			n++
+		}
+	}
+	if n >= maxSavedLocations {
+		return savedLocation{}, errTooManyLocations
+	}
+	deletedAt := rec.DeletedAt
+	rec.DeletedAt = nil
+	if err := ls.save(); err != nil {
+		rec.DeletedAt = deletedAt
+		return savedLocation{}, err
+	}
+	return *rec, nil
+}
+
+// expired reports whether a record deleted at deletedAt is past restoring.
+func (ls *locationStore) expired(deletedAt *time.Time) bool {
+	return time.Since(*deletedAt) > ls.retention
+}
+
+// Purge removes deleted locations for good once they're past the
+// retention.
+func (ls *locationStore) Purge() error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	purged := false
+	for id, rec := range ls.records {
+		if rec.DeletedAt != nil && ls.expired(rec.DeletedAt) {
+			delete(ls.records, id)
+			purged = true
+		}
+	}
+	if !purged {
+		return nil
+	}
+	return ls.save()
+}
+
+// locationsHandler serves the calling client's saved locations:
+//
+//	GET    /locations               list saved locations
+//	GET    /locations?deleted=1     list deleted locations that can be restored
+//	POST   /locations               save a location: {"name", "lat", "lon", "digest"}
+//	DELETE /locations/{id}          remove a saved location
+//	POST   /locations/{id}/restore  bring back a deleted location
+//
+// A POST with an Idempotency-Key header is only acted on once: retrying it
+// returns the location saved the first time, marked Idempotent-Replayed.
+func (s *server) locationsHandler(w http.ResponseWriter, r *http.Request) {
+	clientID := clientFromContext(r.Context()).ID
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/locations"), "/")
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case id == "" && r.Method == "GET":
+		if q := r.URL.Query().Get("deleted"); q == "1" || q == "true" {
+			json.NewEncoder(w).Encode(s.locations.Deleted(clientID))
+			return
+		}
+		json.NewEncoder(w).Encode(s.locations.List(clientID))
+
+	case id == "" && r.Method == "POST":
+		key := r.Header.Get("Idempotency-Key")
+		if len(key) > maxIdempotencyKey {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Idempotency-Key must be at most %d characters", maxIdempotencyKey)
+			return
+		}
+		var req struct {
+			Name   string   `json:"name"`
+			Lat    *float64 `json:"lat"`
+			Lon    *float64 `json:"lon"`
+			Digest string   `json:"digest"`
+		}
+		if !decodeBody(w, r, "POST /locations", 1<<16, &req) {
+			return
+		}
+		loc, err := models.ParseLocation(fmt.Sprint(*req.Lat), fmt.Sprint(*req.Lon))
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		saved, created, err := s.locations.Create(savedLocation{
+			ClientID:       clientID,
+			Name:           strings.TrimSpace(req.Name),
+			Lat:            loc.Lat,
+			Lon:            loc.Lon,
+			Digest:         req.Digest,
+			IdempotencyKey: key,
+		})
+		switch {
+		case err == errTooManyLocations:
+			w.WriteHeader(409)
+			w.Write([]byte(err.Error()))
+			return
+		case err == errIdempotencyKeyReused:
+			w.WriteHeader(422)
+			w.Write([]byte(err.Error()))
+			return
+		case err != nil:
+			s.storageError(w, err)
+			return
+		}
+		if !created {
+			w.Header().Set("Idempotent-Replayed", "true")
+		}
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(saved)
+
+	case id != "" && !strings.Contains(id, "/") && r.Method == "DELETE":
+		saved, err := s.locations.Delete(clientID, id)
+		if err != nil {
+			s.storageError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(saved)
+
+	case strings.HasSuffix(id, "/restore") && r.Method == "POST":
+		saved, err := s.locations.Restore(clientID, strings.TrimSuffix(id, "/restore"))
+		if err == errTooManyLocations {
+			w.WriteHeader(409)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			s.storageError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(saved)
+
+	default:
+		w.WriteHeader(404)
+	}
+}
@@ -0,0 +1,482 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+var (
+	schedulerPolls = newCounter("scheduler_polls_total",
+		"Scheduled location polls, by result.", "result")
+	schedulerMonitors = newGauge("scheduler_monitors",
+		"Locations the scheduler is polling.")
+)
+
+// schedulerPollTimeout bounds a single poll.
+const schedulerPollTimeout = time.Minute
+
+// schedulerStandby is how often a paused scheduler checks whether it may
+// resume.
+const schedulerStandby = 5 * time.Second
+
+// monitor is a location the scheduler polls. Several features may want the
+// same location polled; each names itself as a source with the interval it
+// needs, and the location is polled at the shortest of them.
+type monitor struct {
+	location models.Location
+	sources  map[string]time.Duration
+
+	next      time.Time
+	lastPoll  time.Time
+	lastError string
+	failures  int
+	running   bool
+}
+
+// interval is the shortest interval any source wants.
+func (m *monitor) interval() time.Duration {
+	var min time.Duration
+	for _, interval := range m.sources {
+		if min == 0 || interval < min {
+			min = interval
+		}
+	}
+	return min
+}
+
+// scheduler polls monitored locations, each at its own interval. Polls are
+// jittered so that locations added together don't stay in lockstep, and
+// failing locations back off exponentially up to maxBackoff.
+type scheduler struct {
+	poll        func(ctx context.Context, loc models.Location) error
+	jitter      float64 // fraction of the interval
+	maxBackoff  time.Duration
+	concurrency int
+	// active, if set, pauses polling while it returns false: only the
+	// leader polls
+	active func() bool
+	logger *log.Logger
+
+	mu       sync.Mutex
+	monitors map[string]*monitor // by location key
+	wake     chan struct{}
+
+	// path, when set, is where monitors are saved so they survive restarts
+	path   string
+	dirty  bool
+	saveMu sync.Mutex // serializes writes to path
+}
+
+// monitorRecord is how a monitor is saved.
+type monitorRecord struct {
+	Location  models.Location          `json:"location"`
+	Sources   map[string]time.Duration `json:"sources"`
+	Next      time.Time                `json:"next"`
+	LastPoll  time.Time                `json:"last_poll,omitempty"`
+	LastError string                   `json:"last_error,omitempty"`
+	Failures  int                      `json:"failures,omitempty"`
+}
+
+func newScheduler(poll func(context.Context, models.Location) error, jitter float64, maxBackoff time.Duration, concurrency int) *scheduler {
+	return &scheduler{
+		poll:        poll,
+		jitter:      jitter,
+		maxBackoff:  maxBackoff,
+		concurrency: concurrency,
+		monitors:    make(map[string]*monitor),
+		wake:        make(chan struct{}, 1),
+		logger:      log.Default(),
+	}
+}
+
+// Load restores the monitors saved at path, and saves them there from now
+// on. Monitors pick up where they left off: those that fell due while we
+// were down are polled soon, spread over the jitter window. Sources that no
+// longer want a location should Sync afterwards to drop it.
+func (sc *scheduler) Load(path string) error {
+	var records []monitorRecord
+	if err := loadJSONFile(path, &records); err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.path = path
+	now := time.Now()
+	for _, rec := range records {
+		if len(rec.Sources) == 0 {
+			continue
+		}
+		m := &monitor{
+			location:  rec.Location,
+			sources:   rec.Sources,
+			next:      rec.Next,
+			lastPoll:  rec.LastPoll,
+			lastError: rec.LastError,
+			failures:  rec.Failures,
+		}
+		if m.next.Before(now) {
+			m.next = now.Add(time.Duration(rand.Float64() * sc.jitter * float64(m.interval())))
+		}
+		sc.monitors[rec.Location.Key()] = m
+	}
+	schedulerMonitors.Set(float64(len(sc.monitors)))
+	return nil
+}
+
+// Save writes the monitors to disk if they've changed since the last save.
+func (sc *scheduler) Save() error {
+	sc.saveMu.Lock()
+	defer sc.saveMu.Unlock()
+
+	sc.mu.Lock()
+	if sc.path == "" || !sc.dirty {
+		sc.mu.Unlock()
+		return nil
+	}
+	records := make([]monitorRecord, 0, len(sc.monitors))
+	for _, m := range sc.monitors {
+		sources := make(map[string]time.Duration, len(m.sources))
+		for source, interval := range m.sources {
+			sources[source] = interval
+		}
+		records = append(records, monitorRecord{
+			Location:  m.location,
+			Sources:   sources,
+			Next:      m.next,
+			LastPoll:  m.lastPoll,
+			LastError: m.lastError,
+			Failures:  m.failures,
+		})
+	}
+	sc.dirty = false
+	sc.mu.Unlock()
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Location.Key() < records[j].Location.Key() })
+	if err := saveJSONFile(sc.path, records); err != nil {
+		sc.mu.Lock()
+		sc.dirty = true
+		sc.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// saveEvery periodically saves the monitors until ctx is done.
+func (sc *scheduler) saveEvery(ctx context.Context, interval time.Duration) {
+	for range ticks(ctx, interval) {
+		if err := sc.Save(); err != nil {
+			sc.logger.Printf("Failed to save monitors: %s", err)
+		}
+	}
+}
+
+// jittered spreads d by up to ±jitter.
+func (sc *scheduler) jittered(d time.Duration) time.Duration {
+	return d + time.Duration((rand.Float64()*2-1)*sc.jitter*float64(d))
+}
+
+// Sync sets the locations a source wants polled, and how often, replacing
+// those it wanted before.
+func (sc *scheduler) Sync(source string, locs map[models.Location]time.Duration) {
+	want := make(map[string]models.Location, len(locs))
+	for loc := range locs {
+		want[loc.Key()] = loc
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for key, m := range sc.monitors {
+		if _, ok := want[key]; !ok {
+			delete(m.sources, source)
+			if len(m.sources) == 0 {
+				delete(sc.monitors, key)
+			}
+		}
+	}
+	for key, loc := range want {
+		interval := locs[loc]
+		m, ok := sc.monitors[key]
+		if !ok {
+			// the first poll comes soon, but not all at once
+			m = &monitor{location: loc, sources: make(map[string]time.Duration)}
+			m.next = time.Now().Add(time.Duration(rand.Float64() * sc.jitter * float64(interval)))
+			sc.monitors[key] = m
+		}
+		m.sources[source] = interval
+	}
+	sc.dirty = true
+	schedulerMonitors.Set(float64(len(sc.monitors)))
+	sc.kick()
+}
+
+// Set adds a location for a source, or changes its interval, saving the
+// change straight away.
+func (sc *scheduler) Set(source string, loc models.Location, interval time.Duration) error {
+	sc.mu.Lock()
+	m, ok := sc.monitors[loc.Key()]
+	if !ok {
+		m = &monitor{location: loc, sources: make(map[string]time.Duration), next: time.Now()}
+		sc.monitors[loc.Key()] = m
+	}
+	m.sources[source] = interval
+	sc.dirty = true
+	schedulerMonitors.Set(float64(len(sc.monitors)))
+	sc.kick()
+	sc.mu.Unlock()
+	return sc.Save()
+}
+
+// Remove drops a source's interest in a location. It returns ErrNotFound if
+// the source wasn't monitoring it.
+func (sc *scheduler) Remove(source string, loc models.Location) error {
+	sc.mu.Lock()
+	m, ok := sc.monitors[loc.Key()]
+	if !ok {
+		sc.mu.Unlock()
+		return ErrNotFound
+	}
+	if _, ok := m.sources[source]; !ok {
+		sc.mu.Unlock()
+		return ErrNotFound
+	}
+	delete(m.sources, source)
+	if len(m.sources) == 0 {
+		delete(sc.monitors, loc.Key())
+	}
+	sc.dirty = true
+	schedulerMonitors.Set(float64(len(sc.monitors)))
+	sc.mu.Unlock()
+	return sc.Save()
+}
+
+// kick wakes the run loop to reconsider what's due. The caller must hold
+// sc.mu.
+func (sc *scheduler) kick() {
+	select {
+	case sc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run polls monitors as they fall due, until ctx is done. Polls in flight
+// are cancelled then.
+func (sc *scheduler) Run(ctx context.Context) {
+	sem := make(chan struct{}, sc.concurrency)
+	for ctx.Err() == nil {
+		if sc.active != nil && !sc.active() {
+			// monitors keep their schedules, so whatever falls due while
+			// we're paused is polled as soon as we resume
+			sleep(ctx, schedulerStandby)
+			continue
+		}
+		now := time.Now()
+		wait := time.Minute
+		var due []*monitor
+		sc.mu.Lock()
+		for _, m := range sc.monitors {
+			if m.running {
+				continue
+			}
+			if !m.next.After(now) {
+				m.running = true
+				due = append(due, m)
+			} else if d := m.next.Sub(now); d < wait {
+				wait = d
+			}
+		}
+		sc.mu.Unlock()
+
+		for _, m := range due {
+			sem <- struct{}{}
+			go func(m *monitor) {
+				defer func() { <-sem }()
+				ctx, cancel := context.WithTimeout(ctx, schedulerPollTimeout)
+				err := sc.poll(ctx, m.location)
+				cancel()
+				sc.finish(m, err)
+			}(m)
+		}
+		if len(due) > 0 {
+			continue
+		}
+		select {
+		case <-time.After(wait):
+		case <-sc.wake:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// finish records the result of a poll and schedules the next one.
+func (sc *scheduler) finish(m *monitor, err error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	m.running = false
+	m.lastPoll = time.Now()
+	delay := m.interval()
+	if err != nil {
+		schedulerPolls.Inc("error")
+		sc.logger.Printf("Failed to poll %s: %s", m.location.Key(), err)
+		m.lastError = err.Error()
+		m.failures++
+		for i := 0; i < m.failures && delay < sc.maxBackoff; i++ {
+			delay *= 2
+		}
+		if delay > sc.maxBackoff {
+			delay = sc.maxBackoff
+		}
+	} else {
+		schedulerPolls.Inc("ok")
+		m.lastError = ""
+		m.failures = 0
+	}
+	m.next = m.lastPoll.Add(sc.jittered(delay))
+	sc.dirty = true
+	sc.kick()
+}
+
+// MonitorStatus describes a monitored location.
+type MonitorStatus struct {
+	Location  string     `json:"location"`
+	Lat       float64    `json:"lat"`
+	Lon       float64    `json:"lon"`
+	Interval  string     `json:"interval"`
+	Sources   []string   `json:"sources"`
+	NextPoll  time.Time  `json:"next_poll"`
+	LastPoll  *time.Time `json:"last_poll,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	Failures  int        `json:"failures"`
+}
+
+// Status describes the monitored locations, soonest due first.
+func (sc *scheduler) Status() []MonitorStatus {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	out := make([]MonitorStatus, 0, len(sc.monitors))
+	for key, m := range sc.monitors {
+		status := MonitorStatus{
+			Location:  key,
+			Lat:       m.location.Lat,
+			Lon:       m.location.Lon,
+			Interval:  m.interval().String(),
+			NextPoll:  m.next.UTC(),
+			LastError: m.lastError,
+			Failures:  m.failures,
+		}
+		for source := range m.sources {
+			status.Sources = append(status.Sources, source)
+		}
+		sort.Strings(status.Sources)
+		if !m.lastPoll.IsZero() {
+			last := m.lastPoll.UTC()
+			status.LastPoll = &last
+		}
+		out = append(out, status)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].NextPoll.Before(out[j].NextPoll) })
+	return out
+}
+
+// parseMonitorList parses MONITOR_LOCATIONS: locations written as
+// "lat,lon" or "lat,lon@interval", separated by semicolons.
+func parseMonitorList(raw string, def time.Duration) (map[models.Location]time.Duration, error) {
+	out := make(map[models.Location]time.Duration)
+	for _, item := range strings.Split(raw, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		interval := def
+		if i := strings.Index(item, "@"); i >= 0 {
+			var err error
+			if interval, err = time.ParseDuration(item[i+1:]); err != nil || interval <= 0 {
+				return nil, fmt.Errorf("invalid interval in %q", item)
+			}
+			item = item[:i]
+		}
+		loc, err := models.ParseLocationPair(item)
+		if err != nil {
+			return nil, err
+		}
+		out[loc] = interval
+	}
+	return out, nil
+}
+
+// monitorsHandler serves the monitor management API:
+//
+//	GET    /admin/monitors            list monitored locations
+//	POST   /admin/monitors            monitor a location: {"lat", "lon", "interval"}
+//	DELETE /admin/monitors/{lat,lon}  stop monitoring a location
+//
+// Only locations added here can be deleted here; those monitored for
+// MONITOR_LOCATIONS or subscriptions are managed there.
+func (s *server) monitorsHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/monitors"), "/")
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case rest == "" && r.Method == "GET":
+		json.NewEncoder(w).Encode(s.scheduler.Status())
+
+	case rest == "" && r.Method == "POST":
+		var req struct {
+			Lat      float64 `json:"lat"`
+			Lon      float64 `json:"lon"`
+			Interval string  `json:"interval"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Invalid request body: %s", err)
+			return
+		}
+		loc, err := models.ParseLocation(strconv.FormatFloat(req.Lat, 'f', -1, 64), strconv.FormatFloat(req.Lon, 'f', -1, 64))
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		interval := 10 * time.Minute
+		if req.Interval != "" {
+			if interval, err = time.ParseDuration(req.Interval); err != nil || interval < time.Minute {
+				w.WriteHeader(400)
+				w.Write([]byte("interval must be a duration of at least 1m"))
+				return
+			}
+		}
+		if err := s.scheduler.Set("admin", loc, interval); err != nil {
+			s.storageError(w, err)
+			return
+		}
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(map[string]string{"location": loc.Key(), "interval": interval.String()})
+
+	case r.Method == "DELETE":
+		loc, err := models.ParseLocationPair(rest)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err := s.scheduler.Remove("admin", loc); err != nil {
+			s.storageError(w, err)
+			return
+		}
+		w.WriteHeader(204)
+
+	default:
+		w.WriteHeader(404)
+	}
+}
@@ -0,0 +1,311 @@
+package app
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Recorded schemas of provider responses, one file per snapshot below. They
+// are updated with `make schema-update` (see SchemaCommand).
+//
+//go:embed schemas
+var schemaFiles embed.FS
+
+var schemaDrift = newCounter("provider_schema_drift_total",
+	"Periodic schema checks that found a provider response had drifted from its recorded schema, by snapshot.", "snapshot")
+
+// schema maps the path of each field in a JSON document, such as
+// "current.weather[].description", to its type: object, array, string,
+// number or boolean. A type ending in "?" marks a field that is sometimes
+// left out, like alerts when there are none. Nulls tell us nothing about a
+// field's type, so they're not recorded.
+type schema map[string]string
+
+// schemaSnapshot is a provider response whose schema is recorded.
+type schemaSnapshot struct {
+	name string // also the file name, without .json
+	path string
+	// params, less our credentials and units
+	params url.Values
+}
+
+// schemaSnapshots are the openweathermap responses we decode. The onecall
+// snapshots include every block, so they cover both current weather and
+// forecasts; only the one for the One Call version in use is checked.
+var schemaSnapshots = []schemaSnapshot{
+	{"openweathermap_onecall", oneCallPath(oneCall25), url.Values{"lat": {"30.49"}, "lon": {"-99.77"}}},
+	{"openweathermap_onecall_3", oneCallPath(oneCall30), url.Values{"lat": {"30.49"}, "lon": {"-99.77"}}},
+	{"openweathermap_geocode", "/geo/1.0/direct", url.Values{"q": {"Austin, TX, US"}, "limit": {"5"}}},
+	{"openweathermap_air_pollution", "/data/2.5/air_pollution", url.Values{"lat": {"30.49"}, "lon": {"-99.77"}}},
+}
+
+// inferSchema records the schema of v, a decoded JSON document, under
+// prefix.
+func inferSchema(v interface{}, prefix string, into schema) {
+	var typ string
+	switch v := v.(type) {
+	case nil:
+		return
+	case map[string]interface{}:
+		typ = "object"
+		for name, field := range v {
+			path := name
+			if prefix != "" {
+				path = prefix + "." + name
+			}
+			inferSchema(field, path, into)
+		}
+	case []interface{}:
+		typ = "array"
+		for _, elem := range v {
+			inferSchema(elem, prefix+"[]", into)
+		}
+	case string:
+		typ = "string"
+	case float64, json.Number:
+		typ = "number"
+	case bool:
+		typ = "boolean"
+	}
+	if prefix == "" {
+		return
+	}
+	// elements of mixed types are recorded as the set of them
+	if seen, ok := into[prefix]; ok && seen != typ {
+		types := strings.Split(seen, "|")
+		for _, t := range types {
+			if t == typ {
+				return
+			}
+		}
+		types = append(types, typ)
+		sort.Strings(types)
+		typ = strings.Join(types, "|")
+	}
+	into[prefix] = typ
+}
+
+// optional reports whether a field with the recorded type may be left out,
+// and its type without the marker.
+func optional(typ string) (string, bool) {
+	if strings.HasSuffix(typ, "?") {
+		return strings.TrimSuffix(typ, "?"), true
+	}
+	return typ, false
+}
+
+// diffSchemas compares a response's schema with the recorded one. Problems
+// are fields that are missing, unless recorded as optional, or that changed
+// type; fields that are new to us are only noted.
+func diffSchemas(recorded, got schema) (problems, notes []string) {
+	for _, path := range sortedPaths(recorded) {
+		want, opt := optional(recorded[path])
+		typ, ok := got[path]
+		switch {
+		case !ok && !opt:
+			problems = append(problems, fmt.Sprintf("%s is missing", path))
+		case ok && typ != want:
+			problems = append(problems, fmt.Sprintf("%s is a %s, not a %s", path, typ, want))
+		}
+	}
+	for _, path := range sortedPaths(got) {
+		if _, ok := recorded[path]; !ok {
+			notes = append(notes, fmt.Sprintf("%s is new (%s)", path, got[path]))
+		}
+	}
+	return problems, notes
+}
+
+// updateSchema returns got as the new recorded schema, keeping the
+// optional fields of the old one, whether or not they turned up this time.
+func updateSchema(recorded, got schema) schema {
+	updated := make(schema, len(got))
+	for path, typ := range got {
+		updated[path] = typ
+	}
+	for path, typ := range recorded {
+		if _, opt := optional(typ); !opt {
+			continue
+		}
+		if typ, ok := updated[path]; ok {
+			updated[path] = typ + "?"
+		} else {
+			updated[path] = recorded[path]
+		}
+	}
+	return updated
+}
+
+func sortedPaths(s schema) []string {
+	paths := make([]string, 0, len(s))
+	for path := range s {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// parseSchema parses a recorded schema file.
+func parseSchema(b []byte) (schema, error) {
+	var s schema
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// recordedSchema returns the schema recorded for a snapshot, as built into
+// the binary.
+func recordedSchema(name string) (schema, error) {
+	b, err := schemaFiles.ReadFile("schemas/" + name + ".json")
+	if err != nil {
+		return nil, err
+	}
+	return parseSchema(b)
+}
+
+// checksSnapshot reports whether snap is one of ours to check: any but the
+// onecall snapshot of the One Call version we're not using.
+func (o *OWMService) checksSnapshot(snap schemaSnapshot) bool {
+	if !strings.HasSuffix(snap.path, "/onecall") {
+		return true
+	}
+	return snap.path == oneCallPath(o.oneCall.Get(o.probeOneCall30))
+}
+
+// fetchSchema fetches a snapshot's response from the provider and infers
+// its schema.
+func (o *OWMService) fetchSchema(snap schemaSnapshot) (schema, error) {
+	params := url.Values{}
+	for name, values := range snap.params {
+		params[name] = values
+	}
+	var doc interface{}
+	if err := o.get(o.endpoint(snap.path, params), &doc); err != nil {
+		return nil, err
+	}
+	s := make(schema)
+	inferSchema(doc, "", s)
+	return s, nil
+}
+
+// checkSchemasEvery compares live responses with the recorded schemas
+// every interval until ctx is done, logging any drift. Only the leader
+// checks, to spare our request quota.
+func (s *server) checkSchemasEvery(ctx context.Context, interval time.Duration) {
+	for range ticks(ctx, interval) {
+		if !s.leader.IsLeader() {
+			continue
+		}
+		for _, snap := range schemaSnapshots {
+			if !s.owm.checksSnapshot(snap) {
+				continue
+			}
+			recorded, err := recordedSchema(snap.name)
+			if err != nil {
+				s.logger.Printf("Failed to read recorded schema %s: %s", snap.name, err)
+				continue
+			}
+			got, err := s.owm.fetchSchema(snap)
+			if err != nil {
+				s.logger.Printf("Failed to check schema %s: %s", snap.name, err)
+				continue
+			}
+			if problems, _ := diffSchemas(recorded, got); len(problems) > 0 {
+				schemaDrift.Inc(snap.name)
+				s.logger.Printf("PROVIDER SCHEMA DRIFT: %s no longer matches its recorded schema: %s", snap.name, strings.Join(problems, "; "))
+			}
+		}
+	}
+}
+
+// SchemaCommand implements `banno-project schema [-update] [-dir DIR]`,
+// fetching a live response for each snapshot and comparing its schema with
+// the one recorded in DIR. It exits non-zero if any response has drifted;
+// with -update, it records the live schemas instead. API_KEY and OWM_URL
+// are read from the environment.
+func SchemaCommand(args []string) {
+	flags := flag.NewFlagSet("schema", flag.ExitOnError)
+	update := flags.Bool("update", false, "record the live schemas rather than checking against them")
+	dir := flags.String("dir", filepath.Join("app", "schemas"), "directory of recorded schemas")
+	flags.Parse(args)
+
+	appid := os.Getenv("API_KEY")
+	if appid == "" {
+		log.Fatal("API_KEY must be set to fetch provider responses")
+	}
+	o := &OWMService{
+		client:  &http.Client{Timeout: 30 * time.Second},
+		baseURL: os.Getenv("OWM_URL"),
+		appid:   appid,
+		logger:  log.Default(),
+	}
+	if o.baseURL == "" {
+		o.baseURL = "https://api.openweathermap.org"
+	}
+	oneCall, err := newOneCallVersion(strings.ToLower(os.Getenv("ONECALL_VERSION")), time.Hour)
+	if err != nil {
+		log.Fatalf("invalid ONECALL_VERSION: %s", err)
+	}
+	o.oneCall = oneCall
+
+	drifted := false
+	for _, snap := range schemaSnapshots {
+		if !o.checksSnapshot(snap) {
+			log.Printf("%s: skipped; not the One Call version in use", snap.name)
+			continue
+		}
+		file := filepath.Join(*dir, snap.name+".json")
+		recorded := schema{}
+		if b, err := ioutil.ReadFile(file); err == nil {
+			if recorded, err = parseSchema(b); err != nil {
+				log.Fatalf("%s: %s", file, err)
+			}
+		} else if !os.IsNotExist(err) || !*update {
+			log.Fatal(err)
+		}
+		got, err := o.fetchSchema(snap)
+		if err != nil {
+			log.Fatalf("%s: %s", snap.name, err)
+		}
+
+		problems, notes := diffSchemas(recorded, got)
+		if *update {
+			b, err := json.MarshalIndent(updateSchema(recorded, got), "", "  ")
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := ioutil.WriteFile(file, append(b, '\n'), 0644); err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("%s: recorded %d fields (%d missing or changed, %d new)", snap.name, len(got), len(problems), len(notes))
+			continue
+		}
+		for _, note := range notes {
+			log.Printf("%s: %s", snap.name, note)
+		}
+		for _, problem := range problems {
+			log.Printf("%s: SCHEMA DRIFT: %s", snap.name, problem)
+		}
+		if len(problems) > 0 {
+			drifted = true
+		} else {
+			log.Printf("%s: matches the recorded schema", snap.name)
+		}
+	}
+	if drifted {
+		log.Fatal("Provider responses have drifted from their recorded schemas; update the decoders, then run `make schema-update`")
+	}
+}
@@ -0,0 +1,116 @@
+package app
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+var temperatureType = reflect.TypeOf(models.Temperature{})
+
+// decodedSchema returns the schema of the fields a decoder of type t reads.
+func decodedSchema(t reflect.Type, prefix string, into schema) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var typ string
+	switch {
+	case t == temperatureType:
+		typ = "number"
+	case t.Kind() == reflect.Struct:
+		typ = "object"
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			path := name
+			if prefix != "" {
+				path = prefix + "." + name
+			}
+			decodedSchema(t.Field(i).Type, path, into)
+		}
+	case t.Kind() == reflect.Slice:
+		typ = "array"
+		decodedSchema(t.Elem(), prefix+"[]", into)
+	case t.Kind() == reflect.String:
+		typ = "string"
+	case t.Kind() == reflect.Bool:
+		typ = "boolean"
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Float64:
+		typ = "number"
+	}
+	if prefix != "" {
+		into[prefix] = typ
+	}
+}
+
+// TestDecodersMatchRecordedSchemas checks that every field our decoders
+// read is in the recorded provider schemas, with the type we decode it as.
+// When a provider changes and `make schema-update` records it, this is what
+// fails until the decoders catch up.
+func TestDecodersMatchRecordedSchemas(t *testing.T) {
+	for _, test := range []struct {
+		snapshot string
+		decoder  interface{}
+	}{
+		{"openweathermap_onecall", OWMApiResponse{}},
+		{"openweathermap_onecall_3", OWMApiResponse{}},
+		{"openweathermap_onecall_3", OWMForecastResponse{}},
+		{"openweathermap_geocode", []OWMGeocodeResult{}},
+		{"openweathermap_air_pollution", OWMAirQuality{}},
+	} {
+		recorded, err := recordedSchema(test.snapshot)
+		if err != nil {
+			t.Fatalf("%s: %s", test.snapshot, err)
+		}
+		decoded := make(schema)
+		decodedSchema(reflect.TypeOf(test.decoder), "", decoded)
+		for _, path := range sortedPaths(decoded) {
+			typ, ok := recorded[path]
+			if !ok {
+				t.Errorf("%T reads %s, which isn't in the %s schema", test.decoder, path, test.snapshot)
+				continue
+			}
+			if typ, _ = optional(typ); typ != decoded[path] {
+				t.Errorf("%T reads %s as a %s, but the %s schema has a %s", test.decoder, path, decoded[path], test.snapshot, typ)
+			}
+		}
+	}
+}
+
+func TestSchemaDrift(t *testing.T) {
+	recorded, err := parseSchema([]byte(`{"current":"object","current.temp":"number","current.rain":"object?","alerts":"array?"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name     string
+		response string
+		problems []string
+		notes    []string
+	}{
+		{"same", `{"current":{"temp":70,"rain":{"1h":1}},"alerts":[]}`, nil, []string{"current.rain.1h is new (number)"}},
+		{"optional fields left out", `{"current":{"temp":70}}`, nil, nil},
+		{"null", `{"current":{"temp":null}}`, []string{"current.temp is missing"}, nil},
+		{"renamed", `{"current":{"temperature":70}}`, []string{"current.temp is missing"}, []string{"current.temperature is new (number)"}},
+		{"retyped", `{"current":{"temp":"70"}}`, []string{"current.temp is a string, not a number"}, nil},
+	} {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(test.response), &doc); err != nil {
+			t.Fatal(err)
+		}
+		got := make(schema)
+		inferSchema(doc, "", got)
+		problems, notes := diffSchemas(recorded, got)
+		if !reflect.DeepEqual(problems, test.problems) {
+			t.Errorf("%s: problems %q, want %q", test.name, problems, test.problems)
+		}
+		if !reflect.DeepEqual(notes, test.notes) {
+			t.Errorf("%s: notes %q, want %q", test.name, notes, test.notes)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+)
+
+// checkProvider verifies at startup that the provider is usable, turning
+// the likely causes of failure into advice on how to fix them.
+func checkProvider(o *OWMService) error {
+	err := o.Check()
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrProviderAuth):
+		return fmt.Errorf("openweathermap rejected API_KEY (%s); check that the key is correct and activated (new keys can take a few hours to start working)", err)
+	case errors.Is(err, ErrRateLimited):
+		// the key works, we're just busy; not worth refusing to start over
+		return nil
+	case errors.Is(err, ErrUpstreamUnavailable):
+		return fmt.Errorf("could not reach openweathermap (%s); check network access, DNS and any HTTP(S)_PROXY settings", err)
+	default:
+		return fmt.Errorf("openweathermap self-check failed: %s", err)
+	}
+}
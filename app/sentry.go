@@ -0,0 +1,318 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errorReports = newCounter("error_reports_total",
+	"Events sent to the error reporting service, by kind and result.", "kind", "result")
+
+// sentryQueueSize bounds the events waiting to be sent; more are dropped
+// rather than let a reporting outage back up into request handling.
+const sentryQueueSize = 100
+
+// sentryReporter sends events to Sentry, or anything that speaks its store
+// API, for handler panics and for upstream failures that keep happening. A
+// nil reporter reports nothing.
+type sentryReporter struct {
+	endpoint    string // the project's store URL
+	auth        string // X-Sentry-Auth header
+	client      *http.Client
+	environment string
+	serverName  string
+	logger      *log.Logger
+	redactor    *redactor
+
+	// an upstream failure is reported once failureThreshold of its class
+	// have happened within failureWindow, and then not again that window
+	failureThreshold int
+	failureWindow    time.Duration
+
+	mu       sync.Mutex
+	failures map[string]*failureRun // by provider and class
+	queue    chan sentryEvent
+}
+
+// failureRun counts the upstream failures of one kind.
+type failureRun struct {
+	count    int
+	since    time.Time
+	reported time.Time
+}
+
+// sentryEvent is the subset of Sentry's event payload that we send.
+type sentryEvent struct {
+	EventID     string                 `json:"event_id"`
+	Timestamp   string                 `json:"timestamp"`
+	Level       string                 `json:"level"`
+	Platform    string                 `json:"platform"`
+	Logger      string                 `json:"logger"`
+	ServerName  string                 `json:"server_name,omitempty"`
+	Environment string                 `json:"environment,omitempty"`
+	Message     string                 `json:"message,omitempty"`
+	Exception   *sentryExceptions      `json:"exception,omitempty"`
+	Request     *sentryRequest         `json:"request,omitempty"`
+	Tags        map[string]string      `json:"tags,omitempty"`
+	Extra       map[string]interface{} `json:"extra,omitempty"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryException struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Stacktrace *sentryStacktrace `json:"stacktrace,omitempty"`
+}
+
+type sentryStacktrace struct {
+	Frames []sentryFrame `json:"frames"` // oldest call first
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+// sentryRequest describes the request being handled. Only harmless headers
+// are sent: never Authorization or cookies.
+type sentryRequest struct {
+	URL         string            `json:"url"`
+	Method      string            `json:"method"`
+	QueryString string            `json:"query_string,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+}
+
+// newSentryReporter parses a DSN, "https://KEY@HOST/PROJECT", where HOST may
+// include a path prefix.
+func newSentryReporter(dsn string) (*sentryReporter, error) {
+	// errors mustn't quote the DSN, since it holds our key
+	u, err := url.Parse(dsn)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" || u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("want https://KEY@HOST/PROJECT")
+	}
+	i := strings.LastIndex(u.Path, "/")
+	project := u.Path[i+1:]
+	if project == "" {
+		return nil, fmt.Errorf("missing project ID")
+	}
+	serverName, _ := os.Hostname()
+	return &sentryReporter{
+		endpoint:         fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, u.Path[:i], project),
+		auth:             fmt.Sprintf("Sentry sentry_version=7, sentry_client=banno-project/1.0, sentry_key=%s", u.User.Username()),
+		client:           &http.Client{Timeout: 10 * time.Second},
+		serverName:       serverName,
+		logger:           log.Default(),
+		failureThreshold: 5,
+		failureWindow:    5 * time.Minute,
+		failures:         make(map[string]*failureRun),
+		queue:            make(chan sentryEvent, sentryQueueSize),
+	}, nil
+}
+
+// Middleware reports panics in h, then lets them carry on up to the
+// server, which logs them and drops the connection as usual.
+func (sr *sentryReporter) Middleware(h http.Handler) http.Handler {
+	if sr == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v != http.ErrAbortHandler {
+					sr.reportPanic(r, v)
+				}
+				panic(v)
+			}
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (sr *sentryReporter) reportPanic(r *http.Request, v interface{}) {
+	e := sr.newEvent("fatal", r)
+	e.Exception = &sentryExceptions{Values: []sentryException{{
+		Type:  "panic",
+		Value: sr.redactor.String(fmt.Sprint(v)),
+		// skip this, the deferred function and runtime.gopanic
+		Stacktrace: &sentryStacktrace{Frames: stackFrames(3)},
+	}}}
+	e.Message = e.Exception.Values[0].Value
+	sr.send("panic", e)
+}
+
+// UpstreamFailed counts a failed upstream call made for r, reporting it if
+// the failure has become a pattern. Failures that are the client's fault,
+// or our own load shedding, don't count.
+func (sr *sentryReporter) UpstreamFailed(r *http.Request, err error) {
+	if sr == nil || errors.Is(err, ErrBadRequest) || errors.Is(err, ErrNotFound) || errors.Is(err, ErrSaturated) {
+		return
+	}
+	provider := owmProvider
+	var upstream *UpstreamError
+	if errors.As(err, &upstream) && upstream.Provider != "" {
+		provider = upstream.Provider
+	}
+	class := errorClass(err)
+
+	now := time.Now()
+	sr.mu.Lock()
+	run := sr.failures[provider+" "+class]
+	if run == nil {
+		run = &failureRun{}
+		sr.failures[provider+" "+class] = run
+	}
+	if now.Sub(run.since) > sr.failureWindow {
+		run.count, run.since = 0, now
+	}
+	run.count++
+	count := run.count
+	report := count >= sr.failureThreshold && now.Sub(run.reported) > sr.failureWindow
+	if report {
+		run.reported = now
+	}
+	sr.mu.Unlock()
+	if !report {
+		return
+	}
+
+	e := sr.newEvent("error", r)
+	e.Message = sr.redactor.String(fmt.Sprintf("Repeated %s failures from %s: %s", class, provider, err))
+	e.Tags["provider"] = provider
+	e.Tags["error_class"] = class
+	e.Extra = map[string]interface{}{"failures": count, "window": sr.failureWindow.String()}
+	if upstream != nil && upstream.StatusCode != 0 {
+		e.Extra["status_code"] = upstream.StatusCode
+	}
+	sr.send("upstream", e)
+}
+
+// newEvent starts an event about the handling of r.
+func (sr *sentryReporter) newEvent(level string, r *http.Request) sentryEvent {
+	e := sentryEvent{
+		EventID:     randomHex(16),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Level:       level,
+		Platform:    "go",
+		Logger:      "banno-project",
+		ServerName:  sr.serverName,
+		Environment: sr.environment,
+		Tags:        map[string]string{},
+	}
+	if r == nil {
+		return e
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	e.Request = &sentryRequest{
+		URL:     scheme + "://" + r.Host + r.URL.Path,
+		Method:  r.Method,
+		Headers: map[string]string{},
+	}
+	if uri := redactedURI(r); strings.Contains(uri, "?") {
+		e.Request.QueryString = sr.redactor.String(uri[strings.Index(uri, "?")+1:])
+	}
+	for _, name := range []string{"User-Agent", "Referer", "Accept"} {
+		if v := r.Header.Get(name); v != "" {
+			e.Request.Headers[name] = v
+		}
+	}
+	if ip := clientIPFromContext(r.Context()); ip != nil {
+		e.Request.Env = map[string]string{"REMOTE_ADDR": ip.String()}
+	}
+	if client := clientFromContext(r.Context()); client != nil && client.ID != "" {
+		e.Tags["client_id"] = client.ID
+	}
+	return e
+}
+
+// send queues an event, dropping it if the queue is full.
+func (sr *sentryReporter) send(kind string, e sentryEvent) {
+	select {
+	case sr.queue <- e:
+	default:
+		errorReports.Inc(kind, "dropped")
+		return
+	}
+	errorReports.Inc(kind, "queued")
+}
+
+// Run sends queued events until ctx is done.
+func (sr *sentryReporter) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-sr.queue:
+			if err := sr.post(ctx, e); err != nil {
+				errorReports.Inc("all", "error")
+				sr.logger.Printf("Failed to send error report: %s", err)
+			}
+		}
+	}
+}
+
+func (sr *sentryReporter) post(ctx context.Context, e sentryEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", sr.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", sr.auth)
+	resp, err := sr.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("error reporting service returned %s", resp.Status)
+	}
+	return nil
+}
+
+// stackFrames returns the stack, oldest call first, without the innermost
+// skip frames above its own.
+func stackFrames(skip int) []sentryFrame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(skip+2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var out []sentryFrame
+	for {
+		f, more := frames.Next()
+		out = append(out, sentryFrame{
+			Function: f.Function,
+			Filename: f.File,
+			Lineno:   f.Line,
+			InApp:    strings.HasPrefix(f.Function, "github.com/cstrahan/banno-project/"),
+		})
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
@@ -0,0 +1,370 @@
+package app
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+type server struct {
+	owm        *OWMService
+	nws        *NWSService       // optional
+	openMeteo  *OpenMeteoService // optional
+	lightning  *LightningService // optional
+	nhc        *NHCService
+	usgs       *USGSService
+	history    *historyStore
+	locations  *locationStore
+	notifiers  []notifier
+	deliveries *deliveryQueue
+	audit      *auditLog
+	cap        *capStore
+	capClient  *http.Client
+	// feeds are polled far more often than they change
+	capValidators *validatorCache // optional
+	cache         *weatherCache
+	responses     *responseCache  // optional
+	providers     map[string]bool // that clients may choose; nil if they can't
+	prefetch      *prefetcher     // optional
+	popular       *popularity     // optional
+	compat        string          // the default response compatibility mode
+	deltas        *deltaSnapshots
+	shape         responseShape // the default shape of JSON responses
+	flights       flightGroup
+	clients       *clientRegistry
+	ready         *readiness
+	authRejected  chan struct{} // wakes recheckProviderAuth
+	geoIP         *geoIPDB      // optional
+	logger        *log.Logger
+	redactor      *redactor       // for errors we store; logs are redacted already
+	sentry        *sentryReporter // optional
+	offline       bool
+	adminToken    string
+
+	keyRotationGrace time.Duration
+	tokenKey         []byte
+	tokenTTL         time.Duration
+	slackSecret      []byte
+	capIngestToken   string
+	discordKey       ed25519.PublicKey // optional
+	subscriptions    *subscriptionStore
+	telegram         *telegramBot // optional
+	scheduler        *scheduler
+	leader           *leadership // optional
+	frostProfiles    map[string]models.Temperature
+	fireThresholds   fireThresholds
+	outdoorWeights   map[string]float64
+
+	lightningAlertRadius float64 // km
+	alertCheckInterval   time.Duration
+	pollTimeout          time.Duration // the longest a long poll is held open
+	maxAgeFloor          time.Duration // the freshest data a client may demand
+}
+
+// fetchWeather retrieves current weather for a location, recording what was
+// observed in the history store. Responses are served from cache when they
+// are fresh enough for the calling client's tier, and concurrent misses for
+// the same location share one upstream fetch.
+func (s *server) fetchWeather(ctx context.Context, lat, lon string) (*models.CurrentConditions, error) {
+	if provider := providerFromContext(ctx); provider != "" && provider != owmProvider {
+		return s.fetchWeatherFrom(ctx, provider, lat, lon)
+	}
+	loc, err := models.ParseLocation(lat, lon)
+	if err != nil {
+		// let the provider produce its own error for bad coordinates
+		recordCacheResult(ctx, cacheMiss, 0)
+		defer timePhase(ctx, phaseUpstream)()
+		return s.fetchUpstream(lat, lon)
+	}
+
+	s.popular.Record(loc)
+
+	maxAge := s.maxAge(ctx)
+	staleAge := maxAge
+	if s.offline {
+		// stale data beats no data when we can't refresh it
+		staleAge = math.MaxInt64
+	}
+	stop := timePhase(ctx, phaseCache)
+	data, age, result := s.cache.Get(loc.Key(), maxAge, staleAge)
+	stop()
+	recordCacheResult(ctx, result, age)
+	if result == cacheHit && !s.offline && s.prefetch.Due(age, maxAge) {
+		s.prefetch.Start(loc.Key(), func() error {
+			_, err := s.refreshWeather(loc)
+			return err
+		})
+	}
+	if result != cacheMiss {
+		return data, nil
+	}
+	defer timePhase(ctx, phaseUpstream)()
+	return s.refreshWeather(loc)
+}
+
+// maxAge is how old cached conditions may be for the client making the
+// request ctx belongs to, or for the request itself if it asked for
+// fresher with ?max_age=.
+func (s *server) maxAge(ctx context.Context) time.Duration {
+	maxAge := s.clients.anonymous.Tier.MaxAge
+	if client := clientFromContext(ctx); client != nil {
+		maxAge = client.Tier.MaxAge
+	}
+	if s.responses != nil && s.responses.TTL(cacheCurrent) < maxAge {
+		maxAge = s.responses.TTL(cacheCurrent)
+	}
+	if requested, ok := requestedMaxAge(ctx); ok && requested < maxAge {
+		maxAge = requested
+	}
+	return maxAge
+}
+
+// refreshWeather fetches current weather for a location regardless of what's
+// cached, caching it and recording it in the history store. Concurrent
+// refreshes of the same location share one upstream fetch.
+func (s *server) refreshWeather(loc models.Location) (*models.CurrentConditions, error) {
+	key := loc.Key()
+	v, err := s.flights.Do(key, func() (interface{}, error) {
+		lat, lon := loc.Strings()
+		data, err := s.fetchUpstream(lat, lon)
+		if err != nil {
+			return nil, err
+		}
+		s.cache.Put(key, data)
+		s.history.Record(loc, data)
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*models.CurrentConditions), nil
+}
+
+// fetchUpstream calls the provider, keeping error metrics and readiness up
+// to date.
+func (s *server) fetchUpstream(lat, lon string) (*models.CurrentConditions, error) {
+	data, err := s.owm.GetWeather(lat, lon)
+	if err != nil {
+		s.upstreamFailed(err)
+		return nil, err
+	}
+	return newOWMConditions(data), nil
+}
+
+// upstreamFailed records a failed provider call.
+func (s *server) upstreamFailed(err error) {
+	upstreamErrors.Inc(errorClass(err))
+	if errors.Is(err, ErrProviderAuth) && s.ready.SetNotReady("provider", err.Error()) {
+		s.logger.Println("Provider rejected our API key; marking service not ready")
+		s.providerRejected()
+	}
+}
+
+// providerRejected wakes recheckProviderAuth, if it isn't already awake.
+func (s *server) providerRejected() {
+	select {
+	case s.authRejected <- struct{}{}:
+	default:
+	}
+}
+
+func (s *server) weatherHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lat, lon, resolved := s.requestLocation(r, q)
+	compat, err := s.responseCompat(r, q)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("Invalid compat: " + err.Error()))
+		return
+	}
+
+	fields := parseFields(q.Get("fields"))
+	if fields != nil {
+		// validate up front so a typo doesn't cost an upstream call
+		if _, err := selectFields(&Weather{}, fields); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	protobuf := wantsProtobuf(w, r, q)
+	if protobuf && fields != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("fields can't be selected in protobuf responses"))
+		return
+	}
+	if q.Get("since") != "" && (protobuf || wantsGeoJSON(w, r, q) || wantsHAL(w, r, q)) {
+		w.WriteHeader(400)
+		w.Write([]byte("since is only supported for JSON responses"))
+		return
+	}
+
+	data, err := s.fetchWeather(r.Context(), lat, lon)
+	if err != nil {
+		s.upstreamError(w, r, err)
+		return
+	}
+
+	weather := newWeather(data)
+	weather.Location = resolved
+	weather.Meta = newMeta(r.Context(), data)
+	if compat == compatLegacy {
+		weather.legacy()
+	}
+	if protobuf {
+		writeProtobuf(r.Context(), w, &weather)
+		return
+	}
+	var body interface{} = &weather
+	if fields != nil {
+		body, _ = selectFields(&weather, fields)
+	}
+	if wantsGeoJSON(w, r, q) {
+		feature, err := locationFeature(lat, lon, body)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		writeGeoJSON(w, &feature)
+		return
+	}
+	if wantsHAL(w, r, q) {
+		body, err = halResource(body, locationLinks(lat, lon))
+		if err != nil {
+			w.WriteHeader(500)
+			s.logger.Printf("Failed to build HAL response: %s", err)
+			return
+		}
+		w.Header().Set("Content-Type", halContentType)
+	} else if s.writeDelta(w, r, strings.Join([]string{lat, lon, q.Get("fields"), compat}, "|"), data.Time, body) {
+		return
+	}
+	writeJSON(w, body)
+}
+
+// recheckProviderAuth rechecks our credentials every interval whenever the
+// provider has rejected them, until it accepts them again and the service
+// is marked ready. No traffic is routed to us while we're not ready, so
+// without this we'd never notice a fixed key. It stops when ctx is done.
+func (s *server) recheckProviderAuth(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-s.authRejected:
+		case <-ctx.Done():
+			return
+		}
+		if !s.recheckProvider(ctx, interval) {
+			// still rejected; leave it to whoever runs the jobs next
+			s.providerRejected()
+			return
+		}
+	}
+}
+
+// recheckProvider polls the provider until it accepts our credentials again,
+// then marks the service ready. It returns false if ctx is done first.
+func (s *server) recheckProvider(ctx context.Context, interval time.Duration) bool {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+		// anything short of success, a timeout or an outage included,
+		// leaves us none the wiser about the key
+		if err := s.owm.Check(); err == nil {
+			s.logger.Println("Provider accepted our API key; marking service ready")
+			s.ready.SetReady("provider")
+			return true
+		}
+	}
+}
+
+// newWeather summarizes the current conditions.
+func newWeather(data *models.CurrentConditions) Weather {
+	alerts := make([]string, 0, len(data.Alerts))
+	for _, alert := range data.Alerts {
+		alerts = append(alerts, alert.Event)
+	}
+
+	weather := Weather{
+		Alerts:     alerts,
+		Conditions: data.Conditions,
+	}
+	// no label is better than calling a missing temperature cold
+	if data.FeelsLike != nil {
+		weather.Temperature = classifyTemperature(*data.FeelsLike)
+	}
+	return weather
+}
+
+func newPointWeather(loc models.Location, data *models.CurrentConditions) PointWeather {
+	weather := newWeather(data)
+	return PointWeather{
+		Lat:         loc.Lat,
+		Lon:         loc.Lon,
+		Temperature: data.Temp,
+		FeelsLike:   data.FeelsLike,
+		Label:       weather.Temperature,
+		Conditions:  weather.Conditions,
+		Alerts:      weather.Alerts,
+	}
+}
+
+// formatDegrees formats a temperature in °F, or "unknown" if we don't have
+// one.
+func formatDegrees(t *models.Temperature) string {
+	if t == nil {
+		return "unknown"
+	}
+	return t.In(models.Fahrenheit).String()
+}
+
+// Temperatures at which the label changes: below coldBelow is cold, below
+// hotFrom moderate, and from there on hot.
+var (
+	coldBelow = models.DegreesF(65)
+	hotFrom   = models.DegreesF(80)
+)
+
+// classifyTemperature buckets a temperature into a label.
+func classifyTemperature(t models.Temperature) string {
+	if t.Less(coldBelow) {
+		return "cold"
+	} else if t.Less(hotFrom) {
+		return "moderate"
+	}
+	return "hot"
+}
+
+type Weather struct {
+	Alerts      []string          `json:"alerts"`
+	Conditions  []string          `json:"conditions"`
+	Temperature string            `json:"temperature,omitempty"` // absent if feels_like is unknown
+	Location    *ResolvedLocation `json:"location,omitempty"`
+	Meta        *Meta             `json:"meta,omitempty"`
+}
+
+// PointWeather is the current weather at a point, with the numbers behind
+// the temperature label. Temperatures the provider left out are null, and
+// without a feels like temperature there's no label.
+type PointWeather struct {
+	Lat         float64             `json:"lat"`
+	Lon         float64             `json:"lon"`
+	Temperature *models.Temperature `json:"temperature"`
+	FeelsLike   *models.Temperature `json:"feels_like"`
+	Label       string              `json:"label,omitempty"`
+	Conditions  []string            `json:"conditions"`
+	Alerts      []string            `json:"alerts"`
+}
@@ -0,0 +1,213 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Field naming conventions for JSON responses.
+const (
+	namingSnake = "snake_case" // as the handlers write them
+	namingCamel = "camelCase"
+)
+
+// responseShape is how a client wants JSON responses shaped, so that it
+// doesn't need an adapter: field names in its naming convention and,
+// optionally, the body wrapped in an envelope, {"data": ...} for successes
+// and {"error": ...} for failures. With CBOR the result is encoded in CBOR
+// rather than JSON.
+type responseShape struct {
+	Naming   string
+	Envelope bool
+	CBOR     bool
+}
+
+// plain reports whether the shape leaves responses as they are.
+func (rs responseShape) plain() bool {
+	return rs.Naming == namingSnake && !rs.Envelope && !rs.CBOR
+}
+
+func parseNaming(naming string) (string, error) {
+	switch naming {
+	case "", "snake", namingSnake:
+		return namingSnake, nil
+	case "camel", namingCamel:
+		return namingCamel, nil
+	}
+	return "", fmt.Errorf("%q (want %s or %s)", naming, namingSnake, namingCamel)
+}
+
+// keyShape is a managed key's response shape. Unset fields take the
+// server's defaults, RESPONSE_NAMING and RESPONSE_ENVELOPE.
+type keyShape struct {
+	Naming   string `json:"naming,omitempty"`
+	Envelope *bool  `json:"envelope,omitempty"`
+}
+
+// requestShape returns the response shape for a client's request.
+func (s *server) requestShape(r *http.Request, client *apiClient) responseShape {
+	shape := s.shape
+	shape.CBOR = accepts(r, cborContentType)
+	if client.Shape.Naming != "" {
+		shape.Naming = client.Shape.Naming
+	}
+	if client.Shape.Envelope != nil {
+		shape.Envelope = *client.Shape.Envelope
+	}
+	return shape
+}
+
+// camelCase converts a snake_case name. Leading underscores, as in HAL's
+// _links, are kept.
+func camelCase(name string) string {
+	if !strings.Contains(strings.TrimLeft(name, "_"), "_") {
+		return name
+	}
+	var b strings.Builder
+	upper := false
+	for i, c := range name {
+		switch {
+		case c == '_' && i > 0 && name[i-1] != '_' || c == '_' && upper:
+			upper = true
+		case c == '_':
+			b.WriteRune(c)
+		case upper && 'a' <= c && c <= 'z':
+			b.WriteRune(c - 'a' + 'A')
+			upper = false
+		default:
+			b.WriteRune(c)
+			upper = false
+		}
+	}
+	return b.String()
+}
+
+// renameFields applies a naming convention to the field names in a decoded
+// JSON document.
+func renameFields(v interface{}, rename func(string) string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for name, field := range v {
+			out[rename(name)] = renameFields(field, rename)
+		}
+		return out
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = renameFields(elem, rename)
+		}
+	}
+	return v
+}
+
+// reshape rewrites a JSON response body in the shape.
+func (rs responseShape) reshape(body []byte, status int) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if rs.Naming == namingCamel {
+		doc = renameFields(doc, camelCase)
+	}
+	if rs.Envelope {
+		key := "data"
+		if status >= 400 {
+			key = "error"
+		}
+		doc = map[string]interface{}{key: doc}
+	}
+	if rs.CBOR {
+		return encodeCBOR(nil, doc)
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// shapingWriter holds back a JSON response so that it can be reshaped once
+// the handler is done. Other responses, and streamed ones, pass straight
+// through.
+type shapingWriter struct {
+	http.ResponseWriter
+	ctx   context.Context
+	shape responseShape
+
+	status      int
+	buf         bytes.Buffer
+	wroteHeader bool
+	passthrough bool
+}
+
+// isJSON reports whether a Content-Type is plain JSON. Formats with their
+// own fixed structure, like HAL and GeoJSON, aren't reshaped.
+func isJSON(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mt == "application/json"
+}
+
+func (sw *shapingWriter) WriteHeader(status int) {
+	if sw.wroteHeader {
+		return
+	}
+	sw.wroteHeader = true
+	sw.status = status
+	if !isJSON(sw.Header().Get("Content-Type")) {
+		sw.passthrough = true
+		sw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (sw *shapingWriter) Write(b []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(200)
+	}
+	if sw.passthrough {
+		return sw.ResponseWriter.Write(b)
+	}
+	return sw.buf.Write(b)
+}
+
+// Flush gives up on reshaping: a handler that flushes is streaming.
+func (sw *shapingWriter) Flush() {
+	if !sw.passthrough {
+		if !sw.wroteHeader {
+			sw.WriteHeader(200)
+		}
+		sw.passthrough = true
+		sw.ResponseWriter.WriteHeader(sw.status)
+		sw.ResponseWriter.Write(sw.buf.Bytes())
+		sw.buf.Reset()
+	}
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish writes the held back response, reshaped.
+func (sw *shapingWriter) finish() {
+	if sw.passthrough || !sw.wroteHeader {
+		return
+	}
+	stop := timePhase(sw.ctx, phaseEncode)
+	body, err := sw.shape.reshape(sw.buf.Bytes(), sw.status)
+	stop()
+	if err != nil {
+		// not JSON after all; send it as it came
+		body = sw.buf.Bytes()
+	} else if sw.shape.CBOR {
+		sw.Header().Set("Content-Type", cborContentType)
+	}
+	sw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	sw.ResponseWriter.WriteHeader(sw.status)
+	sw.ResponseWriter.Write(body)
+}
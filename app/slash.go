@@ -0,0 +1,316 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// slashMaxSkew is how old a signed chat request may be before we treat it
+// as a replay.
+const slashMaxSkew = 5 * time.Minute
+
+// errNoPlace is returned by lookupPlace when nothing matches the query.
+var errNoPlace = errors.New("no matching place")
+
+// lookupPlace resolves what someone typed in chat, "lat,lon" or a place
+// name, to a place.
+func (s *server) lookupPlace(query string) (Place, error) {
+	if loc, err := models.ParseLocationPair(query); err == nil {
+		return Place{Name: loc.Key(), Lat: loc.Lat, Lon: loc.Lon}, nil
+	}
+	results, err := s.geocode(query)
+	if err != nil {
+		s.upstreamFailed(err)
+		return Place{}, err
+	}
+	if len(results) == 0 {
+		return Place{}, errNoPlace
+	}
+	return Place(results[0]), nil
+}
+
+// placeWeather looks up the current weather for a chat query, returning the
+// place it resolved to.
+func (s *server) placeWeather(ctx context.Context, query string) (Place, PointWeather, error) {
+	place, err := s.lookupPlace(query)
+	if err != nil {
+		return Place{}, PointWeather{}, err
+	}
+	loc := models.Location{Lat: place.Lat, Lon: place.Lon}
+	lat, lon := loc.Strings()
+	data, err := s.fetchWeather(ctx, lat, lon)
+	if err != nil {
+		return Place{}, PointWeather{}, err
+	}
+	return place, newPointWeather(loc, data), nil
+}
+
+// title is how a place is shown in chat, e.g. "Austin, Texas, US".
+func (p Place) title() string {
+	parts := []string{p.Name}
+	for _, part := range []string{p.State, p.Country} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// chatReply is the text of a reply to a chat query: the weather, or what
+// went wrong.
+func chatReply(query string, place Place, weather PointWeather, err error) (title, text string) {
+	switch {
+	case err == errNoPlace:
+		return "", fmt.Sprintf("I couldn't find a place called %q.", query)
+	case err != nil:
+		return "", "Sorry, I couldn't get the weather right now. Please try again later."
+	}
+	text = formatDegrees(weather.Temperature)
+	if weather.FeelsLike != nil {
+		text += fmt.Sprintf(" (feels like %s)", formatDegrees(weather.FeelsLike))
+	}
+	if weather.Label != "" {
+		text += ", " + weather.Label
+	}
+	if len(weather.Conditions) > 0 {
+		text += ", " + strings.Join(weather.Conditions, ", ")
+	}
+	if len(weather.Alerts) > 0 {
+		text += "\n⚠️ " + strings.Join(weather.Alerts, ", ")
+	}
+	return place.title(), text
+}
+
+// slashHandler serves slash commands from Slack and Discord, so teams can
+// type "/weather austin" and get the weather back. Requests are
+// authenticated by the platform's signature rather than an API key: Slack's
+// with SLACK_SIGNING_SECRET and Discord's with DISCORD_PUBLIC_KEY. A
+// platform without its key configured is rejected.
+func (s *server) slashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(405)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid request body: %s", err)
+		return
+	}
+
+	switch {
+	case r.Header.Get("X-Slack-Signature") != "":
+		if len(s.slackSecret) == 0 || !verifySlack(r.Header, body, s.slackSecret, time.Now()) {
+			w.WriteHeader(401)
+			w.Write([]byte("Invalid signature"))
+			return
+		}
+		s.slackCommand(w, r, body)
+
+	case r.Header.Get("X-Signature-Ed25519") != "":
+		if s.discordKey == nil || !verifyDiscord(r.Header, body, s.discordKey, time.Now()) {
+			w.WriteHeader(401)
+			w.Write([]byte("Invalid signature"))
+			return
+		}
+		s.discordCommand(w, r, body)
+
+	default:
+		w.WriteHeader(401)
+		w.Write([]byte("Missing signature"))
+	}
+}
+
+// verifySlack checks a Slack request signature: an HMAC of the timestamp
+// and body, keyed with the app's signing secret.
+func verifySlack(h http.Header, body, secret []byte, now time.Time) bool {
+	ts := h.Get("X-Slack-Request-Timestamp")
+	if !freshTimestamp(ts, now) {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "v0:%s:", ts)
+	mac.Write(body)
+	want := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(want), []byte(h.Get("X-Slack-Signature")))
+}
+
+// verifyDiscord checks a Discord interaction signature: an Ed25519
+// signature of the timestamp and body, by the app's key.
+func verifyDiscord(h http.Header, body []byte, key ed25519.PublicKey, now time.Time) bool {
+	ts := h.Get("X-Signature-Timestamp")
+	sig, err := hex.DecodeString(h.Get("X-Signature-Ed25519"))
+	if err != nil || !freshTimestamp(ts, now) {
+		return false
+	}
+	return ed25519.Verify(key, append([]byte(ts), body...), sig)
+}
+
+// freshTimestamp reports whether ts, in unix seconds, is within
+// slashMaxSkew of now.
+func freshTimestamp(ts string, now time.Time) bool {
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := now.Sub(time.Unix(sec, 0))
+	return skew <= slashMaxSkew && skew >= -slashMaxSkew
+}
+
+// slackCommand answers a Slack slash command with a Block Kit message.
+func (s *server) slackCommand(w http.ResponseWriter, r *http.Request, body []byte) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("Invalid form body"))
+		return
+	}
+	query := strings.TrimSpace(form.Get("text"))
+	if query == "" {
+		writeJSON(w, map[string]string{
+			"response_type": "ephemeral",
+			"text":          fmt.Sprintf("Usage: %s <place or lat,lon>", form.Get("command")),
+		})
+		return
+	}
+
+	place, weather, err := s.placeWeather(r.Context(), query)
+	if err != nil && err != errNoPlace {
+		s.logger.Printf("Slash command failed: %s", err)
+	}
+	title, text := chatReply(query, place, weather, err)
+	if err != nil {
+		writeJSON(w, map[string]string{"response_type": "ephemeral", "text": text})
+		return
+	}
+	type textObject struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	type block struct {
+		Type string      `json:"type"`
+		Text *textObject `json:"text,omitempty"`
+	}
+	writeJSON(w, struct {
+		ResponseType string  `json:"response_type"`
+		Text         string  `json:"text"` // shown in notifications
+		Blocks       []block `json:"blocks"`
+	}{
+		ResponseType: "in_channel",
+		Text:         title + ": " + text,
+		Blocks: []block{
+			{Type: "header", Text: &textObject{"plain_text", title}},
+			{Type: "section", Text: &textObject{"mrkdwn", slackEscape(text)}},
+		},
+	})
+}
+
+// slackEscape escapes the characters Slack's mrkdwn treats as control
+// characters.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// Discord interaction and response types, and message flags.
+const (
+	discordPing           = 1
+	discordApplicationCmd = 2
+	discordPong           = 1
+	discordChannelMessage = 4
+	discordEphemeralFlag  = 1 << 6
+)
+
+// Discord embed colors, for the weather with and without alerts.
+const (
+	discordEmbedColor        = 0x3498DB
+	discordEmbedColorWarning = 0xE67E22
+)
+
+// discordCommand answers a Discord interaction: pings, which Discord sends
+// to check the endpoint, and the slash command, whose first string option
+// is the place.
+func (s *server) discordCommand(w http.ResponseWriter, r *http.Request, body []byte) {
+	var interaction struct {
+		Type int `json:"type"`
+		Data struct {
+			Name    string `json:"name"`
+			Options []struct {
+				Value interface{} `json:"value"`
+			} `json:"options"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&interaction); err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid request body: %s", err)
+		return
+	}
+	switch interaction.Type {
+	case discordPing:
+		writeJSON(w, map[string]int{"type": discordPong})
+		return
+	case discordApplicationCmd:
+	default:
+		w.WriteHeader(400)
+		w.Write([]byte("Unsupported interaction type"))
+		return
+	}
+
+	var query string
+	for _, opt := range interaction.Data.Options {
+		if v, ok := opt.Value.(string); ok {
+			query = strings.TrimSpace(v)
+			break
+		}
+	}
+	type embed struct {
+		Title       string `json:"title,omitempty"`
+		Description string `json:"description"`
+		Color       int    `json:"color,omitempty"`
+	}
+	type data struct {
+		Content string  `json:"content,omitempty"`
+		Embeds  []embed `json:"embeds,omitempty"`
+		Flags   int     `json:"flags,omitempty"`
+	}
+	respond := func(d data) {
+		writeJSON(w, struct {
+			Type int  `json:"type"`
+			Data data `json:"data"`
+		}{discordChannelMessage, d})
+	}
+	if query == "" {
+		respond(data{Content: fmt.Sprintf("Usage: /%s <place or lat,lon>", interaction.Data.Name), Flags: discordEphemeralFlag})
+		return
+	}
+
+	place, weather, err := s.placeWeather(r.Context(), query)
+	if err != nil && err != errNoPlace {
+		s.logger.Printf("Slash command failed: %s", err)
+	}
+	title, text := chatReply(query, place, weather, err)
+	if err != nil {
+		respond(data{Content: text, Flags: discordEphemeralFlag})
+		return
+	}
+	color := discordEmbedColor
+	if len(weather.Alerts) > 0 {
+		color = discordEmbedColorWarning
+	}
+	respond(data{Embeds: []embed{{Title: title, Description: text, Color: color}}})
+}
@@ -0,0 +1,85 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Service level indicators. Each SLO counts the requests it applies to and
+// how many of them were good; the objectives are exported alongside, so
+// that multi-window burn-rate alerts can be written against /metrics
+// alone. The burn rate over a window is the error ratio divided by the
+// error budget, e.g. for availability over an hour:
+//
+//	(1 - sum(rate(slo_good_requests_total{slo="availability"}[1h]))
+//	   / sum(rate(slo_requests_total{slo="availability"}[1h])))
+//	/ (1 - max(slo_objective{slo="availability"}))
+//
+// Alert when it's above 14.4 over both 1h and 5m (2% of a 30 day budget
+// spent in an hour), or above 6 over both 6h and 30m.
+var (
+	sloRequests = newCounter("slo_requests_total",
+		"Requests counted towards each SLO.", "slo")
+	sloGood = newCounter("slo_good_requests_total",
+		"Requests that met each SLO.", "slo")
+	sloObjective = newGauge("slo_objective",
+		"Target fraction of good requests for each SLO.", "slo")
+	sloLatencyThreshold = newGauge("slo_latency_threshold_seconds",
+		"How quickly a request must be served to count as good for the latency SLO.")
+)
+
+const (
+	sloAvailability = "availability"
+	sloLatency      = "latency"
+)
+
+// sloExcludedPrefixes are routes that don't count towards the SLOs: probes,
+// scrapes, long polls and admin jobs, some of which legitimately run for
+// minutes.
+var sloExcludedPrefixes = []string{"/metrics", "/healthz", "/readyz", "/admin/", "/weather/poll"}
+
+// sloTracker classifies requests against the SLOs:
+//
+//   - availability: a request is good unless we answered with a 5xx. Client
+//     errors, including being rate limited, are the client's problem.
+//   - latency: a request that didn't fail is good if it was served within
+//     latencyThreshold. Failures are left to the availability SLO.
+type sloTracker struct {
+	latencyThreshold time.Duration
+}
+
+func newSLOTracker(availability, latency float64, latencyThreshold time.Duration) *sloTracker {
+	sloObjective.Set(availability, sloAvailability)
+	sloObjective.Set(latency, sloLatency)
+	sloLatencyThreshold.Set(latencyThreshold.Seconds())
+	return &sloTracker{latencyThreshold: latencyThreshold}
+}
+
+// Middleware counts the requests to h.
+func (st *sloTracker) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range sloExcludedPrefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: 200}
+		h.ServeHTTP(rec, r)
+		st.observe(rec.status, time.Since(start))
+	})
+}
+
+func (st *sloTracker) observe(status int, latency time.Duration) {
+	sloRequests.Inc(sloAvailability)
+	if status >= 500 {
+		return
+	}
+	sloGood.Inc(sloAvailability)
+	sloRequests.Inc(sloLatency)
+	if latency <= st.latencyThreshold {
+		sloGood.Inc(sloLatency)
+	}
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// snowRatio is how many inches of snow fall per inch of water. Providers
+// forecast snow as its water equivalent; 10:1 is the usual rule of thumb.
+const snowRatio = 10
+
+// snowPastDays is how far back recent snowfall looks.
+const snowPastDays = 7
+
+// SnowReport is the response of the snow endpoint. Depths are in inches and
+// the freezing level in feet. Fields from the optional snow provider are
+// absent when it isn't configured or fails.
+type SnowReport struct {
+	SnowfallNext24h float64  `json:"snowfall_next_24h"`
+	SnowfallNext7d  float64  `json:"snowfall_next_7d"`
+	SnowfallLast24h *float64 `json:"snowfall_last_24h,omitempty"`
+	SnowfallLast7d  *float64 `json:"snowfall_last_7d,omitempty"`
+	SnowDepth       *float64 `json:"snow_depth,omitempty"`
+	// FreezingLevel is the height above sea level of the 0°C isotherm;
+	// snow falls above it and rain below.
+	FreezingLevel *float64  `json:"freezing_level,omitempty"`
+	Days          []SnowDay `json:"days"`
+}
+
+// SnowDay is the snow forecast for one day.
+type SnowDay struct {
+	Date     string             `json:"date"`
+	Snowfall float64            `json:"snowfall"`
+	Low      models.Temperature `json:"low"`
+	High     models.Temperature `json:"high"`
+}
+
+// snowInches converts a forecast's water equivalent in millimeters to
+// inches of snow.
+func snowInches(mm float64) float64 {
+	return round1(mm / 25.4 * snowRatio)
+}
+
+func round1(v float64) float64 {
+	return math.Round(v*10) / 10
+}
+
+// snowHandler reports forecast and recent snowfall, snow depth and the
+// freezing level at a location, for skiers and other winter sports. The
+// forecast comes from openweathermap; the rest needs OPEN_METEO.
+func (s *server) snowHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lat, lon, _ := s.requestLocation(r, q)
+	data, err := s.forecast(lat, lon, []string{"hourly", "daily"})
+	if err != nil {
+		s.upstreamFailed(err)
+		s.upstreamError(w, r, err)
+		return
+	}
+
+	now := time.Now()
+	report := SnowReport{Days: []SnowDay{}}
+	var next24h float64
+	for _, hour := range data.Hourly {
+		if time.Unix(hour.Dt, 0).Before(now.Add(24 * time.Hour)) {
+			next24h += hour.Snow.OneHour
+		}
+	}
+	report.SnowfallNext24h = snowInches(next24h)
+	var next7d float64
+	for i, day := range data.Daily {
+		if i < 7 {
+			next7d += day.Snow
+		}
+		report.Days = append(report.Days, SnowDay{
+			Date:     time.Unix(day.Dt, 0).UTC().Format("2006-01-02"),
+			Snowfall: snowInches(day.Snow),
+			Low:      day.Temp.Min,
+			High:     day.Temp.Max,
+		})
+	}
+	report.SnowfallNext7d = snowInches(next7d)
+
+	if s.openMeteo != nil {
+		snow, err := s.openMeteo.GetSnow(lat, lon, snowPastDays)
+		if err != nil {
+			upstreamErrors.Inc(errorClass(err))
+			s.logger.Printf("Failed to fetch Open-Meteo snow data: %s", err)
+		} else {
+			addRecentSnow(&report, snow, now)
+		}
+	}
+	writeJSON(w, &report)
+}
+
+// addRecentSnow fills in the report's observed snowfall, and its snow depth
+// and freezing level as of the latest hour up to now.
+func addRecentSnow(report *SnowReport, snow *OpenMeteoSnow, now time.Time) {
+	h := snow.Hourly
+	var last24h, last7d float64
+	for i, dt := range h.Time {
+		at := time.Unix(dt, 0)
+		if at.After(now) {
+			break
+		}
+		if i < len(h.Snowfall) && h.Snowfall[i] != nil && now.Sub(at) < snowPastDays*24*time.Hour {
+			cm := *h.Snowfall[i]
+			last7d += cm
+			if now.Sub(at) < 24*time.Hour {
+				last24h += cm
+			}
+		}
+		if i < len(h.SnowDepth) && h.SnowDepth[i] != nil {
+			depth := round1(*h.SnowDepth[i] * 39.37)
+			report.SnowDepth = &depth
+		}
+		if i < len(h.FreezingLevel) && h.FreezingLevel[i] != nil {
+			level := math.Round(*h.FreezingLevel[i] * 3.281)
+			report.FreezingLevel = &level
+		}
+	}
+	last24h, last7d = round1(last24h/2.54), round1(last7d/2.54)
+	report.SnowfallLast24h = &last24h
+	report.SnowfallLast7d = &last7d
+}
@@ -0,0 +1,393 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// subscription asks for a location's new alerts to be sent somewhere.
+type subscription struct {
+	ID        string    `json:"id"`
+	ClientID  string    `json:"client_id,omitempty"`
+	Channel   string    `json:"channel"` // "telegram"
+	Target    string    `json:"target"`  // for telegram, the chat ID
+	Name      string    `json:"name,omitempty"`
+	Lat       float64   `json:"lat"`
+	Lon       float64   `json:"lon"`
+	CreatedAt time.Time `json:"created_at"`
+	// Rule is what to notify about: weather alerts ("alerts", the default)
+	// or lightning strikes within RadiusKm ("lightning").
+	Rule     string  `json:"rule,omitempty"`
+	RadiusKm float64 `json:"radius_km,omitempty"`
+	// Notified holds the keys (see alertKey) of the alerts in effect that
+	// we've already sent, so each alert is only sent once.
+	Notified []string `json:"notified,omitempty"`
+	// DeletedAt is set when the subscription is deleted. It's kept, and can
+	// be restored, until the store's retention has passed.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// rule returns the subscription's rule, defaulting to "alerts".
+func (sub subscription) rule() string {
+	if sub.Rule == "" {
+		return "alerts"
+	}
+	return sub.Rule
+}
+
+func (sub subscription) location() models.Location {
+	return models.Location{Lat: sub.Lat, Lon: sub.Lon}
+}
+
+// alertKey identifies an alert across checks.
+func alertKey(alert models.Alert) string {
+	return alert.Source + "|" + alert.Event + "|" + strconv.FormatInt(alert.Start.Unix(), 10)
+}
+
+// subscriptionStore holds alert subscriptions. When path is set they are
+// persisted as a JSON file; otherwise they only live in memory. Deleted
+// subscriptions are kept for retention, so an unsubscribe can be undone.
+type subscriptionStore struct {
+	path      string
+	retention time.Duration
+
+	mu      sync.Mutex
+	records map[string]*subscription
+}
+
+// openSubscriptionStore loads the subscription store at path, creating it
+// on first save. An empty path gives an in-memory store.
+func openSubscriptionStore(path string, retention time.Duration) (*subscriptionStore, error) {
+	ss := &subscriptionStore{path: path, retention: retention, records: make(map[string]*subscription)}
+	if path == "" {
+		return ss, nil
+	}
+	var records []*subscription
+	if err := loadJSONFile(path, &records); err != nil {
+		return nil, err
+	}
+	for _, rec := range records {
+		ss.records[rec.ID] = rec
+	}
+	return ss, nil
+}
+
+// save writes the store to disk. The caller must hold ss.mu.
+func (ss *subscriptionStore) save() error {
+	if ss.path == "" {
+		return nil
+	}
+	return saveJSONFile(ss.path, ss.sorted())
+}
+
+// sorted returns the subscriptions, oldest first. The caller must hold
+// ss.mu.
+func (ss *subscriptionStore) sorted() []*subscription {
+	records := make([]*subscription, 0, len(ss.records))
+	for _, rec := range ss.records {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+	return records
+}
+
+// All returns every subscription, oldest first.
+func (ss *subscriptionStore) All() []subscription {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var out []subscription
+	for _, rec := range ss.sorted() {
+		if rec.DeletedAt == nil {
+			out = append(out, *rec)
+		}
+	}
+	return out
+}
+
+// Get returns a subscription.
+func (ss *subscriptionStore) Get(id string) (subscription, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	rec, ok := ss.records[id]
+	if !ok || rec.DeletedAt != nil {
+		return subscription{}, ErrNotFound
+	}
+	return *rec, nil
+}
+
+// Find returns the subscriptions on a channel target, oldest first.
+func (ss *subscriptionStore) Find(channel, target string) []subscription {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var out []subscription
+	for _, rec := range ss.sorted() {
+		if rec.Channel == channel && rec.Target == target && rec.DeletedAt == nil {
+			out = append(out, *rec)
+		}
+	}
+	return out
+}
+
+// Deleted returns the deleted subscriptions on a channel target that can
+// still be restored, oldest first.
+func (ss *subscriptionStore) Deleted(channel, target string) []subscription {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var out []subscription
+	for _, rec := range ss.sorted() {
+		if rec.Channel == channel && rec.Target == target && rec.DeletedAt != nil && !ss.expired(rec.DeletedAt) {
+			out = append(out, *rec)
+		}
+	}
+	return out
+}
+
+// At returns the subscriptions at a location, oldest first.
+func (ss *subscriptionStore) At(loc models.Location) []subscription {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var out []subscription
+	for _, rec := range ss.sorted() {
+		if rec.location().Key() == loc.Key() && rec.DeletedAt == nil {
+			out = append(out, *rec)
+		}
+	}
+	return out
+}
+
+// Create adds a subscription.
+func (ss *subscriptionStore) Create(sub subscription) (subscription, error) {
+	sub.ID = randomHex(8)
+	sub.CreatedAt = time.Now().UTC()
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.records[sub.ID] = &sub
+	if err := ss.save(); err != nil {
+		delete(ss.records, sub.ID)
+		return subscription{}, err
+	}
+	return sub, nil
+}
+
+// AddNotified records that an alert has been sent for a subscription.
+func (ss *subscriptionStore) AddNotified(id, key string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	rec, ok := ss.records[id]
+	if !ok || containsString(rec.Notified, key) {
+		return nil
+	}
+	rec.Notified = append(rec.Notified, key)
+	return ss.save()
+}
+
+// Delete removes a subscription, keeping it for Restore until the
+// retention has passed.
+func (ss *subscriptionStore) Delete(id string) (subscription, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	rec, ok := ss.records[id]
+	if !ok || rec.DeletedAt != nil {
+		return subscription{}, ErrNotFound
+	}
+	now := time.Now().UTC()
+	rec.DeletedAt = &now
+	if err := ss.save(); err != nil {
+		rec.DeletedAt = nil
+		return subscription{}, err
+	}
+	return *rec, nil
+}
+
+// Restore brings back a deleted subscription. Alerts already sent to it
+// aren't sent again.
+func (ss *subscriptionStore) Restore(id string) (subscription, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	rec, ok := ss.records[id]
+	if !ok || rec.DeletedAt == nil || ss.expired(rec.DeletedAt) {
+		return subscription{}, ErrNotFound
+	}
+	deletedAt := rec.DeletedAt
+	rec.DeletedAt = nil
+	if err := ss.save(); err != nil {
+		rec.DeletedAt = deletedAt
+		return subscription{}, err
+	}
+	return *rec, nil
+}
+
+// expired reports whether a record deleted at deletedAt is past restoring.
+func (ss *subscriptionStore) expired(deletedAt *time.Time) bool {
+	return time.Since(*deletedAt) > ss.retention
+}
+
+// Purge removes deleted subscriptions for good once they're past the
+// retention.
+func (ss *subscriptionStore) Purge() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	purged := false
+	for id, rec := range ss.records {
+		if rec.DeletedAt != nil && ss.expired(rec.DeletedAt) {
+			delete(ss.records, id)
+			purged = true
+		}
+	}
+	if !purged {
+		return nil
+	}
+	return ss.save()
+}
+
+// SetNotified records which alerts have been sent for a subscription.
+func (ss *subscriptionStore) SetNotified(id string, keys []string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	rec, ok := ss.records[id]
+	if !ok {
+		// deleted while we were checking it
+		return nil
+	}
+	rec.Notified = keys
+	return ss.save()
+}
+
+// syncMonitors has the scheduler poll every subscribed location. Call it
+// whenever subscriptions are added or removed.
+func (s *server) syncMonitors() {
+	locs := make(map[models.Location]time.Duration)
+	// Telegram is the only subscription channel, so without it there's
+	// nobody to check alerts for
+	if s.telegram != nil {
+		for _, sub := range s.subscriptions.All() {
+			locs[sub.location()] = s.alertCheckInterval
+		}
+	}
+	s.scheduler.Sync("subscriptions", locs)
+}
+
+// pollLocation is the scheduler's poll: it refreshes a location's weather
+// and notifies the subscriptions there.
+func (s *server) pollLocation(ctx context.Context, loc models.Location) error {
+	if _, err := s.refreshWeather(loc); err != nil {
+		return err
+	}
+	return s.checkAlertsAt(ctx, loc)
+}
+
+// checkAlertsAt sends each subscription at a location the alerts in effect
+// there that it hasn't been sent yet.
+func (s *server) checkAlertsAt(ctx context.Context, loc models.Location) error {
+	var alerts []models.Alert
+	fetched := false
+	for _, sub := range s.subscriptions.At(loc) {
+		if sub.rule() == "lightning" {
+			s.checkLightning(sub)
+			continue
+		}
+		if !fetched {
+			lat, lon := loc.Strings()
+			var err error
+			if alerts, err = s.locationAlerts(ctx, lat, lon); err != nil {
+				return fmt.Errorf("checking alerts: %w", err)
+			}
+			fetched = true
+		}
+
+		var notified []string
+		for _, alert := range alerts {
+			key := alertKey(alert)
+			notified = append(notified, key)
+			if !containsString(sub.Notified, key) {
+				s.deliverAlert(sub, alert)
+			}
+		}
+		// alerts no longer in effect drop out, which keeps the list short
+		if err := s.subscriptions.SetNotified(sub.ID, notified); err != nil {
+			s.logger.Printf("Failed to save subscription %s: %s", sub.ID, err)
+		}
+	}
+	return nil
+}
+
+// checkLightning applies the 30-30 rule to a lightning subscription: it's
+// told when lightning strikes within its radius, and given the all clear once
+// there have been no strikes for 30 minutes.
+func (s *server) checkLightning(sub subscription) {
+	if s.lightning == nil {
+		return
+	}
+	lat, lon := sub.location().Strings()
+	strikes, err := s.lightning.GetStrikes(lat, lon, sub.RadiusKm, lightningAllClear)
+	if err != nil {
+		upstreamErrors.Inc(errorClass(err))
+		s.logger.Printf("Failed to check lightning for subscription %s: %s", sub.ID, err)
+		return
+	}
+
+	active := containsString(sub.Notified, "lightning")
+	var alert models.Alert
+	var notified []string
+	switch {
+	case len(strikes) > 0 && !active:
+		closest := strikes[0]
+		alert = models.Alert{
+			Event: "Lightning",
+			Headline: fmt.Sprintf("Lightning struck %.0f km away at %s. Stay indoors until 30 minutes after the last strike.",
+				closest.DistanceKm, closest.Time.Format("15:04 MST")),
+			Start:  closest.Time,
+			Source: lightningProvider,
+		}
+		notified = []string{"lightning"}
+	case len(strikes) == 0 && active:
+		alert = models.Alert{
+			Event:    "Lightning all clear",
+			Headline: fmt.Sprintf("No lightning within %.0f km for 30 minutes.", sub.RadiusKm),
+			Source:   lightningProvider,
+		}
+	default:
+		return
+	}
+	s.deliverAlert(sub, alert)
+	if err := s.subscriptions.SetNotified(sub.ID, notified); err != nil {
+		s.logger.Printf("Failed to save subscription %s: %s", sub.ID, err)
+	}
+}
+
+// deliverAlert sends an alert to a subscription, queueing it for retry if
+// that fails.
+func (s *server) deliverAlert(sub subscription, alert models.Alert) {
+	if err := s.sendAlert(sub, alert); err != nil {
+		s.logger.Printf("Failed to send alert to subscription %s, will retry: %s", sub.ID, err)
+		s.queueDelivery(delivery{Channel: sub.Channel, Target: sub.ID, Subscription: &sub, Alert: &alert}, err)
+	}
+}
+
+// sendAlert sends an alert to a subscription's channel.
+func (s *server) sendAlert(sub subscription, alert models.Alert) error {
+	var err error
+	switch sub.Channel {
+	case "telegram":
+		if s.telegram == nil {
+			return fmt.Errorf("telegram is not configured")
+		}
+		entry := auditEntry{Channel: "telegram", Recipient: sub.Target, Subscription: sub.ID, Type: "alert"}
+		err = s.audited(entry, telegramAlertText(sub, alert), func() error { return s.telegram.sendAlert(sub, alert) })
+	default:
+		err = fmt.Errorf("unknown channel %q", sub.Channel)
+	}
+	if err != nil {
+		notificationsSent.Inc(sub.Channel, "error")
+		return err
+	}
+	notificationsSent.Inc(sub.Channel, "ok")
+	return nil
+}
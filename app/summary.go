@@ -0,0 +1,133 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// Sources of a summary.
+const (
+	summaryProvider = "openweathermap"
+	summaryLocal    = "local"
+)
+
+var summarySources = []string{"auto", summaryProvider, summaryLocal}
+
+// Summary is the response of the summary endpoint.
+type Summary struct {
+	Summary  string            `json:"summary"`
+	Source   string            `json:"source"`         // openweathermap or local
+	Date     string            `json:"date,omitempty"` // the day summarized, if the provider says
+	Location *ResolvedLocation `json:"location,omitempty"`
+}
+
+// OWMOverview is a One Call 3.0 weather overview: a few sentences on the
+// day's weather, written by the provider.
+type OWMOverview struct {
+	Date            string `json:"date"`
+	WeatherOverview string `json:"weather_overview"`
+}
+
+// GetOverview fetches the weather overview for a location. It needs One
+// Call 3.0.
+func (o *OWMService) GetOverview(lat, lon string) (*OWMOverview, error) {
+	params := url.Values{}
+	params.Add("lat", lat)
+	params.Add("lon", lon)
+	var data OWMOverview
+	if err := o.get(o.endpoint(oneCallPath(oneCall30)+"/overview", params), &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// overviewAvailable reports whether we can ask the provider for overviews:
+// our key must have One Call 3.0.
+func (o *OWMService) overviewAvailable() bool {
+	return o.oneCall.Get(o.probeOneCall30) == oneCall30
+}
+
+// overview returns the provider's weather overview for a location, cached.
+func (s *server) overview(lat, lon string) (*OWMOverview, error) {
+	key := locationCacheKey(lat, lon)
+	if v, ok := s.responses.Get(cacheOverview, key); ok {
+		return v.(*OWMOverview), nil
+	}
+	data, err := s.owm.GetOverview(lat, lon)
+	if err != nil {
+		return nil, err
+	}
+	s.responses.Put(cacheOverview, key, data)
+	return data, nil
+}
+
+// errNoOverview is returned when our key can't get the provider's overview.
+var errNoOverview = errors.New("weather overviews need a One Call 3.0 subscription")
+
+// summaryHandler describes the day's weather at a location in a few
+// sentences. ?source= picks who writes it: openweathermap's overview, our
+// own digest summary (local), or by default the overview when our key can
+// get it and the digest summary otherwise.
+func (s *server) summaryHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lat, lon, resolved := s.requestLocation(r, q)
+	source := q.Get("source")
+	if source == "" {
+		source = "auto"
+	}
+	if !containsString(summarySources, source) {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Unknown source %q (available: %s)", source, strings.Join(summarySources, ", "))
+		return
+	}
+	loc, err := models.ParseLocation(lat, lon)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if source != summaryLocal {
+		data, err := s.providerSummary(lat, lon)
+		unavailable := err == errNoOverview || errors.Is(err, ErrProviderAuth) || errors.Is(err, ErrNotFound)
+		switch {
+		case err == nil:
+			writeJSON(w, &Summary{Summary: data.WeatherOverview, Source: summaryProvider, Date: data.Date, Location: resolved})
+			return
+		case err == errNoOverview && source == summaryProvider:
+			w.WriteHeader(501)
+			fmt.Fprintf(w, "Provider summaries aren't available: %s", err)
+			return
+		case source == summaryProvider || !unavailable:
+			s.upstreamError(w, r, err)
+			return
+		}
+		// not for us; write our own
+	}
+
+	d, err := s.composeDigest(r.Context(), "", loc, "daily")
+	if err != nil {
+		s.upstreamError(w, r, err)
+		return
+	}
+	writeJSON(w, &Summary{Summary: d.Summary, Source: summaryLocal, Location: resolved})
+}
+
+// providerSummary fetches the provider's overview, if our key can get it.
+// A refusal only means we lack the subscription, so it doesn't count as a
+// provider failure.
+func (s *server) providerSummary(lat, lon string) (*OWMOverview, error) {
+	if !s.owm.overviewAvailable() {
+		return nil, errNoOverview
+	}
+	data, err := s.overview(lat, lon)
+	if err != nil && !errors.Is(err, ErrProviderAuth) {
+		s.upstreamFailed(err)
+	}
+	return data, err
+}
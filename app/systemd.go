@@ -0,0 +1,78 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdListenFDsStart is the first file descriptor systemd passes to a
+// socket-activated service.
+const sdListenFDsStart = 3
+
+// systemdListener returns the socket systemd passed us with socket
+// activation, or nil if we weren't socket activated. We serve on a single
+// socket, so the unit's .socket should have a single Listen directive.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %q", os.Getenv("LISTEN_FDS"))
+	}
+	if n > 1 {
+		log.Printf("systemd passed %d sockets; serving on the first", n)
+	}
+	// don't let these leak to processes we start
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(sdListenFDsStart, "systemd")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// sdNotify sends a state change to systemd when running as a Type=notify
+// service, e.g. "READY=1". It's a no-op otherwise.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		// abstract namespace socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Failed to notify systemd: %s", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("Failed to notify systemd: %s", err)
+	}
+}
+
+// sdWatchdog pings the systemd watchdog, if the unit has WatchdogSec set,
+// until ctx is done.
+func sdWatchdog(ctx context.Context) {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return
+	}
+	// ping at twice the required rate, as sd_watchdog_enabled(3) suggests
+	for range ticks(ctx, time.Duration(usec)*time.Microsecond/2) {
+		sdNotify("WATCHDOG=1")
+	}
+}
@@ -0,0 +1,360 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// telegramPollTimeout is how long a getUpdates long poll waits for updates.
+const telegramPollTimeout = 30 * time.Second
+
+// telegramBot is a Telegram bot that answers weather queries and sends alert
+// notifications. It gets updates by long polling, or by webhook when
+// webhookSecret is set.
+type telegramBot struct {
+	client        *http.Client
+	apiURL        string // https://api.telegram.org
+	token         string
+	webhookSecret string
+
+	mu     sync.Mutex
+	shared map[int64]models.Location // the last location shared in each chat
+}
+
+// telegramUpdate is the subset of a Telegram update that we handle.
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		Text     string `json:"text"`
+		Location *struct {
+			Latitude  float64 `json:"latitude"`
+			Longitude float64 `json:"longitude"`
+		} `json:"location"`
+	} `json:"message"`
+}
+
+// call invokes a Bot API method. Errors never include the request URL,
+// which contains the bot token.
+func (b *telegramBot) call(ctx context.Context, method string, params, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", b.apiURL+"/bot"+b.token+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("telegram %s: invalid request", method)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("telegram %s: %s", method, err)
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("telegram %s: %s: %s", method, resp.Status, err)
+	}
+	if !envelope.OK {
+		return fmt.Errorf("telegram %s: %s", method, envelope.Description)
+	}
+	if result != nil {
+		return json.Unmarshal(envelope.Result, result)
+	}
+	return nil
+}
+
+func (b *telegramBot) sendMessage(ctx context.Context, chatID int64, text string) error {
+	return b.call(ctx, "sendMessage", map[string]interface{}{"chat_id": chatID, "text": text}, nil)
+}
+
+// telegramAlertText is the message that tells a subscription about an alert.
+func telegramAlertText(sub subscription, alert models.Alert) string {
+	text := fmt.Sprintf("⚠️ %s for %s", alert.Event, sub.Name)
+	if !alert.End.IsZero() {
+		text += " until " + alert.End.UTC().Format("Mon Jan 2 15:04 MST")
+	}
+	if alert.Headline != "" {
+		text += "\n\n" + alert.Headline
+	}
+	return text
+}
+
+// sendAlert sends an alert to a telegram subscription.
+func (b *telegramBot) sendAlert(sub subscription, alert models.Alert) error {
+	chatID, err := strconv.ParseInt(sub.Target, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid chat ID %q", sub.Target)
+	}
+	text := telegramAlertText(sub, alert)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return b.sendMessage(ctx, chatID, text)
+}
+
+// setWebhook registers url to receive updates.
+func (b *telegramBot) setWebhook(url string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return b.call(ctx, "setWebhook", map[string]interface{}{
+		"url":             url,
+		"secret_token":    b.webhookSecret,
+		"allowed_updates": []string{"message"},
+	}, nil)
+}
+
+// pollTelegram gets updates by long polling, until ctx is done.
+func (s *server) pollTelegram(ctx context.Context) {
+	var offset int64
+	for {
+		// Telegram only lets one client poll a bot at a time
+		if !s.leader.waitForLeadership(ctx) {
+			return
+		}
+		pollCtx, cancel := context.WithTimeout(ctx, telegramPollTimeout+10*time.Second)
+		var updates []telegramUpdate
+		err := s.telegram.call(pollCtx, "getUpdates", map[string]interface{}{
+			"offset":          offset,
+			"timeout":         int(telegramPollTimeout.Seconds()),
+			"allowed_updates": []string{"message"},
+		}, &updates)
+		cancel()
+		if err != nil {
+			s.logger.Printf("Failed to get Telegram updates: %s", err)
+			if !sleep(ctx, 5*time.Second) {
+				return
+			}
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			s.handleTelegramUpdate(context.Background(), u)
+		}
+	}
+}
+
+// telegramWebhookHandler receives updates when the bot runs in webhook mode.
+// Telegram authenticates itself with the secret we gave it in setWebhook.
+func (s *server) telegramWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if s.telegram == nil || s.telegram.webhookSecret == "" {
+		w.WriteHeader(404)
+		return
+	}
+	secret := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(s.telegram.webhookSecret)) != 1 {
+		w.WriteHeader(401)
+		w.Write([]byte("Invalid secret token"))
+		return
+	}
+	var u telegramUpdate
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&u); err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid request body: %s", err)
+		return
+	}
+	s.handleTelegramUpdate(r.Context(), u)
+}
+
+const telegramHelp = `Send me a place name, coordinates ("30.27,-97.74") or your location and I'll tell you the weather there.
+
+/subscribe [place] – get alerts for a place, or for the location you last shared
+/lightning [place] – get told when lightning strikes nearby
+/unsubscribe – stop all alerts
+/restore – undo /unsubscribe`
+
+// handleTelegramUpdate answers a message. Failures to reply are logged;
+// Telegram doesn't redeliver updates either way.
+func (s *server) handleTelegramUpdate(ctx context.Context, u telegramUpdate) {
+	msg := u.Message
+	if msg == nil {
+		return
+	}
+	chatID := msg.Chat.ID
+	reply := func(text string) {
+		if err := s.telegram.sendMessage(ctx, chatID, text); err != nil {
+			s.logger.Printf("Failed to reply on Telegram: %s", err)
+		}
+	}
+
+	if msg.Location != nil {
+		loc, err := models.ParseLocation(fmt.Sprint(msg.Location.Latitude), fmt.Sprint(msg.Location.Longitude))
+		if err != nil {
+			reply("That location doesn't look right.")
+			return
+		}
+		s.telegram.mu.Lock()
+		s.telegram.shared[chatID] = loc
+		s.telegram.mu.Unlock()
+		reply(s.telegramWeather(ctx, loc.Key()) + "\n\nSend /subscribe to get alerts for this location.")
+		return
+	}
+
+	command, arg := "", strings.TrimSpace(msg.Text)
+	if strings.HasPrefix(arg, "/") {
+		fields := strings.SplitN(arg, " ", 2)
+		// commands in groups are addressed as /command@botname
+		command = strings.SplitN(fields[0], "@", 2)[0]
+		arg = ""
+		if len(fields) == 2 {
+			arg = strings.TrimSpace(fields[1])
+		}
+	}
+
+	switch command {
+	case "/start", "/help":
+		reply(telegramHelp)
+	case "/subscribe":
+		reply(s.telegramSubscribe(chatID, arg, "alerts"))
+	case "/lightning":
+		if s.lightning == nil {
+			reply("Lightning alerts aren't available.")
+			return
+		}
+		reply(s.telegramSubscribe(chatID, arg, "lightning"))
+	case "/unsubscribe":
+		reply(s.telegramUnsubscribe(chatID))
+	case "/restore":
+		reply(s.telegramRestore(chatID))
+	case "", "/weather":
+		if arg == "" {
+			reply(telegramHelp)
+			return
+		}
+		reply(s.telegramWeather(ctx, arg))
+	default:
+		reply("I don't know that command.\n\n" + telegramHelp)
+	}
+}
+
+// telegramWeather formats the weather for a query.
+func (s *server) telegramWeather(ctx context.Context, query string) string {
+	place, weather, err := s.placeWeather(ctx, query)
+	if err != nil && err != errNoPlace {
+		s.logger.Printf("Telegram weather query failed: %s", err)
+	}
+	title, text := chatReply(query, place, weather, err)
+	if err != nil {
+		return text
+	}
+	return title + "\n" + text
+}
+
+// telegramSubscribe subscribes a chat to a rule's notifications (see
+// subscription.Rule) for a place, or for the location it last shared.
+func (s *server) telegramSubscribe(chatID int64, query, rule string) string {
+	command, what := "/subscribe", "alerts for"
+	if rule == "lightning" {
+		command, what = "/lightning", fmt.Sprintf("lightning alerts within %.0f km of", s.lightningAlertRadius)
+	}
+
+	var place Place
+	if query != "" {
+		var err error
+		if place, err = s.lookupPlace(query); err != nil {
+			_, text := chatReply(query, place, PointWeather{}, err)
+			return text
+		}
+	} else {
+		s.telegram.mu.Lock()
+		loc, ok := s.telegram.shared[chatID]
+		s.telegram.mu.Unlock()
+		if !ok {
+			return "Share your location first, or tell me where: " + command + " austin"
+		}
+		place = Place{Name: loc.Key(), Lat: loc.Lat, Lon: loc.Lon}
+	}
+
+	target := strconv.FormatInt(chatID, 10)
+	for _, sub := range s.subscriptions.Find("telegram", target) {
+		if sub.rule() == rule && sub.location().Key() == (models.Location{Lat: place.Lat, Lon: place.Lon}).Key() {
+			return "You're already subscribed to " + what + " " + sub.Name + "."
+		}
+	}
+	sub := subscription{
+		Channel: "telegram",
+		Target:  target,
+		Name:    place.title(),
+		Lat:     place.Lat,
+		Lon:     place.Lon,
+	}
+	if rule == "lightning" {
+		sub.Rule, sub.RadiusKm = rule, s.lightningAlertRadius
+	}
+	sub, err := s.subscriptions.Create(sub)
+	if err != nil {
+		s.logger.Printf("Failed to save Telegram subscription: %s", err)
+		return "Sorry, I couldn't subscribe you right now. Please try again later."
+	}
+	s.syncMonitors()
+	return "Subscribed to " + what + " " + sub.Name + "."
+}
+
+func (s *server) telegramUnsubscribe(chatID int64) string {
+	subs := s.subscriptions.Find("telegram", strconv.FormatInt(chatID, 10))
+	if len(subs) == 0 {
+		return "You aren't subscribed to any alerts."
+	}
+	for _, sub := range subs {
+		if _, err := s.subscriptions.Delete(sub.ID); err != nil {
+			s.logger.Printf("Failed to delete Telegram subscription: %s", err)
+			return "Sorry, I couldn't unsubscribe you right now. Please try again later."
+		}
+	}
+	s.syncMonitors()
+	return "Unsubscribed from all alerts. Changed your mind? Send /restore."
+}
+
+// telegramRestore brings back the subscriptions a chat deleted, unless it
+// has since subscribed to the same thing again.
+func (s *server) telegramRestore(chatID int64) string {
+	target := strconv.FormatInt(chatID, 10)
+	deleted := s.subscriptions.Deleted("telegram", target)
+	if len(deleted) == 0 {
+		return "There are no recently removed subscriptions to restore."
+	}
+	active := make(map[string]bool)
+	for _, sub := range s.subscriptions.Find("telegram", target) {
+		active[sub.rule()+" "+sub.location().Key()] = true
+	}
+	var names []string
+	for _, sub := range deleted {
+		key := sub.rule() + " " + sub.location().Key()
+		if active[key] {
+			continue
+		}
+		if _, err := s.subscriptions.Restore(sub.ID); err != nil {
+			s.logger.Printf("Failed to restore Telegram subscription: %s", err)
+			return "Sorry, I couldn't restore your subscriptions right now. Please try again later."
+		}
+		active[key] = true
+		names = append(names, sub.Name)
+	}
+	s.syncMonitors()
+	if len(names) == 0 {
+		return "You're already subscribed to everything you removed."
+	}
+	return "Restored your subscriptions: " + strings.Join(names, ", ") + "."
+}
@@ -0,0 +1,130 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request phases timed for Server-Timing and the phase metrics.
+const (
+	phaseCache    = "cache"    // looking up cached responses
+	phaseUpstream = "upstream" // waiting on a provider, including for a fetch another request started
+	phaseEncode   = "encode"   // encoding a JSON response body
+	phaseRender   = "render"   // rendering an HTML, SVG or iCalendar body
+)
+
+// The time requests spend in each phase. The mean time a request spends in
+// one is rate(request_phase_seconds_total) / rate(request_phases_total).
+var (
+	requestPhaseSeconds = newCounter("request_phase_seconds_total",
+		"Time requests spent in each phase: cache, upstream, encode or render.", "phase")
+	requestPhases = newCounter("request_phases_total",
+		"Requests that went through each phase.", "phase")
+)
+
+// phaseTimings collects how long a request spent in each phase.
+type phaseTimings struct {
+	start time.Time
+
+	mu     sync.Mutex
+	order  []string
+	phases map[string]time.Duration
+}
+
+type phaseTimingsKey struct{}
+
+func (t *phaseTimings) add(phase string, d time.Duration) {
+	t.mu.Lock()
+	if _, ok := t.phases[phase]; !ok {
+		t.order = append(t.order, phase)
+		requestPhases.Inc(phase)
+	}
+	t.phases[phase] += d
+	t.mu.Unlock()
+	requestPhaseSeconds.Add(d.Seconds(), phase)
+}
+
+// header renders the timings as a Server-Timing header, in milliseconds,
+// followed by the total so far.
+func (t *phaseTimings) header() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	metrics := make([]string, 0, len(t.order)+1)
+	for _, phase := range t.order {
+		metrics = append(metrics, fmt.Sprintf("%s;dur=%.1f", phase, ms(t.phases[phase])))
+	}
+	metrics = append(metrics, fmt.Sprintf("total;dur=%.1f", ms(time.Since(t.start))))
+	return strings.Join(metrics, ", ")
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// timePhase starts timing a phase of the request ctx belongs to; call the
+// function it returns when the phase ends. Outside a request it does
+// nothing.
+func timePhase(ctx context.Context, phase string) func() {
+	t, ok := ctx.Value(phaseTimingsKey{}).(*phaseTimings)
+	if !ok {
+		return func() {}
+	}
+	start := time.Now()
+	return func() { t.add(phase, time.Since(start)) }
+}
+
+// serverTiming reports where each response's latency went in the phase
+// metrics and, unless header is off, in a Server-Timing header, which
+// browsers' developer tools and APM agents display. Scripts on other
+// origins, such as real user monitoring, can only read it from origins
+// listed in allowOrigin (sent as Timing-Allow-Origin).
+type serverTiming struct {
+	header      bool
+	allowOrigin string
+}
+
+// Middleware times the requests to h.
+func (st *serverTiming) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := &phaseTimings{start: time.Now(), phases: make(map[string]time.Duration)}
+		ctx := context.WithValue(r.Context(), phaseTimingsKey{}, t)
+		h.ServeHTTP(&timingWriter{ResponseWriter: w, timings: t, config: st}, r.WithContext(ctx))
+	})
+}
+
+// timingWriter adds Server-Timing as the response header is written.
+type timingWriter struct {
+	http.ResponseWriter
+	timings     *phaseTimings
+	config      *serverTiming
+	wroteHeader bool
+}
+
+func (tw *timingWriter) WriteHeader(status int) {
+	if !tw.wroteHeader && tw.config.header {
+		tw.Header().Set("Server-Timing", tw.timings.header())
+		if tw.config.allowOrigin != "" {
+			tw.Header().Set("Timing-Allow-Origin", tw.config.allowOrigin)
+		}
+	}
+	tw.wroteHeader = true
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *timingWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(200)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+// Flush lets streaming handlers flush through the writer.
+func (tw *timingWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
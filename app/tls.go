@@ -0,0 +1,59 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// newTLSConfig builds the server TLS configuration. When clientCAFile is
+// set, clients must present a certificate signed by one of the CAs in it;
+// if allowedNames is also non-empty, the certificate's common name or one
+// of its DNS, URI or email SANs must be in the list.
+func newTLSConfig(clientCAFile string, allowedNames []string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+
+	if len(allowedNames) > 0 {
+		allowed := make(map[string]bool, len(allowedNames))
+		for _, name := range allowedNames {
+			allowed[name] = true
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			// the chain has already been verified against ClientCAs
+			cert := cs.PeerCertificates[0]
+			for _, name := range certificateNames(cert) {
+				if allowed[name] {
+					return nil
+				}
+			}
+			return fmt.Errorf("client certificate %q is not in the allowlist", cert.Subject.CommonName)
+		}
+	}
+	return cfg, nil
+}
+
+// certificateNames returns the identities a certificate asserts.
+func certificateNames(cert *x509.Certificate) []string {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
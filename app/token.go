@@ -0,0 +1,132 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// tokenIssuer is the iss claim of the tokens we hand out.
+const tokenIssuer = "banno-project"
+
+var errInvalidToken = errors.New("invalid token")
+
+// tokenClaims are the JWT claims of an access token.
+type tokenClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"` // API client ID
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// jwtHeader is the fixed header of our HS256 tokens, pre-encoded.
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// signToken returns an HS256 JWT carrying claims.
+func signToken(claims tokenClaims, key []byte) string {
+	payload, _ := json.Marshal(claims)
+	signingInput := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyToken checks a token's signature, issuer and expiry, returning its
+// claims.
+func verifyToken(token string, key []byte, now time.Time) (tokenClaims, error) {
+	var claims tokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return claims, errInvalidToken
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return claims, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return claims, errInvalidToken
+	}
+	if claims.Issuer != tokenIssuer || now.Unix() >= claims.ExpiresAt {
+		return claims, errInvalidToken
+	}
+	return claims, nil
+}
+
+// tokenError writes an OAuth2 error response (RFC 6749 section 5.2).
+func tokenError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status == 401 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// tokenHandler implements the OAuth2 client credentials grant. Clients
+// authenticate with their key ID as client_id and key secret as
+// client_secret, either with HTTP Basic auth or in the form body, and get
+// back a short-lived bearer token to use in place of the key. (Keys from
+// CLIENT_KEYS have the ID "static-" followed by the first 12 hex digits of
+// the key's SHA-256.)
+func (s *server) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if len(s.tokenKey) == 0 {
+		w.WriteHeader(404)
+		w.Write([]byte("Token issuance is disabled; set TOKEN_SIGNING_KEY to enable it"))
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(405)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, 400, "invalid_request", "malformed form body")
+		return
+	}
+	if grant := r.PostForm.Get("grant_type"); grant != "client_credentials" {
+		tokenError(w, 400, "unsupported_grant_type", "only client_credentials is supported")
+		return
+	}
+
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	client := s.clients.Lookup(secret)
+	if id == "" || client == nil || client == s.clients.anonymous ||
+		subtle.ConstantTimeCompare([]byte(client.ID), []byte(id)) != 1 {
+		tokenError(w, 401, "invalid_client", "unknown client or bad secret")
+		return
+	}
+
+	now := time.Now()
+	token := signToken(tokenClaims{
+		Issuer:    tokenIssuer,
+		Subject:   client.ID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(s.tokenTTL).Unix(),
+	}, s.tokenKey)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(s.tokenTTL.Seconds()),
+	})
+}
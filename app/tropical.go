@@ -0,0 +1,401 @@
+package app
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+const nhcProvider = "nhc"
+
+// tropicalTTL is how long we keep the active storms. The NHC issues
+// advisories every three to six hours.
+const tropicalTTL = 10 * time.Minute
+
+// tropicalBasins maps the basins we accept to the prefix of the NHC's bin
+// numbers ("AT1", "EP3", ...) for storms in them.
+var tropicalBasins = map[string]string{
+	"atlantic":        "AT",
+	"east-pacific":    "EP",
+	"central-pacific": "CP",
+}
+
+// tropicalClassifications names the NHC's storm classifications.
+var tropicalClassifications = map[string]string{
+	"TD":  "Tropical Depression",
+	"TS":  "Tropical Storm",
+	"HU":  "Hurricane",
+	"STD": "Subtropical Depression",
+	"STS": "Subtropical Storm",
+	"PTC": "Post-tropical Cyclone",
+	"PC":  "Potential Tropical Cyclone",
+	"TY":  "Typhoon",
+}
+
+// NHCService is a client for the National Hurricane Center's feeds of
+// active tropical cyclones. Storms are cached for tropicalTTL.
+type NHCService struct {
+	client     *http.Client
+	baseURL    string
+	logger     *log.Logger
+	validators *validatorCache // optional
+
+	mu      sync.Mutex
+	storms  []TropicalStorm
+	fetched time.Time
+}
+
+// TropicalStorm is an active tropical cyclone.
+type TropicalStorm struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	Basin          string    `json:"basin"`
+	Classification string    `json:"classification"`
+	WindSpeed      float64   `json:"wind_speed"` // maximum sustained, mph
+	Pressure       float64   `json:"pressure"`   // mb
+	Lat            float64   `json:"lat"`
+	Lon            float64   `json:"lon"`
+	Movement       string    `json:"movement,omitempty"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	AdvisoryURL    string    `json:"advisory_url,omitempty"`
+	// Track is the forecast positions, and Cone the GeoJSON MultiPolygon
+	// of the cone of uncertainty around them. Either may be missing
+	// between advisories or for weak systems.
+	Track []TrackPoint    `json:"track,omitempty"`
+	Cone  json.RawMessage `json:"cone,omitempty"`
+	// InCone is set when the request gives a location, to whether the
+	// location falls in the cone.
+	InCone *bool `json:"in_cone,omitempty"`
+}
+
+// TrackPoint is a forecast position of a storm.
+type TrackPoint struct {
+	Lat   float64 `json:"lat"`
+	Lon   float64 `json:"lon"`
+	Label string  `json:"label,omitempty"` // the forecast time and intensity, as the NHC puts it
+}
+
+// nhcNumber is a number that the NHC's feed may send as a string.
+type nhcNumber float64
+
+func (n *nhcNumber) UnmarshalJSON(data []byte) error {
+	raw := strings.Trim(string(data), `"`)
+	if raw == "" || raw == "null" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	*n = nhcNumber(f)
+	return err
+}
+
+// ActiveStorms returns the active tropical cyclones.
+func (n *NHCService) ActiveStorms() ([]TropicalStorm, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.storms != nil && time.Since(n.fetched) < tropicalTTL {
+		return n.storms, nil
+	}
+
+	body, err := n.get(n.baseURL + "/CurrentStorms.json")
+	if err != nil {
+		return nil, err
+	}
+	var current struct {
+		ActiveStorms []struct {
+			ID               string    `json:"id"`
+			BinNumber        string    `json:"binNumber"`
+			Name             string    `json:"name"`
+			Classification   string    `json:"classification"`
+			Intensity        nhcNumber `json:"intensity"` // kt
+			Pressure         nhcNumber `json:"pressure"`
+			LatitudeNumeric  float64   `json:"latitudeNumeric"`
+			LongitudeNumeric float64   `json:"longitudeNumeric"`
+			MovementDir      nhcNumber `json:"movementDir"`
+			MovementSpeed    nhcNumber `json:"movementSpeed"` // mph
+			LastUpdate       time.Time `json:"lastUpdate"`
+			PublicAdvisory   *struct {
+				URL string `json:"url"`
+			} `json:"publicAdvisory"`
+			ForecastTrack *struct {
+				KMZFile string `json:"kmzFile"`
+			} `json:"forecastTrack"`
+			TrackCone *struct {
+				KMZFile string `json:"kmzFile"`
+			} `json:"trackCone"`
+		} `json:"activeStorms"`
+	}
+	if err := json.Unmarshal(body, &current); err != nil {
+		return nil, &UpstreamError{Provider: nhcProvider, Class: ErrUpstreamUnavailable, Message: err.Error()}
+	}
+
+	storms := make([]TropicalStorm, 0, len(current.ActiveStorms))
+	for _, s := range current.ActiveStorms {
+		storm := TropicalStorm{
+			ID:             s.ID,
+			Name:           s.Name,
+			Classification: s.Classification,
+			// converted from knots, rounded to 5 mph as the NHC does
+			WindSpeed: math.Round(float64(s.Intensity)*1.15078/5) * 5,
+			Pressure:  float64(s.Pressure),
+			Lat:       s.LatitudeNumeric,
+			Lon:       s.LongitudeNumeric,
+			UpdatedAt: s.LastUpdate.UTC(),
+		}
+		if name, ok := tropicalClassifications[s.Classification]; ok {
+			storm.Classification = name
+		}
+		for basin, prefix := range tropicalBasins {
+			if strings.HasPrefix(s.BinNumber, prefix) {
+				storm.Basin = basin
+			}
+		}
+		if s.MovementSpeed > 0 {
+			storm.Movement = fmt.Sprintf("%s at %.0f mph", compassPoint(float64(s.MovementDir)), float64(s.MovementSpeed))
+		}
+		if s.PublicAdvisory != nil {
+			storm.AdvisoryURL = s.PublicAdvisory.URL
+		}
+		// the storm is still worth reporting without its track or cone
+		if s.ForecastTrack != nil && s.ForecastTrack.KMZFile != "" {
+			if storm.Track, err = n.forecastTrack(s.ForecastTrack.KMZFile); err != nil {
+				n.logger.Printf("Failed to fetch forecast track for %s: %s", s.ID, err)
+			}
+		}
+		if s.TrackCone != nil && s.TrackCone.KMZFile != "" {
+			if storm.Cone, err = n.cone(s.TrackCone.KMZFile); err != nil {
+				n.logger.Printf("Failed to fetch forecast cone for %s: %s", s.ID, err)
+			}
+		}
+		storms = append(storms, storm)
+	}
+	n.storms, n.fetched = storms, time.Now()
+	return storms, nil
+}
+
+// get fetches a feed.
+func (n *NHCService) get(url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, &UpstreamError{Provider: nhcProvider, Class: ErrBadRequest, Message: err.Error()}
+	}
+	resp, err := n.validators.Do(n.client, req)
+	if err != nil {
+		return nil, &UpstreamError{Provider: nhcProvider, Class: ErrUpstreamUnavailable, Message: err.Error()}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, &UpstreamError{
+			Provider:   nhcProvider,
+			Class:      classifyStatus(resp.StatusCode),
+			StatusCode: resp.StatusCode,
+			Message:    resp.Status,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now(), 0),
+		}
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return nil, &UpstreamError{Provider: nhcProvider, Class: ErrUpstreamUnavailable, StatusCode: resp.StatusCode, Message: err.Error()}
+	}
+	return body, nil
+}
+
+// kml fetches a KMZ file and returns a decoder for the KML document in it.
+func (n *NHCService) kml(url string) (*xml.Decoder, error) {
+	body, err := n.get(url)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range archive.File {
+		if strings.HasSuffix(strings.ToLower(f.Name), ".kml") {
+			r, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(r, 16<<20))
+			r.Close()
+			if err != nil {
+				return nil, err
+			}
+			return xml.NewDecoder(bytes.NewReader(data)), nil
+		}
+	}
+	return nil, fmt.Errorf("no KML document in %s", url)
+}
+
+// forecastTrack reads the forecast positions from a forecast track KMZ.
+func (n *NHCService) forecastTrack(url string) ([]TrackPoint, error) {
+	dec, err := n.kml(url)
+	if err != nil {
+		return nil, err
+	}
+	var track []TrackPoint
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return track, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "Placemark" {
+			continue
+		}
+		var placemark struct {
+			Name  string `xml:"name"`
+			Point *struct {
+				Coordinates string `xml:"coordinates"`
+			} `xml:"Point"`
+		}
+		if err := dec.DecodeElement(&placemark, &start); err != nil {
+			return nil, err
+		}
+		if placemark.Point == nil {
+			continue // the line joining the points
+		}
+		coords := parseKMLCoordinates(placemark.Point.Coordinates)
+		if len(coords) == 1 {
+			track = append(track, TrackPoint{
+				Lon:   coords[0][0],
+				Lat:   coords[0][1],
+				Label: strings.TrimSpace(placemark.Name),
+			})
+		}
+	}
+}
+
+// cone reads the cone of uncertainty from a cone KMZ, as a GeoJSON
+// MultiPolygon.
+func (n *NHCService) cone(url string) (json.RawMessage, error) {
+	dec, err := n.kml(url)
+	if err != nil {
+		return nil, err
+	}
+	var polygons [][][][2]float64
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "Polygon" {
+			continue
+		}
+		var polygon struct {
+			Outer string   `xml:"outerBoundaryIs>LinearRing>coordinates"`
+			Inner []string `xml:"innerBoundaryIs>LinearRing>coordinates"`
+		}
+		if err := dec.DecodeElement(&polygon, &start); err != nil {
+			return nil, err
+		}
+		rings := [][][2]float64{parseKMLCoordinates(polygon.Outer)}
+		for _, inner := range polygon.Inner {
+			rings = append(rings, parseKMLCoordinates(inner))
+		}
+		polygons = append(polygons, rings)
+	}
+	if len(polygons) == 0 {
+		return nil, fmt.Errorf("no cone in %s", url)
+	}
+	return json.Marshal(map[string]interface{}{"type": "MultiPolygon", "coordinates": polygons})
+}
+
+// parseKMLCoordinates parses a KML coordinates list: whitespace separated
+// "lon,lat[,alt]" tuples. Malformed tuples are skipped.
+func parseKMLCoordinates(raw string) [][2]float64 {
+	var coords [][2]float64
+	for _, tuple := range strings.Fields(raw) {
+		parts := strings.Split(tuple, ",")
+		if len(parts) < 2 {
+			continue
+		}
+		lon, err1 := strconv.ParseFloat(parts[0], 64)
+		lat, err2 := strconv.ParseFloat(parts[1], 64)
+		if err1 == nil && err2 == nil {
+			coords = append(coords, [2]float64{lon, lat})
+		}
+	}
+	return coords
+}
+
+// compassPoint names the 16-point compass direction of a bearing.
+func compassPoint(degrees float64) string {
+	points := []string{"N", "NNE", "NE", "ENE", "E", "ESE", "SE", "SSE", "S", "SSW", "SW", "WSW", "W", "WNW", "NW", "NNW"}
+	i := int(degrees/22.5+0.5) % 16
+	if i < 0 {
+		i += 16
+	}
+	return points[i]
+}
+
+// TropicalStorms is the response of the tropical endpoint.
+type TropicalStorms struct {
+	Basin  string          `json:"basin,omitempty"`
+	Storms []TropicalStorm `json:"storms"`
+}
+
+// tropicalHandler lists the active tropical cyclones, optionally in one
+// ?basin=. Given ?lat= and ?lon=, each storm says whether the location is in
+// its forecast cone.
+func (s *server) tropicalHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	basin := q.Get("basin")
+	if _, ok := tropicalBasins[basin]; basin != "" && !ok {
+		w.WriteHeader(400)
+		w.Write([]byte("basin must be atlantic, east-pacific or central-pacific"))
+		return
+	}
+	var loc *models.Location
+	if q.Get("lat") != "" || q.Get("lon") != "" {
+		l, err := models.ParseLocation(q.Get("lat"), q.Get("lon"))
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		loc = &l
+	}
+
+	storms, err := s.nhc.ActiveStorms()
+	if err != nil {
+		upstreamErrors.Inc(errorClass(err))
+		s.upstreamError(w, r, err)
+		return
+	}
+	result := TropicalStorms{Basin: basin, Storms: []TropicalStorm{}}
+	for _, storm := range storms {
+		if basin != "" && storm.Basin != basin {
+			continue
+		}
+		if loc != nil && storm.Cone != nil {
+			inCone, err := geometryContains(storm.Cone, loc.Lon, loc.Lat)
+			if err != nil {
+				s.logger.Printf("Bad cone geometry for %s: %s", storm.ID, err)
+			} else {
+				storm.InCone = &inCone
+			}
+		}
+		result.Storms = append(result.Storms, storm)
+	}
+	writeJSON(w, &result)
+}
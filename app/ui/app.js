@@ -0,0 +1,104 @@
+"use strict";
+
+const coordinates = /^\s*(-?\d+(?:\.\d+)?)\s*,\s*(-?\d+(?:\.\d+)?)\s*$/;
+
+const $ = (id) => document.getElementById(id);
+
+const keyInput = $("key");
+keyInput.value = localStorage.getItem("apiKey") || "";
+
+function setStatus(text, isError) {
+  $("status").textContent = text;
+  $("status").className = isError ? "error" : "";
+}
+
+async function api(path, params) {
+  const headers = {};
+  if (keyInput.value) {
+    headers["X-API-Key"] = keyInput.value;
+  }
+  const resp = await fetch(path + "?" + new URLSearchParams(params), { headers });
+  if (!resp.ok) {
+    throw new Error(`${path}: ${resp.status} ${await resp.text()}`);
+  }
+  return resp.json();
+}
+
+// resolve turns the search box into a place with coordinates, geocoding
+// city names.
+async function resolve(where) {
+  const match = coordinates.exec(where);
+  if (match) {
+    return { name: `${match[1]}, ${match[2]}`, lat: match[1], lon: match[2] };
+  }
+  const places = await api("/geocode", { q: where });
+  if (places.length === 0) {
+    throw new Error(`No place called "${where}"`);
+  }
+  const p = places[0];
+  return { name: [p.name, p.state, p.country].filter(Boolean).join(", "), lat: p.lat, lon: p.lon };
+}
+
+function row(tbody, cells) {
+  const tr = document.createElement("tr");
+  for (const cell of cells) {
+    const td = document.createElement("td");
+    td.textContent = cell;
+    tr.appendChild(td);
+  }
+  tbody.appendChild(tr);
+}
+
+const percent = (p) => `${Math.round(p * 100)}%`;
+const degrees = (t) => `${Math.round(t)}°F`;
+
+function render(place, weather, forecast) {
+  $("place").textContent = place.name;
+
+  const badge = { lat: place.lat, lon: place.lon, label: place.name };
+  if (keyInput.value) {
+    badge.api_key = keyInput.value;
+  }
+  $("badge").src = "/badge?" + new URLSearchParams(badge);
+  $("badge").alt = `${place.name}: ${weather.temperature}`;
+
+  $("conditions").textContent = `Feels ${weather.temperature}; ${weather.conditions.join(", ")}.`;
+
+  const alerts = $("alerts");
+  alerts.replaceChildren();
+  for (const alert of weather.alerts) {
+    const li = document.createElement("li");
+    li.textContent = alert;
+    alerts.appendChild(li);
+  }
+
+  const hourly = $("hourly").tBodies[0];
+  hourly.replaceChildren();
+  for (const hour of (forecast.hourly || []).slice(0, 12)) {
+    const time = new Date(hour.time).toLocaleTimeString([], { hour: "numeric", minute: "2-digit" });
+    row(hourly, [time, degrees(hour.temperature), percent(hour.precipitation_chance), hour.conditions.join(", ")]);
+  }
+
+  const daily = $("daily").tBodies[0];
+  daily.replaceChildren();
+  for (const day of forecast.daily || []) {
+    row(daily, [day.date, degrees(day.low), degrees(day.high), percent(day.precipitation_chance), day.conditions.join(", ")]);
+  }
+
+  $("result").hidden = false;
+}
+
+$("search").addEventListener("submit", async (event) => {
+  event.preventDefault();
+  localStorage.setItem("apiKey", keyInput.value);
+  setStatus("Loading…");
+  try {
+    const place = await resolve($("where").value);
+    const params = { lat: place.lat, lon: place.lon };
+    const [weather, forecast] = await Promise.all([api("/weather/", params), api("/forecast", params)]);
+    render(place, weather, forecast);
+    setStatus("");
+  } catch (err) {
+    setStatus(err.message, true);
+  }
+});
@@ -0,0 +1,148 @@
+"use strict";
+
+// A small OpenAPI explorer: lists the operations in /openapi.json and lets
+// you try them from the browser.
+
+const keyInput = document.getElementById("key");
+keyInput.value = localStorage.getItem("apiKey") || "";
+keyInput.addEventListener("change", () => localStorage.setItem("apiKey", keyInput.value));
+
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  Object.assign(node, attrs);
+  node.append(...children);
+  return node;
+}
+
+// deref resolves a local "$ref" against the spec.
+function deref(spec, obj) {
+  while (obj && obj.$ref) {
+    obj = obj.$ref.slice(2).split("/").reduce((o, key) => o[key], spec);
+  }
+  return obj;
+}
+
+function paramInput(param) {
+  const schema = param.schema || {};
+  if (schema.enum) {
+    const select = el("select", { name: param.name });
+    select.append(el("option", { value: "" }, ""));
+    for (const value of schema.enum) {
+      select.append(el("option", { value }, value));
+    }
+    return select;
+  }
+  const placeholder = param.example !== undefined ? String(param.example) : (schema.default !== undefined ? String(schema.default) : "");
+  return el("input", { name: param.name, placeholder, required: !!param.required });
+}
+
+// useMyLocation fills in lat/lon from the browser's geolocation.
+function useMyLocation(form, button) {
+  button.disabled = true;
+  navigator.geolocation.getCurrentPosition((pos) => {
+    form.elements.lat.value = pos.coords.latitude.toFixed(4);
+    form.elements.lon.value = pos.coords.longitude.toFixed(4);
+    button.disabled = false;
+  }, (err) => {
+    button.textContent = `Location unavailable: ${err.message}`;
+  });
+}
+
+async function showResponse(out, resp) {
+  const type = resp.headers.get("Content-Type") || "";
+  out.replaceChildren(el("p", {}, `${resp.status} ${resp.statusText} · ${type}`));
+  if (type.startsWith("image/")) {
+    out.append(el("img", { src: URL.createObjectURL(await resp.blob()) }));
+    return;
+  }
+  let body = await resp.text();
+  if (type.includes("json")) {
+    try {
+      body = JSON.stringify(JSON.parse(body), null, 2);
+    } catch (e) {
+      // show it as is
+    }
+  }
+  out.append(el("pre", {}, body));
+}
+
+function renderOperation(spec, path, method, op) {
+  const params = (op.parameters || []).map((p) => deref(spec, p));
+  const form = el("form");
+
+  for (const param of params) {
+    const row = el("label", { className: "param" }, param.name + (param.required ? " *" : ""), paramInput(param));
+    if (param.description) {
+      row.append(el("small", {}, param.description));
+    }
+    form.append(row);
+  }
+
+  const body = op.requestBody && op.requestBody.content["application/x-www-form-urlencoded"];
+  const bodyFields = body ? Object.entries(deref(spec, body.schema).properties) : [];
+  for (const [name, schema] of bodyFields) {
+    form.append(el("label", { className: "param" }, name, paramInput({ name, schema })));
+  }
+
+  const buttons = el("p");
+  if (params.some((p) => p.name === "lat") && "geolocation" in navigator) {
+    const locate = el("button", { type: "button" }, "Use my location");
+    locate.addEventListener("click", () => useMyLocation(form, locate));
+    buttons.append(locate, " ");
+  }
+  buttons.append(el("button", { type: "submit" }, "Try it"));
+  form.append(buttons);
+
+  const out = el("div", { className: "response" });
+  form.addEventListener("submit", async (event) => {
+    event.preventDefault();
+    const query = new URLSearchParams();
+    for (const param of params) {
+      const value = form.elements[param.name].value;
+      if (value) {
+        query.set(param.name, value);
+      }
+    }
+    const init = { method: method.toUpperCase(), headers: {} };
+    if (keyInput.value) {
+      init.headers["X-API-Key"] = keyInput.value;
+    }
+    if (body) {
+      const data = new URLSearchParams();
+      for (const [name] of bodyFields) {
+        if (form.elements[name].value) {
+          data.set(name, form.elements[name].value);
+        }
+      }
+      init.body = data;
+    }
+    out.replaceChildren(el("p", {}, "Loading…"));
+    try {
+      const qs = query.toString();
+      await showResponse(out, await fetch(path + (qs ? "?" + qs : ""), init));
+    } catch (err) {
+      out.replaceChildren(el("p", {}, err.message));
+    }
+  });
+
+  const summary = el("summary", {}, el("span", { className: "method" }, method), el("code", {}, path), " — ", op.summary || "");
+  const details = el("details", { className: "operation" }, summary);
+  if (op.description) {
+    details.append(el("p", {}, op.description));
+  }
+  details.append(form, out);
+  return details;
+}
+
+fetch("/openapi.json")
+  .then((resp) => resp.json())
+  .then((spec) => {
+    document.getElementById("title").textContent = spec.info.title + " API";
+    document.getElementById("description").textContent = spec.info.description || "";
+    const operations = document.getElementById("operations");
+    for (const [path, item] of Object.entries(spec.paths)) {
+      for (const [method, op] of Object.entries(item)) {
+        operations.append(renderOperation(spec, path, method, op));
+      }
+    }
+  });
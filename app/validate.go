@@ -0,0 +1,141 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+var upstreamInvalid = newCounter("upstream_invalid_total",
+	"Upstream responses that failed validation, by kind of response.", "kind")
+
+// Strict modes: how to treat upstream responses that fail validation.
+const (
+	strictFlag   = "flag"   // log and count them, but use them anyway
+	strictReject = "reject" // fail the request
+)
+
+// Plausible bounds on what openweathermap reports, in imperial units.
+// Temperatures are in °F.
+const (
+	minPlausibleTemp = -130 // °F; the coldest ever recorded is about -128
+	maxPlausibleTemp = 140  // °F; the hottest is about 134
+	maxPlausibleWind = 300  // mph
+)
+
+// checkTemp reports a problem with a temperature, if it has one.
+func checkTemp(field string, t models.Temperature) string {
+	if f := t.F(); math.IsNaN(f) || math.IsInf(f, 0) || f < minPlausibleTemp || f > maxPlausibleTemp {
+		return fmt.Sprintf("%s is %v", field, t)
+	}
+	return ""
+}
+
+// validateWeather checks a current weather response, given both decoded
+// and raw so absent fields can be told apart from zero ones.
+func validateWeather(raw json.RawMessage, data *OWMApiResponse) []string {
+	var problems []string
+	var fields struct {
+		Current map[string]json.RawMessage `json:"current"`
+	}
+	if err := json.Unmarshal(raw, &fields); err != nil || fields.Current == nil {
+		return []string{"current is missing"}
+	}
+	for _, name := range []string{"dt", "temp", "feels_like", "humidity", "weather"} {
+		if v, ok := fields.Current[name]; !ok || string(v) == "null" {
+			problems = append(problems, "current."+name+" is missing")
+		}
+	}
+
+	c := data.Current
+	if c.Dt <= 0 {
+		problems = append(problems, "current.dt is not a time")
+	}
+	for _, t := range []struct {
+		field string
+		value *models.Temperature
+	}{{"current.temp", c.Temp}, {"current.feels_like", c.FeelsLike}} {
+		if t.value == nil {
+			continue // reported missing above
+		}
+		if p := checkTemp(t.field, *t.value); p != "" {
+			problems = append(problems, p)
+		}
+	}
+	if c.Humidity < 0 || c.Humidity > 100 {
+		problems = append(problems, fmt.Sprintf("current.humidity is %v", c.Humidity))
+	}
+	if c.WindSpeed < 0 || c.WindSpeed > maxPlausibleWind {
+		problems = append(problems, fmt.Sprintf("current.wind_speed is %v", c.WindSpeed))
+	}
+	if len(c.Weather) == 0 {
+		problems = append(problems, "current.weather is empty")
+	}
+	return dedupe(problems)
+}
+
+// validateForecast checks the blocks of a forecast response that were
+// decoded. The forecast is streamed, so only values are checked, not
+// whether fields were present.
+func validateForecast(data *OWMForecastResponse) []string {
+	var problems []string
+	for i, h := range data.Hourly {
+		if h.Dt <= 0 {
+			problems = append(problems, fmt.Sprintf("hourly[%d].dt is not a time", i))
+		}
+		if p := checkTemp(fmt.Sprintf("hourly[%d].temp", i), h.Temp); p != "" {
+			problems = append(problems, p)
+		}
+		if h.Pop < 0 || h.Pop > 1 {
+			problems = append(problems, fmt.Sprintf("hourly[%d].pop is %v", i, h.Pop))
+		}
+	}
+	for i, d := range data.Daily {
+		if d.Dt <= 0 {
+			problems = append(problems, fmt.Sprintf("daily[%d].dt is not a time", i))
+		}
+		for _, p := range []string{
+			checkTemp(fmt.Sprintf("daily[%d].temp.min", i), d.Temp.Min),
+			checkTemp(fmt.Sprintf("daily[%d].temp.max", i), d.Temp.Max),
+		} {
+			if p != "" {
+				problems = append(problems, p)
+			}
+		}
+		if d.Temp.Max.Less(d.Temp.Min) {
+			problems = append(problems, fmt.Sprintf("daily[%d].temp.min is above temp.max", i))
+		}
+	}
+	return problems
+}
+
+// dedupe drops repeated problems, keeping the first of each.
+func dedupe(problems []string) []string {
+	seen := make(map[string]bool, len(problems))
+	out := problems[:0]
+	for _, p := range problems {
+		if !seen[p] {
+			seen[p] = true
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// validated applies the strict mode to the problems found in a response of
+// the given kind, returning an error if the response should be rejected.
+func (o *OWMService) validated(kind string, problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	upstreamInvalid.Inc(kind)
+	msg := fmt.Sprintf("malformed %s response: %s", kind, strings.Join(problems, "; "))
+	if o.strict != strictReject {
+		o.logger.Printf("Using openweathermap's %s", msg)
+		return nil
+	}
+	return &UpstreamError{Class: ErrMalformedResponse, StatusCode: 200, Message: msg}
+}
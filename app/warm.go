@@ -0,0 +1,52 @@
+package app
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/cstrahan/banno-project/models"
+)
+
+// parseLocationList parses a list of locations written as
+// "lat,lon;lat,lon".
+func parseLocationList(raw string) ([]models.Location, error) {
+	var locs []models.Location
+	for _, item := range strings.Split(raw, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		loc, err := models.ParseLocationPair(item)
+		if err != nil {
+			return nil, err
+		}
+		locs = append(locs, loc)
+	}
+	return locs, nil
+}
+
+// warmCache fetches weather for each location so the cache is populated
+// before we take traffic, then marks the cache ready (callers mark it not
+// ready before starting). Failures are logged but don't keep the service out
+// of rotation.
+func (s *server) warmCache(ctx context.Context, locs []models.Location, concurrency int) {
+	defer s.ready.SetReady("cache")
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, loc := range locs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(loc models.Location) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			lat, lon := loc.Strings()
+			if _, err := s.fetchWeather(ctx, lat, lon); err != nil {
+				s.logger.Printf("Failed to warm cache for %s: %s", loc.Key(), err)
+			}
+		}(loc)
+	}
+	wg.Wait()
+	s.logger.Printf("Warmed cache for %d locations", len(locs))
+}
@@ -0,0 +1,115 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// widgetTheme holds the colors used to render a widget.
+type widgetTheme struct {
+	Background string
+	Foreground string
+	Accent     string
+}
+
+var widgetThemes = map[string]widgetTheme{
+	"light": {Background: "#ffffff", Foreground: "#222222", Accent: "#c0392b"},
+	"dark":  {Background: "#1e1e1e", Foreground: "#eeeeee", Accent: "#ff6b5b"},
+}
+
+// widgetData is the view model shared by the HTML and SVG widget templates.
+type widgetData struct {
+	Theme       widgetTheme
+	Degrees     string
+	Temperature string
+	Conditions  string
+	Alerts      []string
+}
+
+var widgetHTML = template.Must(template.New("widget.html").Parse(`<div style="font-family:sans-serif;display:inline-block;padding:8px 12px;border-radius:6px;background:{{.Theme.Background}};color:{{.Theme.Foreground}}">
+<div style="font-size:24px">{{.Degrees}} <span style="font-size:14px">{{.Temperature}}</span></div>
+<div style="font-size:13px">{{.Conditions}}</div>
+{{range .Alerts}}<div style="font-size:12px;color:{{$.Theme.Accent}}">&#9888; {{.}}</div>
+{{end}}</div>
+`))
+
+var widgetSVG = template.Must(template.New("widget.svg").Parse(`<svg xmlns="http://www.w3.org/2000/svg" width="220" height="{{.Height}}" font-family="sans-serif">
+<rect width="100%" height="100%" rx="6" fill="{{.Theme.Background}}"/>
+<text x="12" y="30" font-size="24" fill="{{.Theme.Foreground}}">{{.Degrees}} <tspan font-size="14">{{.Temperature}}</tspan></text>
+<text x="12" y="50" font-size="13" fill="{{.Theme.Foreground}}">{{.Conditions}}</text>
+{{range $i, $a := .Alerts}}<text x="12" y="{{$.AlertY $i}}" font-size="12" fill="{{$.Theme.Accent}}">&#9888; {{$a}}</text>
+{{end}}</svg>
+`))
+
+// Height returns the SVG canvas height needed to fit all alerts.
+func (d widgetData) Height() int {
+	return d.AlertY(len(d.Alerts)) - 8
+}
+
+// AlertY returns the baseline of the i-th alert line in the SVG widget.
+func (d widgetData) AlertY(i int) int {
+	return 70 + 18*i
+}
+
+// widgetHandler serves a self-contained HTML or SVG snippet showing current
+// conditions, suitable for iframes and README badges.
+func (s *server) widgetHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lat, lon, _ := s.requestLocation(r, q)
+
+	themeName := q.Get("theme")
+	if themeName == "" {
+		themeName = "light"
+	}
+	theme, ok := widgetThemes[themeName]
+	if !ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Unknown theme: %q", themeName)
+		return
+	}
+
+	var tmpl *template.Template
+	var contentType string
+	switch format := q.Get("format"); format {
+	case "", "html":
+		tmpl, contentType = widgetHTML, "text/html; charset=utf-8"
+	case "svg":
+		tmpl, contentType = widgetSVG, "image/svg+xml"
+	default:
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Unknown format: %q", format)
+		return
+	}
+
+	data, err := s.fetchWeather(r.Context(), lat, lon)
+	if err != nil {
+		s.upstreamError(w, r, err)
+		return
+	}
+
+	weather := newWeather(data)
+	view := widgetData{
+		Theme:       theme,
+		Degrees:     formatDegrees(data.Temp),
+		Temperature: weather.Temperature,
+		Conditions:  strings.Join(weather.Conditions, ", "),
+		Alerts:      weather.Alerts,
+	}
+
+	var buf bytes.Buffer
+	stop := timePhase(r.Context(), phaseRender)
+	err = tmpl.Execute(&buf, view)
+	stop()
+	if err != nil {
+		w.WriteHeader(500)
+		s.logger.Printf("Failed to render widget: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Alert is a weather alert in full.
+type Alert struct {
+	Event       string    `json:"event"`
+	Sender      string    `json:"sender"`
+	Severity    string    `json:"severity,omitempty"`
+	Headline    string    `json:"headline,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Source      string    `json:"source"` // the provider it came from
+	// Geometry is the GeoJSON geometry of the affected area, when the
+	// provider gives one.
+	Geometry json.RawMessage `json:"geometry,omitempty"`
+}
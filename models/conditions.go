@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// CurrentConditions is the weather at a place as last observed. Readings the
+// provider left out are nil, rather than zero.
+type CurrentConditions struct {
+	Time      time.Time    `json:"time"`
+	Temp      *Temperature `json:"temp"`
+	FeelsLike *Temperature `json:"feels_like"`
+	Humidity  float64      `json:"humidity"`   // %
+	WindSpeed float64      `json:"wind_speed"` // mph
+	WindGust  float64      `json:"wind_gust"`  // mph
+	UVI       float64      `json:"uvi"`
+	// Conditions describes the weather, e.g. "light rain". It's nil if the
+	// provider didn't say, as opposed to empty if there's nothing to say.
+	Conditions []string `json:"conditions"`
+	Precip     float64  `json:"precip"` // inches in the hour before, as water
+	// Alerts are the alerts the provider reported along with the
+	// conditions.
+	Alerts []Alert `json:"alerts"`
+}
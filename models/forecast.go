@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// Forecast is an hourly and daily forecast. Either may be left out.
+type Forecast struct {
+	Hourly []ForecastHour `json:"hourly,omitempty"`
+	Daily  []ForecastDay  `json:"daily,omitempty"`
+}
+
+// ForecastHour is the forecast for a single hour.
+type ForecastHour struct {
+	Time                time.Time   `json:"time"`
+	Temperature         Temperature `json:"temperature"`
+	FeelsLike           Temperature `json:"feels_like"`
+	DewPoint            Temperature `json:"dew_point"`
+	WindSpeed           float64     `json:"wind_speed"` // mph
+	PrecipitationChance float64     `json:"precipitation_chance"`
+	Conditions          []string    `json:"conditions"`
+}
+
+// ForecastDay is the forecast for a single day.
+type ForecastDay struct {
+	Date                string      `json:"date"`
+	Low                 Temperature `json:"low"`
+	High                Temperature `json:"high"`
+	PrecipitationChance float64     `json:"precipitation_chance"`
+	Conditions          []string    `json:"conditions"`
+	Sunrise             *time.Time  `json:"sunrise,omitempty"` // absent in polar day and night
+	Sunset              *time.Time  `json:"sunset,omitempty"`
+	Summary             string      `json:"summary,omitempty"` // a sentence describing the day, when the provider gives one
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Location is a point on the globe in decimal degrees.
+type Location struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// ParseLocation parses and range checks a lat/lon pair.
+func ParseLocation(lat, lon string) (Location, error) {
+	la, err := strconv.ParseFloat(lat, 64)
+	if err != nil || math.IsNaN(la) || la < -90 || la > 90 {
+		return Location{}, fmt.Errorf("Invalid latitude: %q", lat)
+	}
+	lo, err := strconv.ParseFloat(lon, 64)
+	if err != nil || math.IsNaN(lo) || lo < -180 || lo > 180 {
+		return Location{}, fmt.Errorf("Invalid longitude: %q", lon)
+	}
+	return Location{Lat: la, Lon: lo}, nil
+}
+
+// ParseLocationPair parses a "lat,lon" pair.
+func ParseLocationPair(raw string) (Location, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) != 2 {
+		return Location{}, fmt.Errorf("Invalid location %q: want lat,lon", raw)
+	}
+	return ParseLocation(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+}
+
+// Key identifies the location to roughly 1km, so that nearby requests share
+// history (and anything else keyed by place).
+func (l Location) Key() string {
+	// this is on the hot path; build it without fmt
+	b := make([]byte, 0, 16)
+	b = strconv.AppendFloat(b, l.Lat, 'f', 2, 64)
+	b = append(b, ',')
+	b = strconv.AppendFloat(b, l.Lon, 'f', 2, 64)
+	return string(b)
+}
+
+// Strings formats the location as lat and lon query parameter values.
+func (l Location) Strings() (lat, lon string) {
+	return strconv.FormatFloat(l.Lat, 'f', -1, 64), strconv.FormatFloat(l.Lon, 'f', -1, 64)
+}
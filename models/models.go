@@ -0,0 +1,4 @@
+// Package models holds the weather service's provider-agnostic data types.
+// Each provider maps its own responses onto these, and handlers work from
+// them alone, so neither depends on the other's shape.
+package models
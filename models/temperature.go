@@ -0,0 +1,157 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// TempUnit is a temperature scale.
+type TempUnit int
+
+const (
+	Fahrenheit TempUnit = iota // the API's unit, and the zero value
+	Celsius
+	Kelvin
+)
+
+// String returns the unit's symbol, e.g. "°F".
+func (u TempUnit) String() string {
+	switch u {
+	case Celsius:
+		return "°C"
+	case Kelvin:
+		return "K"
+	}
+	return "°F"
+}
+
+// Temperature is a temperature along with its unit. Read it with F, C or K
+// rather than assuming what unit a number is in, so that a threshold in one
+// unit is never compared with data in another. The zero value is 0°F.
+//
+// In JSON, temperatures are bare numbers of degrees Fahrenheit, the unit of
+// the API and of the files we persist. A provider whose JSON is in other
+// units must convert with NewTemperature rather than decode into one.
+type Temperature struct {
+	value float64
+	unit  TempUnit
+}
+
+// NewTemperature returns a temperature of v in unit.
+func NewTemperature(v float64, unit TempUnit) Temperature {
+	return Temperature{v, unit}
+}
+
+// DegreesF returns a temperature of v°F.
+func DegreesF(v float64) Temperature { return Temperature{v, Fahrenheit} }
+
+// DegreesC returns a temperature of v°C.
+func DegreesC(v float64) Temperature { return Temperature{v, Celsius} }
+
+// Kelvins returns a temperature of v kelvins.
+func Kelvins(v float64) Temperature { return Temperature{v, Kelvin} }
+
+// Freezing is the freezing point of water.
+var Freezing = DegreesC(0)
+
+// K returns the temperature in kelvins.
+func (t Temperature) K() float64 {
+	switch t.unit {
+	case Celsius:
+		return t.value + 273.15
+	case Kelvin:
+		return t.value
+	}
+	return (t.value-32)*5/9 + 273.15
+}
+
+// C returns the temperature in degrees Celsius.
+func (t Temperature) C() float64 {
+	if t.unit == Celsius {
+		return t.value
+	}
+	return t.K() - 273.15
+}
+
+// F returns the temperature in degrees Fahrenheit.
+func (t Temperature) F() float64 {
+	if t.unit == Fahrenheit {
+		return t.value
+	}
+	return t.C()*9/5 + 32
+}
+
+// In converts the temperature to another unit.
+func (t Temperature) In(u TempUnit) Temperature {
+	switch u {
+	case Celsius:
+		return DegreesC(t.C())
+	case Kelvin:
+		return Kelvins(t.K())
+	}
+	return DegreesF(t.F())
+}
+
+// Unit returns the unit the temperature is in.
+func (t Temperature) Unit() TempUnit {
+	return t.unit
+}
+
+// Less reports whether t is colder than o, whatever their units.
+func (t Temperature) Less(o Temperature) bool {
+	return t.K() < o.K()
+}
+
+// String formats the temperature to the nearest degree in its own unit,
+// e.g. "93°F".
+func (t Temperature) String() string {
+	return fmt.Sprintf("%.0f%s", t.value, t.unit)
+}
+
+// MarshalJSON encodes the temperature as a number of degrees Fahrenheit.
+func (t Temperature) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.F())
+}
+
+// UnmarshalJSON decodes a number of degrees Fahrenheit.
+func (t *Temperature) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	var f float64
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+	*t = DegreesF(f)
+	return nil
+}
+
+// ParseTemperature parses a temperature such as "32", "32F", "0C", "0°C" or
+// "273.15K". Bare numbers are in degrees Fahrenheit.
+func ParseTemperature(raw string) (Temperature, error) {
+	s := strings.TrimSpace(raw)
+	unit := Fahrenheit
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'F', 'f':
+			s = s[:n-1]
+		case 'C', 'c':
+			unit, s = Celsius, s[:n-1]
+		case 'K', 'k':
+			unit, s = Kelvin, s[:n-1]
+		}
+	}
+	s = strings.TrimSpace(strings.TrimSuffix(s, "°"))
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return Temperature{}, fmt.Errorf("%q is not a temperature", raw)
+	}
+	t := Temperature{v, unit}
+	if t.K() < 0 {
+		return Temperature{}, fmt.Errorf("%q is below absolute zero", raw)
+	}
+	return t, nil
+}